@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/antongulenko/golib"
+)
+
+// Bandwidth is a data rate in bits per second. It implements flag.Value to parse values with an optional
+// bps, kbps, mbps or gbps suffix (decimal units), for example '500kbps' or '2.5mbps'.
+type Bandwidth float64
+
+var bandwidthSuffixes = []struct {
+	suffix string
+	factor float64
+}{{"gbps", 1e9}, {"mbps", 1e6}, {"kbps", 1e3}, {"bps", 1}}
+
+func (b *Bandwidth) String() string {
+	for _, unit := range bandwidthSuffixes {
+		if *b >= Bandwidth(unit.factor) {
+			return strconv.FormatFloat(float64(*b)/unit.factor, 'f', -1, 64) + unit.suffix
+		}
+	}
+	return strconv.FormatFloat(float64(*b), 'f', -1, 64) + "bps"
+}
+
+func (b *Bandwidth) Set(value string) error {
+	number, factor := strings.ToLower(strings.TrimSpace(value)), 1.0
+	for _, unit := range bandwidthSuffixes {
+		if strings.HasSuffix(number, unit.suffix) {
+			number, factor = strings.TrimSuffix(number, unit.suffix), unit.factor
+			break
+		}
+	}
+	rate, err := strconv.ParseFloat(strings.TrimSpace(number), 64)
+	if err != nil {
+		return fmt.Errorf("Failed to parse bandwidth '%v': %v", value, err)
+	}
+	if rate <= 0 {
+		return fmt.Errorf("Bandwidth must be positive, but got '%v'", value)
+	}
+	*b = Bandwidth(rate * factor)
+	return nil
+}
+
+// bandwidthLimiterBurst is the time span of data that the limiter allows to be received at once
+const bandwidthLimiterBurst = 50 * time.Millisecond
+
+// BandwidthLimiter is a token bucket, which paces the consumption of data to a fixed rate.
+// It is not safe for concurrent use, every stream uses its own limiter.
+type BandwidthLimiter struct {
+	bytesPerSecond float64
+	tokens         float64
+	last           time.Time
+}
+
+func newBandwidthLimiter(bandwidth Bandwidth) *BandwidthLimiter {
+	return &BandwidthLimiter{bytesPerSecond: float64(bandwidth) / 8, last: time.Now()}
+}
+
+// Consume takes the given number of bytes from the bucket. If the bucket does not contain enough tokens, Consume
+// blocks until the tokens are refilled, so the average rate does not exceed the bandwidth. Returns false if
+// the given StopChan was stopped while waiting.
+func (l *BandwidthLimiter) Consume(bytes int, stopper golib.StopChan) bool {
+	now := time.Now()
+	maxTokens := l.bytesPerSecond * bandwidthLimiterBurst.Seconds()
+	l.tokens += now.Sub(l.last).Seconds() * l.bytesPerSecond
+	if l.tokens > maxTokens {
+		l.tokens = maxTokens
+	}
+	l.tokens -= float64(bytes)
+	l.last = now
+	if l.tokens >= 0 {
+		return true
+	}
+	wait := time.Duration(-l.tokens / l.bytesPerSecond * float64(time.Second))
+	return stopper.WaitTimeout(wait)
+}
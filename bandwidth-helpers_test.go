@@ -0,0 +1,63 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/antongulenko/golib"
+	testAssert "github.com/stretchr/testify/require"
+)
+
+func TestBandwidthFlag(t *testing.T) {
+	assert := testAssert.New(t)
+	for value, expected := range map[string]float64{
+		"500kbps": 500e3, "2.5Mbps": 2.5e6, "1gbps": 1e9, "800bps": 800, "1200": 1200, " 3 mbps ": 3e6,
+	} {
+		var bandwidth Bandwidth
+		assert.NoError(bandwidth.Set(value), value)
+		assert.Equal(expected, float64(bandwidth), value)
+	}
+	bandwidth := Bandwidth(500e3)
+	assert.Equal("500kbps", bandwidth.String())
+	bandwidth = Bandwidth(2.5e6)
+	assert.Equal("2.5mbps", bandwidth.String())
+
+	for _, value := range []string{"", "kbps", "fast", "-5kbps", "0"} {
+		assert.Error(bandwidth.Set(value), value)
+	}
+}
+
+func TestBandwidthLimiter(t *testing.T) {
+	assert := testAssert.New(t)
+	limiter := newBandwidthLimiter(8 * 1000 * 1000) // 1 MB/s
+	stopper := golib.NewStopChan()
+	start := time.Now()
+	for i := 0; i < 200; i++ {
+		assert.True(limiter.Consume(1000, stopper))
+	}
+	// 200 KB at 1 MB/s, minus the initial burst
+	duration := time.Since(start)
+	assert.True(duration > 120*time.Millisecond && duration < 300*time.Millisecond, "Consuming took %v", duration)
+
+	// Waiting is interrupted by stopping
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		stopper.Stop()
+	}()
+	start = time.Now()
+	assert.False(limiter.Consume(10*1000*1000, stopper))
+	assert.True(time.Since(start) < time.Second)
+}
+
+func TestStreamBandwidth(t *testing.T) {
+	assert := testAssert.New(t)
+	endpoint := newTestFactory(t, "rtmp://host/app/stream").hosts[0].endpoints[0]
+	running := newTestRunningStream()
+	running.col.StreamBandwidth = 800 * 1000 // 100 KB/s
+	running.col.MaxStreamDuration = 300 * time.Millisecond
+
+	// The stream delivers 10 byte packets as fast as possible
+	running.receiveStream(newEndlessStream(endpoint, 0), &endpoint.host.stats)
+	bytes := float64(running.col.bytes.Get())
+	assert.True(bytes > 25*1000 && bytes < 40*1000, "Expected about 30 KB, received %v bytes", bytes)
+}
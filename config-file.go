@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"sort"
+)
+
+// configFileEndpointsKey is the key of the list of streaming endpoints in a configuration file,
+// which are used instead of the command line arguments if none are given
+const configFileEndpointsKey = "endpoints"
+
+// configFileExcludedFlags are applied while parsing the command line and cannot be set in a configuration file
+var configFileExcludedFlags = map[string]bool{"config": true, "v": true, "q": true, "qq": true, "log": true}
+
+// ConfigFile contains the values of command line flags, indexed by the flag names without the leading dash. Values can be
+// strings, numbers or booleans, which are parsed like the respective command line flag. Arrays set a flag repeatedly,
+// e.g. for multiple outputs. The key 'endpoints' lists the streaming endpoint URLs or URL templates.
+type ConfigFile map[string]json.RawMessage
+
+// loadConfigFile reads a ConfigFile in JSON format
+func loadConfigFile(path string) (ConfigFile, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read configuration file %v: %v", path, err)
+	}
+	var config ConfigFile
+	if err := json.Unmarshal(content, &config); err != nil {
+		return nil, fmt.Errorf("Failed to parse configuration file %v: %v", path, err)
+	}
+	return config, nil
+}
+
+// Apply sets the flags defined in the configuration, unless they were set on the command line. The endpoints of the
+// configuration are returned instead of the given command line arguments, if no arguments are given.
+func (c ConfigFile) Apply(flags *flag.FlagSet, args []string) ([]string, error) {
+	setOnCommandLine := make(map[string]bool)
+	flags.Visit(func(f *flag.Flag) {
+		setOnCommandLine[f.Name] = true
+	})
+	names := make([]string, 0, len(c))
+	for name := range c {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		values, err := c.values(name)
+		if err != nil {
+			return nil, err
+		}
+		if name == configFileEndpointsKey {
+			if len(args) == 0 {
+				args = values
+			}
+			continue
+		}
+		if configFileExcludedFlags[name] {
+			return nil, fmt.Errorf("Flag -%v cannot be set in a configuration file", name)
+		}
+		if flags.Lookup(name) == nil {
+			return nil, fmt.Errorf("Unknown flag in configuration file: %v", name)
+		}
+		if setOnCommandLine[name] {
+			continue
+		}
+		for _, value := range values {
+			if err := flags.Set(name, value); err != nil {
+				return nil, fmt.Errorf("Invalid value '%v' for flag -%v in configuration file: %v", value, name, err)
+			}
+		}
+	}
+	return args, nil
+}
+
+// values returns the values of the given key as strings. Numbers keep their original formatting.
+func (c ConfigFile) values(name string) ([]string, error) {
+	raw := bytes.TrimSpace(c[name])
+	if len(raw) > 0 && raw[0] == '[' {
+		var elements []json.RawMessage
+		if err := json.Unmarshal(raw, &elements); err != nil {
+			return nil, fmt.Errorf("Invalid value of %v in configuration file: %v", name, err)
+		}
+		values := make([]string, 0, len(elements))
+		for _, element := range elements {
+			value, err := configFileValue(name, element)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, value)
+		}
+		return values, nil
+	}
+	value, err := configFileValue(name, raw)
+	if err != nil {
+		return nil, err
+	}
+	return []string{value}, nil
+}
+
+func configFileValue(name string, raw json.RawMessage) (string, error) {
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return "", fmt.Errorf("Invalid value of %v in configuration file: %v", name, err)
+	}
+	switch value := value.(type) {
+	case string:
+		return value, nil
+	case json.Number:
+		return value.String(), nil
+	case bool:
+		return fmt.Sprint(value), nil
+	}
+	return "", fmt.Errorf("Value of %v in configuration file must be a string, number, boolean or array, but is: %s", name, raw)
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/antongulenko/golib"
+	testAssert "github.com/stretchr/testify/require"
+)
+
+type testConfigFlags struct {
+	flags        *flag.FlagSet
+	streams      *int
+	timeout      *time.Duration
+	ewmaAlpha    *float64
+	insecureTLS  *bool
+	apiKey       *string
+	delaySampler DistributionSampler
+	outputs      golib.StringSlice
+}
+
+func newTestConfigFlags() *testConfigFlags {
+	f := &testConfigFlags{flags: flag.NewFlagSet("test", flag.ContinueOnError)}
+	f.streams = f.flags.Int("n", 1, "")
+	f.timeout = f.flags.Duration("timeout", 5*time.Second, "")
+	f.ewmaAlpha = f.flags.Float64("ewmaAlpha", 0.3, "")
+	f.insecureTLS = f.flags.Bool("insecureTLS", false, "")
+	f.apiKey = f.flags.String("apiKey", "", "")
+	f.flags.Var(&f.delaySampler, "restartDelayDistribution", "")
+	f.flags.Var(&f.outputs, "o", "")
+	f.flags.String("config", "", "")
+	f.flags.Bool("v", false, "")
+	return f
+}
+
+func writeTestConfigFile(t *testing.T, content string) string {
+	file, err := ioutil.TempFile("", "config")
+	testAssert.NoError(t, err)
+	testAssert.NoError(t, file.Close())
+	testAssert.NoError(t, ioutil.WriteFile(file.Name(), []byte(content), 0644))
+	return file.Name()
+}
+
+func applyTestConfigFile(t *testing.T, content string, args ...string) (*testConfigFlags, []string, error) {
+	path := writeTestConfigFile(t, content)
+	defer os.Remove(path)
+	f := newTestConfigFlags()
+	testAssert.NoError(t, f.flags.Parse(args))
+	config, err := loadConfigFile(path)
+	if err != nil {
+		return f, nil, err
+	}
+	args, err = config.Apply(f.flags, f.flags.Args())
+	return f, args, err
+}
+
+func TestConfigFile(t *testing.T) {
+	assert := testAssert.New(t)
+	expected := newTestConfigFlags()
+	assert.NoError(expected.flags.Parse([]string{"-n", "10", "-timeout", "2s", "-ewmaAlpha", "0.5", "-insecureTLS",
+		"-apiKey", "secret", "-restartDelayDistribution", "equal:1s,3s", "-o", "csv://-", "-o", "file.bin",
+		"rtmp://host/app/stream"}))
+	actual, args, err := applyTestConfigFile(t, `{
+		"n": 10,
+		"timeout": "2s",
+		"ewmaAlpha": 0.5,
+		"insecureTLS": true,
+		"apiKey": "secret",
+		"restartDelayDistribution": "equal:1s,3s",
+		"o": ["csv://-", "file.bin"],
+		"endpoints": ["rtmp://host/app/stream"]
+	}`)
+	assert.NoError(err)
+	assert.Equal(expected.flags.Args(), args)
+	assert.Equal(*expected.streams, *actual.streams)
+	assert.Equal(*expected.timeout, *actual.timeout)
+	assert.Equal(*expected.ewmaAlpha, *actual.ewmaAlpha)
+	assert.Equal(*expected.insecureTLS, *actual.insecureTLS)
+	assert.Equal(*expected.apiKey, *actual.apiKey)
+	assert.Equal(expected.delaySampler, actual.delaySampler)
+	assert.Equal(expected.outputs, actual.outputs)
+}
+
+func TestConfigFileOverriddenByFlags(t *testing.T) {
+	assert := testAssert.New(t)
+	actual, args, err := applyTestConfigFile(t, `{"n": 10, "timeout": "2s", "o": ["file.bin"], "endpoints": ["rtmp://host/app/stream"]}`,
+		"-n", "3", "-o", "csv://-", "rtmp://other/app/stream")
+	assert.NoError(err)
+	assert.Equal(3, *actual.streams)
+	assert.Equal(2*time.Second, *actual.timeout)
+	assert.Equal(golib.StringSlice{"csv://-"}, actual.outputs)
+	assert.Equal([]string{"rtmp://other/app/stream"}, args)
+}
+
+func TestConfigFileErrors(t *testing.T) {
+	assert := testAssert.New(t)
+	for _, content := range []string{
+		`{"n": 10`,
+		`["n"]`,
+		`{"unknownFlag": 1}`,
+		`{"n": "ten"}`,
+		`{"n": {"value": 10}}`,
+		`{"restartDelayDistribution": "invalid"}`,
+		`{"v": true}`,
+		`{"config": "other.json"}`,
+	} {
+		_, _, err := applyTestConfigFile(t, content)
+		assert.Error(err, content)
+	}
+	_, err := loadConfigFile("/non/existing/config.json")
+	assert.Error(err)
+}
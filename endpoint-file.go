@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"github.com/antongulenko/golib"
+	log "github.com/sirupsen/logrus"
+)
+
+const defaultEndpointFileReloadInterval = 5 * time.Second
+
+// EndpointFile synchronizes the endpoints of a RtmpStreamFactory with a file containing one URL or URL template per line.
+// Endpoints added through other means, like the REST API, are not affected.
+type EndpointFile struct {
+	Factory        *RtmpStreamFactory
+	Path           string
+	ReloadInterval time.Duration // Defaults to 5 seconds
+
+	lock   sync.Mutex
+	loaded map[string]bool // URLs of the endpoints that were added from the file, excluding endpoints that existed before
+}
+
+// Load reads the file and adds and removes endpoints, so the factory contains exactly the endpoints listed in the file.
+// If the file cannot be read or contains invalid URLs, the previously loaded endpoints are kept.
+func (f *EndpointFile) Load() error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	content, err := ioutil.ReadFile(f.Path)
+	if err != nil {
+		return fmt.Errorf("Failed to read endpoints file %v: %v", f.Path, err)
+	}
+	var hosts []string
+	hostEndpoints := make(map[string][]*RtmpEndpoint)
+	listed := make(map[string]bool)
+	for _, line := range getStrippedLines(content) {
+		host, endpoints, err := f.Factory.ParseURLArgument(line)
+		if err != nil {
+			return fmt.Errorf("Error handling streaming endpoint '%v' in file %v: %v", line, f.Path, err)
+		}
+		if _, ok := hostEndpoints[host]; !ok {
+			hosts = append(hosts, host)
+		}
+		for _, endpoint := range endpoints {
+			if url := endpoint.url.String(); !listed[url] {
+				listed[url] = true
+				if !f.loaded[url] {
+					hostEndpoints[host] = append(hostEndpoints[host], endpoint)
+				}
+			}
+		}
+	}
+
+	removed := f.Factory.RemoveEndpoints(func(endpoint *RtmpEndpoint) bool {
+		url := endpoint.url.String()
+		return f.loaded[url] && !listed[url]
+	})
+	// Only the endpoints actually added from the file are removed later, endpoints that were already added through
+	// other means are skipped by AddEndpoints and stay untouched
+	loaded := make(map[string]bool)
+	for url := range f.loaded {
+		if listed[url] {
+			loaded[url] = true
+		}
+	}
+	added := 0
+	for _, host := range hosts {
+		if endpoints := hostEndpoints[host]; len(endpoints) > 0 {
+			_, addedEndpoints := f.Factory.AddEndpoints(host, endpoints)
+			for _, endpoint := range addedEndpoints {
+				loaded[endpoint.url.String()] = true
+			}
+			added += len(addedEndpoints)
+		}
+	}
+	f.loaded = loaded
+	if added > 0 || removed > 0 {
+		log.Printf("Loaded endpoints file %v: added %v and removed %v endpoint(s)", f.Path, added, removed)
+	}
+	return nil
+}
+
+// Watch reloads the file every ReloadInterval until the given StopChan is stopped
+func (f *EndpointFile) Watch(stopper golib.StopChan) {
+	interval := f.ReloadInterval
+	if interval <= 0 {
+		interval = defaultEndpointFileReloadInterval
+	}
+	for stopper.WaitTimeout(interval) {
+		if err := f.Load(); err != nil {
+			log.Warnf("Failed to reload endpoints, keeping the previous endpoints: %v", err)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/antongulenko/golib"
+	testAssert "github.com/stretchr/testify/require"
+)
+
+func endpointURLs(factory *RtmpStreamFactory) []string {
+	var urls []string
+	for _, endpoint := range factory.allEndpoints() {
+		urls = append(urls, endpoint.String())
+	}
+	sort.Strings(urls)
+	return urls
+}
+
+func TestEndpointFile(t *testing.T) {
+	assert := testAssert.New(t)
+	file, err := ioutil.TempFile("", "endpoints")
+	assert.NoError(err)
+	defer os.Remove(file.Name())
+	writeURLs := func(urls ...string) {
+		assert.NoError(ioutil.WriteFile(file.Name(), []byte(strings.Join(urls, "\n")+"\n"), 0644))
+	}
+
+	factory := newTestFactory(t, "rtmp://other/app/stream")
+	endpointFile := &EndpointFile{Factory: factory, Path: file.Name(), ReloadInterval: 20 * time.Millisecond}
+	writeURLs("rtmp://host1/app/stream{{1 2}}", "", "  rtmp://host2/app/stream")
+	assert.NoError(endpointFile.Load())
+	assert.Equal([]string{"rtmp://host1/app/stream1", "rtmp://host1/app/stream2", "rtmp://host2/app/stream", "rtmp://other/app/stream"},
+		endpointURLs(factory))
+	kept := factory.hosts[1].endpoints[0]
+
+	stopper := golib.NewStopChan()
+	defer stopper.Stop()
+	go endpointFile.Watch(stopper)
+
+	// Vanished endpoints are removed, new ones are added, endpoints not loaded from the file are kept
+	writeURLs("rtmp://host1/app/stream1", "rtmp://host3/app/stream")
+	expected := []string{"rtmp://host1/app/stream1", "rtmp://host3/app/stream", "rtmp://other/app/stream"}
+	assert.Eventually(func() bool {
+		return strings.Join(endpointURLs(factory), " ") == strings.Join(expected, " ")
+	}, time.Second, 5*time.Millisecond)
+	assert.Len(factory.getHosts(), 3, "Hosts without endpoints must be removed")
+	endpoint, err := factory.nextHostEndpoint("host1")
+	assert.NoError(err)
+	assert.True(endpoint == kept, "Endpoints that are still listed must not be replaced")
+
+	// Invalid files keep the previous endpoints
+	writeURLs("rtmp://host1/app/stream{{2 1}}")
+	assert.Error(endpointFile.Load())
+	assert.NoError(os.Remove(file.Name()))
+	assert.Error(endpointFile.Load())
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(expected, endpointURLs(factory))
+}
+
+func TestEndpointFileKeepsOtherEndpoints(t *testing.T) {
+	assert := testAssert.New(t)
+	file, err := ioutil.TempFile("", "endpoints")
+	assert.NoError(err)
+	defer os.Remove(file.Name())
+	writeURLs := func(urls ...string) {
+		assert.NoError(ioutil.WriteFile(file.Name(), []byte(strings.Join(urls, "\n")+"\n"), 0644))
+	}
+
+	// Endpoints from the command line or the REST API, which are also listed in the file, are not owned by the file
+	factory := newTestFactory(t, "rtmp://cli/app/stream")
+	endpointFile := &EndpointFile{Factory: factory, Path: file.Name()}
+	writeURLs("rtmp://cli/app/stream", "rtmp://rest/app/stream", "rtmp://file/app/stream")
+	host, endpoints, err := factory.ParseURLArgument("rtmp://rest/app/stream")
+	assert.NoError(err)
+	factory.AddEndpoints(host, endpoints)
+	assert.NoError(endpointFile.Load())
+	assert.Equal([]string{"rtmp://cli/app/stream", "rtmp://file/app/stream", "rtmp://rest/app/stream"}, endpointURLs(factory))
+
+	writeURLs("rtmp://file/app/stream")
+	assert.NoError(endpointFile.Load())
+	assert.Equal([]string{"rtmp://cli/app/stream", "rtmp://file/app/stream", "rtmp://rest/app/stream"}, endpointURLs(factory))
+	writeURLs("rtmp://rest/app/stream")
+	assert.NoError(endpointFile.Load())
+	assert.Equal([]string{"rtmp://cli/app/stream", "rtmp://rest/app/stream"}, endpointURLs(factory))
+}
@@ -10,5 +10,5 @@ require (
 	github.com/gorilla/mux v1.7.3
 	github.com/sirupsen/logrus v1.4.2
 	github.com/stretchr/testify v1.4.0
-	github.com/zhangpeihao/goamf v0.0.0-20140409082417-3ff2c19514a8 // indirect
+	github.com/zhangpeihao/goamf v0.0.0-20140409082417-3ff2c19514a8
 )
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/bitflow-stream/go-bitflow/bitflow"
+)
+
+// maxGraphitePacketSize limits the size of the UDP packets sent to Graphite, to avoid IP fragmentation
+const maxGraphitePacketSize = 1400
+
+const defaultGraphitePrefix = "stream-statistics"
+
+// GraphiteSink sends the fields of the statistics samples as metrics in the Graphite plaintext protocol over UDP.
+// The metrics of one sample are buffered and sent in as few packets as possible.
+type GraphiteSink struct {
+	Prefix string // Prepended to all metric names, separated by a dot
+
+	conn   net.Conn
+	buffer bytes.Buffer
+}
+
+// NewGraphiteSink creates a GraphiteSink sending to the given host:port address
+func NewGraphiteSink(address string, prefix string) (*GraphiteSink, error) {
+	conn, err := net.Dial("udp", address)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to connect to Graphite at %v: %v", address, err)
+	}
+	return &GraphiteSink{Prefix: prefix, conn: conn}, nil
+}
+
+// Send writes one metric line for every field of the sample. Values that are NaN or infinite are skipped,
+// because Graphite cannot store them.
+func (s *GraphiteSink) Send(sample *bitflow.Sample, header *bitflow.Header) error {
+	timestamp := strconv.FormatInt(sample.Time.Unix(), 10)
+	s.buffer.Reset()
+	for i, field := range header.Fields {
+		value := float64(sample.Values[i])
+		if math.IsNaN(value) || math.IsInf(value, 0) {
+			continue
+		}
+		line := graphiteMetricName(s.Prefix, field) + " " + strconv.FormatFloat(value, 'f', -1, 64) + " " + timestamp + "\n"
+		if s.buffer.Len() > 0 && s.buffer.Len()+len(line) > maxGraphitePacketSize {
+			if err := s.flush(); err != nil {
+				return err
+			}
+		}
+		s.buffer.WriteString(line)
+	}
+	return s.flush()
+}
+
+func (s *GraphiteSink) flush() error {
+	if s.buffer.Len() == 0 {
+		return nil
+	}
+	_, err := s.conn.Write(s.buffer.Bytes())
+	s.buffer.Reset()
+	return err
+}
+
+func (s *GraphiteSink) Close() error {
+	return s.conn.Close()
+}
+
+var graphiteNameReplacer = strings.NewReplacer("/", "_per_", ".", "_", ":", "_", " ", "_")
+
+// graphiteMetricName converts a field name to a dot-separated Graphite metric path. For example, the per-host field
+// 'bytes/s{host=example.com}' becomes '<prefix>.host.example_com.bytes_per_s'.
+func graphiteMetricName(prefix string, field string) string {
+	name := graphiteNameReplacer.Replace(field)
+	if start := strings.Index(field, "{host="); start >= 0 && strings.HasSuffix(field, "}") {
+		host := field[start+len("{host=") : len(field)-1]
+		name = "host." + graphiteNameReplacer.Replace(host) + "." + graphiteNameReplacer.Replace(field[:start])
+	}
+	if prefix != "" {
+		name = prefix + "." + name
+	}
+	return name
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"math"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bitflow-stream/go-bitflow/bitflow"
+	testAssert "github.com/stretchr/testify/require"
+)
+
+func receiveGraphiteLines(t *testing.T, listener *net.UDPConn) []string {
+	assert := testAssert.New(t)
+	var lines []string
+	buffer := make([]byte, 64*1024)
+	assert.NoError(listener.SetReadDeadline(time.Now().Add(200 * time.Millisecond)))
+	for {
+		num, err := listener.Read(buffer)
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			return lines
+		}
+		assert.NoError(err)
+		assert.True(num <= maxGraphitePacketSize)
+		lines = append(lines, strings.Split(strings.TrimSuffix(string(buffer[:num]), "\n"), "\n")...)
+	}
+}
+
+func TestGraphiteSink(t *testing.T) {
+	assert := testAssert.New(t)
+	listener, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	assert.NoError(err)
+	defer listener.Close()
+	sink, err := NewGraphiteSink(listener.LocalAddr().String(), "test")
+	assert.NoError(err)
+	defer sink.Close()
+
+	timestamp := time.Unix(1500000000, 0)
+	assert.NoError(sink.Send(
+		&bitflow.Sample{Time: timestamp, Values: []bitflow.Value{3, 1250.5, bitflow.Value(math.NaN()), 7}},
+		&bitflow.Header{Fields: []string{"streams", "bytes/s", "packetDelay", "openConnections{host=example.com:1935}"}}))
+	assert.Equal([]string{
+		"test.streams 3 1500000000",
+		"test.bytes_per_s 1250.5 1500000000",
+		"test.host.example_com_1935.openConnections 7 1500000000",
+	}, receiveGraphiteLines(t, listener))
+
+	// Large samples are split into multiple packets
+	const numFields = 200
+	sample := &bitflow.Sample{Time: timestamp, Values: make([]bitflow.Value, numFields)}
+	header := &bitflow.Header{Fields: make([]string, numFields)}
+	for i := range header.Fields {
+		header.Fields[i] = "field"
+	}
+	assert.NoError(sink.Send(sample, header))
+	lines := receiveGraphiteLines(t, listener)
+	assert.Len(lines, numFields)
+	assert.Equal("test.field 0 1500000000", lines[numFields-1])
+}
+
+func TestGraphiteStatistics(t *testing.T) {
+	assert := testAssert.New(t)
+	listener, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	assert.NoError(err)
+	defer listener.Close()
+	col := &StreamStatisticsCollector{Factory: &RtmpStreamFactory{}}
+	col.Graphite, err = NewGraphiteSink(listener.LocalAddr().String(), "")
+	assert.NoError(err)
+	defer col.Graphite.Close()
+	assert.NoError(col.SelectFields([]string{"bytes", "errors"}))
+	col.SetSink(new(recordingSink))
+	col.statisticsTime = time.Now()
+	col.bytes.Increment(300)
+	col.sinkSample()
+
+	lines := receiveGraphiteLines(t, listener)
+	assert.Len(lines, 2)
+	assert.True(strings.HasPrefix(lines[0], "errors 0 "), lines[0])
+	assert.True(strings.HasPrefix(lines[1], "bytes 300 "), lines[1])
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const defaultHlsTargetDuration = 2 * time.Second
+
+// isHlsURL returns true for http(s) URLs pointing to an .m3u8 playlist. Such endpoints are streamed via HlsStreamFactory.
+func isHlsURL(target *url.URL) bool {
+	return (target.Scheme == "http" || target.Scheme == "https") && strings.HasSuffix(target.Path, ".m3u8")
+}
+
+// HlsStreamFactory opens HLS streams to the endpoints managed by Endpoints.
+// RtmpStreamFactory automatically delegates to an HlsStreamFactory for HLS endpoint URLs.
+type HlsStreamFactory struct {
+	Endpoints       *RtmpStreamFactory
+	TimeoutDuration time.Duration
+	Client          *http.Client // Defaults to http.DefaultClient
+
+	now func() time.Time // Seam for testing, defaults to time.Now
+}
+
+var _ StreamFactory = &HlsStreamFactory{}
+
+func (f *HlsStreamFactory) OpenStream(ctx context.Context) (Stream, error) {
+	endpoint, err := f.Endpoints.nextEndpoint()
+	if err != nil {
+		return nil, err
+	}
+	return f.OpenEndpoint(ctx, endpoint)
+}
+
+// OpenEndpoint fetches the playlist of the given endpoint and returns a stream delivering the playlist segments
+func (f *HlsStreamFactory) OpenEndpoint(ctx context.Context, endpoint *RtmpEndpoint) (Stream, error) {
+	start := f.currentTime()
+	streamCtx, cancel := context.WithCancel(context.Background())
+	stream := &HlsStream{
+		StreamInfo:      StreamInfo{Endpoint: endpoint},
+		TimeoutDuration: f.TimeoutDuration,
+		client:          f.Client,
+		ctx:             streamCtx,
+		cancel:          cancel,
+		playlistURL:     endpoint.url,
+		nextSequence:    -1,
+	}
+	if stream.client == nil {
+		stream.client = http.DefaultClient
+	}
+	playlistDone := abortOnCancel(ctx, cancel)
+	err := stream.refreshPlaylist()
+	if canceled := playlistDone(); canceled != nil {
+		stream.Close()
+		return nil, canceled
+	} else if err != nil {
+		stream.Close()
+		return nil, err
+	}
+	stream.ConnectLatency = f.currentTime().Sub(start)
+	return stream, nil
+}
+
+func (f *HlsStreamFactory) currentTime() time.Time {
+	if f.now != nil {
+		return f.now()
+	}
+	return time.Now()
+}
+
+// HlsStream follows the segment list of an HLS media playlist. Every successful call to Receive downloads one segment
+// and returns its size. Live playlists are re-fetched when all known segments have been received.
+type HlsStream struct {
+	StreamInfo
+	TimeoutDuration time.Duration
+
+	client *http.Client
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	playlistURL    *url.URL
+	segments       []*url.URL
+	nextSequence   int64 // Media sequence number of the next segment that has not been queued yet, -1 before the first playlist
+	targetDuration time.Duration
+	ended          bool
+}
+
+var _ Stream = &HlsStream{}
+
+// Receive downloads the next segment. HLS segments usually contain multiplexed audio and video, so they are
+// reported as VideoPacket. After the last segment of a playlist marked with #EXT-X-ENDLIST, io.EOF is returned.
+func (s *HlsStream) Receive() (int, PacketType, error) {
+	waitingSince := time.Now()
+	for len(s.segments) == 0 {
+		if s.ended {
+			return 0, NoPacket, io.EOF
+		}
+		if time.Since(waitingSince) > s.TimeoutDuration+s.targetDuration {
+			return 0, NoPacket, categorizedError(TimeoutError, fmt.Errorf("Timeout after %v waiting for new segments in playlist %v", time.Since(waitingSince), s.playlistURL))
+		}
+		select {
+		case <-time.After(s.targetDuration / 2):
+		case <-s.ctx.Done():
+			return 0, NoPacket, s.ctx.Err()
+		}
+		if err := s.refreshPlaylist(); err != nil {
+			return 0, NoPacket, err
+		}
+	}
+	segment := s.segments[0]
+	s.segments = s.segments[1:]
+	body, err := s.get(segment)
+	if err != nil {
+		return 0, NoPacket, err
+	}
+	defer body.Close()
+	size, err := io.Copy(ioutil.Discard, body)
+	if err != nil {
+		return int(size), NoPacket, fmt.Errorf("Failed to download HLS segment %v: %w", segment, err)
+	}
+	return int(size), VideoPacket, nil
+}
+
+func (s *HlsStream) Close() {
+	if s != nil && s.cancel != nil {
+		s.cancel()
+	}
+}
+
+// get requests the given URL. The request is canceled if the response headers or the next data of the body are not
+// received within TimeoutDuration, so downloading a large segment can take longer than that in total.
+func (s *HlsStream) get(target *url.URL) (io.ReadCloser, error) {
+	req, err := http.NewRequest("GET", target.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(s.ctx)
+	body := &idleTimeoutBody{timeout: s.TimeoutDuration, target: target, cancel: cancel}
+	body.timer = time.AfterFunc(s.TimeoutDuration, body.expire)
+	resp, err := s.client.Do(req.WithContext(ctx))
+	if err != nil {
+		body.Close()
+		return nil, body.mapError(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		body.Close()
+		return nil, categorizedError(HandshakeError, fmt.Errorf("Request to %v returned status %v", target, resp.Status))
+	}
+	body.ReadCloser = resp.Body
+	return body, nil
+}
+
+// refreshPlaylist fetches the playlist and queues all segments that have not been queued before.
+// Master playlists are resolved by following their first variant stream, which must be a media playlist.
+func (s *HlsStream) refreshPlaylist() error {
+	playlist, err := s.fetchPlaylist()
+	if err != nil {
+		return err
+	}
+	if playlist.variant != nil {
+		log.Debugf("Following variant stream %v of HLS master playlist %v", playlist.variant, s.playlistURL)
+		s.playlistURL = playlist.variant
+		if playlist, err = s.fetchPlaylist(); err != nil {
+			return err
+		}
+		if playlist.variant != nil {
+			return categorizedError(HandshakeError, fmt.Errorf("Variant stream %v of HLS master playlist is a master playlist as well", s.playlistURL))
+		}
+	}
+	s.targetDuration = playlist.targetDuration
+	s.ended = playlist.ended
+	for i, segment := range playlist.segments {
+		sequence := playlist.mediaSequence + int64(i)
+		if sequence >= s.nextSequence {
+			s.segments = append(s.segments, segment)
+			s.nextSequence = sequence + 1
+		}
+	}
+	return nil
+}
+
+type hlsPlaylist struct {
+	targetDuration time.Duration
+	mediaSequence  int64
+	segments       []*url.URL
+	variant        *url.URL
+	ended          bool
+}
+
+func (s *HlsStream) fetchPlaylist() (*hlsPlaylist, error) {
+	body, err := s.get(s.playlistURL)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	playlist, err := parseHlsPlaylist(s.playlistURL, body)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse HLS playlist %v: %v", s.playlistURL, err)
+	}
+	return playlist, nil
+}
+
+func parseHlsPlaylist(base *url.URL, reader io.Reader) (*hlsPlaylist, error) {
+	playlist := &hlsPlaylist{targetDuration: defaultHlsTargetDuration}
+	scanner := bufio.NewScanner(reader)
+	first := true
+	isVariant := false
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if first {
+			if line != "#EXTM3U" {
+				return nil, errors.New("Missing #EXTM3U header")
+			}
+			first = false
+			continue
+		}
+		switch {
+		case strings.HasPrefix(line, "#EXT-X-TARGETDURATION:"):
+			seconds, err := strconv.ParseFloat(strings.TrimPrefix(line, "#EXT-X-TARGETDURATION:"), 64)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid target duration: %v", err)
+			}
+			if seconds > 0 {
+				playlist.targetDuration = time.Duration(seconds * float64(time.Second))
+			}
+		case strings.HasPrefix(line, "#EXT-X-MEDIA-SEQUENCE:"):
+			sequence, err := strconv.ParseInt(strings.TrimPrefix(line, "#EXT-X-MEDIA-SEQUENCE:"), 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid media sequence: %v", err)
+			}
+			playlist.mediaSequence = sequence
+		case strings.HasPrefix(line, "#EXT-X-STREAM-INF"):
+			isVariant = true
+		case line == "#EXT-X-ENDLIST":
+			playlist.ended = true
+		case strings.HasPrefix(line, "#"):
+			// Ignore other tags and comments
+		default:
+			ref, err := base.Parse(line)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid URI '%v': %v", line, err)
+			}
+			if isVariant {
+				if playlist.variant == nil {
+					playlist.variant = ref
+				}
+			} else {
+				playlist.segments = append(playlist.segments, ref)
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if first {
+		return nil, errors.New("Empty playlist")
+	}
+	return playlist, nil
+}
+
+// idleTimeoutBody cancels its request when no data is received within the timeout, like HttpStream.
+// Closing the body releases the context of the request.
+type idleTimeoutBody struct {
+	io.ReadCloser
+	timeout time.Duration
+	target  *url.URL
+	cancel  context.CancelFunc
+	timer   *time.Timer
+	expired int32
+}
+
+func (b *idleTimeoutBody) Read(p []byte) (int, error) {
+	b.timer.Reset(b.timeout)
+	num, err := b.ReadCloser.Read(p)
+	if err != nil && err != io.EOF {
+		err = b.mapError(err)
+	}
+	return num, err
+}
+
+func (b *idleTimeoutBody) Close() error {
+	b.timer.Stop()
+	var err error
+	if b.ReadCloser != nil {
+		err = b.ReadCloser.Close()
+	}
+	b.cancel()
+	return err
+}
+
+func (b *idleTimeoutBody) expire() {
+	atomic.StoreInt32(&b.expired, 1)
+	b.cancel()
+}
+
+// mapError reports errors caused by the timer canceling the request as timeout
+func (b *idleTimeoutBody) mapError(err error) error {
+	if atomic.LoadInt32(&b.expired) == 1 {
+		return categorizedError(TimeoutError, fmt.Errorf("Timeout after %v waiting for data from %v", b.timeout, b.target))
+	}
+	return err
+}
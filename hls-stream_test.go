@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	testAssert "github.com/stretchr/testify/require"
+)
+
+// newTestHlsServer serves a live playlist at /live/index.m3u8, which gains one segment per request until it contains
+// the given segment sizes and is marked with #EXT-X-ENDLIST. A master playlist pointing to it is served at /master.m3u8.
+func newTestHlsServer(t *testing.T, segmentSizes ...int) *httptest.Server {
+	var lock sync.Mutex
+	playlistRequests := 0
+	mux := http.NewServeMux()
+	mux.HandleFunc("/master.m3u8", func(w http.ResponseWriter, _ *http.Request) {
+		fmt.Fprint(w, "#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=1000\nlive/index.m3u8\n")
+	})
+	mux.HandleFunc("/live/index.m3u8", func(w http.ResponseWriter, _ *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		playlistRequests++
+		available := playlistRequests
+		if available > len(segmentSizes) {
+			available = len(segmentSizes)
+		}
+		// Sliding window of at most two segments
+		first := available - 2
+		if first < 0 {
+			first = 0
+		}
+		fmt.Fprintf(w, "#EXTM3U\n#EXT-X-TARGETDURATION:0.02\n#EXT-X-MEDIA-SEQUENCE:%v\n", first)
+		for i := first; i < available; i++ {
+			fmt.Fprintf(w, "#EXTINF:0.02,\nsegment%v.ts\n", i)
+		}
+		if available == len(segmentSizes) {
+			fmt.Fprint(w, "#EXT-X-ENDLIST\n")
+		}
+	})
+	for i, size := range segmentSizes {
+		data := strings.Repeat("x", size)
+		mux.HandleFunc(fmt.Sprintf("/live/segment%v.ts", i), func(w http.ResponseWriter, _ *http.Request) {
+			fmt.Fprint(w, data)
+		})
+	}
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func receiveAll(t *testing.T, stream Stream) []int {
+	var sizes []int
+	for {
+		size, packetType, err := stream.Receive()
+		if err == io.EOF {
+			return sizes
+		}
+		testAssert.NoError(t, err)
+		testAssert.Equal(t, VideoPacket, packetType)
+		sizes = append(sizes, size)
+	}
+}
+
+func TestHlsStream(t *testing.T) {
+	assert := testAssert.New(t)
+	for _, path := range []string{"/live/index.m3u8", "/master.m3u8"} {
+		server := newTestHlsServer(t, 10, 20, 30, 40)
+		factory := newTestFactory(t, server.URL+path)
+		stream, err := factory.OpenStream(context.Background())
+		assert.NoError(err)
+		assert.IsType(&HlsStream{}, stream)
+		assert.Equal(server.URL+path, stream.Info().Endpoint.String())
+		assert.Equal([]int{10, 20, 30, 40}, receiveAll(t, stream))
+		stream.Close()
+	}
+}
+
+func TestHlsStreamErrors(t *testing.T) {
+	assert := testAssert.New(t)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/invalid.m3u8":
+			fmt.Fprint(w, "not a playlist")
+		case "/stalled.m3u8":
+			fmt.Fprint(w, "#EXTM3U\n#EXT-X-TARGETDURATION:0.02\n")
+		case "/loop.m3u8":
+			fmt.Fprint(w, "#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=1000\nloop.m3u8\n")
+		case "/slow.m3u8", "/stalledSegment.m3u8":
+			fmt.Fprintf(w, "#EXTM3U\n#EXT-X-TARGETDURATION:0.02\n#EXTINF:0.02,\n%v.ts\n#EXT-X-ENDLIST\n", strings.TrimSuffix(req.URL.Path[1:], ".m3u8"))
+		case "/slow.ts":
+			// Every chunk arrives within the timeout, but the whole segment takes longer
+			for i := 0; i < 5; i++ {
+				fmt.Fprint(w, "xxxxxxxxxx")
+				w.(http.Flusher).Flush()
+				time.Sleep(30 * time.Millisecond)
+			}
+		case "/stalledSegment.ts":
+			fmt.Fprint(w, "xxxxxxxxxx")
+			w.(http.Flusher).Flush()
+			time.Sleep(300 * time.Millisecond)
+		default:
+			http.NotFound(w, req)
+		}
+	}))
+	defer server.Close()
+
+	factory := newTestFactory(t, server.URL+"/missing.m3u8")
+	_, err := factory.OpenStream(context.Background())
+	assert.Error(err)
+
+	factory = newTestFactory(t, server.URL+"/invalid.m3u8")
+	_, err = factory.OpenStream(context.Background())
+	assert.Error(err)
+
+	factory = newTestFactory(t, server.URL+"/stalled.m3u8")
+	factory.TimeoutDuration = 50 * time.Millisecond
+	stream, err := factory.OpenStream(context.Background())
+	assert.NoError(err)
+	_, _, err = stream.Receive()
+	assert.Error(err)
+	assert.NotEqual(io.EOF, err)
+
+	// Master playlists must not refer to other master playlists
+	factory = newTestFactory(t, server.URL+"/loop.m3u8")
+	_, err = factory.OpenStream(context.Background())
+	assert.Error(err)
+	assert.Equal(HandshakeError, categorizeError(err, ReadError))
+
+	// The timeout applies to the gaps between the received data, not to the whole segment
+	factory = newTestFactory(t, server.URL+"/slow.m3u8")
+	factory.TimeoutDuration = 100 * time.Millisecond
+	stream, err = factory.OpenStream(context.Background())
+	assert.NoError(err)
+	assert.Equal([]int{50}, receiveAll(t, stream))
+	factory = newTestFactory(t, server.URL+"/stalledSegment.m3u8")
+	factory.TimeoutDuration = 100 * time.Millisecond
+	stream, err = factory.OpenStream(context.Background())
+	assert.NoError(err)
+	_, _, err = stream.Receive()
+	assert.Equal(TimeoutError, categorizeError(err, ReadError))
+}
+
+func TestAllEndpointURLsHls(t *testing.T) {
+	assert := testAssert.New(t)
+	server := newTestHlsServer(t, 10)
+	factory := newTestFactory(t, server.URL+"/live/index.m3u8", server.URL+"/live/missing.m3u8")
+	summary, err := factory.TestAllEndpointURLs()
+	assert.Contains(summary, "Successfully connected to 1 / 2 endpoints")
+	assert.Error(err)
+}
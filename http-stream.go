@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const defaultHttpReceiveBufferSize = 32 * 1024
+
+// isHttpURL returns true for http(s) URLs that are not HLS playlists. Such endpoints are downloaded via HttpStreamFactory.
+func isHttpURL(target *url.URL) bool {
+	return (target.Scheme == "http" || target.Scheme == "https") && !isHlsURL(target)
+}
+
+// HttpStreamFactory downloads the response bodies of the endpoints managed by Endpoints to measure the raw throughput.
+// RtmpStreamFactory automatically delegates to an HttpStreamFactory for http(s) URLs that are not HLS playlists.
+type HttpStreamFactory struct {
+	Endpoints         *RtmpStreamFactory
+	TimeoutDuration   time.Duration
+	Client            *http.Client // Defaults to http.DefaultClient
+	ReceiveBufferSize int          // Size of the buffer allocated for every stream, defaults to 32 KB
+
+	now func() time.Time // Seam for testing, defaults to time.Now
+}
+
+var _ StreamFactory = &HttpStreamFactory{}
+
+func (f *HttpStreamFactory) OpenStream(ctx context.Context) (Stream, error) {
+	endpoint, err := f.Endpoints.nextEndpoint()
+	if err != nil {
+		return nil, err
+	}
+	return f.OpenEndpoint(ctx, endpoint)
+}
+
+// OpenEndpoint sends the request to the given endpoint and returns a stream reading the response body
+func (f *HttpStreamFactory) OpenEndpoint(ctx context.Context, endpoint *RtmpEndpoint) (Stream, error) {
+	start := f.currentTime()
+	client := f.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	req, err := http.NewRequest("GET", endpoint.url.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	streamCtx, cancel := context.WithCancel(context.Background())
+	stream := &HttpStream{
+		StreamInfo:      StreamInfo{Endpoint: endpoint},
+		TimeoutDuration: f.TimeoutDuration,
+		cancel:          cancel,
+	}
+	// The timer cancels the request when the server does not respond or stops sending data
+	stream.timer = time.AfterFunc(f.TimeoutDuration, stream.timeout)
+	log.Debugln("Requesting HTTP URL:", endpoint.url)
+	requestDone := abortOnCancel(ctx, cancel)
+	resp, err := client.Do(req.WithContext(streamCtx))
+	if canceled := requestDone(); canceled != nil {
+		if err == nil {
+			resp.Body.Close()
+		}
+		stream.Close()
+		return nil, canceled
+	} else if err != nil {
+		stream.Close()
+		return nil, stream.mapError(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		stream.Close()
+		return nil, categorizedError(HandshakeError, fmt.Errorf("Request to %v returned status %v", endpoint.url, resp.Status))
+	}
+	bufferSize := f.ReceiveBufferSize
+	if bufferSize <= 0 {
+		bufferSize = defaultHttpReceiveBufferSize
+	}
+	stream.body = resp.Body
+	stream.buffer = make([]byte, bufferSize)
+	stream.ConnectLatency = f.currentTime().Sub(start)
+	return stream, nil
+}
+
+func (f *HttpStreamFactory) currentTime() time.Time {
+	if f.now != nil {
+		return f.now()
+	}
+	return time.Now()
+}
+
+// HttpStream reads the body of an HTTP response. Every call to Receive reads up to the size of the receive buffer.
+// When the response body is complete, io.EOF is returned.
+type HttpStream struct {
+	StreamInfo
+	TimeoutDuration time.Duration
+
+	body     io.ReadCloser
+	buffer   []byte // Owned by this stream, the received data is discarded
+	received int    // Number of bytes in buffer from the last call to Receive
+	cancel   context.CancelFunc
+	timer    *time.Timer
+	timedOut int32
+}
+
+var _ Stream = &HttpStream{}
+
+// Receive returns the number of bytes read from the response body. The data is not reported as audio or video.
+func (s *HttpStream) Receive() (int, PacketType, error) {
+	s.timer.Reset(s.TimeoutDuration)
+	num, err := s.body.Read(s.buffer)
+	s.received = num
+	if err != nil && err != io.EOF {
+		err = s.mapError(err)
+	}
+	return num, NoPacket, err
+}
+
+func (s *HttpStream) Payload() []byte {
+	return s.buffer[:s.received]
+}
+
+func (s *HttpStream) Close() {
+	if s == nil || s.cancel == nil {
+		return
+	}
+	s.timer.Stop()
+	s.cancel()
+	if s.body != nil {
+		s.body.Close()
+	}
+}
+
+func (s *HttpStream) timeout() {
+	atomic.StoreInt32(&s.timedOut, 1)
+	s.cancel()
+}
+
+// mapError reports errors caused by the timer canceling the request as timeout
+func (s *HttpStream) mapError(err error) error {
+	if atomic.LoadInt32(&s.timedOut) == 1 {
+		return categorizedError(TimeoutError, fmt.Errorf("Timeout after %v waiting for data from %v", s.TimeoutDuration, s.Endpoint.url))
+	}
+	return err
+}
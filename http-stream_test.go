@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	testAssert "github.com/stretchr/testify/require"
+)
+
+// newTestHttpServer serves a chunked body of the given chunk sizes at /download, a body that stops sending data
+// at /stalled and a 404 status at any other path
+func newTestHttpServer(chunkSizes ...int) *httptest.Server {
+	return httptest.NewServer(newTestHttpHandler(chunkSizes...))
+}
+
+func newTestHttpHandler(chunkSizes ...int) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/download", func(w http.ResponseWriter, _ *http.Request) {
+		for _, size := range chunkSizes {
+			w.Write([]byte(strings.Repeat("x", size)))
+			w.(http.Flusher).Flush()
+		}
+	})
+	mux.HandleFunc("/stalled", func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("x"))
+		w.(http.Flusher).Flush()
+		<-req.Context().Done()
+	})
+	mux.HandleFunc("/", http.NotFound)
+	return mux
+}
+
+func TestHttpStream(t *testing.T) {
+	assert := testAssert.New(t)
+	server := newTestHttpServer(1000, 50000, 3000)
+	defer server.Close()
+	factory := newTestFactory(t, server.URL+"/download")
+	factory.HttpReceiveBuffer = 4096
+	assert.IsType(&HttpStreamFactory{}, factory.delegateFactory(factory.allEndpoints()[0].url))
+
+	stream, err := factory.OpenStream(context.Background())
+	assert.NoError(err)
+	assert.IsType(&HttpStream{}, stream)
+	running := newTestRunningStream()
+	running.receiveStream(stream, &factory.hosts[0].stats)
+	stream.Close()
+	assert.Equal(float64(54000), float64(running.col.bytes.Get()))
+	assert.True(running.col.packets.Get() >= 3)
+	assert.Equal(float64(0), float64(running.col.errors.Get()))
+	assert.Equal(float64(1), float64(running.col.closed.Get()))
+}
+
+func TestHttpStreamErrors(t *testing.T) {
+	assert := testAssert.New(t)
+	server := newTestHttpServer()
+	defer server.Close()
+	factory := newTestFactory(t, server.URL+"/missing")
+	_, err := factory.OpenStream(context.Background())
+	assert.Error(err)
+	assert.Contains(err.Error(), "404")
+
+	factory = newTestFactory(t, server.URL+"/stalled")
+	factory.TimeoutDuration = 50 * time.Millisecond
+	stream, err := factory.OpenStream(context.Background())
+	assert.NoError(err)
+	defer stream.Close()
+	num, _, err := stream.Receive()
+	assert.NoError(err)
+	assert.Equal(1, num)
+	_, _, err = stream.Receive()
+	assert.Error(err)
+	assert.Contains(err.Error(), "Timeout after 50ms")
+}
+
+func TestHttpStreamsConcurrently(t *testing.T) {
+	assert := testAssert.New(t)
+	server := newTestHttpServer(20000, 20000, 20000)
+	defer server.Close()
+	factory := newTestFactory(t, server.URL+"/download")
+	factory.HttpReceiveBuffer = 1024
+
+	const numStreams = 10
+	running := newTestRunningStream()
+	var wg sync.WaitGroup
+	for i := 0; i < numStreams; i++ {
+		stream, err := factory.OpenStream(context.Background())
+		assert.NoError(err)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer stream.Close()
+			running.receiveStream(stream, &factory.hosts[0].stats)
+		}()
+	}
+	wg.Wait()
+	assert.Equal(float64(numStreams*60000), float64(running.col.bytes.Get()))
+	assert.Equal(float64(numStreams), float64(running.col.closed.Get()))
+}
+
+func TestInsecureTLS(t *testing.T) {
+	assert := testAssert.New(t)
+	// The test server uses a self-signed certificate
+	server := httptest.NewTLSServer(newTestHttpHandler(1000))
+	defer server.Close()
+
+	factory := newTestFactory(t, server.URL+"/download")
+	_, err := factory.OpenStream(context.Background())
+	assert.Error(err)
+	assert.Contains(err.Error(), "certificate")
+	assert.Equal(http.DefaultClient, factory.delegateFactory(factory.allEndpoints()[0].url).(*HttpStreamFactory).Client)
+
+	factory = newTestFactory(t, server.URL+"/download", server.URL+"/live.m3u8")
+	factory.InsecureSkipVerify = true
+	stream, err := factory.openEndpoint(context.Background(), factory.allEndpoints()[0])
+	assert.NoError(err)
+	running := newTestRunningStream()
+	running.receiveStream(stream, &factory.hosts[0].stats)
+	stream.Close()
+	assert.Equal(float64(1000), float64(running.col.bytes.Get()))
+	hlsFactory := factory.delegateFactory(factory.allEndpoints()[1].url).(*HlsStreamFactory)
+	assert.NotEqual(http.DefaultClient, hlsFactory.Client)
+	assert.True(hlsFactory.Client.Transport.(*http.Transport).TLSClientConfig.InsecureSkipVerify)
+}
@@ -1,12 +1,21 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"math"
 	"math/rand"
+	"net"
 	"os"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/antongulenko/golib"
@@ -17,6 +26,12 @@ import (
 
 const noUrlsSleepDuration = 5 * time.Second
 
+// saturatedHostsSleepDuration is the time to wait before retrying to open a stream, if all hosts reached their connection limit
+const saturatedHostsSleepDuration = time.Second
+
+// errorSummaryInterval is the interval for summarizing the suppressed stream error logs in Quiet mode
+const errorSummaryInterval = 10 * time.Second
+
 func main() {
 	os.Exit(do_main())
 }
@@ -27,34 +42,177 @@ func do_main() int {
 	flag.Var(&delaySampler, "restartDelayDistribution", "Define an random distribution for the time before starting a stream."+
 		" This is applied, when streams are initially started and when a stream ends (with or without error). Definition format: "+
 		"<distribution type>:<comma separated list of duration parameters>. Supported distribution types  (with required parameters): "+
-		"'const:<value>', 'equal:<min_value>,<max_value>', 'norm:<mean>,<std_dev>'. Examples: 'const:500ms', 'const:5s', 'norm:100ms,30ms', 'equal:0ms,1s'.")
+		"'const:<value>', 'equal:<min_value>,<max_value>', 'norm:<mean>,<std_dev>', 'lognorm:<mean>,<std_dev>' (log-normal parameters "+
+		"are interpreted in log-nanosecond space and must be at most 43ns), 'list:<value1>,<value2>,...', 'gamma:<shape>,<scale>' (shape is a plain positive number), "+
+		"'tri:<min_value>,<mode>,<max_value>', "+
+		"'mix:<probability>:<distribution>:<distribution>' (chooses the first distribution with the given probability, otherwise the second), "+
+		"'file:<path>[,<reload interval>]' (reads a distribution definition from a file and re-reads it every 5s by default, "+
+		"must be the last part of a definition and cannot be used inside the file). "+
+		"Examples: 'const:500ms', 'const:5s', 'norm:100ms,30ms', 'equal:0ms,1s', 'lognorm:20ns,1ns', 'list:1s,5s,30s', 'gamma:2,500ms', 'tri:0s,1s,10s', "+
+		"'mix:0.8:const:100ms:norm:10s,2s', 'file:/tmp/delay.txt,10s'.")
+	rampUp := flag.Duration("rampUp", 0, "When increasing the number of streams, start the new streams evenly spread over this duration "+
+		"instead of all at once")
+	runFor := flag.Duration("runFor", 0, "Stop streaming and exit after running for the given duration. "+
+		"The statistics of the last interval are emitted before exiting.")
+	maxStreamDuration := flag.Duration("maxStreamDuration", 0, "Close each stream after the given duration and reconnect after the "+
+		"restart delay. Such closed streams are not counted as errors.")
+	stallTimeout := flag.Duration("stallTimeout", 0, "Close streams that do not deliver any data for the given duration and count them as stalls")
+	backoff := flag.Duration("backoff", 0, "After a stream fails to open, wait this duration before the next attempt, doubling it "+
+		"after every consecutive failure. The backoff is reset when a stream is opened successfully. By default, no backoff is applied.")
+	maxBackoff := flag.Duration("maxBackoff", time.Minute, "Upper limit for the -backoff")
+	backoffReplacesDelay := flag.Bool("backoffReplacesDelay", false, "When backing off, wait only for the backoff instead of "+
+		"adding it to the restart delay")
+	maxRetries := flag.Int("maxRetries", 0, "Abandon a stream slot after failing to open a stream this many times in a row, "+
+		"which reduces the number of running streams. By default, streams are retried indefinitely.")
+	var streamBandwidth Bandwidth
+	flag.Var(&streamBandwidth, "streamBandwidth", "Limit the rate at which each stream consumes data, e.g. '500kbps' or '2mbps'. "+
+		"Received packets are delayed accordingly, so RTMP and RTSP servers are slowed down by TCP flow control, "+
+		"while HLS segments are downloaded at full speed and the next segment is delayed. By default, streams are not limited.")
+	var maxTotalBytes ByteSize
+	flag.Var(&maxTotalBytes, "maxTotalBytes", "Stop streaming and exit after receiving this number of bytes in total over all streams "+
+		"(optionally with K/M/G suffix). The limit is checked whenever statistics are emitted, so it can be exceeded slightly. "+
+		"The bytes received during the -warmup are counted as well.")
+	maxOpens := flag.Uint64("maxOpens", 0, "Stop streaming and exit after opening this number of streams in total, including reconnects. "+
+		"Like -maxTotalBytes, the limit is checked whenever statistics are emitted. With -warmup, only the streams opened "+
+		"after the warmup are counted.")
+	streamLog := flag.String("streamLog", "", "Append the lifecycle events of all streams (opened, firstByte, error, closed) "+
+		"as JSON lines to the given file")
+	captureTo := flag.String("captureTo", "", "Directory to write the data received by the first stream of every endpoint to, "+
+		"one file per stream. Supported for RTMP, RTSP, HTTP, UDP and SRT streams. By default, no data is captured.")
+	captureMaxBytes := ByteSize(defaultCaptureMaxBytes)
+	flag.Var(&captureMaxBytes, "captureMaxBytes", "Stop capturing after writing this number of bytes in total with -captureTo")
+	drainTimeout := flag.Duration("drainTimeout", 10*time.Second, "When shutting down, wait at most this duration for all streams to close "+
+		"before exiting anyway. A value of 0 waits indefinitely.")
+	ewmaAlpha := flag.Float64("ewmaAlpha", 0.3, "Smoothing factor between 0 and 1 for the moving averages bytes/s_ewma and packets/s_ewma. "+
+		"Lower values smooth more. A value of 0 disables the moving averages.")
+	warmup := flag.Duration("warmup", 0, "Mark the samples emitted during this duration after starting with warmup=1. "+
+		"At the end of the warmup, the cumulative statistics like bytes, opened and closed are reset once. "+
+		"Since streams opened during the warmup stay open, closed can exceed opened afterwards.")
+	quiet := flag.Bool("quiet", false, "Log only the first error of failing streams every "+errorSummaryInterval.String()+
+		" and summarize the error counters instead of logging every failed open and read")
 	sinkInterval := flag.Duration("si", 1000*time.Millisecond, "Interval in which to send out stream statistics")
-	timeout := flag.Duration("timeout", 5*time.Second, "Timeout for RTMP streams")
+	timeout := flag.Duration("timeout", 5*time.Second, "Timeout for RTMP, HLS, RTSP, HTTP, UDP and SRT streams")
+	connectTimeout := flag.Duration("connectTimeout", 0, "Timeout for connecting to RTMP endpoints and creating the streams (defaults to -timeout)")
+	readTimeout := flag.Duration("readTimeout", 0, "Timeout for receiving data from opened RTMP streams (defaults to -timeout)")
+	insecureTLS := flag.Bool("insecureTLS", false, "Do not verify the server certificates of rtmps and https endpoints, "+
+		"e.g. for test origins with self-signed certificates. Never use this in production.")
+	httpReceiveBuffer := ByteSize(defaultHttpReceiveBufferSize)
+	flag.Var(&httpReceiveBuffer, "httpReceiveBuffer", "Size of the buffer for reading the response body of plain http(s) endpoints, "+
+		"which are downloaded to measure the throughput (optionally with K/M/G suffix)")
+	var selection EndpointSelection
+	flag.Var(&selection, "endpointSelection", "Selection of the endpoint when opening a stream to a host, one of: random, round-robin, "+
+		"pixels (probability proportional to the pixels of the endpoints) (default random)")
+	urlsFile := flag.String("urlsFile", "", "File with one streaming endpoint URL or URL template per line. The file is re-read "+
+		"periodically: endpoints are added and removed to match the file. On read errors, the previous endpoints are kept.")
+	urlsFileReload := flag.Duration("urlsFileReload", defaultEndpointFileReloadInterval, "Interval for re-reading the -urlsFile")
+	maxConnectionsPerHost := flag.Int("maxConnectionsPerHost", 0, "Limit the number of concurrent streams to each host. "+
+		"Streams wait until a host below the limit is available. Endpoints can override the limit of their host with the "+
+		"'maxConnections' query parameter. By default, the connections are not limited.")
 	testEndpoints := flag.Bool("test", false, "Test initial endpoints by trying to connect to each and log the summarized results before "+
 		"the regular streaming is started.")
+	testJson := flag.Bool("testJson", false, "With -test, print the result of every endpoint test as JSON to the standard output "+
+		"instead of logging the summary")
+	dryRun := flag.Bool("dryRun", false, "Parse all streaming endpoints, print them and exit without opening any connection, "+
+		"starting the pipeline or the REST API. Exits with a non-zero status if any endpoint is invalid.")
+	testConcurrency := flag.Int("testConcurrency", 16, "Number of endpoints tested in parallel when using -test")
+	var packetSizes HistogramCounter
+	flag.Var(&packetSizes, "packetSizeBuckets", fmt.Sprintf("Comma-separated, ascending list of upper boundaries (in bytes, "+
+		"optionally with K/M/G suffix) of the packet size histogram buckets. One field per bucket is emitted (default %v)", defaultPacketSizeBuckets))
+	seed := flag.Int64("seed", 0, "Seed for the random number generator. When set to a non-zero value, the restart delay sampling "+
+		"and the endpoint selection become reproducible across runs with the same configuration. By default, a time-based seed is used. "+
+		"The effective seed is always logged at startup.")
+	healthMinReceiving := flag.Int("healthMinReceiving", 1, "Number of receiving connections required by the /api/health REST endpoint "+
+		"to report the collector as healthy")
+	healthMaxErrorRate := flag.Float64("healthMaxErrorRate", 0, "Also report the collector as healthy without enough receiving "+
+		"connections, if streams are configured and the errors per second are below this value. By default, receiving connections are required.")
+	restRateLimit := flag.Float64("restRateLimit", 0, "Number of requests per second accepted by the REST API from each client. "+
+		"Further requests are rejected with status 429. By default, requests are not limited.")
+	apiKey := flag.String("apiKey", "", "Require this key for modifying requests to the REST API, passed as bearer token in the "+
+		"Authorization header or as apiKey query parameter. By default, the REST API is not authenticated.")
+	apiKeyForReads := flag.Bool("apiKeyForReads", false, "With -apiKey, also require the key for GET requests, except for the health check")
+	logLevel := flag.String("logLevel", "", "Log level, one of debug, info, warn or error. Overrides -v, -q and -qq (default info)")
+	logJson := flag.Bool("logJson", false, "Write log messages as JSON objects, one per line, instead of text")
+	graphite := flag.String("graphite", "", "Additionally send every emitted sample to Graphite at the given host:port, "+
+		"using the plaintext protocol over UDP")
+	graphitePrefix := flag.String("graphitePrefix", defaultGraphitePrefix, "Prefix of the metric names sent to -graphite")
+	fields := flag.String("fields", "", "Comma-separated list of statistics fields to emit, e.g. 'streams,bytes/s'. "+
+		"The fields are emitted in the default order. By default, all fields are emitted.")
+	configFile := flag.String("config", "", "JSON file with values for the command line flags, indexed by the flag names, e.g. "+
+		"{\"n\": 10, \"o\": [\"csv://-\"]}. The key 'endpoints' lists streaming endpoints, which are used when none are given as arguments. "+
+		"Flags given on the command line override the file. The logging flags -v, -q, -qq and -log are not supported in the file.")
+	helper := newCollectorHelper()
+	parsedFlags, args := cmd.ParseFlags()
+	if *configFile != "" {
+		config, err := loadConfigFile(*configFile)
+		golib.Checkerr(err)
+		args, err = config.Apply(parsedFlags, args)
+		golib.Checkerr(err)
+	}
+	for _, logger := range []*log.Logger{log.StandardLogger(), golib.Log} {
+		golib.Checkerr(configureLogger(logger, *logLevel, *logJson))
+	}
+	restApiEndpoint, err := restApiAddress(parsedFlags)
+	golib.Checkerr(err)
+	defer golib.ProfileCpu()()
+	args, err = expandURLArguments(args, os.Stdin)
+	golib.Checkerr(err)
+
+	if *ewmaAlpha < 0 || *ewmaAlpha > 1 {
+		golib.Checkerr(fmt.Errorf("-ewmaAlpha must be between 0 and 1, but is %v", *ewmaAlpha))
+	}
+	log.Infof("Using random seed %v", seedRandom(*seed))
+	if *insecureTLS {
+		log.Warnln("TLS certificate verification is disabled by -insecureTLS. Connections to rtmps and https endpoints are not secure!")
+	}
 	if delaySampler.distribution == nil {
 		delaySampler = DistributionSampler{distribution: &ConstDistribution{0 * time.Millisecond}}
 		log.Infof("No restart delay distribution defined. Using: %v", delaySampler.String())
 	}
-
-	rand.Seed(time.Now().UTC().UnixNano())
+	if packetSizes.boundaries == nil {
+		golib.Checkerr(packetSizes.Set(defaultPacketSizeBuckets))
+	}
 	factory := &RtmpStreamFactory{
-		TimeoutDuration: *timeout,
+		TimeoutDuration:       *timeout,
+		ConnectTimeout:        *connectTimeout,
+		ReadTimeout:           *readTimeout,
+		InsecureSkipVerify:    *insecureTLS,
+		Selection:             selection,
+		TestConcurrency:       *testConcurrency,
+		HttpReceiveBuffer:     int(httpReceiveBuffer),
+		MaxConnectionsPerHost: *maxConnectionsPerHost,
 	}
-	helper := cmd.CmdDataCollector{DefaultOutput: "csv://-"}
-	helper.RegisterFlags()
-	_, args := cmd.ParseFlags()
-	defer golib.ProfileCpu()()
-	if len(args) > 0 {
-		for _, urlTemplate := range args {
-			if host, endpoints, err := factory.ParseURLArgument(urlTemplate); err == nil {
-				host := factory.getHost(host)
-				host.addEndpoints(endpoints)
-			} else {
-				log.Errorf("Error handling streaming endpoint %v: %v", urlTemplate, err)
-			}
+	var endpointFile *EndpointFile
+	invalidEndpoints := false
+	if *urlsFile != "" {
+		endpointFile = &EndpointFile{Factory: factory, Path: *urlsFile, ReloadInterval: *urlsFileReload}
+		if err := endpointFile.Load(); err != nil {
+			log.Errorln(err)
+			invalidEndpoints = true
 		}
-		if *testEndpoints {
+	}
+	for _, urlTemplate := range args {
+		if host, endpoints, err := factory.ParseURLArgument(urlTemplate); err == nil {
+			factory.AddEndpoints(host, endpoints)
+		} else {
+			log.Errorf("Error handling streaming endpoint %v: %v", urlTemplate, err)
+			invalidEndpoints = true
+		}
+	}
+	if *dryRun {
+		factory.printEndpoints(os.Stdout)
+		if invalidEndpoints {
+			log.Errorln("Dry run failed: not all streaming endpoints are valid")
+			return 1
+		}
+		log.Infoln("Dry run succeeded: all streaming endpoints are valid")
+		return 0
+	}
+	if len(args) > 0 || endpointFile != nil {
+		if *testEndpoints && *testJson {
+			encoder := json.NewEncoder(os.Stdout)
+			encoder.SetIndent("", "  ")
+			golib.Checkerr(encoder.Encode(factory.TestEndpoints()))
+		} else if *testEndpoints {
 			summary, err := factory.TestAllEndpointURLs()
 			log.Info(summary)
 			if err != nil {
@@ -65,32 +223,222 @@ func do_main() int {
 		log.Info("No streaming endpoints defined. Cannot request streams. Use /api/endpoints to add streaming endpoints.")
 	}
 
+	var streamEventLog *StreamEventLog
+	if *streamLog != "" {
+		file, err := os.OpenFile(*streamLog, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		golib.Checkerr(err)
+		defer file.Close()
+		streamEventLog = &StreamEventLog{Writer: file}
+	}
+
+	var capture *StreamCapture
+	if *captureTo != "" {
+		golib.Checkerr(os.MkdirAll(*captureTo, 0755))
+		capture = &StreamCapture{Dir: *captureTo, MaxBytes: uint64(captureMaxBytes)}
+	}
+
 	stats := &StreamStatisticsCollector{
-		InitialStreams:     *parallelStreams,
-		Factory:            factory,
-		DelaySampler:       delaySampler,
-		SampleSinkInterval: *sinkInterval,
+		InitialStreams:       *parallelStreams,
+		Factory:              factory,
+		DelaySampler:         delaySampler,
+		SampleSinkInterval:   *sinkInterval,
+		RestApiEndpoint:      restApiEndpoint,
+		PacketSizes:          &packetSizes,
+		RampUp:               *rampUp,
+		RunFor:               *runFor,
+		MaxStreamDuration:    *maxStreamDuration,
+		StallTimeout:         *stallTimeout,
+		DrainTimeout:         *drainTimeout,
+		Backoff:              *backoff,
+		MaxBackoff:           *maxBackoff,
+		BackoffReplacesDelay: *backoffReplacesDelay,
+		MaxRetries:           *maxRetries,
+		StreamBandwidth:      streamBandwidth,
+		MaxTotalBytes:        uint64(maxTotalBytes),
+		MaxOpens:             *maxOpens,
+		StreamLog:            streamEventLog,
+		Capture:              capture,
+		Warmup:               *warmup,
+		Quiet:                *quiet,
+		EwmaAlpha:            *ewmaAlpha,
+		EndpointFile:         endpointFile,
+	}
+	golib.Checkerr(stats.SelectFields(splitFieldList(*fields)))
+	if *graphite != "" {
+		stats.Graphite, err = NewGraphiteSink(*graphite, *graphitePrefix)
+		golib.Checkerr(err)
+		defer stats.Graphite.Close()
+	}
+	restApi := &SetUrlsRestApi{
+		Col:                           stats,
+		HealthMinReceivingConnections: *healthMinReceiving,
+		HealthMaxErrorRate:            *healthMaxErrorRate,
+		RateLimit:                     *restRateLimit,
+		APIKey:                        *apiKey,
+		APIKeyForReads:                *apiKeyForReads,
+	}
+	helper.RestApis = append(helper.RestApis, restApi, &PrometheusRestApi{Col: stats})
+	if restApiEndpoint != "" {
+		log.Infof("Serving the REST API at %v", restApiEndpoint)
 	}
-	helper.RestApis = append(helper.RestApis, &SetUrlsRestApi{Col: stats})
 
 	pipe, err := helper.BuildPipeline(stats)
 	golib.Checkerr(err)
 	return pipe.StartAndWait()
 }
 
+// newCollectorHelper registers the flags of the pipeline. When building the pipeline, the returned helper serves its
+// RestApis at the address of the -api flag.
+func newCollectorHelper() *cmd.CmdDataCollector {
+	helper := &cmd.CmdDataCollector{DefaultOutput: "csv://-"}
+	helper.RegisterFlags()
+	flag.Lookup("api").Usage = "Listen address of the REST API in the form [host]:port, e.g. '127.0.0.1:7000' or ':7000'. " +
+		"The REST API controls the streams, endpoints, tags and file output. By default, the REST API is disabled."
+	return helper
+}
+
+// restApiAddress returns the validated listen address of the REST API, which is configured by the -api flag
+// of cmd.CmdDataCollector. An empty address disables the REST API.
+func restApiAddress(flags *flag.FlagSet) (string, error) {
+	apiFlag := flags.Lookup("api")
+	if apiFlag == nil || apiFlag.Value.String() == "" {
+		return "", nil
+	}
+	address := apiFlag.Value.String()
+	if err := validateListenAddress(address); err != nil {
+		return "", fmt.Errorf("Invalid -api: %v", err)
+	}
+	return address, nil
+}
+
+// validateListenAddress checks that the address has the form [host]:port with a numeric port
+func validateListenAddress(address string) error {
+	_, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return fmt.Errorf("Listen address '%v' must have the form [host]:port: %v", address, err)
+	}
+	if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+		return fmt.Errorf("Port of listen address '%v' must be a number between 0 and 65535", address)
+	}
+	return nil
+}
+
+// splitFieldList splits a comma-separated list of field names, ignoring empty names and surrounding whitespace
+func splitFieldList(list string) []string {
+	var fields []string
+	for _, field := range strings.Split(list, ",") {
+		if field = strings.TrimSpace(field); field != "" {
+			fields = append(fields, field)
+		}
+	}
+	return fields
+}
+
+// configureLogger sets the level of the logger, unless the level is empty, and optionally switches to JSON formatting
+func configureLogger(logger *log.Logger, level string, jsonFormat bool) error {
+	if level != "" {
+		parsedLevel, err := log.ParseLevel(level)
+		if err != nil {
+			return fmt.Errorf("Invalid -logLevel: %v", err)
+		}
+		logger.SetLevel(parsedLevel)
+	}
+	if jsonFormat {
+		logger.SetFormatter(&log.JSONFormatter{TimestampFormat: time.RFC3339Nano})
+	}
+	return nil
+}
+
+// expandURLArguments replaces the argument "-" with the non-empty lines read from the given reader (usually stdin),
+// so that URLs and URL templates can be piped into the process
+func expandURLArguments(args []string, stdin io.Reader) ([]string, error) {
+	var result []string
+	for _, arg := range args {
+		if arg != "-" {
+			result = append(result, arg)
+			continue
+		}
+		content, err := ioutil.ReadAll(stdin)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read streaming endpoints from stdin: %v", err)
+		}
+		result = append(result, getStrippedLines(content)...)
+	}
+	return result, nil
+}
+
+// seedRandom seeds the global random number generator and returns the effective seed.
+// A seed of zero is replaced by a time-based seed.
+func seedRandom(seed int64) int64 {
+	if seed == 0 {
+		seed = time.Now().UTC().UnixNano()
+	}
+	rand.Seed(seed)
+	return seed
+}
+
 type StreamStatisticsCollector struct {
 	bitflow.AbstractSampleSource
 
 	InitialStreams     int
-	Factory            *RtmpStreamFactory
+	Factory            *RtmpStreamFactory // Manages the streaming endpoints
+	StreamFactory      StreamFactory      // Opens the streams, defaults to Factory
 	DelaySampler       DistributionSampler
 	SampleSinkInterval time.Duration
-	RestApiEndpoint    string
+	RestApiEndpoint    string            // Listen address of the REST API, empty if it is disabled
+	PacketSizes        *HistogramCounter // Optional histogram of received packet sizes
+	RampUp             time.Duration     // When increasing the number of streams, spread starting the new streams over this duration
+	RunFor             time.Duration     // If positive, the collector stops after running for this duration
+	MaxStreamDuration  time.Duration     // If positive, streams are closed after this duration and then restarted
+	StallTimeout       time.Duration     // If positive, streams are closed and counted as stalled when receiving no data for this duration
+	DrainTimeout       time.Duration     // If positive, Close waits at most this duration for the streams to finish
+	EndpointFile       *EndpointFile     // If set, the endpoints file is reloaded periodically while running
+	// If positive, streams wait for this duration after failing to open, doubled with every consecutive failure up to MaxBackoff
+	Backoff              time.Duration
+	MaxBackoff           time.Duration
+	BackoffReplacesDelay bool            // If set, the backoff is used instead of the restart delay, otherwise it is added to it
+	MaxRetries           int             // If positive, streams are abandoned after failing to open this many times in a row
+	StreamBandwidth      Bandwidth       // If positive, each stream consumes data at most at this rate
+	MaxTotalBytes        uint64          // If positive, the collector stops after receiving this number of bytes
+	MaxOpens             uint64          // If positive, the collector stops after opening this number of streams
+	StreamLog            *StreamEventLog // Optional log of the lifecycle events of all streams
+	Capture              *StreamCapture  // Optionally writes the data received by some streams to files
+	EwmaAlpha            float64         // If positive, moving averages of bytes/s and packets/s are emitted with this smoothing factor
+	Graphite             *GraphiteSink   // Optionally receives all emitted samples in addition to the bitflow sink
+	// If positive, samples are marked with the warmup field during this duration after starting. At the end of the warmup,
+	// the cumulative statistics are reset once, see endWarmup.
+	Warmup time.Duration
+	// If set, only the first error log of failing streams is printed in every errorSummaryInterval. The suppressed logs
+	// are replaced by a periodic summary of the error counters, see logStreamError.
+	Quiet bool
 
 	wg             *sync.WaitGroup
+	delayLock      sync.Mutex // Protects DelaySampler after the collector is started
 	runningStreams []*RunningStream
+	hostStreams    map[string][]*RunningStream // Streams pinned to a single host, protected by streamsLock
 	streamsLock    sync.Mutex
+	rampUpStopper  golib.StopChan // Stops the currently running ramp-up, protected by streamsLock
+	targetStreams  int            // Number of streams last set through SetNumberOfStreams, protected by streamsLock
 	stopper        golib.StopChan
+	drained        golib.StopChan     // Stopped after Close finished draining the streams
+	lastValues     map[string]float64 // Values of the most recently computed sample
+	lastValuesLock sync.Mutex
+	selectedFields map[string]bool // Fields emitted in the samples, see SelectFields. All fields are emitted if nil.
+	warmupEnd      time.Time       // End of the Warmup, only accessed by sinkSamples
+	warmedUp       bool            // Set after the cumulative statistics were reset at the end of the Warmup
+
+	// State of the Quiet mode, protected by quietLock
+	quietLock          sync.Mutex
+	suppressedLogs     int       // Number of stream error logs suppressed since the last summary
+	loggedSinceSummary bool      // Set after logging one stream error since the last summary
+	lastErrorSummary   time.Time // Time of the last summary of suppressed logs
+
+	// State of Pause and Resume, protected by streamsLock
+	paused            bool
+	pausedHostStreams map[string]int // Number of streams pinned to each host to restore when resuming
+
+	now         func() time.Time                                         // Replaces time.Now in tests
+	waitTimeout func(stopper golib.StopChan, timeout time.Duration) bool // Replaces waiting for the ramp-up and sample intervals in tests
 
 	// Stream statistics
 	statisticsTime       time.Time
@@ -99,31 +447,109 @@ type StreamStatisticsCollector struct {
 	opened               IncrementedCounter
 	closed               IncrementedCounter
 	errors               IncrementedCounter
+	categoryErrors       [numErrorCategories]IncrementedCounter // Breakdown of errors, indexed by ErrorCategory
+	stalls               IncrementedCounter
+	reconnects           IncrementedCounter
+	abandoned            IncrementedCounter
 	bytes                IncrementedCounter
+	wireBytes            IncrementedCounter // Bytes received over the network including the protocol overhead, see WireByteCounter
+	audioBytes           IncrementedCounter
+	videoBytes           IncrementedCounter
 	packets              IncrementedCounter
+	lostPackets          IncrementedCounter // Packets detected as lost by streams implementing PacketLossCounter
 	packetDelay          AveragingCounter
+	packetDelayQuantiles StreamingQuantile // Estimates the quantiles 0.5, 0.95 and 0.99
+	packetSizeQuantiles  StreamingQuantile // Estimates the quantiles 0.5, 0.95 and 0.99 of the received packet sizes
+	connectLatency       AveragingCounter
+	timeToFirstByte      AveragingCounter
+	streamLifetime       AveragingCounter // Seconds from opening to closing each stream, except for streams stopped on shutdown
 	pixels               TwoWayCounter
+	liveStreams          TwoWayCounter // Receiving streams reported as live, see StreamKindReporter
+	recordedStreams      TwoWayCounter // Receiving streams reported as recorded
+	bytesEwma            MovingAverage
+	packetsEwma          MovingAverage
+}
+
+func (c *StreamStatisticsCollector) currentTime() time.Time {
+	if c.now != nil {
+		return c.now()
+	}
+	return time.Now()
+}
+
+// wait waits for the timeout like StopChan.WaitTimeout and returns false if the StopChan was stopped instead
+func (c *StreamStatisticsCollector) wait(stopper golib.StopChan, timeout time.Duration) bool {
+	if c.waitTimeout != nil {
+		return c.waitTimeout(stopper, timeout)
+	}
+	return stopper.WaitTimeout(timeout)
 }
 
 func (c *StreamStatisticsCollector) String() string {
-	return fmt.Sprintf("Measure %v stream(s) from %T", len(c.runningStreams), c.Factory)
+	return fmt.Sprintf("Measure %v stream(s) from %T", c.NumStreams(), c.Factory)
+}
+
+// NumStreams returns the number of running streams that are not pinned to a host
+func (c *StreamStatisticsCollector) NumStreams() int {
+	c.streamsLock.Lock()
+	defer c.streamsLock.Unlock()
+	return len(c.runningStreams)
+}
+
+// TargetStreams returns the number of streams last set through SetNumberOfStreams. The actual number of streams
+// can lag behind the target, e.g. during the ramp-up or when streams are abandoned.
+func (c *StreamStatisticsCollector) TargetStreams() int {
+	c.streamsLock.Lock()
+	defer c.streamsLock.Unlock()
+	return c.targetStreams
 }
 
 func (c *StreamStatisticsCollector) Start(wg *sync.WaitGroup) golib.StopChan {
 	c.wg = wg
 	c.stopper = golib.NewStopChan()
+	// The wait channel is created lazily and unsynchronized, so create it before multiple goroutines wait for the stopper
+	c.stopper.WaitChan()
+	c.drained = golib.NewStopChan()
 	wg.Add(1)
 	go c.sinkSamples(wg)
 	c.SetNumberOfStreams(c.InitialStreams)
+	if c.EndpointFile != nil {
+		go c.EndpointFile.Watch(c.stopper)
+	}
+	if c.RunFor > 0 {
+		go c.stopAfter(c.RunFor)
+	}
 	return c.stopper
 }
 
+// stopAfter closes the collector after the given duration, unless it is stopped before
+func (c *StreamStatisticsCollector) stopAfter(duration time.Duration) {
+	if c.stopper.WaitTimeout(duration) {
+		log.Printf("Stopping after running for %v", duration)
+		c.Close()
+	}
+}
+
 func (c *StreamStatisticsCollector) SetNumberOfStreams(num int) {
 	c.streamsLock.Lock()
 	defer c.streamsLock.Unlock()
 	if num < 0 {
 		num = 0
 	}
+	c.targetStreams = num
+	if c.paused {
+		log.Printf("Streaming is paused, %v stream(s) will be started when resuming", num)
+		return
+	}
+	c.setNumberOfStreams(num)
+}
+
+// setNumberOfStreams must be called while holding streamsLock
+func (c *StreamStatisticsCollector) setNumberOfStreams(num int) {
+	if !c.rampUpStopper.IsNil() {
+		// Cancel the ramp-up of a previous call
+		c.rampUpStopper.Stop()
+	}
 	if len(c.runningStreams) > num {
 		// Close excess the streams
 		toClose := c.runningStreams[num:]
@@ -138,148 +564,975 @@ func (c *StreamStatisticsCollector) SetNumberOfStreams(num int) {
 			return
 		}
 		missing := num - len(c.runningStreams)
+		if c.RampUp > 0 && missing > 1 {
+			log.Printf("Starting %v new stream(s) over %v, new number of streams: %v", missing, c.RampUp, len(c.runningStreams)+missing)
+			c.rampUpStopper = golib.NewStopChan()
+			go c.rampUpStreams(c.rampUpStopper, missing, c.RampUp/time.Duration(missing))
+			return
+		}
 		log.Printf("Starting %v new stream(s), new number of streams: %v", missing, len(c.runningStreams)+missing)
 		for i := 0; i < missing; i++ {
-			newStream := &RunningStream{col: c, stopper: golib.NewStopChan()}
-			c.runningStreams = append(c.runningStreams, newStream)
+			c.startStream()
+		}
+	}
+}
+
+// startStream must be called while holding streamsLock
+func (c *StreamStatisticsCollector) startStream() {
+	newStream := &RunningStream{col: c, stopper: golib.NewStopChan()}
+	c.runningStreams = append(c.runningStreams, newStream)
+	newStream.start()
+}
+
+// SetNumberOfHostStreams sets the number of streams pinned to the given host. These streams are managed independently
+// of the streams set through SetNumberOfStreams and only open endpoints of that host. They are started without ramp-up.
+func (c *StreamStatisticsCollector) SetNumberOfHostStreams(host string, num int) {
+	c.streamsLock.Lock()
+	defer c.streamsLock.Unlock()
+	if num < 0 {
+		num = 0
+	}
+	if c.paused {
+		log.Printf("Streaming is paused, %v stream(s) to host %v will be started when resuming", num, host)
+		if num == 0 {
+			delete(c.pausedHostStreams, host)
+		} else {
+			c.pausedHostStreams[host] = num
+		}
+		return
+	}
+	c.setNumberOfHostStreams(host, num)
+}
+
+// setNumberOfHostStreams must be called while holding streamsLock
+func (c *StreamStatisticsCollector) setNumberOfHostStreams(host string, num int) {
+	streams := c.hostStreams[host]
+	if len(streams) > num {
+		toClose := streams[num:]
+		streams = streams[:num]
+		log.Printf("Closing %v stream(s) to host %v, new number of streams to that host: %v", len(toClose), host, len(streams))
+		for _, stream := range toClose {
+			stream.stop()
+		}
+	} else if len(streams) < num {
+		if c.stopper.Stopped() {
+			return
+		}
+		log.Printf("Starting %v new stream(s) to host %v, new number of streams to that host: %v", num-len(streams), host, num)
+		for len(streams) < num {
+			newStream := &RunningStream{col: c, host: host, stopper: golib.NewStopChan()}
+			streams = append(streams, newStream)
 			newStream.start()
 		}
 	}
+	if len(streams) == 0 {
+		delete(c.hostStreams, host)
+	} else {
+		if c.hostStreams == nil {
+			c.hostStreams = make(map[string][]*RunningStream)
+		}
+		c.hostStreams[host] = streams
+	}
+}
+
+// abandonStream removes a stream that gave up opening streams, without replacing it
+func (c *StreamStatisticsCollector) abandonStream(stream *RunningStream) {
+	c.streamsLock.Lock()
+	defer c.streamsLock.Unlock()
+	var found bool
+	if stream.host == "" {
+		c.runningStreams, found = removeRunningStream(c.runningStreams, stream)
+		if found {
+			log.Warnf("Abandoning stream after failing to open %v times in a row, new number of streams: %v", stream.failures, len(c.runningStreams))
+		}
+	} else if streams, ok := c.hostStreams[stream.host]; ok {
+		streams, found = removeRunningStream(streams, stream)
+		if len(streams) == 0 {
+			delete(c.hostStreams, stream.host)
+		} else {
+			c.hostStreams[stream.host] = streams
+		}
+		if found {
+			log.Warnf("Abandoning stream to host %v after failing to open %v times in a row, new number of streams to the host: %v",
+				stream.host, stream.failures, len(streams))
+		}
+	}
+	if found {
+		// Streams that were concurrently closed are not counted
+		c.abandoned.Increment(1)
+	}
+}
+
+func removeRunningStream(streams []*RunningStream, stream *RunningStream) ([]*RunningStream, bool) {
+	for i, existing := range streams {
+		if existing == stream {
+			return append(streams[:i], streams[i+1:]...), true
+		}
+	}
+	return streams, false
+}
+
+// HostStreamCounts returns the number of streams pinned to each host
+func (c *StreamStatisticsCollector) HostStreamCounts() map[string]int {
+	c.streamsLock.Lock()
+	defer c.streamsLock.Unlock()
+	return c.hostStreamCounts()
+}
+
+// hostStreamCounts must be called while holding streamsLock
+func (c *StreamStatisticsCollector) hostStreamCounts() map[string]int {
+	counts := make(map[string]int, len(c.hostStreams))
+	for host, streams := range c.hostStreams {
+		counts[host] = len(streams)
+	}
+	return counts
+}
+
+// Pause closes all streams and stops opening new ones until Resume is called. The collected statistics are kept.
+// Returns false if streaming is already paused.
+func (c *StreamStatisticsCollector) Pause() bool {
+	c.streamsLock.Lock()
+	defer c.streamsLock.Unlock()
+	if c.paused {
+		return false
+	}
+	log.Println("Pausing all streams")
+	c.pausedHostStreams = c.hostStreamCounts()
+	for host := range c.pausedHostStreams {
+		c.setNumberOfHostStreams(host, 0)
+	}
+	c.setNumberOfStreams(0)
+	c.paused = true
+	return true
+}
+
+// Resume restarts the streams closed by Pause, taking into account stream counts that were set in the meantime.
+// Returns false if streaming is not paused.
+func (c *StreamStatisticsCollector) Resume() bool {
+	c.streamsLock.Lock()
+	defer c.streamsLock.Unlock()
+	if !c.paused {
+		return false
+	}
+	log.Println("Resuming streams")
+	c.paused = false
+	c.setNumberOfStreams(c.targetStreams)
+	for host, num := range c.pausedHostStreams {
+		c.setNumberOfHostStreams(host, num)
+	}
+	c.pausedHostStreams = nil
+	return true
+}
+
+// rampUpStreams starts the given number of streams, one every interval, until the ramp-up is stopped
+func (c *StreamStatisticsCollector) rampUpStreams(stopper golib.StopChan, num int, interval time.Duration) {
+	for i := 0; i < num; i++ {
+		if i > 0 && !c.wait(stopper, interval) {
+			return
+		}
+		c.streamsLock.Lock()
+		if stopper.Stopped() || c.stopper.Stopped() {
+			c.streamsLock.Unlock()
+			return
+		}
+		c.startStream()
+		c.streamsLock.Unlock()
+	}
 }
 
 func (c *StreamStatisticsCollector) Close() {
 	c.stopper.Stop()
-	c.SetNumberOfStreams(0)
+	c.drainStreams()
+	if !c.drained.IsNil() {
+		c.drained.Stop()
+	}
+}
+
+// drainStreams stops all streams in parallel and waits for them to finish. After DrainTimeout, the streams that are still
+// running are closed once more and then abandoned, so shutting down is not blocked by streams that do not react to closing.
+func (c *StreamStatisticsCollector) drainStreams() {
+	c.streamsLock.Lock()
+	if !c.rampUpStopper.IsNil() {
+		c.rampUpStopper.Stop()
+	}
+	streams := c.runningStreams
+	for _, hostStreams := range c.hostStreams {
+		streams = append(streams, hostStreams...)
+	}
+	c.runningStreams = nil
+	c.hostStreams = nil
+	c.streamsLock.Unlock()
+	if len(streams) == 0 {
+		return
+	}
+
+	log.Printf("Closing %v stream(s)", len(streams))
+	var wg sync.WaitGroup
+	remaining := int32(len(streams))
+	for _, stream := range streams {
+		wg.Add(1)
+		go func(stream *RunningStream) {
+			defer wg.Done()
+			stream.stop()
+			atomic.AddInt32(&remaining, -1)
+		}(stream)
+	}
+	drained := golib.WaitFunc(nil, wg.Wait)
+	if c.DrainTimeout <= 0 {
+		drained.Wait()
+	} else if drained.WaitTimeout(c.DrainTimeout) {
+		log.Warnf("%v stream(s) did not finish within %v, closing them forcibly", atomic.LoadInt32(&remaining), c.DrainTimeout)
+		for _, stream := range streams {
+			stream.closeStream()
+		}
+	}
 }
 
 func (c *StreamStatisticsCollector) sinkSamples(wg *sync.WaitGroup) {
 	defer wg.Done()
 	defer c.CloseSinkParallel(wg)
-	c.statisticsTime = time.Now()
-	for c.stopper.WaitTimeout(c.SampleSinkInterval) {
-		now := time.Now()
-		previousTime := c.statisticsTime
-		c.statisticsTime = now
-		timeDiff := now.Sub(previousTime)
-		opened, openedDiff := c.opened.ComputeDiff(timeDiff)
-		closed, closedDiff := c.closed.ComputeDiff(timeDiff)
-		errors, errorsDiff := c.errors.ComputeDiff(timeDiff)
-		bytes, bytesDiff := c.bytes.ComputeDiff(timeDiff)
-		packets, packetsDiff := c.packets.ComputeDiff(timeDiff)
-		packetDelay := c.packetDelay.ComputeAvg()
-		pixels := c.pixels.Get()
-		receivingConnections := c.receivingConnections.Get()
-		values := []bitflow.Value{
-			// Meta values
-			bitflow.Value(len(c.runningStreams)),
-			c.openConnections.Get(),
-			receivingConnections,
-			// Absolute values
-			opened, closed, errors, bytes, packets,
-			// Values per second
-			openedDiff, closedDiff, errorsDiff, bytesDiff, packetsDiff,
-			// Average values
-			packetDelay,
-			// Pixels and values per pixel
-			pixels, bytesDiff / pixels, packetsDiff / pixels,
-			// Values per running connection
-			bytesDiff / receivingConnections, packetsDiff / receivingConnections,
-		}
-		fields := []string{
-			"streams", "openConnections", "receivingConnections",
-			"opened", "closed", "errors", "bytes", "packets",
-			"opened/s", "closed/s", "errors/s", "bytes/s", "packets/s",
-			"packetDelay",
-			"pixels", "bytes/pixel", "packets/pixel",
-			"bytes/connection", "packets/connection",
-		}
-		err := c.GetSink().Sample(
-			&bitflow.Sample{
-				Time:   time.Now(),
-				Values: values,
-			},
-			&bitflow.Header{
-				Fields: fields,
-			})
-		if err != nil {
-			log.Errorln("Failed to sink stream statistics:", err)
+	c.statisticsTime = c.currentTime()
+	c.warmupEnd = c.statisticsTime.Add(c.Warmup)
+	c.quietLock.Lock()
+	c.lastErrorSummary = c.statisticsTime
+	c.quietLock.Unlock()
+	for c.wait(c.stopper, c.nextSampleDelay()) {
+		c.sinkSample()
+		if !c.warmedUp && c.Warmup > 0 && !c.statisticsTime.Before(c.warmupEnd) {
+			c.endWarmup()
+		}
+		if c.MaxTotalBytes > 0 && uint64(c.bytes.Get()) >= c.MaxTotalBytes {
+			log.Printf("Stopping after receiving %v bytes (limit %v)", uint64(c.bytes.Get()), c.MaxTotalBytes)
+			c.Close()
+		} else if c.MaxOpens > 0 && uint64(c.opened.GetSinceReset()) >= c.MaxOpens {
+			log.Printf("Stopping after opening %v streams (limit %v)", uint64(c.opened.GetSinceReset()), c.MaxOpens)
+			c.Close()
+		}
+		if c.Quiet && c.currentTime().Sub(c.errorSummaryTime()) >= errorSummaryInterval {
+			c.logSuppressedErrors()
+		}
+	}
+	// Flush the statistics of the last, incomplete interval, including the closing of the streams
+	c.drained.Wait()
+	c.sinkSample()
+	c.logSuppressedErrors()
+}
+
+// nextSampleDelay returns the SampleSinkInterval, unless the end of the Warmup is reached earlier. In that case, an
+// additional sample is emitted at the end of the warmup.
+func (c *StreamStatisticsCollector) nextSampleDelay() time.Duration {
+	if c.warmedUp || c.Warmup <= 0 {
+		return c.SampleSinkInterval
+	}
+	if untilEnd := c.warmupEnd.Sub(c.currentTime()); untilEnd < c.SampleSinkInterval {
+		if untilEnd < 0 {
+			return 0
+		}
+		return untilEnd
+	}
+	return c.SampleSinkInterval
+}
+
+// endWarmup resets the cumulative statistics, so the totals of the following samples only contain the steady state:
+// opened, closed, errors, stalls, reconnects, abandoned, bytes, packets and receivingConnections_lifetimePeak.
+// Streams that were opened during the warmup are still open, so closed can exceed opened afterwards.
+// The values per second and the current values like openConnections are not affected. The totals of the
+// StatisticsSnapshot, which are also exported to Prometheus, and the -maxTotalBytes budget still include the warmup.
+func (c *StreamStatisticsCollector) endWarmup() {
+	log.Printf("Warmup of %v finished, resetting the cumulative statistics", c.Warmup)
+	c.warmedUp = true
+	for _, counter := range []*IncrementedCounter{
+		&c.opened, &c.closed, &c.errors, &c.stalls, &c.reconnects, &c.abandoned,
+		&c.bytes, &c.wireBytes, &c.audioBytes, &c.videoBytes, &c.packets, &c.lostPackets,
+	} {
+		counter.ResetTotal()
+	}
+	for i := range c.categoryErrors {
+		c.categoryErrors[i].ResetTotal()
+	}
+	c.receivingConnections.ResetPeak()
+}
+
+func (c *StreamStatisticsCollector) sinkSample() {
+	now := c.currentTime()
+	previousTime := c.statisticsTime
+	c.statisticsTime = now
+	sample, header := c.collectSample(now.Sub(previousTime))
+	if c.selectedFields != nil {
+		sample, header = c.filterFields(sample, header)
+	}
+	// Send to Graphite first, since the bitflow pipeline can modify the sample
+	if c.Graphite != nil {
+		if err := c.Graphite.Send(sample, header); err != nil {
+			log.Errorln("Failed to send stream statistics to Graphite:", err)
+		}
+	}
+	if err := c.GetSink().Sample(sample, header); err != nil {
+		log.Errorln("Failed to sink stream statistics:", err)
+	}
+}
+
+// SelectFields restricts the emitted samples to the given fields, which are emitted in the order in which they are collected.
+// Per-host fields are selected by their full name, e.g. 'bytes/s{host=example.com}', without validating the host.
+// An empty list selects all fields.
+func (c *StreamStatisticsCollector) SelectFields(fields []string) error {
+	if len(fields) == 0 {
+		c.selectedFields = nil
+		return nil
+	}
+	known := make(map[string]bool)
+	for _, field := range c.sampleFields() {
+		known[field] = true
+	}
+	selected := make(map[string]bool, len(fields))
+	for _, field := range fields {
+		if !known[field] && !isHostField(field) {
+			return fmt.Errorf("Unknown statistics field '%v', expected one of: %v", field, strings.Join(c.sampleFields(), ", "))
+		}
+		selected[field] = true
+	}
+	c.selectedFields = selected
+	return nil
+}
+
+func isHostField(field string) bool {
+	for _, name := range hostFields {
+		if strings.HasPrefix(field, name+"{host=") && strings.HasSuffix(field, "}") {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *StreamStatisticsCollector) filterFields(sample *bitflow.Sample, header *bitflow.Header) (*bitflow.Sample, *bitflow.Header) {
+	values := make([]bitflow.Value, 0, len(c.selectedFields))
+	fields := make([]string, 0, len(c.selectedFields))
+	for i, field := range header.Fields {
+		if c.selectedFields[field] {
+			values = append(values, sample.Values[i])
+			fields = append(fields, field)
+		}
+	}
+	sample.Values = values
+	return sample, &bitflow.Header{Fields: fields}
+}
+
+func (c *StreamStatisticsCollector) collectSample(timeDiff time.Duration) (*bitflow.Sample, *bitflow.Header) {
+	opened, openedDiff := c.opened.ComputeDiff(timeDiff)
+	closed, closedDiff := c.closed.ComputeDiff(timeDiff)
+	errors, errorsDiff := c.errors.ComputeDiff(timeDiff)
+	stalls, stallsDiff := c.stalls.ComputeDiff(timeDiff)
+	reconnects, reconnectsDiff := c.reconnects.ComputeDiff(timeDiff)
+	abandoned := c.abandoned.GetSinceReset()
+	bytes, bytesDiff := c.bytes.ComputeDiff(timeDiff)
+	_, audioBytesDiff := c.audioBytes.ComputeDiff(timeDiff)
+	_, videoBytesDiff := c.videoBytes.ComputeDiff(timeDiff)
+	_, wireBytesDiff := c.wireBytes.ComputeDiff(timeDiff)
+	packets, packetsDiff := c.packets.ComputeDiff(timeDiff)
+	_, lostPacketsDiff := c.lostPackets.ComputeDiff(timeDiff)
+	packetDelay := c.packetDelay.ComputeStats()
+	packetDelayQuantiles := c.packetDelayQuantiles.ComputeQuantiles()
+	packetSizeQuantiles := c.packetSizeQuantiles.ComputeQuantiles()
+	connectLatency := c.connectLatency.ComputeAvg()
+	timeToFirstByte := c.timeToFirstByte.ComputeAvg()
+	streamLifetime := c.streamLifetime.ComputeAvg()
+	pixels := c.pixels.Get()
+	receivingConnections := c.receivingConnections.Get()
+	values := []bitflow.Value{
+		// Meta values
+		bitflow.Value(c.NumStreams()),
+		bitflow.Value(c.TargetStreams()),
+		c.openConnections.Get(),
+		receivingConnections, c.receivingConnections.ComputeIntervalPeak(), c.receivingConnections.Peak(),
+		c.liveStreams.Get(), c.recordedStreams.Get(),
+		// Absolute values
+		opened, closed, errors, stalls, reconnects, abandoned, bytes, packets,
+		// Values per second
+		openedDiff, closedDiff, errorsDiff, stallsDiff, reconnectsDiff, bytesDiff, packetsDiff,
+		audioBytesDiff, videoBytesDiff, wireBytesDiff, lostPacketsDiff,
+		// Bitrate
+		bytesDiff * 8 / 1000, bytesDiff * 8 / 1000000,
+		// Average values and quantiles
+		packetDelay.Avg, packetDelay.Min, packetDelay.Max, packetDelay.Stddev,
+		packetDelayQuantiles[0], packetDelayQuantiles[1], packetDelayQuantiles[2],
+		safeDivide(bytesDiff, packetsDiff), packetSizeQuantiles[0], packetSizeQuantiles[1], packetSizeQuantiles[2],
+		connectLatency, timeToFirstByte, streamLifetime,
+		// Pixels and values per pixel. The bytes per pixel are cumulative, the other values are per second.
+		pixels, safeDivide(bytes, pixels), safeDivide(bytesDiff, pixels), safeDivide(packetsDiff, pixels),
+		// Values per running connection
+		safeDivide(bytesDiff, receivingConnections), safeDivide(packetsDiff, receivingConnections),
+	}
+	for category := range c.categoryErrors {
+		_, categoryDiff := c.categoryErrors[category].ComputeDiff(timeDiff)
+		values = append(values, categoryDiff)
+	}
+	if c.EwmaAlpha > 0 {
+		values = append(values, c.bytesEwma.Update(float64(bytesDiff), c.EwmaAlpha), c.packetsEwma.Update(float64(packetsDiff), c.EwmaAlpha))
+	}
+	if c.PacketSizes != nil {
+		values = append(values, c.PacketSizes.ComputeCounts()...)
+	}
+	if c.Warmup > 0 {
+		warmup := bitflow.Value(0)
+		if !c.warmedUp {
+			warmup = 1
+		}
+		values = append(values, warmup)
+	}
+	fields := c.sampleFields()
+
+	c.storeLastValues(values, fields)
+
+	// Per-host values. The set of hosts only changes when endpoints are added or replaced.
+	for _, host := range c.Factory.getHosts() {
+		_, hostBytesDiff := host.stats.bytes.ComputeDiff(timeDiff)
+		_, hostPacketsDiff := host.stats.packets.ComputeDiff(timeDiff)
+		values = append(values, host.stats.openConnections.Get(), hostBytesDiff, hostPacketsDiff)
+		for _, field := range hostFields {
+			fields = append(fields, field+"{host="+host.host+"}")
+		}
+	}
+
+	return &bitflow.Sample{
+			Time:   c.currentTime(),
+			Values: values,
+		},
+		&bitflow.Header{
+			Fields: fields,
+		}
+}
+
+// hostFields are the names of the values collected for each host
+var hostFields = []string{"openConnections", "bytes/s", "packets/s"}
+
+// sampleFields returns the names of the collected fields, except for the per-host fields
+func (c *StreamStatisticsCollector) sampleFields() []string {
+	fields := []string{
+		"streams", "targetStreams", "openConnections",
+		"receivingConnections", "receivingConnections_peak", "receivingConnections_lifetimePeak",
+		"liveStreams", "recordedStreams",
+		"opened", "closed", "errors", "stalls", "reconnects", "abandoned", "bytes", "packets",
+		"opened/s", "closed/s", "errors/s", "stalls/s", "reconnects/s", "bytes/s", "packets/s",
+		"audioBytes/s", "videoBytes/s", "wireBytes/s", "lostPackets/s",
+		"bitrate_kbps", "bitrate_mbps",
+		"packetDelay", "packetDelay_min", "packetDelay_max", "packetDelay_stddev",
+		"packetDelay_p50", "packetDelay_p95", "packetDelay_p99",
+		"avgPacketSize", "packetSize_p50", "packetSize_p95", "packetSize_p99",
+		"connectLatency", "timeToFirstByte", "streamLifetime",
+		"pixels", "bytes/pixel", "bytes/s/pixel", "packets/pixel",
+		"bytes/connection", "packets/connection",
+	}
+	for category := range c.categoryErrors {
+		fields = append(fields, "errors_"+ErrorCategory(category).String()+"/s")
+	}
+	if c.EwmaAlpha > 0 {
+		fields = append(fields, "bytes/s_ewma", "packets/s_ewma")
+	}
+	if c.PacketSizes != nil {
+		fields = append(fields, c.PacketSizes.Fields("packets")...)
+	}
+	if c.Warmup > 0 {
+		fields = append(fields, "warmup")
+	}
+	return fields
+}
+
+func (c *StreamStatisticsCollector) storeLastValues(values []bitflow.Value, fields []string) {
+	lastValues := make(map[string]float64, len(fields))
+	for i, field := range fields {
+		lastValues[field] = float64(values[i])
+	}
+	c.lastValuesLock.Lock()
+	defer c.lastValuesLock.Unlock()
+	c.lastValues = lastValues
+}
+
+// LastValue returns the value of the given field in the most recently computed sample, or 0 if no such value exists
+func (c *StreamStatisticsCollector) LastValue(field string) float64 {
+	c.lastValuesLock.Lock()
+	defer c.lastValuesLock.Unlock()
+	return c.lastValues[field]
+}
+
+// StatisticsSnapshot contains the current values of the collected statistics. The totals like Opened and Bytes are
+// counted since starting the collector and are not reset at the end of the warmup, so they can be exported as counters.
+type StatisticsSnapshot struct {
+	Streams              int                            `json:"streams"`
+	TargetStreams        int                            `json:"targetStreams"`
+	OpenConnections      float64                        `json:"openConnections"`
+	ReceivingConnections float64                        `json:"receivingConnections"`
+	Opened               float64                        `json:"opened"`
+	Closed               float64                        `json:"closed"`
+	Errors               float64                        `json:"errors"`
+	Stalls               float64                        `json:"stalls"`
+	Bytes                float64                        `json:"bytes"`
+	Packets              float64                        `json:"packets"`
+	Pixels               float64                        `json:"pixels"`
+	Selections           map[string]uint64              `json:"selections"`  // Number of times each endpoint URL was selected to open a stream
+	OpenResults          map[string]EndpointOpenResults `json:"openResults"` // Results of opening streams for each endpoint URL
+	Rates                map[string]float64             `json:"rates"`       // Computed at the time of the last emitted sample
+}
+
+// EndpointOpenResults counts the streams that were opened successfully or failed to open for one endpoint
+type EndpointOpenResults struct {
+	Opened      uint64  `json:"opened"`
+	Failed      uint64  `json:"failed"`
+	SuccessRate float64 `json:"successRate"` // Share of the attempts that were opened successfully, 0 without attempts
+}
+
+func (c *StreamStatisticsCollector) Snapshot() StatisticsSnapshot {
+	streams := c.NumStreams()
+	selections := make(map[string]uint64)
+	openResults := make(map[string]EndpointOpenResults)
+	for _, endpoint := range c.Factory.allEndpoints() {
+		selections[endpoint.url.String()] = endpoint.Selections()
+		opened, failed := endpoint.OpenResults()
+		openResults[endpoint.url.String()] = EndpointOpenResults{
+			Opened:      opened,
+			Failed:      failed,
+			SuccessRate: float64(safeDivide(bitflow.Value(opened), bitflow.Value(opened+failed))),
+		}
+	}
+	rates := make(map[string]float64)
+	c.lastValuesLock.Lock()
+	for field, value := range c.lastValues {
+		if strings.HasSuffix(field, "/s") {
+			rates[field] = value
+		}
+	}
+	c.lastValuesLock.Unlock()
+	return StatisticsSnapshot{
+		Streams:              streams,
+		TargetStreams:        c.TargetStreams(),
+		OpenConnections:      float64(c.openConnections.Get()),
+		ReceivingConnections: float64(c.receivingConnections.Get()),
+		Opened:               float64(c.opened.Get()),
+		Closed:               float64(c.closed.Get()),
+		Errors:               float64(c.errors.Get()),
+		Stalls:               float64(c.stalls.Get()),
+		Bytes:                float64(c.bytes.Get()),
+		Packets:              float64(c.packets.Get()),
+		Pixels:               float64(c.pixels.Get()),
+		Selections:           selections,
+		OpenResults:          openResults,
+		Rates:                rates,
+	}
+}
+
+// SetRestartDelay parses the given distribution definition and uses it for all subsequent restart delays.
+// On success, the description of the new distribution is returned.
+func (c *StreamStatisticsCollector) SetRestartDelay(definition string) (string, error) {
+	var sampler DistributionSampler
+	if err := sampler.Set(definition); err != nil {
+		return "", err
+	}
+	c.delayLock.Lock()
+	defer c.delayLock.Unlock()
+	c.DelaySampler = sampler
+	return sampler.String(), nil
+}
+
+// RestartDelay returns the description of the current restart delay distribution
+func (c *StreamStatisticsCollector) RestartDelay() string {
+	c.delayLock.Lock()
+	defer c.delayLock.Unlock()
+	return c.DelaySampler.String()
+}
+
+func (c *StreamStatisticsCollector) sampleRestartDelay() time.Duration {
+	c.delayLock.Lock()
+	distribution := c.DelaySampler.distribution
+	c.delayLock.Unlock()
+	// Sample outside of the lock, since file distributions might read their file
+	return distribution.Sample()
+}
+
+// countError counts a stream error in total and in its category. Uncategorized errors are counted in the fallback category.
+func (c *StreamStatisticsCollector) countError(err error, fallback ErrorCategory) {
+	c.errors.Increment(1)
+	c.categoryErrors[categorizeError(err, fallback)].Increment(1)
+}
+
+// logStreamError logs an error of a single stream. In Quiet mode, only the first error is logged in every
+// errorSummaryInterval, and the number of suppressed logs is reported by logSuppressedErrors instead.
+func (c *StreamStatisticsCollector) logStreamError(level log.Level, format string, args ...interface{}) {
+	if c.Quiet {
+		c.quietLock.Lock()
+		suppress := c.loggedSinceSummary
+		if suppress {
+			c.suppressedLogs++
 		}
+		c.loggedSinceSummary = true
+		c.quietLock.Unlock()
+		if suppress {
+			return
+		}
+	}
+	log.StandardLogger().Logf(level, format, args...)
+}
+
+// logSuppressedErrors summarizes the stream error logs suppressed by logStreamError since the last summary,
+// together with the total error counters. Nothing is logged if no logs were suppressed.
+func (c *StreamStatisticsCollector) logSuppressedErrors() {
+	c.quietLock.Lock()
+	suppressed := c.suppressedLogs
+	since := c.lastErrorSummary
+	c.suppressedLogs = 0
+	c.loggedSinceSummary = false
+	c.lastErrorSummary = c.currentTime()
+	c.quietLock.Unlock()
+	if suppressed == 0 {
+		return
+	}
+	categories := make([]string, len(c.categoryErrors))
+	for category := range c.categoryErrors {
+		categories[category] = fmt.Sprintf("%v: %v", ErrorCategory(category), c.categoryErrors[category].Get())
+	}
+	message := fmt.Sprintf("Suppressed %v error log(s) of failing streams", suppressed)
+	if !since.IsZero() {
+		message += fmt.Sprintf(" in the last %v", c.currentTime().Sub(since).Round(time.Second))
 	}
+	log.Errorf("%v. Total errors: %v (%v), stalls: %v", message, c.errors.Get(), strings.Join(categories, ", "), c.stalls.Get())
+}
+
+func (c *StreamStatisticsCollector) errorSummaryTime() time.Time {
+	c.quietLock.Lock()
+	defer c.quietLock.Unlock()
+	return c.lastErrorSummary
+}
+
+// backoff returns the additional delay before retrying to open a stream after the given number of consecutive failures
+func (c *StreamStatisticsCollector) backoff(failures int) time.Duration {
+	if c.Backoff <= 0 || failures <= 0 {
+		return 0
+	}
+	backoff := c.Backoff
+	for i := 1; i < failures; i++ {
+		if (c.MaxBackoff > 0 && backoff >= c.MaxBackoff) || backoff > math.MaxInt64/2 {
+			break
+		}
+		backoff *= 2
+	}
+	if c.MaxBackoff > 0 && backoff > c.MaxBackoff {
+		backoff = c.MaxBackoff
+	}
+	return backoff
+}
+
+func (c *StreamStatisticsCollector) streamFactory() StreamFactory {
+	if c.StreamFactory != nil {
+		return c.StreamFactory
+	}
+	return c.Factory
 }
 
 type RunningStream struct {
-	col     *StreamStatisticsCollector
-	stopper golib.StopChan
-	wg      sync.WaitGroup
-	stream  *RtmpStream
+	col        *StreamStatisticsCollector
+	host       string // If set, only endpoints of this host are streamed
+	stopper    golib.StopChan
+	wg         sync.WaitGroup
+	stream     Stream
+	cancelOpen context.CancelFunc // Aborts opening the next stream, protected by streamLock like stream
+	streamLock sync.Mutex
+	wasOpened  bool // Set after the first successful open, subsequent calls of handleStream count as reconnects
+	failures   int  // Number of consecutive failures to open a stream
 }
 
+// start runs the stream in a loop until it is stopped. The collector does not add the stream to its wait group,
+// because shutting down must not wait for streams that exceed the DrainTimeout.
 func (c *RunningStream) start() {
-	c.col.wg.Add(1)
 	c.wg.Add(1)
 	go func() {
-		defer c.col.wg.Done()
-		defer c.wg.Done()
-		for !c.stopper.Stopped() {
-			c.stopper.WaitTimeout(c.col.DelaySampler.distribution.Sample())
-			c.handleStream()
+		if c.loop() {
+			// Remove the stream only after the loop finished, so a concurrent call to stop() does not block while holding streamsLock
+			c.col.abandonStream(c)
 		}
 	}()
 }
 
+// loop opens streams until the RunningStream is stopped. Returns true if it was abandoned after MaxRetries consecutive failures.
+func (c *RunningStream) loop() bool {
+	defer c.wg.Done()
+	for !c.stopper.Stopped() {
+		c.stopper.WaitTimeout(c.restartDelay())
+		c.handleStream()
+		if maxRetries := c.col.MaxRetries; maxRetries > 0 && c.failures >= maxRetries {
+			c.stopper.Stop()
+			return true
+		}
+	}
+	return false
+}
+
+// restartDelay returns the time to wait before opening the next stream, including the backoff after failures
+func (c *RunningStream) restartDelay() time.Duration {
+	backoff := c.col.backoff(c.failures)
+	if backoff > 0 && c.col.BackoffReplacesDelay {
+		return backoff
+	}
+	return c.col.sampleRestartDelay() + backoff
+}
+
 func (c *RunningStream) stop() {
 	c.stopper.Stop()
-	c.stream.Close()
+	c.closeStream()
 	c.wg.Wait()
 }
 
-func (c *RunningStream) handleStream() {
-	stream, err := c.col.Factory.OpenStream()
+// closeStream closes the currently opened stream, if any, or aborts opening the next stream
+func (c *RunningStream) closeStream() {
+	c.streamLock.Lock()
+	defer c.streamLock.Unlock()
+	if c.stream != nil {
+		c.stream.Close()
+	}
+	if c.cancelOpen != nil {
+		c.cancelOpen()
+	}
+}
+
+func (c *RunningStream) setStream(stream Stream) {
+	c.streamLock.Lock()
+	defer c.streamLock.Unlock()
 	c.stream = stream
+}
+
+// openStream opens the next stream. Stopping the RunningStream in the meantime cancels the context passed to the factory.
+func (c *RunningStream) openStream() (Stream, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c.setCancelOpen(cancel)
+	defer c.setCancelOpen(nil)
+
+	factory := c.col.streamFactory()
+	if c.host == "" {
+		return factory.OpenStream(ctx)
+	}
+	hostFactory, ok := factory.(HostStreamFactory)
+	if !ok {
+		return nil, fmt.Errorf("Cannot open streams pinned to host %v with %T", c.host, factory)
+	}
+	return hostFactory.OpenHostStream(ctx, c.host)
+}
+
+func (c *RunningStream) setCancelOpen(cancel context.CancelFunc) {
+	c.streamLock.Lock()
+	defer c.streamLock.Unlock()
+	c.cancelOpen = cancel
+	if cancel != nil && c.stopper.Stopped() {
+		// stop() did not see the cancel function anymore
+		cancel()
+	}
+}
+
+func (c *RunningStream) handleStream() {
+	if c.wasOpened {
+		c.col.reconnects.Increment(1)
+	}
+	stream, err := c.openStream()
 	if err == ErrorNoURLs {
 		log.Infof("No URLs available for streaming, sleeping for %v...", noUrlsSleepDuration)
 		c.stopper.WaitTimeout(noUrlsSleepDuration)
 		return
+	} else if err == ErrorHostsSaturated {
+		log.Debugf("All hosts reached their maximum number of connections, retrying in %v...", saturatedHostsSleepDuration)
+		c.stopper.WaitTimeout(saturatedHostsSleepDuration)
+		return
+	} else if errors.Is(err, context.Canceled) && c.stopper.Stopped() {
+		// Streams aborted while opening due to stopping the RunningStream do not count as error
+		log.Debugln("Canceled opening stream:", err)
+		return
 	} else if err != nil {
-		log.Errorln("Error opening stream:", err)
-		c.col.errors.Increment(1)
+		c.failures++
+		if backoff := c.col.backoff(c.failures); backoff > 0 {
+			c.col.logStreamError(log.ErrorLevel, "Error opening stream (retrying with a backoff of %v): %v", backoff, err)
+		} else {
+			c.col.logStreamError(log.ErrorLevel, "Error opening stream: %v", err)
+		}
+		c.col.countError(err, ConnectError)
+		c.col.StreamLog.Log(streamEventError, nil, err)
 		return
 	}
 
-	// Make sure the stream is closed when we are finished
-	defer c.stream.Close()
+	c.wasOpened = true
+	c.failures = 0
+
+	// Make sure the stream is closed when we are finished, and free its connection afterwards
+	info := stream.Info()
+	defer info.releaseConnection()
+	c.setStream(stream)
+	defer c.setStream(nil)
+	defer stream.Close()
+
+	c.col.StreamLog.Log(streamEventOpened, info.Endpoint, nil)
+	c.col.connectLatency.Add(info.ConnectLatency.Seconds())
+	c.receiveStream(stream, &info.Endpoint.host.stats)
+}
+
+// streamKind returns the kind of the stream, or UnknownStream if the stream does not implement StreamKindReporter
+func streamKind(stream Stream) StreamKind {
+	if reporter, ok := stream.(StreamKindReporter); ok {
+		return reporter.StreamKind()
+	}
+	return UnknownStream
+}
+
+// updateStreamKind moves a stream from the counter of the previous kind to the counter of the new kind
+func (c *StreamStatisticsCollector) updateStreamKind(previous, kind StreamKind) {
+	if counter := c.streamKindCounter(previous); counter != nil {
+		counter.Increment(-1)
+	}
+	if counter := c.streamKindCounter(kind); counter != nil {
+		counter.Increment(1)
+	}
+}
+
+func (c *StreamStatisticsCollector) streamKindCounter(kind StreamKind) *TwoWayCounter {
+	switch kind {
+	case LiveStream:
+		return &c.liveStreams
+	case RecordedStream:
+		return &c.recordedStreams
+	}
+	return nil
+}
+
+// streamWireBytes returns the number of bytes the stream received over the network, if it implements WireByteCounter
+func streamWireBytes(stream Stream) (uint64, bool) {
+	if counter, ok := stream.(WireByteCounter); ok {
+		return counter.WireBytes()
+	}
+	return 0, false
+}
 
-	pixels := int64(stream.Endpoint.pixels)
+// receiveStream reads from an opened stream until it ends or the RunningStream is stopped.
+// The pixels of the endpoint are counted when the first data is received, because they can be obtained from the stream metadata.
+func (c *RunningStream) receiveStream(stream Stream, hostStats *HostStatistics) {
+	openTime := c.col.currentTime()
 	c.col.opened.Increment(1)
 	c.col.openConnections.Increment(1)
 	defer c.col.openConnections.Increment(-1)
+	hostStats.openConnections.Increment(1)
+	defer hostStats.openConnections.Increment(-1)
+	var expired, stalled int32
+	var stallTimer *time.Timer
+	if stallTimeout := c.col.StallTimeout; stallTimeout > 0 {
+		// Close the stream if no data is received for the stall timeout
+		stallTimer = time.AfterFunc(stallTimeout, func() {
+			atomic.StoreInt32(&stalled, 1)
+			stream.Close()
+		})
+		defer stallTimer.Stop()
+	}
+	if maxDuration := c.col.MaxStreamDuration; maxDuration > 0 {
+		// Close the stream after the maximum duration, the ongoing Receive call fails but does not count as error
+		timer := time.AfterFunc(maxDuration, func() {
+			atomic.StoreInt32(&expired, 1)
+			stream.Close()
+		})
+		defer timer.Stop()
+	}
+	capture := c.col.Capture.start(stream)
+	defer capture.close()
+	var limiter *BandwidthLimiter
+	if c.col.StreamBandwidth > 0 {
+		limiter = newBandwidthLimiter(c.col.StreamBandwidth)
+	}
 	received := false
 	var previousPacketTime time.Time
+	var previousWireBytes, previousLostPackets uint64
+	kind := UnknownStream
+	defer func() {
+		c.col.updateStreamKind(kind, UnknownStream)
+	}()
 	for !c.stopper.Stopped() {
-		num, err := stream.Receive()
+		num, packetType, err := stream.Receive()
+		if newKind := streamKind(stream); newKind != kind {
+			c.col.updateStreamKind(kind, newKind)
+			kind = newKind
+		}
+		if wireBytes, ok := streamWireBytes(stream); ok {
+			c.col.wireBytes.Increment(wireBytes - previousWireBytes)
+			previousWireBytes = wireBytes
+		} else if num > 0 {
+			// The payload is the best available approximation
+			c.col.wireBytes.Increment(uint64(num))
+		}
+		if counter, ok := stream.(PacketLossCounter); ok {
+			lostPackets := counter.LostPackets()
+			c.col.lostPackets.Increment(lostPackets - previousLostPackets)
+			previousLostPackets = lostPackets
+		}
 		if num > 0 {
 			c.col.bytes.Increment(uint64(num))
+			switch packetType {
+			case AudioPacket:
+				c.col.audioBytes.Increment(uint64(num))
+			case VideoPacket:
+				c.col.videoBytes.Increment(uint64(num))
+			}
 			c.col.packets.Increment(1)
-			now := time.Now()
+			c.col.packetSizeQuantiles.Add(float64(num))
+			capture.write(stream)
+			if c.col.PacketSizes != nil {
+				c.col.PacketSizes.Add(uint64(num))
+			}
+			hostStats.bytes.Increment(uint64(num))
+			hostStats.packets.Increment(1)
+			if stallTimer != nil {
+				stallTimer.Reset(c.col.StallTimeout)
+			}
+			now := c.col.currentTime()
 			if !received {
 				received = true
 				c.col.receivingConnections.Increment(1)
 				defer c.col.receivingConnections.Increment(-1)
-				c.col.pixels.Increment(pixels)
-				defer c.col.pixels.Increment(-pixels)
+				if endpoint := stream.Info().Endpoint; endpoint != nil {
+					pixels := int64(endpoint.Pixels())
+					c.col.pixels.Increment(pixels)
+					defer c.col.pixels.Increment(-pixels)
+				}
+				c.col.timeToFirstByte.Add(now.Sub(openTime).Seconds())
+				c.col.StreamLog.Log(streamEventFirstByte, stream.Info().Endpoint, nil)
 			} else {
 				diff := now.Sub(previousPacketTime)
 				c.col.packetDelay.Add(diff.Seconds())
+				c.col.packetDelayQuantiles.Add(diff.Seconds())
 			}
 			previousPacketTime = now
+			if limiter != nil {
+				// Delay receiving the next packet. The stall timer is not affected, because this delay is intended.
+				limiter.Consume(num, c.stopper)
+				if stallTimer != nil {
+					stallTimer.Reset(c.col.StallTimeout)
+				}
+			}
+		}
+		if err != nil && atomic.LoadInt32(&stalled) == 1 {
+			err = &StallError{Duration: c.col.StallTimeout}
 		}
-		if err == io.EOF {
+		if stallErr, ok := err.(*StallError); ok {
+			c.col.logStreamError(log.WarnLevel, "Closed stream after receiving no data for %v", stallErr.Duration)
+			c.col.streamLifetime.Add(c.col.currentTime().Sub(openTime).Seconds())
+			c.col.stalls.Increment(1)
+			c.col.closed.Increment(1)
+			c.col.StreamLog.Log(streamEventClosed, stream.Info().Endpoint, stallErr)
+			return
+		} else if err == io.EOF || atomic.LoadInt32(&expired) == 1 || c.stopper.Stopped() {
+			// Streams closed due to the maximum duration or by stopping the RunningStream do not count as error
+			if !c.stopper.Stopped() {
+				c.col.streamLifetime.Add(c.col.currentTime().Sub(openTime).Seconds())
+			}
 			c.col.closed.Increment(1)
+			c.col.StreamLog.Log(streamEventClosed, stream.Info().Endpoint, nil)
 			return
 		} else if err != nil {
-			log.Errorln("Error reading from stream:", err)
-			c.col.errors.Increment(1)
+			c.col.logStreamError(log.ErrorLevel, "Error reading from stream: %v", err)
+			c.col.countError(err, ReadError)
+			c.col.streamLifetime.Add(c.col.currentTime().Sub(openTime).Seconds())
 			c.col.closed.Increment(1)
+			c.col.StreamLog.Log(streamEventError, stream.Info().Endpoint, err)
+			c.col.StreamLog.Log(streamEventClosed, stream.Info().Endpoint, nil)
 			return
 		}
 	}
@@ -0,0 +1,1333 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/antongulenko/golib"
+	rtmp "github.com/antongulenko/rtmpclient"
+	"github.com/bitflow-stream/go-bitflow/bitflow"
+	log "github.com/sirupsen/logrus"
+	testAssert "github.com/stretchr/testify/require"
+)
+
+func sampleSequence(t *testing.T, distString string, seed int64, length int) []time.Duration {
+	testAssert.Equal(t, seed, seedRandom(seed))
+	sampler := parse(t, distString, false)
+	result := make([]time.Duration, length)
+	for i := range result {
+		result[i] = sampler.distribution.Sample()
+	}
+	return result
+}
+
+func TestSeedReproducibleSampling(t *testing.T) {
+	assert := testAssert.New(t)
+	for _, distString := range []string{"equal:0s,10s", "norm:5s,1s", "list:1s,2s,3s", "mix:0.3:const:1s:equal:1s,5s"} {
+		first := sampleSequence(t, distString, 42, 100)
+		second := sampleSequence(t, distString, 42, 100)
+		assert.Equal(first, second, distString)
+		other := sampleSequence(t, distString, 43, 100)
+		assert.NotEqual(first, other, distString)
+	}
+}
+
+func TestSeedRandomDefault(t *testing.T) {
+	testAssert.NotZero(t, seedRandom(0))
+}
+
+func sampleValues(sample *bitflow.Sample, header *bitflow.Header) map[string]float64 {
+	result := make(map[string]float64, len(header.Fields))
+	for i, field := range header.Fields {
+		result[field] = float64(sample.Values[i])
+	}
+	return result
+}
+
+func TestPerHostStatisticsHeader(t *testing.T) {
+	assert := testAssert.New(t)
+	factory := &RtmpStreamFactory{}
+	for _, urlArg := range []string{"rtmp://host1/app/stream", "rtmp://host2/app/stream{{1 2}}"} {
+		host, endpoints, err := factory.ParseURLArgument(urlArg)
+		assert.NoError(err)
+		factory.AddEndpoints(host, endpoints)
+	}
+	col := &StreamStatisticsCollector{Factory: factory}
+
+	factory.hosts[1].endpoints[0].host.stats.bytes.Increment(300)
+	sample, header := col.collectSample(time.Second)
+	assert.Len(sample.Values, len(header.Fields))
+	for _, host := range []string{"host1:1935", "host2:1935"} {
+		for _, field := range []string{"openConnections", "bytes/s", "packets/s"} {
+			assert.Contains(header.Fields, field+"{host="+host+"}")
+		}
+	}
+	values := sampleValues(sample, header)
+	assert.Equal(300.0, values["bytes/s{host=host2:1935}"])
+	assert.Equal(0.0, values["bytes/s{host=host1:1935}"])
+
+	// The header stays stable for subsequent samples
+	sample2, header2 := col.collectSample(time.Second)
+	assert.Equal(header.Fields, header2.Fields)
+	assert.Equal(0.0, sampleValues(sample2, header2)["bytes/s{host=host2:1935}"])
+}
+
+func TestBitrateFields(t *testing.T) {
+	assert := testAssert.New(t)
+	col := &StreamStatisticsCollector{Factory: &RtmpStreamFactory{}}
+	col.bytes.Increment(250000)
+	values := sampleValues(col.collectSample(2 * time.Second))
+	assert.Equal(125000.0, values["bytes/s"])
+	assert.Equal(1000.0, values["bitrate_kbps"])
+	assert.Equal(1.0, values["bitrate_mbps"])
+
+	// Zero-length intervals do not produce infinite values
+	col.bytes.Increment(1000)
+	values = sampleValues(col.collectSample(0))
+	assert.Equal(0.0, values["bitrate_kbps"])
+	assert.Equal(0.0, values["bitrate_mbps"])
+}
+
+func TestPacketSizeFields(t *testing.T) {
+	assert := testAssert.New(t)
+	col := &StreamStatisticsCollector{Factory: &RtmpStreamFactory{}}
+	col.bytes.Increment(3600)
+	col.packets.Increment(5)
+	for _, size := range []float64{500, 600, 700, 800, 1000} {
+		col.packetSizeQuantiles.Add(size)
+	}
+	values := sampleValues(col.collectSample(2 * time.Second))
+	assert.Equal(720.0, values["avgPacketSize"])
+	assert.Equal(700.0, values["packetSize_p50"])
+
+	// Intervals without packets report 0
+	values = sampleValues(col.collectSample(2 * time.Second))
+	assert.Equal(0.0, values["avgPacketSize"])
+	assert.Equal(0.0, values["packetSize_p50"])
+}
+
+func TestMovingAverageFields(t *testing.T) {
+	assert := testAssert.New(t)
+	col := &StreamStatisticsCollector{Factory: &RtmpStreamFactory{}}
+	col.bytes.Increment(1000)
+	values := sampleValues(col.collectSample(time.Second))
+	assert.NotContains(values, "bytes/s_ewma")
+
+	col.EwmaAlpha = 0.5
+	col.bytes.Increment(1000)
+	col.packets.Increment(10)
+	values = sampleValues(col.collectSample(time.Second))
+	assert.Equal(1000.0, values["bytes/s_ewma"])
+	assert.Equal(10.0, values["packets/s_ewma"])
+	col.bytes.Increment(3000)
+	col.packets.Increment(30)
+	values = sampleValues(col.collectSample(time.Second))
+	assert.Equal(3000.0, values["bytes/s"])
+	assert.Equal(2000.0, values["bytes/s_ewma"])
+	assert.Equal(20.0, values["packets/s_ewma"])
+}
+
+func TestReceivingConnectionsPeak(t *testing.T) {
+	assert := testAssert.New(t)
+	col := &StreamStatisticsCollector{Factory: &RtmpStreamFactory{}}
+	col.receivingConnections.Increment(5)
+	col.receivingConnections.Increment(-3)
+	values := sampleValues(col.collectSample(time.Second))
+	assert.Equal(2.0, values["receivingConnections"])
+	assert.Equal(5.0, values["receivingConnections_peak"])
+	assert.Equal(5.0, values["receivingConnections_lifetimePeak"])
+
+	col.receivingConnections.Increment(1)
+	values = sampleValues(col.collectSample(time.Second))
+	assert.Equal(3.0, values["receivingConnections_peak"])
+	assert.Equal(5.0, values["receivingConnections_lifetimePeak"])
+}
+
+func TestNormalizedFieldsWithoutPixelsAndConnections(t *testing.T) {
+	assert := testAssert.New(t)
+	col := &StreamStatisticsCollector{Factory: &RtmpStreamFactory{}}
+	col.bytes.Increment(1000)
+	col.packets.Increment(10)
+	values := sampleValues(col.collectSample(time.Second))
+	for _, field := range []string{"bytes/pixel", "bytes/s/pixel", "packets/pixel", "bytes/connection", "packets/connection"} {
+		assert.Equal(0.0, values[field], field)
+	}
+
+	col.bytes.Increment(1000)
+	col.pixels.Increment(100)
+	col.receivingConnections.Increment(2)
+	values = sampleValues(col.collectSample(time.Second))
+	assert.Equal(10.0, values["bytes/s/pixel"])
+	assert.Equal(500.0, values["bytes/connection"])
+}
+
+func TestBytesPerPixelFields(t *testing.T) {
+	assert := testAssert.New(t)
+	col := &StreamStatisticsCollector{Factory: &RtmpStreamFactory{}}
+	col.pixels.Increment(1000)
+	col.bytes.Increment(4000)
+	values := sampleValues(col.collectSample(2 * time.Second))
+	assert.Equal(2.0, values["bytes/s/pixel"])
+	assert.Equal(4.0, values["bytes/pixel"])
+
+	// The throughput per pixel covers only the last interval, the bytes per pixel include all received bytes
+	col.bytes.Increment(1000)
+	values = sampleValues(col.collectSample(time.Second))
+	assert.Equal(1.0, values["bytes/s/pixel"])
+	assert.Equal(5.0, values["bytes/pixel"])
+
+	// Without pixels, both values are 0
+	col.pixels.Increment(-1000)
+	values = sampleValues(col.collectSample(time.Second))
+	assert.Equal(0.0, values["bytes/s/pixel"])
+	assert.Equal(0.0, values["bytes/pixel"])
+}
+
+type fakePacket struct {
+	delay      time.Duration
+	num        int
+	packetType PacketType
+	err        error
+}
+
+// fakeStream implements Stream and delivers a fixed sequence of packets
+type fakeStream struct {
+	StreamInfo
+	packets []fakePacket
+	closed  bool
+}
+
+func (s *fakeStream) Receive() (int, PacketType, error) {
+	if len(s.packets) == 0 {
+		return 0, NoPacket, io.EOF
+	}
+	packet := s.packets[0]
+	s.packets = s.packets[1:]
+	time.Sleep(packet.delay)
+	return packet.num, packet.packetType, packet.err
+}
+
+func (s *fakeStream) Close() {
+	s.closed = true
+}
+
+func newTestRunningStream() *RunningStream {
+	col := &StreamStatisticsCollector{Factory: &RtmpStreamFactory{}, stopper: golib.NewStopChan()}
+	return &RunningStream{col: col, stopper: golib.NewStopChan()}
+}
+
+func TestTimeToFirstByte(t *testing.T) {
+	assert := testAssert.New(t)
+	running := newTestRunningStream()
+	// The clock advances on every reading: when opening the stream and when receiving each packet with data
+	running.col.now = fakeClock(30 * time.Millisecond)
+	running.receiveStream(&fakeStream{packets: []fakePacket{
+		{num: 0, packetType: NoPacket},
+		{num: 100, packetType: VideoPacket},
+		{num: 200, packetType: AudioPacket},
+		{num: 300, packetType: VideoPacket},
+	}}, &HostStatistics{})
+
+	running.col.timeToFirstByte.lock.Lock()
+	count := running.col.timeToFirstByte.count
+	running.col.timeToFirstByte.lock.Unlock()
+	assert.Equal(uint(1), count, "Time to first byte must be recorded exactly once")
+	assert.Equal(bitflow.Value(0.03), running.col.timeToFirstByte.ComputeAvg())
+
+	// Streams without data do not contribute
+	running.receiveStream(&fakeStream{packets: []fakePacket{{num: 0}}}, &HostStatistics{})
+	assert.Equal(AveragingStatistics{}, running.col.timeToFirstByte.ComputeStats())
+	assert.Equal(2.0, float64(running.col.opened.Get()))
+	assert.Equal(2.0, float64(running.col.closed.Get()))
+}
+
+func TestStreamLifetime(t *testing.T) {
+	assert := testAssert.New(t)
+	running := newTestRunningStream()
+	// Streams ending with EOF and with an error contribute their lifetime
+	running.receiveStream(&fakeStream{packets: []fakePacket{{delay: 50 * time.Millisecond, num: 100}}}, &HostStatistics{})
+	running.receiveStream(&fakeStream{packets: []fakePacket{
+		{delay: 100 * time.Millisecond, num: 100},
+		{delay: 50 * time.Millisecond, err: errors.New("Broken pipe")},
+	}}, &HostStatistics{})
+
+	// Streams stopped on shutdown do not contribute
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		running.receiveStream(newEndlessStream(nil, 10*time.Millisecond), &HostStatistics{})
+	}()
+	time.Sleep(300 * time.Millisecond)
+	running.stopper.Stop()
+	<-done
+
+	values := sampleValues(running.col.collectSample(time.Second))
+	assert.InDelta(0.1, values["streamLifetime"], 0.03)
+	values = sampleValues(running.col.collectSample(time.Second))
+	assert.Equal(0.0, values["streamLifetime"])
+}
+
+func TestQuietStreamErrors(t *testing.T) {
+	assert := testAssert.New(t)
+	var output bytes.Buffer
+	previousOutput := log.StandardLogger().Out
+	log.SetOutput(&output)
+	defer log.SetOutput(previousOutput)
+	countLogs := func(message string) int {
+		return strings.Count(output.String(), message)
+	}
+	failStreams := func(running *RunningStream, num int) {
+		for i := 0; i < num; i++ {
+			running.col.StreamFactory = &fakeStreamFactory{open: func() (Stream, error) {
+				return nil, errors.New("Connection refused")
+			}}
+			running.handleStream()
+			running.receiveStream(&fakeStream{packets: []fakePacket{{err: errors.New("Broken pipe")}}}, &HostStatistics{})
+		}
+	}
+
+	// Without quiet mode, every error is logged
+	running := newTestRunningStream()
+	failStreams(running, 3)
+	assert.Equal(3, countLogs("Error opening stream: Connection refused"))
+	assert.Equal(3, countLogs("Error reading from stream: Broken pipe"))
+
+	// In quiet mode, only the first error is logged until the next summary, but all errors are counted
+	output.Reset()
+	running = newTestRunningStream()
+	running.col.Quiet = true
+	failStreams(running, 5)
+	assert.Equal(10.0, float64(running.col.errors.Get()))
+	assert.Equal(1, countLogs("Error opening stream"))
+	assert.Equal(0, countLogs("Error reading from stream"))
+	running.col.logSuppressedErrors()
+	assert.Equal(1, countLogs("Suppressed 9 error log(s) of failing streams. Total errors: 10 (connect: 5, dial: 0, handshake: 0, read: 5"),
+		output.String())
+
+	// After the summary, the next error is logged again, and summaries are only logged for suppressed errors
+	failStreams(running, 1)
+	assert.Equal(2, countLogs("Error opening stream"))
+	running.col.logSuppressedErrors()
+	assert.Equal(1, countLogs("Suppressed 1 error log(s)"))
+	running.col.logSuppressedErrors()
+	assert.Equal(2, countLogs("Suppressed"))
+}
+
+// fakeWireStream is a fakeStream that reports a fixed protocol overhead for every packet as wire bytes
+type fakeWireStream struct {
+	fakeStream
+	overhead  int
+	wireBytes uint64
+}
+
+func (s *fakeWireStream) Receive() (int, PacketType, error) {
+	num, packetType, err := s.fakeStream.Receive()
+	if num > 0 {
+		s.wireBytes += uint64(num + s.overhead)
+	}
+	return num, packetType, err
+}
+
+func (s *fakeWireStream) WireBytes() (uint64, bool) {
+	return s.wireBytes, true
+}
+
+func TestWireBytesFields(t *testing.T) {
+	assert := testAssert.New(t)
+	running := newTestRunningStream()
+	packets := []fakePacket{{num: 100, packetType: VideoPacket}, {num: 200, packetType: AudioPacket}}
+	running.receiveStream(&fakeWireStream{fakeStream: fakeStream{packets: packets}, overhead: 12}, &HostStatistics{})
+	values := sampleValues(running.col.collectSample(time.Second))
+	assert.Equal(300.0, values["bytes/s"])
+	assert.Equal(324.0, values["wireBytes/s"])
+
+	// Streams without wire bytes count the payload
+	running.receiveStream(&fakeStream{packets: packets}, &HostStatistics{})
+	values = sampleValues(running.col.collectSample(time.Second))
+	assert.Equal(300.0, values["bytes/s"])
+	assert.Equal(300.0, values["wireBytes/s"])
+}
+
+// fakeLossStream is a fakeStream that reports a fixed number of lost packets for every received packet
+type fakeLossStream struct {
+	fakeStream
+	lostPackets uint64
+}
+
+func (s *fakeLossStream) Receive() (int, PacketType, error) {
+	num, packetType, err := s.fakeStream.Receive()
+	if num > 0 {
+		s.lostPackets += 2
+	}
+	return num, packetType, err
+}
+
+func (s *fakeLossStream) LostPackets() uint64 {
+	return s.lostPackets
+}
+
+func TestLostPacketsField(t *testing.T) {
+	assert := testAssert.New(t)
+	running := newTestRunningStream()
+	packets := []fakePacket{{num: 100, packetType: VideoPacket}, {num: 200, packetType: AudioPacket}}
+	running.receiveStream(&fakeLossStream{fakeStream: fakeStream{packets: packets}}, &HostStatistics{})
+	values := sampleValues(running.col.collectSample(time.Second))
+	assert.Equal(4.0, values["lostPackets/s"])
+	running.receiveStream(&fakeStream{packets: packets}, &HostStatistics{})
+	values = sampleValues(running.col.collectSample(time.Second))
+	assert.Equal(0.0, values["lostPackets/s"])
+}
+
+// fakeKindStream is a fakeStream that reports the given kind after delivering each packet. Before each packet,
+// the observe function is called.
+type fakeKindStream struct {
+	fakeStream
+	kinds   []StreamKind
+	kind    StreamKind
+	observe func()
+}
+
+func (s *fakeKindStream) Receive() (int, PacketType, error) {
+	s.observe()
+	if len(s.kinds) > 0 {
+		s.kind = s.kinds[0]
+		s.kinds = s.kinds[1:]
+	}
+	return s.fakeStream.Receive()
+}
+
+func (s *fakeKindStream) StreamKind() StreamKind {
+	return s.kind
+}
+
+func TestStreamKindFields(t *testing.T) {
+	assert := testAssert.New(t)
+	running := newTestRunningStream()
+	var observed []map[string]float64
+	stream := &fakeKindStream{
+		fakeStream: fakeStream{packets: []fakePacket{{num: 100}, {num: 100}, {num: 100}}},
+		kinds:      []StreamKind{UnknownStream, LiveStream, RecordedStream},
+		observe: func() {
+			observed = append(observed, sampleValues(running.col.collectSample(time.Second)))
+		},
+	}
+	running.receiveStream(stream, &HostStatistics{})
+	assert.Len(observed, 4)
+	for i, expected := range [][2]float64{{0, 0}, {0, 0}, {1, 0}, {0, 1}} {
+		assert.Equal(expected[0], observed[i]["liveStreams"], "sample %v", i)
+		assert.Equal(expected[1], observed[i]["recordedStreams"], "sample %v", i)
+	}
+
+	// Closed streams are no longer counted
+	values := sampleValues(running.col.collectSample(time.Second))
+	assert.Equal(0.0, values["liveStreams"])
+	assert.Equal(0.0, values["recordedStreams"])
+}
+
+// fakeStreamFactory implements StreamFactory and opens streams created by the given function
+type fakeStreamFactory struct {
+	open func() (Stream, error)
+}
+
+func (f *fakeStreamFactory) OpenStream(context.Context) (Stream, error) {
+	return f.open()
+}
+
+func TestSelectFields(t *testing.T) {
+	assert := testAssert.New(t)
+	col := &StreamStatisticsCollector{Factory: newTestFactory(t, "rtmp://host1/app/stream")}
+	assert.NoError(col.SelectFields(splitFieldList(" errors, openConnections{host=host1:1935},bytes,")))
+	sink := new(recordingSink)
+	col.SetSink(sink)
+	col.statisticsTime = time.Now()
+	col.bytes.Increment(300)
+	col.errors.Increment(2)
+	col.packets.Increment(5)
+	col.Factory.hosts[0].stats.openConnections.Increment(1)
+	col.sinkSample()
+	assert.Len(sink.samples, 1)
+	assert.Equal([]string{"errors", "bytes", "openConnections{host=host1:1935}"}, sink.headers[0].Fields)
+	assert.Equal([]bitflow.Value{2, 300, 1}, sink.samples[0].Values)
+
+	// All values are still collected for the REST API
+	assert.Equal(5.0, col.LastValue("packets"))
+
+	assert.Error(col.SelectFields([]string{"bytes", "unknown"}))
+	assert.Error(col.SelectFields([]string{"bytes{host=host1:1935}"}))
+	assert.NoError(col.SelectFields(nil))
+	col.sinkSample()
+	assert.Equal(col.sampleFields(), sink.headers[1].Fields[:len(col.sampleFields())])
+}
+
+func TestStreamFactories(t *testing.T) {
+	assert := testAssert.New(t)
+	factory := newTestFactory(t, "rtmp://host/app/stream")
+	endpoint := factory.hosts[0].endpoints[0]
+
+	col := &StreamStatisticsCollector{Factory: factory}
+	assert.Equal(factory, col.streamFactory())
+
+	var opened *fakeStream
+	col.StreamFactory = &fakeStreamFactory{open: func() (Stream, error) {
+		opened = &fakeStream{StreamInfo: StreamInfo{Endpoint: endpoint}, packets: []fakePacket{{num: 10}, {num: 20}}}
+		return opened, nil
+	}}
+	running := &RunningStream{col: col, stopper: golib.NewStopChan()}
+	running.handleStream()
+	assert.True(opened.closed)
+	assert.Equal(bitflow.Value(30), col.bytes.Get())
+	assert.Equal(bitflow.Value(30), endpoint.host.stats.bytes.Get())
+}
+
+func newTestCollector() *StreamStatisticsCollector {
+	return &StreamStatisticsCollector{
+		Factory:      &RtmpStreamFactory{},
+		DelaySampler: DistributionSampler{distribution: &ConstDistribution{0}},
+		wg:           new(sync.WaitGroup),
+		stopper:      golib.NewStopChan(),
+	}
+}
+
+func TestRampUp(t *testing.T) {
+	assert := testAssert.New(t)
+	col := newTestCollector()
+	col.RampUp = 400 * time.Millisecond
+	var lock sync.Mutex
+	var intervals []time.Duration
+	var started []int
+	col.waitTimeout = func(stopper golib.StopChan, timeout time.Duration) bool {
+		lock.Lock()
+		defer lock.Unlock()
+		intervals = append(intervals, timeout)
+		started = append(started, col.NumStreams())
+		return !stopper.Stopped()
+	}
+	// Polls instead of assert.Eventually, which can panic when the condition is still evaluated after returning
+	waitForStreams := func(num int) {
+		for deadline := time.Now().Add(time.Second); col.NumStreams() != num; time.Sleep(time.Millisecond) {
+			assert.True(time.Now().Before(deadline), "Expected %v streams, but got %v", num, col.NumStreams())
+		}
+	}
+	col.SetNumberOfStreams(100)
+	waitForStreams(100)
+
+	// One stream is started after every interval, the intervals spread the streams evenly over the ramp-up
+	lock.Lock()
+	assert.Len(intervals, 99)
+	for i, interval := range intervals {
+		assert.Equal(4*time.Millisecond, interval)
+		assert.Equal(i+1, started[i], "Streams started before interval %v", i)
+	}
+	lock.Unlock()
+
+	// Changing the target cancels the ramp-up. The ramp-up is blocked after reaching 110 streams.
+	waited := make(chan bool)
+	col.waitTimeout = func(stopper golib.StopChan, timeout time.Duration) bool {
+		if col.NumStreams() < 110 {
+			return !stopper.Stopped()
+		}
+		result := stopper.WaitTimeout(time.Hour)
+		waited <- result
+		return result
+	}
+	col.SetNumberOfStreams(200)
+	waitForStreams(110)
+	col.SetNumberOfStreams(105)
+	assert.False(<-waited)
+	assert.Equal(105, col.NumStreams())
+
+	// Closing cancels the ramp-up
+	col.SetNumberOfStreams(200)
+	waitForStreams(110)
+	col.Close()
+	assert.False(<-waited)
+	col.wg.Wait()
+	assert.Equal(0, col.NumStreams())
+}
+
+func TestTargetStreams(t *testing.T) {
+	assert := testAssert.New(t)
+	col := newTestCollector()
+	col.RampUp = 200 * time.Millisecond
+	defer func() {
+		col.Close()
+		col.wg.Wait()
+	}()
+	col.SetNumberOfStreams(20)
+	assert.Equal(20, col.TargetStreams())
+	values := sampleValues(col.collectSample(time.Second))
+	assert.Equal(20.0, values["targetStreams"])
+	assert.True(values["streams"] < 20, "Streams must still be ramping up, have %v", values["streams"])
+	assert.Equal(20, col.Snapshot().TargetStreams)
+
+	assert.Eventually(func() bool { return col.NumStreams() == 20 }, 2*time.Second, 10*time.Millisecond)
+	values = sampleValues(col.collectSample(time.Second))
+	assert.Equal(20.0, values["streams"])
+	assert.Equal(20.0, values["targetStreams"])
+
+	// The target is also updated while paused, without starting streams
+	assert.True(col.Pause())
+	col.SetNumberOfStreams(5)
+	values = sampleValues(col.collectSample(time.Second))
+	assert.Equal(5.0, values["targetStreams"])
+	assert.Equal(0.0, values["streams"])
+}
+
+// recordingSink stores all received samples
+type recordingSink struct {
+	bitflow.DroppingSampleProcessor
+	lock    sync.Mutex
+	samples []*bitflow.Sample
+	headers []*bitflow.Header
+}
+
+func (s *recordingSink) Sample(sample *bitflow.Sample, header *bitflow.Header) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.samples = append(s.samples, sample)
+	s.headers = append(s.headers, header)
+	return nil
+}
+
+func TestRunFor(t *testing.T) {
+	assert := testAssert.New(t)
+	col := newTestCollector()
+	col.RunFor = 150 * time.Millisecond
+	col.SampleSinkInterval = time.Hour
+	col.InitialStreams = 3
+	endpoint := newTestFactory(t, "rtmp://host/app/stream").hosts[0].endpoints[0]
+	col.StreamFactory = &fakeStreamFactory{open: func() (Stream, error) {
+		return newEndlessStream(endpoint, 5*time.Millisecond), nil
+	}}
+	sink := new(recordingSink)
+	col.SetSink(sink)
+
+	var wg sync.WaitGroup
+	stopper := col.Start(&wg)
+	assert.False(stopper.WaitTimeout(time.Second), "Collector must stop after RunFor")
+	wg.Wait()
+	assert.Equal(0, col.NumStreams())
+
+	// The final sample is flushed, even though the sink interval did not elapse
+	sink.lock.Lock()
+	defer sink.lock.Unlock()
+	assert.Len(sink.samples, 1)
+	assert.Contains(sink.headers[0].Fields, "streams")
+
+	// The final sample is emitted after all streams are closed
+	values := sampleValues(sink.samples[0], sink.headers[0])
+	assert.Equal(3.0, values["closed"])
+	assert.Equal(0.0, values["openConnections"])
+}
+
+func TestWarmup(t *testing.T) {
+	assert := testAssert.New(t)
+	col := newTestCollector()
+	col.Warmup = 250 * time.Millisecond
+	col.SampleSinkInterval = 100 * time.Millisecond
+	// Waiting advances a fake clock immediately. The collector is closed when waiting beyond 500ms.
+	start := time.Unix(0, 0)
+	var clockLock sync.Mutex
+	now := start
+	col.now = func() time.Time {
+		clockLock.Lock()
+		defer clockLock.Unlock()
+		return now
+	}
+	col.waitTimeout = func(stopper golib.StopChan, timeout time.Duration) bool {
+		clockLock.Lock()
+		now = now.Add(timeout)
+		finished := now.Sub(start) > 500*time.Millisecond
+		clockLock.Unlock()
+		if finished {
+			col.Close()
+		}
+		return !stopper.Stopped()
+	}
+	sink := new(recordingSink)
+	col.SetSink(sink)
+	col.bytes.Increment(1000)
+	col.opened.Increment(2)
+	col.receivingConnections.Increment(3)
+	col.receivingConnections.Increment(-3)
+
+	var wg sync.WaitGroup
+	stopper := col.Start(&wg)
+	assert.False(stopper.WaitTimeout(time.Second), "Collector must stop after 500ms")
+	wg.Wait()
+
+	sink.lock.Lock()
+	defer sink.lock.Unlock()
+	var warmupSamples int
+	for i, sample := range sink.samples {
+		values := sampleValues(sample, sink.headers[i])
+		if values["warmup"] == 1 {
+			warmupSamples++
+			assert.Equal(1000.0, values["bytes"], "sample %v", i)
+			assert.Equal(3.0, values["receivingConnections_lifetimePeak"], "sample %v", i)
+		} else {
+			assert.Equal(0.0, values["bytes"], "sample %v", i)
+			assert.Equal(0.0, values["opened"], "sample %v", i)
+			assert.Equal(0.0, values["receivingConnections_lifetimePeak"], "sample %v", i)
+		}
+	}
+	// Samples at 100ms and 200ms, and an additional sample at the end of the warmup
+	assert.Equal(3, warmupSamples)
+	assert.Equal(col.Warmup, sink.samples[warmupSamples-1].Time.Sub(start))
+	// Samples at 350ms and 450ms, and the final sample when closing at 550ms
+	assert.Len(sink.samples, warmupSamples+3)
+	assert.Equal(550*time.Millisecond, sink.samples[len(sink.samples)-1].Time.Sub(start))
+
+	// The totals of the snapshot are monotonic and still include the warmup
+	snapshot := col.Snapshot()
+	assert.Equal(1000.0, snapshot.Bytes)
+	assert.Equal(2.0, snapshot.Opened)
+}
+
+func TestRunForStoppedEarly(t *testing.T) {
+	assert := testAssert.New(t)
+	col := newTestCollector()
+	col.RunFor = time.Hour
+	col.SampleSinkInterval = time.Hour
+	col.SetSink(new(recordingSink))
+	var wg sync.WaitGroup
+	col.Start(&wg)
+	col.Close()
+	wg.Wait()
+	assert.True(col.stopper.Stopped())
+}
+
+// endlessStream delivers a packet every interval until it is closed
+type endlessStream struct {
+	StreamInfo
+	interval time.Duration
+	closed   golib.StopChan
+}
+
+func newEndlessStream(endpoint *RtmpEndpoint, interval time.Duration) *endlessStream {
+	return &endlessStream{StreamInfo: StreamInfo{Endpoint: endpoint}, interval: interval, closed: golib.NewStopChan()}
+}
+
+func (s *endlessStream) Receive() (int, PacketType, error) {
+	if !s.closed.WaitTimeout(s.interval) {
+		return 0, NoPacket, errors.New("Stream closed")
+	}
+	return 10, VideoPacket, nil
+}
+
+func (s *endlessStream) Close() {
+	s.closed.Stop()
+}
+
+// limitedStreamFactory opens a limited number of endless streams. Afterwards, opening blocks until it is canceled.
+type limitedStreamFactory struct {
+	endpoint *RtmpEndpoint
+	limit    int
+	lock     sync.Mutex
+	streams  []*endlessStream
+	blocked  chan struct{} // Closed when opening blocks for the first time
+}
+
+func (f *limitedStreamFactory) OpenStream(ctx context.Context) (Stream, error) {
+	f.lock.Lock()
+	if len(f.streams) < f.limit {
+		defer f.lock.Unlock()
+		stream := newEndlessStream(f.endpoint, 5*time.Millisecond)
+		f.streams = append(f.streams, stream)
+		return stream, nil
+	}
+	close(f.blocked)
+	f.lock.Unlock()
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestMaxStreamDuration(t *testing.T) {
+	assert := testAssert.New(t)
+	endpoint := newTestFactory(t, "rtmp://host/app/stream").hosts[0].endpoints[0]
+	col := newTestCollector()
+	col.MaxStreamDuration = 20 * time.Millisecond
+	factory := &limitedStreamFactory{endpoint: endpoint, limit: 3, blocked: make(chan struct{})}
+	col.StreamFactory = factory
+	col.SetNumberOfStreams(1)
+
+	// The endless streams are only closed by the maximum duration, so opening the next stream means it expired
+	select {
+	case <-factory.blocked:
+	case <-time.After(5 * time.Second):
+		assert.Fail("Streams must be re-opened after the maximum duration")
+	}
+	col.Close()
+	col.wg.Wait()
+
+	factory.lock.Lock()
+	defer factory.lock.Unlock()
+	for _, stream := range factory.streams {
+		assert.True(stream.closed.Stopped())
+	}
+	assert.Equal(0.0, float64(col.errors.Get()))
+	assert.Equal(3.0, float64(col.opened.Get()))
+	assert.Equal(3.0, float64(col.closed.Get()))
+	assert.Equal(3.0, float64(col.reconnects.Get()))
+}
+
+func TestStallTimeout(t *testing.T) {
+	assert := testAssert.New(t)
+	endpoint := newTestFactory(t, "rtmp://host/app/stream").hosts[0].endpoints[0]
+	running := newTestRunningStream()
+	running.col.StallTimeout = 50 * time.Millisecond
+
+	// A stream that delivers nothing is closed and counted as stall
+	stream := newEndlessStream(endpoint, time.Hour)
+	running.receiveStream(stream, &endpoint.host.stats)
+	assert.True(stream.closed.Stopped())
+	assert.Equal(bitflow.Value(1), running.col.stalls.Get())
+	assert.Equal(bitflow.Value(0), running.col.errors.Get())
+	assert.Equal(bitflow.Value(1), running.col.closed.Get())
+
+	// Streams delivering data are not stalled
+	running.col.MaxStreamDuration = 150 * time.Millisecond
+	stream = newEndlessStream(endpoint, 10*time.Millisecond)
+	running.receiveStream(stream, &endpoint.host.stats)
+	assert.Equal(bitflow.Value(1), running.col.stalls.Get())
+	assert.Equal(bitflow.Value(2), running.col.closed.Get())
+
+	values := sampleValues(running.col.collectSample(time.Second))
+	assert.Equal(1.0, values["stalls"])
+	assert.Equal(1.0, values["stalls/s"])
+}
+
+func TestReconnects(t *testing.T) {
+	assert := testAssert.New(t)
+	endpoint := newTestFactory(t, "rtmp://host/app/stream").hosts[0].endpoints[0]
+	running := newTestRunningStream()
+	running.col.StreamFactory = &fakeStreamFactory{open: func() (Stream, error) {
+		return &fakeStream{StreamInfo: StreamInfo{Endpoint: endpoint}, packets: []fakePacket{{num: 10}}}, nil
+	}}
+
+	// The first open of a stream slot is not a reconnect
+	running.handleStream()
+	values := sampleValues(running.col.collectSample(time.Second))
+	assert.Equal(1.0, values["opened"])
+	assert.Equal(0.0, values["reconnects"])
+
+	running.handleStream()
+	running.handleStream()
+	values = sampleValues(running.col.collectSample(time.Second))
+	assert.Equal(2.0, values["reconnects"])
+	assert.Equal(2.0, values["reconnects/s"])
+
+	for i := 0; i < 4; i++ {
+		running.handleStream()
+	}
+	values = sampleValues(running.col.collectSample(time.Second))
+	assert.Equal(6.0, values["reconnects"])
+	assert.Equal(4.0, values["reconnects/s"])
+	assert.Equal(7.0, values["opened"])
+}
+
+// slowStream blocks in Receive until it is closed and then needs closeDelay to return.
+// If closeDelay is negative, Receive only returns when release is stopped.
+type slowStream struct {
+	StreamInfo
+	closeDelay time.Duration
+	closed     golib.StopChan
+	release    golib.StopChan
+	closeCalls int32
+}
+
+func newSlowStream(endpoint *RtmpEndpoint, closeDelay time.Duration) *slowStream {
+	return &slowStream{StreamInfo: StreamInfo{Endpoint: endpoint}, closeDelay: closeDelay,
+		closed: golib.NewStopChan(), release: golib.NewStopChan()}
+}
+
+func (s *slowStream) Receive() (int, PacketType, error) {
+	if s.closeDelay < 0 {
+		s.release.Wait()
+	} else {
+		s.closed.Wait()
+		time.Sleep(s.closeDelay)
+	}
+	return 0, NoPacket, errors.New("Stream closed")
+}
+
+func (s *slowStream) Close() {
+	atomic.AddInt32(&s.closeCalls, 1)
+	s.closed.Stop()
+}
+
+func TestDrainStreams(t *testing.T) {
+	assert := testAssert.New(t)
+	endpoint := newTestFactory(t, "rtmp://host/app/stream").hosts[0].endpoints[0]
+	col := newTestCollector()
+	col.DrainTimeout = 2 * time.Second
+	col.StreamFactory = &fakeStreamFactory{open: func() (Stream, error) {
+		return newSlowStream(endpoint, 50*time.Millisecond), nil
+	}}
+	col.SetNumberOfStreams(250)
+	assert.Eventually(func() bool { return col.openConnections.Get() == 250 }, 5*time.Second, 10*time.Millisecond)
+
+	// Closing the streams one after the other would take more than 10 seconds
+	start := time.Now()
+	col.Close()
+	assert.True(time.Since(start) < time.Second, "Draining took %v", time.Since(start))
+	assert.Equal(0, col.NumStreams())
+	assert.Equal(bitflow.Value(0), col.openConnections.Get())
+	assert.Equal(bitflow.Value(0), col.errors.Get())
+}
+
+func TestDrainTimeout(t *testing.T) {
+	assert := testAssert.New(t)
+	endpoint := newTestFactory(t, "rtmp://host/app/stream").hosts[0].endpoints[0]
+	col := newTestCollector()
+	col.DrainTimeout = 100 * time.Millisecond
+	var lock sync.Mutex
+	var streams []*slowStream
+	col.StreamFactory = &fakeStreamFactory{open: func() (Stream, error) {
+		lock.Lock()
+		defer lock.Unlock()
+		stream := newSlowStream(endpoint, 0)
+		if len(streams) == 0 {
+			// The first stream does not react to being closed
+			stream.closeDelay = -1
+		}
+		streams = append(streams, stream)
+		return stream, nil
+	}}
+	col.SetNumberOfStreams(5)
+	assert.Eventually(func() bool { return col.openConnections.Get() == 5 }, time.Second, time.Millisecond)
+
+	start := time.Now()
+	col.Close()
+	assert.True(time.Since(start) >= col.DrainTimeout)
+	assert.True(time.Since(start) < time.Second, "Draining took %v", time.Since(start))
+	assert.Equal(bitflow.Value(1), col.openConnections.Get())
+
+	lock.Lock()
+	defer lock.Unlock()
+	assert.Equal(int32(2), atomic.LoadInt32(&streams[0].closeCalls), "The remaining stream must be closed again after the timeout")
+	streams[0].release.Stop()
+}
+
+type errorReader struct {
+	err error
+}
+
+func (r errorReader) Read([]byte) (int, error) {
+	return 0, r.err
+}
+
+func TestConfigureLogger(t *testing.T) {
+	assert := testAssert.New(t)
+	logger := log.New()
+	assert.NoError(configureLogger(logger, "", false))
+	assert.Equal(log.InfoLevel, logger.Level)
+	assert.IsType(&log.TextFormatter{}, logger.Formatter)
+
+	var output bytes.Buffer
+	logger.SetOutput(&output)
+	assert.NoError(configureLogger(logger, "debug", true))
+	assert.Equal(log.DebugLevel, logger.Level)
+	assert.IsType(&log.JSONFormatter{}, logger.Formatter)
+	logger.Debugln("Dialing RTMP URL:", "rtmp://host/app/")
+	var entry map[string]interface{}
+	assert.NoError(json.Unmarshal(output.Bytes(), &entry))
+	assert.Equal("debug", entry["level"])
+	assert.Equal("Dialing RTMP URL: rtmp://host/app/", entry["msg"])
+
+	assert.NoError(configureLogger(logger, "warn", false))
+	assert.Equal(log.WarnLevel, logger.Level)
+	assert.Error(configureLogger(logger, "verbose", false))
+	assert.Equal(log.WarnLevel, logger.Level)
+}
+
+func TestRestApiAddress(t *testing.T) {
+	assert := testAssert.New(t)
+	for _, address := range []string{":7000", "127.0.0.1:0", "[::1]:7000", "localhost:65535"} {
+		assert.NoError(validateListenAddress(address), address)
+	}
+	for _, address := range []string{"7000", "localhost", "localhost:", "localhost:http", "localhost:65536", "::1:7000"} {
+		assert.Error(validateListenAddress(address), address)
+	}
+
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	address, err := restApiAddress(flags)
+	assert.NoError(err)
+	assert.Equal("", address, "Without the -api flag, the REST API is disabled")
+	flags.String("api", "", "")
+	assert.NoError(flags.Parse([]string{"-api", "127.0.0.1:0"}))
+	address, err = restApiAddress(flags)
+	assert.NoError(err)
+	assert.Equal("127.0.0.1:0", address)
+	assert.NoError(flags.Parse([]string{"-api", "7000"}))
+	_, err = restApiAddress(flags)
+	assert.EqualError(err, "Invalid -api: Listen address '7000' must have the form [host]:port: address 7000: missing port in address")
+
+	// The helper of do_main serves the REST API at the validated address
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(err)
+	freeAddress := listener.Addr().String()
+	listener.Close()
+	previousFlags := flag.CommandLine
+	defer func() {
+		flag.CommandLine = previousFlags
+	}()
+	flag.CommandLine = flag.NewFlagSet("test", flag.ContinueOnError)
+	helper := newCollectorHelper()
+	assert.NoError(flag.CommandLine.Parse([]string{"-api", freeAddress}))
+	address, err = restApiAddress(flag.CommandLine)
+	assert.NoError(err)
+	col := newTestCollector()
+	helper.RestApis = append(helper.RestApis, &SetUrlsRestApi{Col: col})
+	_, err = helper.BuildPipeline(col)
+	assert.NoError(err)
+	assert.Eventually(func() bool {
+		response, err := http.Get("http://" + address + "/api/streams")
+		if err != nil {
+			return false
+		}
+		response.Body.Close()
+		return response.StatusCode == http.StatusOK
+	}, time.Second, 10*time.Millisecond, "The REST API must be served at %v", address)
+}
+
+// runMain runs do_main with the given arguments and returns the exit code and the standard output
+func runMain(t *testing.T, args ...string) (int, string) {
+	stdout, err := ioutil.TempFile("", "stdout")
+	testAssert.NoError(t, err)
+	defer os.Remove(stdout.Name())
+	defer stdout.Close()
+	previousArgs, previousStdout := os.Args, os.Stdout
+	defer func() {
+		os.Args, os.Stdout = previousArgs, previousStdout
+	}()
+	os.Args, os.Stdout = append([]string{"stream-statistics-client"}, args...), stdout
+	code := do_main()
+	output, err := ioutil.ReadFile(stdout.Name())
+	testAssert.NoError(t, err)
+	return code, string(output)
+}
+
+func TestDryRun(t *testing.T) {
+	assert := testAssert.New(t)
+	code, output := runMain(t, "-dryRun", "rtmp://host1/app/stream{{1 2}}", "http://host2/live.m3u8?pixels=1280x720")
+	assert.Equal(0, code)
+	assert.Contains(output, "rtmp://host1/app/stream1")
+	assert.Contains(output, "rtmp://host1/app/stream2")
+	assert.Contains(output, "Endpoint 0 (pixels: 921600): http://host2/live.m3u8")
+
+	code, output = runMain(t, "-dryRun", "rtmp://host1/app/stream", "ftp://host2/file")
+	assert.Equal(1, code)
+	assert.Contains(output, "rtmp://host1/app/stream")
+	assert.NotContains(output, "ftp://")
+}
+
+func TestExpandURLArguments(t *testing.T) {
+	assert := testAssert.New(t)
+	stdin := strings.NewReader("rtmp://host1/app/stream{{1 2}}\n\n   rtmp://host2/app/stream  \r\n\t\n")
+	args, err := expandURLArguments([]string{"rtmp://host0/app/stream", "-"}, stdin)
+	assert.NoError(err)
+	assert.Equal([]string{"rtmp://host0/app/stream", "rtmp://host1/app/stream{{1 2}}", "rtmp://host2/app/stream"}, args)
+
+	factory := newTestFactory(t, args...)
+	var urls []string
+	for _, endpoint := range factory.allEndpoints() {
+		urls = append(urls, endpoint.String())
+	}
+	assert.Equal([]string{"rtmp://host0/app/stream", "rtmp://host1/app/stream1", "rtmp://host1/app/stream2", "rtmp://host2/app/stream"}, urls)
+
+	// Without "-", stdin is not read
+	args, err = expandURLArguments([]string{"rtmp://host/app/stream"}, errorReader{errors.New("Must not be read")})
+	assert.NoError(err)
+	assert.Equal([]string{"rtmp://host/app/stream"}, args)
+	_, err = expandURLArguments([]string{"-"}, errorReader{errors.New("Read error")})
+	assert.Error(err)
+}
+
+func TestBackoff(t *testing.T) {
+	assert := testAssert.New(t)
+	col := newTestCollector()
+	assert.Equal(time.Duration(0), col.backoff(3), "Backoff is disabled by default")
+	col.Backoff = 10 * time.Millisecond
+	col.MaxBackoff = 50 * time.Millisecond
+	var backoffs []time.Duration
+	for failures := 0; failures <= 5; failures++ {
+		backoffs = append(backoffs, col.backoff(failures))
+	}
+	assert.Equal([]time.Duration{0, 10 * time.Millisecond, 20 * time.Millisecond, 40 * time.Millisecond,
+		50 * time.Millisecond, 50 * time.Millisecond}, backoffs)
+	col.MaxBackoff = 0
+	assert.Equal(80*time.Millisecond, col.backoff(4))
+	assert.True(col.backoff(1000) > 0, "Uncapped backoff must not overflow")
+
+	// The delay between the attempts to open a failing stream grows until it reaches the maximum
+	col.MaxBackoff = 40 * time.Millisecond
+	col.BackoffReplacesDelay = true
+	col.DelaySampler = DistributionSampler{distribution: &ConstDistribution{time.Hour}}
+	var lock sync.Mutex
+	var attempts []time.Time
+	col.StreamFactory = &fakeStreamFactory{open: func() (Stream, error) {
+		lock.Lock()
+		defer lock.Unlock()
+		attempts = append(attempts, time.Now())
+		return nil, errors.New("Endpoint down")
+	}}
+	running := &RunningStream{col: col, stopper: golib.NewStopChan()}
+	running.failures = 1 // Skip the initial restart delay
+	running.start()
+	assert.Eventually(func() bool {
+		lock.Lock()
+		defer lock.Unlock()
+		return len(attempts) >= 6
+	}, 2*time.Second, 5*time.Millisecond)
+	running.stop()
+
+	lock.Lock()
+	defer lock.Unlock()
+	for i, expected := range []time.Duration{20 * time.Millisecond, 40 * time.Millisecond, 40 * time.Millisecond, 40 * time.Millisecond} {
+		delay := attempts[i+1].Sub(attempts[i])
+		assert.True(delay >= expected && delay < expected+20*time.Millisecond, "Delay %v: expected %v, got %v", i, expected, delay)
+	}
+
+	// A successful open resets the backoff
+	running.failures = 3
+	col.StreamFactory = &fakeStreamFactory{open: func() (Stream, error) {
+		return &fakeStream{StreamInfo: StreamInfo{Endpoint: newTestFactory(t, "rtmp://host/app/stream").hosts[0].endpoints[0]}}, nil
+	}}
+	running.handleStream()
+	assert.Equal(0, running.failures)
+	assert.Equal(time.Hour, running.restartDelay())
+}
+
+func TestMaxRetries(t *testing.T) {
+	assert := testAssert.New(t)
+	col := newTestCollector()
+	col.MaxRetries = 3
+	var attempts int32
+	col.StreamFactory = &fakeStreamFactory{open: func() (Stream, error) {
+		atomic.AddInt32(&attempts, 1)
+		return nil, errors.New("Endpoint down")
+	}}
+	col.SetNumberOfStreams(2)
+	assert.Eventually(func() bool { return col.NumStreams() == 0 }, time.Second, time.Millisecond)
+	assert.Equal(int32(6), atomic.LoadInt32(&attempts), "Every slot must be abandoned after 3 tries")
+	assert.Equal(bitflow.Value(6), col.errors.Get())
+	values := sampleValues(col.collectSample(time.Second))
+	assert.Equal(2.0, values["abandoned"])
+	assert.Equal(0.0, values["streams"])
+
+	// Abandoned slots can be replaced by setting the number of streams again
+	col.SetNumberOfStreams(1)
+	assert.Eventually(func() bool { return col.abandoned.Get() == 3 }, time.Second, time.Millisecond)
+	assert.Equal(int32(9), atomic.LoadInt32(&attempts))
+	col.Close()
+}
+
+func TestAbandonPinnedStream(t *testing.T) {
+	assert := testAssert.New(t)
+	var output bytes.Buffer
+	previousOutput := log.StandardLogger().Out
+	log.SetOutput(&output)
+	defer log.SetOutput(previousOutput)
+	col := newTestCollector()
+	pinned := []*RunningStream{{col: col, host: "host1"}, {col: col, host: "host1"}}
+	col.runningStreams = []*RunningStream{{col: col}}
+	col.hostStreams = map[string][]*RunningStream{"host1": append([]*RunningStream(nil), pinned...)}
+
+	// The remaining count refers to the host of pinned streams
+	col.abandonStream(pinned[0])
+	assert.Contains(output.String(), "Abandoning stream to host host1 after failing to open 0 times in a row, new number of streams to the host: 1")
+	assert.Len(col.runningStreams, 1)
+	col.abandonStream(pinned[1])
+	assert.Contains(output.String(), "new number of streams to the host: 0")
+	assert.NotContains(col.hostStreams, "host1")
+	assert.Equal(bitflow.Value(2), col.abandoned.Get())
+}
+
+func TestErrorCategories(t *testing.T) {
+	assert := testAssert.New(t)
+	endpoint := newTestFactory(t, "rtmp://host/app/stream").hosts[0].endpoints[0]
+	col := newTestCollector()
+	running := &RunningStream{col: col, stopper: golib.NewStopChan()}
+	openWith := func(stream Stream, err error) {
+		col.StreamFactory = &fakeStreamFactory{open: func() (Stream, error) {
+			return stream, err
+		}}
+		running.handleStream()
+	}
+	failingStream := func(err error) Stream {
+		return &fakeStream{StreamInfo: StreamInfo{Endpoint: endpoint}, packets: []fakePacket{{num: 10}, {err: err}}}
+	}
+
+	openWith(nil, errors.New("Connection refused"))
+	openWith(nil, categorizedError(HandshakeError, errors.New("Request returned status 404")))
+	openWith(nil, categorizedError(HandshakeError, errors.New("Request returned status 403")))
+	openWith(nil, &net.OpError{Op: "dial", Err: timeoutNetError{}})
+	openWith(failingStream(errors.New("Invalid packet")), nil)
+	openWith(failingStream(categorizedError(TimeoutError, errors.New("No stream started"))), nil)
+	openWith(failingStream(categorizedError(EOFError, errors.New("Stream closed early"))), nil)
+	openWith(failingStream(io.ErrUnexpectedEOF), nil)
+	// Regularly closed streams do not count as errors
+	openWith(failingStream(io.EOF), nil)
+
+	values := sampleValues(col.collectSample(time.Second))
+	assert.Equal(8.0, values["errors"])
+	assert.Equal(8.0, values["errors/s"])
+	assert.Equal(1.0, values["errors_connect/s"])
+	assert.Equal(0.0, values["errors_dial/s"])
+	assert.Equal(2.0, values["errors_handshake/s"])
+	assert.Equal(1.0, values["errors_read/s"])
+	assert.Equal(2.0, values["errors_timeout/s"])
+	assert.Equal(2.0, values["errors_eof/s"])
+
+	// The rates are computed per interval
+	values = sampleValues(col.collectSample(time.Second))
+	assert.Equal(8.0, values["errors"])
+	assert.Equal(0.0, values["errors_handshake/s"])
+}
+
+func TestStopWhileOpening(t *testing.T) {
+	assert := testAssert.New(t)
+	col := newTestCollector()
+	col.Factory = newTestFactory(t, "rtmp://host/app/stream")
+	col.Factory.ConnectTimeout = time.Hour
+	var dialing int32
+	col.Factory.dial = func(ctx context.Context, _ *net.Dialer, _ string, _ int) (rtmp.ClientConn, error) {
+		atomic.AddInt32(&dialing, 1)
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	col.SetNumberOfStreams(3)
+	assert.Eventually(func() bool { return atomic.LoadInt32(&dialing) == 3 }, time.Second, 10*time.Millisecond)
+
+	// Removing the streams cancels the dials instead of waiting for the connect timeout
+	start := time.Now()
+	col.SetNumberOfStreams(0)
+	assert.True(time.Since(start) < time.Second, "Stopping the streams took %v", time.Since(start))
+	assert.Equal(bitflow.Value(0), col.errors.Get(), "Canceled dials must not count as errors")
+	col.Close()
+}
+
+func TestMaxTotalBytes(t *testing.T) {
+	assert := testAssert.New(t)
+	col := newTestCollector()
+	col.InitialStreams = 2
+	col.SampleSinkInterval = 10 * time.Millisecond
+	var budget ByteSize
+	assert.NoError(budget.Set("10K"))
+	col.MaxTotalBytes = uint64(budget)
+	endpoint := newTestFactory(t, "rtmp://host/app/stream").hosts[0].endpoints[0]
+	col.StreamFactory = &fakeStreamFactory{open: func() (Stream, error) {
+		return newEndlessStream(endpoint, 0), nil
+	}}
+	sink := new(recordingSink)
+	col.SetSink(sink)
+
+	var wg sync.WaitGroup
+	stopper := col.Start(&wg)
+	assert.False(stopper.WaitTimeout(5*time.Second), "Collector must stop after receiving the maximum number of bytes")
+	wg.Wait()
+	assert.True(uint64(col.bytes.Get()) >= 10*1024)
+	assert.Equal(bitflow.Value(0), col.openConnections.Get())
+
+	sink.lock.Lock()
+	defer sink.lock.Unlock()
+	last := sampleValues(sink.samples[len(sink.samples)-1], sink.headers[len(sink.headers)-1])
+	assert.Equal(float64(col.bytes.Get()), last["bytes"], "The final sample must contain all received bytes")
+}
+
+func TestMaxOpens(t *testing.T) {
+	assert := testAssert.New(t)
+	col := newTestCollector()
+	col.InitialStreams = 2
+	col.SampleSinkInterval = 10 * time.Millisecond
+	col.MaxOpens = 20
+	endpoint := newTestFactory(t, "rtmp://host/app/stream").hosts[0].endpoints[0]
+	col.StreamFactory = &fakeStreamFactory{open: func() (Stream, error) {
+		// Every stream delivers a single packet and ends, so the streams are reopened continuously
+		time.Sleep(2 * time.Millisecond)
+		return &fakeStream{StreamInfo: StreamInfo{Endpoint: endpoint}, packets: []fakePacket{{num: 10}}}, nil
+	}}
+	sink := new(recordingSink)
+	col.SetSink(sink)
+
+	var wg sync.WaitGroup
+	stopper := col.Start(&wg)
+	assert.False(stopper.WaitTimeout(5*time.Second), "Collector must stop after opening the maximum number of streams")
+	wg.Wait()
+	opened := uint64(col.opened.Get())
+	assert.True(opened >= col.MaxOpens, "Opened only %v streams", opened)
+	assert.True(opened < 4*col.MaxOpens, "Opened %v streams, the limit was not checked in time", opened)
+
+	sink.lock.Lock()
+	defer sink.lock.Unlock()
+	last := sampleValues(sink.samples[len(sink.samples)-1], sink.headers[len(sink.headers)-1])
+	assert.Equal(float64(opened), last["opened"], "The final sample must contain all opened streams")
+}
+
+// closableRtmpConn is a fakeRtmpConn whose events channel is closed when closing the connection
+type closableRtmpConn struct {
+	*fakeRtmpConn
+	closeOnce sync.Once
+}
+
+func (c *closableRtmpConn) Close() {
+	c.closeOnce.Do(func() {
+		close(c.events)
+	})
+}
+
+func TestMaxConnectionsPerHostStreams(t *testing.T) {
+	assert := testAssert.New(t)
+	col := newTestCollector()
+	col.Factory = newTestFactory(t, "rtmp://host1/app/stream{{1 5}}", "rtmp://host2/app/stream?maxConnections=1")
+	col.Factory.MaxConnectionsPerHost = 2
+	col.Factory.ReadTimeout = time.Hour
+	col.Factory.dial = func(context.Context, *net.Dialer, string, int) (rtmp.ClientConn, error) {
+		return &closableRtmpConn{fakeRtmpConn: newFakeRtmpConn(&rtmp.StreamCreatedEvent{Stream: &fakeClientStream{}})}, nil
+	}
+	limits := map[string]bitflow.Value{"host1:1935": 2, "host2:1935": 1}
+	var exceeded int32
+	openStreams := func() bitflow.Value {
+		total := bitflow.Value(0)
+		for _, host := range col.Factory.getHosts() {
+			open := host.stats.openConnections.Get()
+			if open > limits[host.host] {
+				atomic.StoreInt32(&exceeded, 1)
+			}
+			total += open
+		}
+		return total
+	}
+
+	col.SetNumberOfStreams(6)
+	assert.Eventually(func() bool { return openStreams() == 3 }, time.Second, 10*time.Millisecond)
+	for i := 0; i < 10; i++ {
+		time.Sleep(10 * time.Millisecond)
+		assert.Equal(bitflow.Value(3), openStreams())
+	}
+	assert.Equal(int32(0), atomic.LoadInt32(&exceeded), "The streams to a host exceeded its limit")
+	assert.Equal(bitflow.Value(0), col.errors.Get(), "Saturated hosts must not count as errors")
+
+	// Closed streams release their connections
+	col.SetNumberOfStreams(0)
+	assert.Equal(bitflow.Value(0), openStreams())
+	col.Factory.hostsLock.Lock()
+	connections := []int{col.Factory.hosts[0].connections, col.Factory.hosts[1].connections}
+	col.Factory.hostsLock.Unlock()
+	assert.Equal([]int{0, 0}, connections)
+	col.Close()
+}
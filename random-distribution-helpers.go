@@ -1,10 +1,14 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"math"
 	"math/rand"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 	log "github.com/sirupsen/logrus"
 )
@@ -36,6 +40,9 @@ type EqualDistribution struct {
 }
 
 func (equalDist *EqualDistribution) Sample() time.Duration {
+	if equalDist.max <= equalDist.min {
+		return equalDist.min
+	}
 	return time.Duration(rand.Int63n(int64(equalDist.max)-int64(equalDist.min)) + int64(equalDist.min))
 }
 
@@ -59,6 +66,188 @@ func (normDist *NormalDistribution) String() string {
 	return fmt.Sprintf("Normal distribution with mean %v and standard deviation %v.", normDist.mu, normDist.sigma)
 }
 
+var _ Distribution = &LogNormalDistribution{}
+
+// maxLogNormalParameter limits the log-space parameters of LogNormalDistribution. Larger values would let already the
+// median delay e^mu nanoseconds overflow a time.Duration.
+const maxLogNormalParameter = 43
+
+// LogNormalDistribution samples delays whose natural logarithm in nanoseconds is normally distributed. The parameters
+// are given in log-nanosecond space, so a mu of 20ns results in a median delay of e^20 nanoseconds.
+type LogNormalDistribution struct {
+	mu    time.Duration
+	sigma time.Duration
+}
+
+func (logNormDist *LogNormalDistribution) Sample() time.Duration {
+	value := math.Exp(rand.NormFloat64()*float64(logNormDist.sigma) + float64(logNormDist.mu))
+	// Large deviations can still overflow, clamp them to the largest duration
+	if value >= math.MaxInt64 {
+		return math.MaxInt64
+	}
+	return time.Duration(value)
+}
+
+func (logNormDist *LogNormalDistribution) String() string {
+	return fmt.Sprintf("Log-normal distribution whose logarithm of the delay in nanoseconds has mean %v and standard deviation %v "+
+		"(median delay %v).", int64(logNormDist.mu), int64(logNormDist.sigma), time.Duration(math.Exp(float64(logNormDist.mu))))
+}
+
+var _ Distribution = &ListDistribution{}
+
+type ListDistribution struct {
+	values []time.Duration
+}
+
+func (listDist *ListDistribution) Sample() time.Duration {
+	return listDist.values[rand.Intn(len(listDist.values))]
+}
+
+func (listDist *ListDistribution) String() string {
+	return fmt.Sprintf("Uniform choice from list of values: %v.", listDist.values)
+}
+
+var _ Distribution = &GammaDistribution{}
+
+type GammaDistribution struct {
+	shape float64
+	scale time.Duration
+}
+
+func (gammaDist *GammaDistribution) Sample() time.Duration {
+	return time.Duration(sampleGamma(gammaDist.shape) * float64(gammaDist.scale))
+}
+
+func (gammaDist *GammaDistribution) String() string {
+	return fmt.Sprintf("Gamma distribution with shape %v and scale %v.", gammaDist.shape, gammaDist.scale)
+}
+
+// sampleGamma draws a sample from a gamma distribution with the given shape and a scale of 1,
+// using the method of Marsaglia and Tsang. Shapes below 1 are boosted by sampling with shape+1.
+func sampleGamma(shape float64) float64 {
+	if shape < 1 {
+		return sampleGamma(shape+1) * math.Pow(rand.Float64(), 1/shape)
+	}
+	d := shape - 1.0/3.0
+	c := 1 / math.Sqrt(9*d)
+	for {
+		x := rand.NormFloat64()
+		v := 1 + c*x
+		if v <= 0 {
+			continue
+		}
+		v = v * v * v
+		u := rand.Float64()
+		if u < 1-0.0331*x*x*x*x || math.Log(u) < 0.5*x*x+d*(1-v+math.Log(v)) {
+			return d * v
+		}
+	}
+}
+
+var _ Distribution = &TriangularDistribution{}
+
+type TriangularDistribution struct {
+	min  time.Duration
+	mode time.Duration
+	max  time.Duration
+}
+
+func (triDist *TriangularDistribution) Sample() time.Duration {
+	min, mode, max := float64(triDist.min), float64(triDist.mode), float64(triDist.max)
+	if max <= min {
+		return triDist.min
+	}
+	// Inverse of the cumulative distribution function
+	var value float64
+	u := rand.Float64()
+	if u < (mode-min)/(max-min) {
+		value = min + math.Sqrt(u*(max-min)*(mode-min))
+	} else {
+		value = max - math.Sqrt((1-u)*(max-min)*(max-mode))
+	}
+	return time.Duration(math.Max(min, math.Min(max, value)))
+}
+
+func (triDist *TriangularDistribution) String() string {
+	return fmt.Sprintf("Triangular distribution between %v and %v with mode %v.", triDist.min, triDist.max, triDist.mode)
+}
+
+var _ Distribution = &MixtureDistribution{}
+
+type MixtureDistribution struct {
+	probability float64
+	first       Distribution
+	second      Distribution
+}
+
+func (mixDist *MixtureDistribution) Sample() time.Duration {
+	if rand.Float64() < mixDist.probability {
+		return mixDist.first.Sample()
+	}
+	return mixDist.second.Sample()
+}
+
+func (mixDist *MixtureDistribution) String() string {
+	return fmt.Sprintf("Mixture distribution choosing (%v) with probability %v, otherwise (%v)",
+		mixDist.first, mixDist.probability, mixDist.second)
+}
+
+const defaultFileDistributionReloadInterval = 5 * time.Second
+
+var _ Distribution = &FileDistribution{}
+
+// FileDistribution reads a distribution definition from a file and delegates to it. The file is read again
+// when sampling after the reload interval has passed, so the distribution can be changed at runtime.
+// The definition in the file must not refer to a file distribution itself, which could recurse endlessly.
+type FileDistribution struct {
+	path           string
+	reloadInterval time.Duration
+
+	lock         sync.Mutex
+	distribution Distribution
+	loaded       time.Time
+}
+
+func (fileDist *FileDistribution) Sample() time.Duration {
+	fileDist.lock.Lock()
+	if time.Since(fileDist.loaded) >= fileDist.reloadInterval {
+		if err := fileDist.loadLocked(); err != nil {
+			log.Warnf("Failed to reload distribution from file %v, keeping previous distribution (%v): %v",
+				fileDist.path, fileDist.distribution, err)
+		}
+	}
+	distribution := fileDist.distribution
+	fileDist.lock.Unlock()
+	return distribution.Sample()
+}
+
+func (fileDist *FileDistribution) String() string {
+	fileDist.lock.Lock()
+	defer fileDist.lock.Unlock()
+	return fmt.Sprintf("Distribution from file %v (reloaded every %v), currently: %v", fileDist.path, fileDist.reloadInterval, fileDist.distribution)
+}
+
+func (fileDist *FileDistribution) load() error {
+	fileDist.lock.Lock()
+	defer fileDist.lock.Unlock()
+	return fileDist.loadLocked()
+}
+
+func (fileDist *FileDistribution) loadLocked() error {
+	// Update the timestamp also in case of errors to avoid reading a broken file on every sample
+	fileDist.loaded = time.Now()
+	content, err := ioutil.ReadFile(fileDist.path)
+	if err != nil {
+		return fmt.Errorf("Failed to read distribution file %v: %v", fileDist.path, err)
+	}
+	distribution, err := parseDistributionString(strings.TrimSpace(string(content)), false)
+	if err != nil {
+		return err
+	}
+	fileDist.distribution = distribution
+	return nil
+}
+
 type DistributionSampler struct {
 	distribution Distribution
 }
@@ -72,66 +261,196 @@ func (distSampler *DistributionSampler) String() string {
 }
 
 func (distSampler *DistributionSampler) Set(value string) error {
-	formatErr := "Invalid random argument format. Please use format [const|equal|norm]:[param1, param2,...]. Reason: %v"
+	distribution, err := parseDistributionString(value, true)
+	if err != nil {
+		return err
+	}
+	distSampler.distribution = distribution
+	log.Printf("Successfully parsed distribution parameter %v. Result: %v", value, distSampler.distribution.String())
+
+	return nil
+}
+
+// parseDistributionString parses a complete distribution definition. File distributions are only allowed with allowFile.
+func parseDistributionString(value string, allowFile bool) (Distribution, error) {
+	formatErr := "Invalid random argument format. Please use format [const|equal|norm|lognorm|list|gamma|tri|mix|file]:[param1, param2,...]. Reason: %v"
 	if len(value) == 0 || !strings.Contains(value, ":") {
-		return fmt.Errorf(formatErr, "Distribution type and parameters must be devided by ':'.")
+		return nil, fmt.Errorf(formatErr, "Distribution type and parameters must be devided by ':'.")
 	}
-	typeAndParams := strings.Split(value, ":")
-	if len(typeAndParams) != 2 {
-		return fmt.Errorf(formatErr, "Missing distribution parameters.")
+	distribution, remaining, err := parseDistribution(strings.Split(value, ":"), allowFile)
+	if err != nil {
+		return nil, fmt.Errorf(formatErr, err)
 	}
-	params := strings.Split(typeAndParams[1], ",")
-	switch typeAndParams[0] { // Check the distribution type identifier
+	if len(remaining) > 0 {
+		return nil, fmt.Errorf(formatErr, fmt.Sprintf("Unexpected trailing distribution parameters: %v", strings.Join(remaining, ":")))
+	}
+	return distribution, nil
+}
+
+// parseDistribution consumes one distribution definition from the beginning of the ':'-separated tokens and
+// returns the unconsumed tokens. Nested distributions (like the children of a mixture) are parsed recursively.
+// A file distribution consumes all remaining tokens, so it must be the last part of a definition.
+func parseDistribution(tokens []string, allowFile bool) (Distribution, []string, error) {
+	if len(tokens) < 2 {
+		return nil, nil, errors.New("Missing distribution parameters.")
+	}
+	distType, rawParams, remaining := tokens[0], tokens[1], tokens[2:]
+	params := strings.Split(rawParams, ",")
+	switch distType { // Check the distribution type identifier
 	case "const": // Parse values for constant distribution
 		if len(params) != 1 {
-			return fmt.Errorf(formatErr, "Constant distribution expects exactly one parameter but got %v.", len(params))
+			return nil, nil, fmt.Errorf("Constant distribution expects exactly one parameter but got %v.", len(params))
 		}
-		if value, err := parseDuration(typeAndParams[1]); err == nil {
-			distSampler.distribution = &ConstDistribution{value: value}
-		} else {
-			return fmt.Errorf(formatErr, err)
+		value, err := parseDuration(rawParams)
+		if err != nil {
+			return nil, nil, err
 		}
+		return &ConstDistribution{value: value}, remaining, nil
 	case "equal": // Parse values for equal distribution
 		if len(params) != 2 {
-			return fmt.Errorf(formatErr, "Equal distribution expects exactly two parameters but got %v.", len(params))
-		} else {
-			min, err := parseDuration(params[0])
-			if err != nil {
-				return fmt.Errorf(formatErr, err)
-			}
-			max, err := time.ParseDuration(params[1])
-			if err != nil {
-				return fmt.Errorf(formatErr, err)
-			}
-			distSampler.distribution = &EqualDistribution{min: min, max: max}
+			return nil, nil, fmt.Errorf("Equal distribution expects exactly two parameters but got %v.", len(params))
+		}
+		min, err := parseDuration(params[0])
+		if err != nil {
+			return nil, nil, err
 		}
+		max, err := parseDuration(params[1])
+		if err != nil {
+			return nil, nil, err
+		}
+		if min > max {
+			return nil, nil, fmt.Errorf("Equal distribution requires min <= max, but got %v and %v.", min, max)
+		}
+		return &EqualDistribution{min: min, max: max}, remaining, nil
 	case "norm": // Parse values for normal distribution
 		if len(params) != 2 {
-			return fmt.Errorf(formatErr, "Normal distribution expects exactly two parameters but got %v.", len(params))
-		} else {
-			mu, err := parseDuration(params[0])
+			return nil, nil, fmt.Errorf("Normal distribution expects exactly two parameters but got %v.", len(params))
+		}
+		mu, err := parseDuration(params[0])
+		if err != nil {
+			return nil, nil, err
+		}
+		sigma, err := parseDuration(params[1])
+		if err != nil {
+			return nil, nil, err
+		}
+		return &NormalDistribution{mu: mu, sigma: sigma}, remaining, nil
+	case "lognorm": // Parse values for log-normal distribution
+		if len(params) != 2 {
+			return nil, nil, fmt.Errorf("Log-normal distribution expects exactly two parameters but got %v.", len(params))
+		}
+		mu, err := time.ParseDuration(params[0])
+		if err != nil {
+			return nil, nil, err
+		}
+		sigma, err := parseDuration(params[1])
+		if err != nil {
+			return nil, nil, err
+		}
+		if mu > maxLogNormalParameter || mu < -maxLogNormalParameter || sigma > maxLogNormalParameter {
+			return nil, nil, fmt.Errorf("Log-normal parameters are interpreted in log-nanosecond space and must be at most %vns, "+
+				"but got %v and %v (e.g. 'lognorm:20ns,1ns' results in a median delay of e^20 nanoseconds).",
+				maxLogNormalParameter, params[0], params[1])
+		}
+		return &LogNormalDistribution{mu: mu, sigma: sigma}, remaining, nil
+	case "list": // Parse values for list distribution
+		if rawParams == "" {
+			return nil, nil, errors.New("List distribution expects at least one parameter.")
+		}
+		values := make([]time.Duration, 0, len(params))
+		for _, param := range params {
+			value, err := parseDuration(param)
 			if err != nil {
-				return fmt.Errorf(formatErr, err)
+				return nil, nil, err
 			}
-			sigma, err := parseDuration(params[1])
+			values = append(values, value)
+		}
+		return &ListDistribution{values: values}, remaining, nil
+	case "gamma": // Parse values for gamma distribution
+		if len(params) != 2 {
+			return nil, nil, fmt.Errorf("Gamma distribution expects exactly two parameters but got %v.", len(params))
+		}
+		shape, err := strconv.ParseFloat(params[0], 64)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Failed to parse gamma shape '%v': %v", params[0], err)
+		}
+		if shape <= 0 {
+			return nil, nil, fmt.Errorf("Gamma shape must be positive but is %v.", shape)
+		}
+		scale, err := parseDuration(params[1])
+		if err != nil {
+			return nil, nil, err
+		}
+		return &GammaDistribution{shape: shape, scale: scale}, remaining, nil
+	case "tri": // Parse values for triangular distribution
+		if len(params) != 3 {
+			return nil, nil, fmt.Errorf("Triangular distribution expects exactly three parameters but got %v.", len(params))
+		}
+		var values [3]time.Duration
+		for i, param := range params {
+			value, err := parseDuration(param)
 			if err != nil {
-				return fmt.Errorf(formatErr, err)
+				return nil, nil, err
 			}
-			distSampler.distribution = &NormalDistribution{mu: mu, sigma: sigma}
+			values[i] = value
 		}
+		min, mode, max := values[0], values[1], values[2]
+		if min > mode || mode > max {
+			return nil, nil, fmt.Errorf("Triangular distribution requires min <= mode <= max, but got %v, %v, %v.", min, mode, max)
+		}
+		return &TriangularDistribution{min: min, mode: mode, max: max}, remaining, nil
+	case "file": // Parse path and optional reload interval of a file distribution
+		if !allowFile {
+			return nil, nil, errors.New("File distributions cannot be nested in distribution files.")
+		}
+		// The path can contain ':' and ',', only a trailing duration after the last ',' is the reload interval
+		path := strings.Join(tokens[1:], ":")
+		fileDist := &FileDistribution{reloadInterval: defaultFileDistributionReloadInterval}
+		if i := strings.LastIndex(path, ","); i >= 0 {
+			if _, err := time.ParseDuration(path[i+1:]); err == nil {
+				reloadInterval, err := parseDuration(path[i+1:])
+				if err != nil {
+					return nil, nil, err
+				}
+				path, fileDist.reloadInterval = path[:i], reloadInterval
+			}
+		}
+		if path == "" {
+			return nil, nil, errors.New("File distribution expects a file path and an optional reload interval.")
+		}
+		fileDist.path = path
+		if err := fileDist.load(); err != nil {
+			return nil, nil, err
+		}
+		return fileDist, nil, nil
+	case "mix": // Parse probability and the two child distributions of a mixture distribution
+		probability, err := strconv.ParseFloat(rawParams, 64)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Failed to parse mixture probability '%v': %v", rawParams, err)
+		}
+		if probability < 0 || probability > 1 {
+			return nil, nil, fmt.Errorf("Mixture probability must be in [0, 1] but is %v.", probability)
+		}
+		first, remaining, err := parseDistribution(remaining, allowFile)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Failed to parse first child of mixture distribution: %v", err)
+		}
+		second, remaining, err := parseDistribution(remaining, allowFile)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Failed to parse second child of mixture distribution: %v", err)
+		}
+		return &MixtureDistribution{probability: probability, first: first, second: second}, remaining, nil
 	default:
-		return fmt.Errorf(formatErr, "Unknown distribution type identifier %v.", typeAndParams[0])
+		return nil, nil, fmt.Errorf("Unknown distribution type identifier %v.", distType)
 	}
-	log.Printf("Successfully parsed distribution parameter %v. Result: %v", value, distSampler.distribution.String())
-
-	return nil
 }
 
 func parseDuration(value string) (time.Duration, error) {
 	timeValue, err := time.ParseDuration(value)
-	if err != nil && timeValue >= 0 {
+	if err != nil {
 		return -1, err
-	} else if err == nil && timeValue < 0 {
+	}
+	if timeValue < 0 {
 		return -1, fmt.Errorf("Distribution argument must be a positive time value but actually is %v", timeValue)
 	}
 	return timeValue, nil
@@ -2,6 +2,9 @@ package main
 
 import (
 	testAssert "github.com/stretchr/testify/require"
+	"io/ioutil"
+	"math"
+	"os"
 	"strconv"
 	"testing"
 	"time"
@@ -81,8 +84,210 @@ func TestNormalDistribution(t *testing.T) {
 }
 
 func TestWrongDistributionStrings(t *testing.T) {
-	wrongs := []string{ "norm:1s,", "norm:1s", "equal:10s", "const:", "cost:1ms,5s"}
+	wrongs := []string{ "norm:1s,", "norm:1s", "equal:10s", "const:", "cost:1ms,5s", "lognorm:1ns", "lognorm:1ns,"}
 	for _, w := range wrongs {
 		_ = parse(t, w, true)
 	}
 }
+
+func TestLogNormalDistribution(t *testing.T) {
+	logNormalDistStringIdentifier := "lognorm:"
+	for mu := -10; mu <= 10; mu++ {
+		for sigma := -10; sigma <= 10; sigma++ {
+			logNormDistString := logNormalDistStringIdentifier + strconv.Itoa(mu) + "ns," + strconv.Itoa(sigma) + "ns"
+			if sigma < 0 {
+				_ = parse(t, logNormDistString, true)
+			} else {
+				expected := DistributionSampler{
+					distribution: &LogNormalDistribution{
+						mu: time.Duration(mu),
+						sigma: time.Duration(sigma)},
+				}
+				actual := parse(t, logNormDistString, false)
+				compare(t, expected, actual)
+			}
+		}
+	}
+
+	// Parameters that are not in log-nanosecond space are rejected instead of overflowing
+	_ = parse(t, "lognorm:1s,100ms", true)
+	_ = parse(t, "lognorm:44ns,1ns", true)
+	_ = parse(t, "lognorm:-44ns,1ns", true)
+	_ = parse(t, "lognorm:20ns,44ns", true)
+
+	// Samples exceeding the largest duration are clamped
+	sampler := parse(t, "lognorm:43ns,43ns", false)
+	clamped := 0
+	for i := 0; i < 100; i++ {
+		sample := sampler.distribution.Sample()
+		testAssert.True(t, sample >= 0, "Negative sample %v", sample)
+		if sample == math.MaxInt64 {
+			clamped++
+		}
+	}
+	testAssert.True(t, clamped > 0)
+}
+
+func TestListDistribution(t *testing.T) {
+	assert := testAssert.New(t)
+	expected := DistributionSampler{
+		distribution: &ListDistribution{
+			values: []time.Duration{time.Second, 5 * time.Second, 30 * time.Second}},
+	}
+	actual := parse(t, "list:1s,5s,30s", false)
+	compare(t, expected, actual)
+	for i := 0; i < 100; i++ {
+		assert.Contains(expected.distribution.(*ListDistribution).values, actual.distribution.Sample())
+	}
+
+	_ = parse(t, "list:", true)
+	_ = parse(t, "list:1s,-5s,30s", true)
+}
+
+func TestMixtureDistribution(t *testing.T) {
+	assert := testAssert.New(t)
+	expected := DistributionSampler{
+		distribution: &MixtureDistribution{
+			probability: 0.8,
+			first:       &ConstDistribution{value: 100 * time.Millisecond},
+			second:      &NormalDistribution{mu: 10 * time.Second, sigma: 2 * time.Second}},
+	}
+	compare(t, expected, parse(t, "mix:0.8:const:100ms:norm:10s,2s", false))
+
+	actual := parse(t, "mix:0.8:const:1s:const:2s", false)
+	totalSamples := 100000
+	firstSamples := 0
+	for i := 0; i < totalSamples; i++ {
+		sample := actual.distribution.Sample()
+		if sample == time.Second {
+			firstSamples++
+		} else {
+			assert.Equal(2*time.Second, sample)
+		}
+	}
+	assert.InDelta(0.8, float64(firstSamples)/float64(totalSamples), 0.01)
+
+	// Nested mixtures
+	_ = parse(t, "mix:0.5:mix:0.5:const:1s:const:2s:const:3s", false)
+
+	wrongs := []string{"mix:1.5:const:1s:const:2s", "mix:-0.1:const:1s:const:2s", "mix:0.5:const:1s",
+		"mix:0.5:const:1s:const:2s:const:3s", "mix:abc:const:1s:const:2s"}
+	for _, w := range wrongs {
+		_ = parse(t, w, true)
+	}
+}
+
+func TestGammaDistribution(t *testing.T) {
+	assert := testAssert.New(t)
+	expected := DistributionSampler{
+		distribution: &GammaDistribution{shape: 2.5, scale: 100 * time.Millisecond},
+	}
+	compare(t, expected, parse(t, "gamma:2.5,100ms", false))
+
+	for _, shape := range []float64{0.5, 1, 3, 10} {
+		dist := &GammaDistribution{shape: shape, scale: time.Second}
+		totalSamples := 100000
+		var sum float64
+		for i := 0; i < totalSamples; i++ {
+			sample := dist.Sample()
+			assert.True(sample >= 0)
+			sum += sample.Seconds()
+		}
+		assert.InEpsilon(shape, sum/float64(totalSamples), 0.03, "shape %v", shape)
+	}
+
+	wrongs := []string{"gamma:0,1s", "gamma:-1,1s", "gamma:2,-1s", "gamma:2", "gamma:abc,1s"}
+	for _, w := range wrongs {
+		_ = parse(t, w, true)
+	}
+}
+
+func TestFileDistribution(t *testing.T) {
+	assert := testAssert.New(t)
+	file, err := ioutil.TempFile("", "distribution")
+	assert.NoError(err)
+	defer os.Remove(file.Name())
+	writeSpec := func(spec string) {
+		assert.NoError(ioutil.WriteFile(file.Name(), []byte(spec+"\n"), 0644))
+	}
+
+	writeSpec("const:1s")
+	reloadInterval := 50 * time.Millisecond
+	sampler := parse(t, "file:"+file.Name()+","+reloadInterval.String(), false)
+	assert.Equal(time.Second, sampler.distribution.Sample())
+
+	writeSpec("const:2s")
+	assert.Equal(time.Second, sampler.distribution.Sample(), "Reloaded before reload interval passed")
+	time.Sleep(2 * reloadInterval)
+	assert.Equal(2*time.Second, sampler.distribution.Sample())
+
+	// Invalid definitions keep the previous distribution
+	writeSpec("const:-5s,xxx")
+	time.Sleep(2 * reloadInterval)
+	assert.Equal(2*time.Second, sampler.distribution.Sample())
+
+	_ = parse(t, "file:", true)
+	_ = parse(t, "file:"+file.Name()+",-1s", true)
+	_ = parse(t, "file:"+file.Name()+".missing", true)
+
+	// Files referring to file distributions are rejected instead of recursing endlessly
+	writeSpec("file:" + file.Name())
+	_ = parse(t, "file:"+file.Name(), true)
+	writeSpec("mix:0.5:const:1s:file:" + file.Name())
+	_ = parse(t, "file:"+file.Name(), true)
+
+	// Paths can contain ':' and ','
+	dir, err := ioutil.TempDir("", "distribution")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+	path := dir + "/delay:a,b.txt"
+	assert.NoError(ioutil.WriteFile(path, []byte("const:3s\n"), 0644))
+	sampler = parse(t, "file:"+path, false)
+	assert.Equal(3*time.Second, sampler.distribution.Sample())
+	_ = parse(t, "mix:1:file:"+path+",1s:const:1s", true)
+	sampler = parse(t, "mix:1:const:1s:file:"+path+",1s", false)
+	assert.Equal(time.Second, sampler.distribution.Sample())
+	assert.Equal(time.Second, sampler.distribution.(*MixtureDistribution).second.(*FileDistribution).reloadInterval)
+}
+
+func TestTriangularDistribution(t *testing.T) {
+	assert := testAssert.New(t)
+	expected := DistributionSampler{
+		distribution: &TriangularDistribution{min: time.Second, mode: 2 * time.Second, max: 10 * time.Second},
+	}
+	compare(t, expected, parse(t, "tri:1s,2s,10s", false))
+
+	dist := expected.distribution.(*TriangularDistribution)
+	totalSamples := 100000
+	var sum float64
+	for i := 0; i < totalSamples; i++ {
+		sample := dist.Sample()
+		assert.True(sample >= dist.min && sample <= dist.max, "Sample %v out of bounds", sample)
+		sum += sample.Seconds()
+	}
+	assert.InEpsilon((1.0+2.0+10.0)/3, sum/float64(totalSamples), 0.02)
+
+	degenerate := &TriangularDistribution{min: time.Second, mode: time.Second, max: time.Second}
+	assert.Equal(time.Second, degenerate.Sample())
+
+	wrongs := []string{"tri:1s,2s", "tri:2s,1s,3s", "tri:1s,4s,3s", "tri:-1s,0s,1s", "tri:1s,2s,3s,4s"}
+	for _, w := range wrongs {
+		_ = parse(t, w, true)
+	}
+}
+
+func TestNegativeDurations(t *testing.T) {
+	negatives := []string{"equal:0s,-1s", "equal:-1s,0s", "const:-5s", "norm:-1s,1s", "norm:1s,-1s"}
+	for _, n := range negatives {
+		_ = parse(t, n, true)
+	}
+}
+
+func TestEqualDistributionBounds(t *testing.T) {
+	assert := testAssert.New(t)
+	actual := parse(t, "equal:5s,5s", false)
+	assert.NotPanics(func() {
+		assert.Equal(5*time.Second, actual.distribution.Sample())
+	})
+	_ = parse(t, "equal:5s,4s", true)
+}
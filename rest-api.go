@@ -1,11 +1,18 @@
 package main
 
 import (
+	"crypto/subtle"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"math"
+	"net"
 	"net/http"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/gorilla/mux"
 	log "github.com/sirupsen/logrus"
@@ -13,21 +20,184 @@ import (
 
 type SetUrlsRestApi struct {
 	Col *StreamStatisticsCollector
+
+	// Thresholds of the health check: the collector is healthy with at least HealthMinReceivingConnections receiving
+	// connections, or if streams are configured and the errors per second of the last sample are below HealthMaxErrorRate.
+	HealthMinReceivingConnections int     // Defaults to 1
+	HealthMaxErrorRate            float64 // A value of 0 requires receiving connections
+
+	// Number of requests per second accepted from each client, further requests are answered with 429 Too Many Requests.
+	// A value of 0 disables the limit. The health check is not limited.
+	RateLimit float64
+	limiter   *RequestLimiter
+
+	// If set, POST, PUT and DELETE requests must pass this key as bearer token in the Authorization header
+	// or as apiKey query parameter, otherwise they are rejected with 401 Unauthorized.
+	// With APIKeyForReads, GET requests also require the key. The health check never requires it.
+	// The rate limit and the key apply to all routes of the router, including the tags and file output of bitflow.
+	APIKey         string
+	APIKeyForReads bool
 }
 
 func (api *SetUrlsRestApi) Register(pathPrefix string, router *mux.Router) {
-	router.HandleFunc(pathPrefix+"/endpoints", api.handleEndpoints).Methods("GET", "POST", "PUT")
+	if api.RateLimit > 0 {
+		api.limiter = NewRequestLimiter(api.RateLimit)
+	}
+	router.Use(api.protect(pathPrefix + "/health"))
+	router.HandleFunc(pathPrefix+"/endpoints", api.handleEndpoints).Methods("GET", "POST", "PUT", "DELETE")
 	router.HandleFunc(pathPrefix+"/streams", api.handleStreams).Methods("GET", "POST", "PUT")
+	router.HandleFunc(pathPrefix+"/stats", api.handleStats).Methods("GET")
+	router.HandleFunc(pathPrefix+"/config", api.handleConfig).Methods("GET", "POST", "PUT")
+	router.HandleFunc(pathPrefix+"/pause", api.handlePause).Methods("POST")
+	router.HandleFunc(pathPrefix+"/resume", api.handleResume).Methods("POST")
+	router.HandleFunc(pathPrefix+"/health", api.handleHealth).Methods("GET")
+}
+
+// protect returns a middleware applying the RateLimit and the APIKey check to all routes except the health check.
+// As middleware, it also covers the routes registered by other APIs on the same router.
+func (api *SetUrlsRestApi) protect(healthPath string) mux.MiddlewareFunc {
+	return func(handler http.Handler) http.Handler {
+		protected := api.limit(api.authorize(handler.ServeHTTP))
+		return http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+			if req.URL.Path == healthPath {
+				handler.ServeHTTP(writer, req)
+			} else {
+				protected(writer, req)
+			}
+		})
+	}
+}
+
+// authorize wraps the handler to reject requests without the APIKey
+func (api *SetUrlsRestApi) authorize(handler http.HandlerFunc) http.HandlerFunc {
+	if api.APIKey == "" {
+		return handler
+	}
+	return func(writer http.ResponseWriter, req *http.Request) {
+		if (req.Method != "GET" || api.APIKeyForReads) && !api.hasAPIKey(req) {
+			writer.Header().Set("WWW-Authenticate", "Bearer")
+			writer.WriteHeader(http.StatusUnauthorized)
+			writer.Write([]byte("Missing or invalid API key\n"))
+			return
+		}
+		handler(writer, req)
+	}
+}
+
+func (api *SetUrlsRestApi) hasAPIKey(req *http.Request) bool {
+	key := req.URL.Query().Get("apiKey")
+	if header := req.Header.Get("Authorization"); header != "" {
+		key = strings.TrimPrefix(header, "Bearer ")
+	}
+	return subtle.ConstantTimeCompare([]byte(key), []byte(api.APIKey)) == 1
+}
+
+// limit wraps the handler to reject requests of clients exceeding the RateLimit
+func (api *SetUrlsRestApi) limit(handler http.HandlerFunc) http.HandlerFunc {
+	if api.limiter == nil {
+		return handler
+	}
+	return func(writer http.ResponseWriter, req *http.Request) {
+		if !api.limiter.Allow(requestClient(req)) {
+			writer.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(1/api.limiter.rate))))
+			writer.WriteHeader(http.StatusTooManyRequests)
+			writer.Write([]byte(fmt.Sprintf("Rate limit of %v request(s) per second exceeded\n", api.limiter.rate)))
+			return
+		}
+		handler(writer, req)
+	}
+}
+
+// requestClient returns the IP address of the client that sent the request
+func requestClient(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+// maxIdleRequestClients is the number of clients after which idle clients are forgotten, at most once per refill interval
+const maxIdleRequestClients = 1024
+
+// RequestLimiter is a token bucket per client, which allows a fixed number of requests per second. Every client
+// can send a burst of requests up to the number of requests per second, but at least one. It is safe for concurrent use.
+type RequestLimiter struct {
+	rate           float64
+	burst          float64
+	refillInterval time.Duration // Time to refill an empty bucket
+	clients        map[string]*requestBucket
+	lastPrune      time.Time // Last time idle clients were forgotten
+	lock           sync.Mutex
+	now            func() time.Time // Seam for testing, defaults to time.Now
+}
+
+type requestBucket struct {
+	tokens float64
+	last   time.Time // Last request of the client
+}
+
+func NewRequestLimiter(requestsPerSecond float64) *RequestLimiter {
+	burst := math.Max(1, math.Floor(requestsPerSecond))
+	return &RequestLimiter{
+		rate:           requestsPerSecond,
+		burst:          burst,
+		refillInterval: time.Duration(burst / requestsPerSecond * float64(time.Second)),
+		clients:        make(map[string]*requestBucket),
+	}
+}
+
+// Allow takes a token from the bucket of the given client and returns false if the bucket is empty
+func (l *RequestLimiter) Allow(client string) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	now := time.Now()
+	if l.now != nil {
+		now = l.now()
+	}
+	if len(l.clients) >= maxIdleRequestClients && now.Sub(l.lastPrune) >= l.refillInterval {
+		l.forgetIdleClients(now)
+	}
+	bucket, ok := l.clients[client]
+	if !ok {
+		bucket = &requestBucket{tokens: l.burst, last: now}
+		l.clients[client] = bucket
+	}
+	bucket.refill(now, l.rate, l.burst)
+	if bucket.tokens < 1 {
+		return false
+	}
+	bucket.tokens--
+	return true
+}
+
+// forgetIdleClients removes the clients without requests during the refill interval. Their buckets are full,
+// so they are treated like new clients.
+func (l *RequestLimiter) forgetIdleClients(now time.Time) {
+	l.lastPrune = now
+	for client, bucket := range l.clients {
+		if now.Sub(bucket.last) >= l.refillInterval {
+			delete(l.clients, client)
+		}
+	}
+}
+
+func (b *requestBucket) refill(now time.Time, rate, burst float64) {
+	b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
 }
 
 func (api *SetUrlsRestApi) handleEndpoints(writer http.ResponseWriter, req *http.Request) {
 	switch req.Method {
 	case "GET":
-		api.Col.Factory.printEndpoints(writer)
+		writer.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(writer).Encode(api.Col.Factory.EndpointInfos()); err != nil {
+			log.Errorln("Failed to send endpoint list:", err)
+		}
 	case "POST":
 		lines := api.getRequestLines(writer, req)
 		if len(lines) > 0 {
-			api.Col.Factory.hosts = nil
+			api.Col.Factory.ClearEndpoints()
 			api.appendEndpointURLs(lines, writer)
 		} else {
 			return
@@ -39,22 +209,53 @@ func (api *SetUrlsRestApi) handleEndpoints(writer http.ResponseWriter, req *http
 		} else {
 			return
 		}
+	case "DELETE":
+		lines := api.getRequestLines(writer, req)
+		if len(lines) > 0 {
+			api.removeEndpoints(lines, writer)
+		}
 	}
 }
 
-func (api *SetUrlsRestApi) appendEndpointURLs(lines []string, writer http.ResponseWriter) {
+// removeEndpoints removes endpoints by host name or URL. URL templates remove all endpoints generated from them.
+func (api *SetUrlsRestApi) removeEndpoints(lines []string, writer http.ResponseWriter) {
+	hosts := make(map[string]bool)
+	urls := make(map[string]bool)
 	for _, entry := range lines {
-		if host, endpoints, err := api.Col.Factory.ParseURLArgument(entry); err != nil {
-			host := &RtmpHost{
-				host:      host,
-				endpoints: endpoints,
+		if !strings.Contains(entry, "://") {
+			hosts[api.Col.Factory.ResolveHost(entry)] = true
+		} else if _, endpoints, err := api.Col.Factory.ParseURLArgument(entry); err == nil {
+			for _, endpoint := range endpoints {
+				urls[endpoint.url.String()] = true
 			}
-			api.Col.Factory.hosts = append(api.Col.Factory.hosts, host)
-
-			writer.Write([]byte(fmt.Sprintf("For host %v successfully added following URLs as streaming endpoints: %v", host, endpoints)))
 		} else {
+			writer.WriteHeader(http.StatusBadRequest)
+			writer.Write([]byte(fmt.Sprintf("Error handling streaming endpoint line '%v': %v\n", entry, err)))
+			return
+		}
+	}
+	removed := api.Col.Factory.RemoveEndpoints(func(endpoint *RtmpEndpoint) bool {
+		return hosts[endpoint.host.host] || urls[endpoint.url.String()]
+	})
+	writer.Write([]byte(fmt.Sprintf("Removed %v endpoint(s)\n", removed)))
+}
+
+func (api *SetUrlsRestApi) appendEndpointURLs(lines []string, writer http.ResponseWriter) {
+	for _, entry := range lines {
+		host, endpoints, err := api.Col.Factory.ParseURLArgument(entry)
+		if len(endpoints) > 0 {
+			// Endpoints might be returned in addition to an error, if only some URLs generated from a template are invalid
+			host, added := api.Col.Factory.AddEndpoints(host, endpoints)
+			if len(added) > 0 {
+				writer.Write([]byte(fmt.Sprintf("For host %v successfully added following URLs as streaming endpoints: %v\n", host, added)))
+			}
+			if skipped := len(endpoints) - len(added); skipped > 0 {
+				writer.Write([]byte(fmt.Sprintf("For host %v skipped %v URL(s) that are already defined as streaming endpoints\n", host, skipped)))
+			}
+		}
+		if err != nil {
 			log.Errorf("Error handling streaming endpoint line '%v': %v", entry, err)
-			writer.Write([]byte(fmt.Sprintf("Error handling streaming endpoint line '%v': %v", entry, err)))
+			writer.Write([]byte(fmt.Sprintf("Error handling streaming endpoint line '%v': %v\n", entry, err)))
 		}
 	}
 }
@@ -62,7 +263,16 @@ func (api *SetUrlsRestApi) appendEndpointURLs(lines []string, writer http.Respon
 func (api *SetUrlsRestApi) handleStreams(writer http.ResponseWriter, req *http.Request) {
 	switch req.Method {
 	case "GET":
-		writer.Write([]byte(fmt.Sprintf("Number of active streams: %v\n", len(api.Col.runningStreams))))
+		writer.Write([]byte(fmt.Sprintf("Number of active streams: %v\n", api.Col.NumStreams())))
+		hostCounts := api.Col.HostStreamCounts()
+		hosts := make([]string, 0, len(hostCounts))
+		for host := range hostCounts {
+			hosts = append(hosts, host)
+		}
+		sort.Strings(hosts)
+		for _, host := range hosts {
+			writer.Write([]byte(fmt.Sprintf("Number of active streams pinned to host %v: %v\n", host, hostCounts[host])))
+		}
 	case "POST", "PUT":
 		numStr := req.FormValue("num")
 		if numStr == "" {
@@ -76,9 +286,102 @@ func (api *SetUrlsRestApi) handleStreams(writer http.ResponseWriter, req *http.R
 			writer.Write([]byte(fmt.Sprintf("Failed to parse value of form/query parameter 'num' ('%v': %v)\n", numStr, err)))
 			return
 		}
-		previousNum := len(api.Col.runningStreams)
+		if host := req.FormValue("host"); host != "" {
+			// Streams pinned to 'h' and 'h:1935' must be counted for the same host
+			host = api.Col.Factory.ResolveHost(host)
+			if !api.Col.Factory.HasHost(host) {
+				writer.WriteHeader(http.StatusBadRequest)
+				writer.Write([]byte(fmt.Sprintf("Unknown host '%v'\n", host)))
+				return
+			}
+			previousNum := api.Col.HostStreamCounts()[host]
+			api.Col.SetNumberOfHostStreams(host, num)
+			writer.Write([]byte(fmt.Sprintf("Number of active streams pinned to host %v set from %v to %v\n",
+				host, previousNum, api.Col.HostStreamCounts()[host])))
+			return
+		}
+		previousNum := api.Col.NumStreams()
 		api.Col.SetNumberOfStreams(num)
-		writer.Write([]byte(fmt.Sprintf("Number of active streams set from %v to %v\n", previousNum, len(api.Col.runningStreams))))
+		writer.Write([]byte(fmt.Sprintf("Number of active streams set from %v to %v\n", previousNum, api.Col.NumStreams())))
+	}
+}
+
+func (api *SetUrlsRestApi) handleStats(writer http.ResponseWriter, _ *http.Request) {
+	writer.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(writer).Encode(api.Col.Snapshot()); err != nil {
+		log.Errorln("Failed to send statistics snapshot:", err)
+	}
+}
+
+func (api *SetUrlsRestApi) handleConfig(writer http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case "GET":
+		writer.Write([]byte(fmt.Sprintf("Restart delay: %v\n", api.Col.RestartDelay())))
+	case "POST", "PUT":
+		restartDelay := req.FormValue("restartDelay")
+		if restartDelay == "" {
+			writer.WriteHeader(http.StatusBadRequest)
+			writer.Write([]byte("Form or query parameter 'restartDelay' not defined\n"))
+			return
+		}
+		description, err := api.Col.SetRestartDelay(restartDelay)
+		if err != nil {
+			writer.WriteHeader(http.StatusBadRequest)
+			writer.Write([]byte(fmt.Sprintf("Failed to parse value of form/query parameter 'restartDelay' ('%v'): %v\n", restartDelay, err)))
+			return
+		}
+		writer.Write([]byte(fmt.Sprintf("Restart delay set to: %v\n", description)))
+	}
+}
+
+func (api *SetUrlsRestApi) handlePause(writer http.ResponseWriter, _ *http.Request) {
+	if api.Col.Pause() {
+		writer.Write([]byte("Paused all streams\n"))
+	} else {
+		writer.Write([]byte("Streams are already paused\n"))
+	}
+}
+
+func (api *SetUrlsRestApi) handleResume(writer http.ResponseWriter, _ *http.Request) {
+	if api.Col.Resume() {
+		writer.Write([]byte("Resumed streams\n"))
+	} else {
+		writer.Write([]byte("Streams are not paused\n"))
+	}
+}
+
+// HealthStatus is the response of the health check
+type HealthStatus struct {
+	Healthy              bool    `json:"healthy"`
+	TargetStreams        int     `json:"targetStreams"`
+	ReceivingConnections float64 `json:"receivingConnections"`
+	ErrorRate            float64 `json:"errorRate"`
+}
+
+// Health reports whether the collector is actually receiving data, see HealthMinReceivingConnections and HealthMaxErrorRate
+func (api *SetUrlsRestApi) Health() HealthStatus {
+	status := HealthStatus{
+		TargetStreams:        api.Col.TargetStreams(),
+		ReceivingConnections: float64(api.Col.receivingConnections.Get()),
+		ErrorRate:            api.Col.LastValue("errors/s"),
+	}
+	minReceiving := api.HealthMinReceivingConnections
+	if minReceiving < 1 {
+		minReceiving = 1
+	}
+	status.Healthy = status.ReceivingConnections >= float64(minReceiving) ||
+		(status.TargetStreams > 0 && status.ErrorRate < api.HealthMaxErrorRate)
+	return status
+}
+
+func (api *SetUrlsRestApi) handleHealth(writer http.ResponseWriter, _ *http.Request) {
+	status := api.Health()
+	writer.Header().Set("Content-Type", "application/json")
+	if !status.Healthy {
+		writer.WriteHeader(http.StatusServiceUnavailable)
+	}
+	if err := json.NewEncoder(writer).Encode(status); err != nil {
+		log.Errorln("Failed to send health status:", err)
 	}
 }
 
@@ -89,7 +392,7 @@ func (api *SetUrlsRestApi) getRequestLines(writer http.ResponseWriter, req *http
 		writer.WriteHeader(http.StatusInternalServerError)
 		return nil
 	}
-	lines := api.getStrippedLines(content)
+	lines := getStrippedLines(content)
 	if len(lines) == 0 {
 		writer.WriteHeader(http.StatusBadRequest)
 		writer.Write([]byte("Request body must define at least one non-empty URL\n"))
@@ -98,7 +401,7 @@ func (api *SetUrlsRestApi) getRequestLines(writer http.ResponseWriter, req *http
 	return lines
 }
 
-func (api *SetUrlsRestApi) getStrippedLines(content []byte) []string {
+func getStrippedLines(content []byte) []string {
 	lines := strings.Split(string(content), "\n")
 	cleanedLines := make([]string, 0, len(lines))
 	for _, line := range lines {
@@ -109,3 +412,38 @@ func (api *SetUrlsRestApi) getStrippedLines(content []byte) []string {
 	}
 	return cleanedLines
 }
+
+// PrometheusRestApi exposes the collected statistics in the Prometheus text exposition format.
+// The metrics are served at /metrics, independent of the path prefix, since that is where Prometheus scrapes by default.
+type PrometheusRestApi struct {
+	Col *StreamStatisticsCollector
+}
+
+const prometheusMetricPrefix = "stream_statistics_"
+
+func (api *PrometheusRestApi) Register(_ string, router *mux.Router) {
+	router.HandleFunc("/metrics", api.handleMetrics).Methods("GET")
+}
+
+func (api *PrometheusRestApi) handleMetrics(writer http.ResponseWriter, _ *http.Request) {
+	snapshot := api.Col.Snapshot()
+	writer.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	writeMetric := func(name, metricType, help string, value float64) {
+		name = prometheusMetricPrefix + name
+		fmt.Fprintf(writer, "# HELP %v %v\n# TYPE %v %v\n%v %v\n", name, help, name, metricType, name,
+			strconv.FormatFloat(value, 'g', -1, 64))
+	}
+	writeMetric("streams", "gauge", "Number of running stream slots.", float64(snapshot.Streams))
+	writeMetric("target_streams", "gauge", "Number of stream slots last requested.", float64(snapshot.TargetStreams))
+	writeMetric("open_connections", "gauge", "Number of currently open connections.", snapshot.OpenConnections)
+	writeMetric("receiving_connections", "gauge", "Number of open connections that received data.", snapshot.ReceivingConnections)
+	writeMetric("pixels", "gauge", "Sum of the pixels of all receiving connections.", snapshot.Pixels)
+	writeMetric("opened_total", "counter", "Total number of opened streams.", snapshot.Opened)
+	writeMetric("closed_total", "counter", "Total number of closed streams.", snapshot.Closed)
+	writeMetric("errors_total", "counter", "Total number of stream errors.", snapshot.Errors)
+	writeMetric("stalls_total", "counter", "Total number of streams closed because they stopped delivering data.", snapshot.Stalls)
+	writeMetric("bytes_total", "counter", "Total number of received bytes.", snapshot.Bytes)
+	writeMetric("packets_total", "counter", "Total number of received packets.", snapshot.Packets)
+	writeMetric("packet_delay_seconds", "gauge", "Average delay between packets during the last sample interval.",
+		api.Col.LastValue("packetDelay"))
+}
@@ -0,0 +1,581 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	rtmp "github.com/antongulenko/rtmpclient"
+	"github.com/bitflow-stream/go-bitflow/bitflow"
+	"github.com/bitflow-stream/go-bitflow/cmd"
+	"github.com/bitflow-stream/go-bitflow/steps"
+	"github.com/gorilla/mux"
+	testAssert "github.com/stretchr/testify/require"
+)
+
+func newTestRestApi(col *StreamStatisticsCollector) *mux.Router {
+	router := mux.NewRouter()
+	(&SetUrlsRestApi{Col: col}).Register("/api", router)
+	return router
+}
+
+func doRequest(router http.Handler, method string, path string, body io.Reader) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(method, path, body))
+	return recorder
+}
+
+func TestStatsHandler(t *testing.T) {
+	assert := testAssert.New(t)
+	col := &StreamStatisticsCollector{Factory: &RtmpStreamFactory{}}
+	router := newTestRestApi(col)
+
+	col.opened.Increment(3)
+	col.bytes.Increment(2000)
+	col.openConnections.Increment(2)
+	col.receivingConnections.Increment(1)
+	col.collectSample(2 * time.Second)
+	col.bytes.Increment(500)
+
+	response := doRequest(router, "GET", "/api/stats", nil)
+	assert.Equal(http.StatusOK, response.Code)
+	assert.Equal("application/json", response.Header().Get("Content-Type"))
+
+	var raw map[string]interface{}
+	assert.NoError(json.Unmarshal(response.Body.Bytes(), &raw))
+	for _, key := range []string{"streams", "openConnections", "receivingConnections", "opened", "closed",
+		"errors", "bytes", "packets", "pixels", "selections", "openResults", "rates"} {
+		assert.Contains(raw, key)
+	}
+
+	var snapshot StatisticsSnapshot
+	assert.NoError(json.Unmarshal(response.Body.Bytes(), &snapshot))
+	assert.Equal(3.0, snapshot.Opened)
+	assert.Equal(2500.0, snapshot.Bytes)
+	assert.Equal(2.0, snapshot.OpenConnections)
+	assert.Equal(1.0, snapshot.ReceivingConnections)
+	assert.Equal(1000.0, snapshot.Rates["bytes/s"])
+	assert.Equal(1.5, snapshot.Rates["opened/s"])
+}
+
+func TestStatsHandlerOpenResults(t *testing.T) {
+	assert := testAssert.New(t)
+	factory := newTestFactory(t, "rtmp://good/app/stream", "rtmp://bad/app/stream", "rtmp://flaky/app/stream", "rtmp://unused/app/stream")
+	factory.Selection = RoundRobinSelection
+	flakyAttempts := 0
+	factory.dial = func(ctx context.Context, _ *net.Dialer, dialURL string, _ int) (rtmp.ClientConn, error) {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if strings.Contains(dialURL, "bad") {
+			return nil, errors.New("Connection refused")
+		} else if strings.Contains(dialURL, "flaky") {
+			flakyAttempts++
+			if flakyAttempts%2 == 0 {
+				return nil, errors.New("Connection reset")
+			}
+		}
+		return newFakeRtmpConn(&rtmp.StreamCreatedEvent{Stream: &fakeClientStream{}}), nil
+	}
+	for _, host := range []string{"good", "bad", "flaky"} {
+		for i := 0; i < 4; i++ {
+			stream, err := factory.OpenHostStream(context.Background(), host)
+			if err == nil {
+				stream.Info().releaseConnection()
+			}
+		}
+	}
+	// Canceled attempts do not count as failures
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := factory.OpenHostStream(canceled, "good")
+	assert.Error(err)
+
+	response := doRequest(newTestRestApi(&StreamStatisticsCollector{Factory: factory}), "GET", "/api/stats", nil)
+	assert.Equal(http.StatusOK, response.Code)
+	var snapshot StatisticsSnapshot
+	assert.NoError(json.Unmarshal(response.Body.Bytes(), &snapshot))
+	assert.Equal(map[string]EndpointOpenResults{
+		"rtmp://good/app/stream":   {Opened: 4, Failed: 0, SuccessRate: 1},
+		"rtmp://bad/app/stream":    {Opened: 0, Failed: 4, SuccessRate: 0},
+		"rtmp://flaky/app/stream":  {Opened: 2, Failed: 2, SuccessRate: 0.5},
+		"rtmp://unused/app/stream": {},
+	}, snapshot.OpenResults)
+}
+
+func TestHealthHandler(t *testing.T) {
+	assert := testAssert.New(t)
+	col := newTestCollector()
+	api := &SetUrlsRestApi{Col: col}
+	router := mux.NewRouter()
+	api.Register("/api", router)
+	checkHealth := func(expectedCode int) HealthStatus {
+		response := doRequest(router, "GET", "/api/health", nil)
+		assert.Equal(expectedCode, response.Code)
+		assert.Equal("application/json", response.Header().Get("Content-Type"))
+		var status HealthStatus
+		assert.NoError(json.Unmarshal(response.Body.Bytes(), &status))
+		return status
+	}
+
+	// Nothing is received
+	assert.False(checkHealth(http.StatusServiceUnavailable).Healthy)
+	col.receivingConnections.Increment(1)
+	status := checkHealth(http.StatusOK)
+	assert.True(status.Healthy)
+	assert.Equal(1.0, status.ReceivingConnections)
+
+	api.HealthMinReceivingConnections = 2
+	assert.False(checkHealth(http.StatusServiceUnavailable).Healthy)
+	col.receivingConnections.Increment(1)
+	assert.True(checkHealth(http.StatusOK).Healthy)
+
+	// Without receiving connections, configured streams are healthy while the error rate is low
+	col.receivingConnections.Increment(-2)
+	col.targetStreams = 3
+	assert.False(checkHealth(http.StatusServiceUnavailable).Healthy, "Receiving connections must be required by default")
+	api.HealthMaxErrorRate = 5
+	col.errors.Increment(4)
+	col.collectSample(time.Second)
+	status = checkHealth(http.StatusOK)
+	assert.Equal(HealthStatus{Healthy: true, TargetStreams: 3, ErrorRate: 4}, status)
+	col.errors.Increment(10)
+	col.collectSample(time.Second)
+	assert.False(checkHealth(http.StatusServiceUnavailable).Healthy)
+	col.targetStreams = 0
+	col.collectSample(time.Second)
+	assert.False(checkHealth(http.StatusServiceUnavailable).Healthy, "Streams must be configured")
+}
+
+func TestRateLimit(t *testing.T) {
+	assert := testAssert.New(t)
+	col := newTestCollector()
+	api := &SetUrlsRestApi{Col: col, RateLimit: 2}
+	router := mux.NewRouter()
+	api.Register("/api", router)
+	(&PrometheusRestApi{Col: col}).Register("/api", router)
+	now := time.Unix(0, 0)
+	api.limiter.now = func() time.Time { return now }
+	requestFrom := func(client string) int {
+		return requestPathFrom(router, "POST", "/api/streams?num=0", client)
+	}
+	// Every client can send a burst of 2 requests
+	assert.Equal(http.StatusOK, requestFrom("10.0.0.1"))
+	assert.Equal(http.StatusOK, requestFrom("10.0.0.1"))
+	assert.Equal(http.StatusTooManyRequests, requestFrom("10.0.0.1"))
+	assert.Equal(http.StatusTooManyRequests, requestFrom("10.0.0.1"))
+	assert.Equal(http.StatusOK, requestFrom("10.0.0.2"))
+
+	// The health check is not limited
+	col.receivingConnections.Increment(1)
+	for i := 0; i < 5; i++ {
+		assert.Equal(http.StatusOK, doRequest(router, "GET", "/api/health", nil).Code)
+	}
+
+	// The Prometheus metrics share the limit with the other requests
+	assert.Equal(http.StatusOK, requestPathFrom(router, "GET", "/metrics", "10.0.0.2"))
+	assert.Equal(http.StatusTooManyRequests, requestPathFrom(router, "GET", "/metrics", "10.0.0.2"))
+
+	// Tokens are refilled over time
+	now = now.Add(500 * time.Millisecond)
+	assert.Equal(http.StatusOK, requestFrom("10.0.0.1"))
+	assert.Equal(http.StatusTooManyRequests, requestFrom("10.0.0.1"))
+	now = now.Add(time.Hour)
+	assert.Equal(http.StatusOK, requestFrom("10.0.0.1"))
+	assert.Equal(http.StatusOK, requestFrom("10.0.0.1"))
+	assert.Equal(http.StatusTooManyRequests, requestFrom("10.0.0.1"))
+
+	// Without limit, all requests are accepted
+	router = newTestRestApi(col)
+	for i := 0; i < 10; i++ {
+		assert.Equal(http.StatusOK, doRequest(router, "GET", "/api/stats", nil).Code)
+	}
+}
+
+func requestPathFrom(router *mux.Router, method, path, client string) int {
+	req := httptest.NewRequest(method, path, nil)
+	req.RemoteAddr = client + ":1234"
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, req)
+	return recorder.Code
+}
+
+func TestRequestLimiterForgetsIdleClients(t *testing.T) {
+	assert := testAssert.New(t)
+	limiter := NewRequestLimiter(0.5)
+	now := time.Unix(0, 0)
+	limiter.now = func() time.Time { return now }
+	for i := 0; i < maxIdleRequestClients; i++ {
+		assert.True(limiter.Allow(strconv.Itoa(i)))
+	}
+	assert.False(limiter.Allow("0"))
+	now = now.Add(2 * time.Second)
+	assert.True(limiter.Allow("new"))
+	assert.Len(limiter.clients, 1, "Clients with a full bucket must be forgotten")
+
+	// Idle clients are forgotten at most once per refill interval, clients with recent requests are kept
+	for i := 0; i < maxIdleRequestClients; i++ {
+		assert.True(limiter.Allow("other" + strconv.Itoa(i)))
+	}
+	now = now.Add(time.Second)
+	assert.True(limiter.Allow("recent"))
+	assert.Len(limiter.clients, maxIdleRequestClients+2)
+	now = now.Add(time.Second)
+	assert.False(limiter.Allow("recent"))
+	assert.Len(limiter.clients, 1)
+}
+
+func TestAPIKey(t *testing.T) {
+	assert := testAssert.New(t)
+	col := newTestCollector()
+	api := &SetUrlsRestApi{Col: col, APIKey: "secret"}
+	router := mux.NewRouter()
+	api.Register("/api", router)
+	request := func(method, path, authorization string) int {
+		req := httptest.NewRequest(method, path, nil)
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, req)
+		return recorder.Code
+	}
+
+	// Modifying requests require the key
+	assert.Equal(http.StatusUnauthorized, request("POST", "/api/streams?num=0", ""))
+	assert.Equal(http.StatusUnauthorized, request("POST", "/api/streams?num=0", "Bearer wrong"))
+	assert.Equal(http.StatusUnauthorized, request("POST", "/api/streams?num=0&apiKey=wrong", ""))
+	assert.Equal(http.StatusUnauthorized, request("DELETE", "/api/endpoints", ""))
+	assert.Equal(http.StatusUnauthorized, request("POST", "/api/pause", ""))
+	assert.False(col.paused)
+	assert.Equal(http.StatusOK, request("POST", "/api/streams?num=0", "Bearer secret"))
+	assert.Equal(http.StatusOK, request("POST", "/api/streams?num=0", "secret"))
+	assert.Equal(http.StatusOK, request("POST", "/api/streams?num=0&apiKey=secret", ""))
+
+	// Reading is allowed without key, unless configured otherwise
+	assert.Equal(http.StatusOK, request("GET", "/api/stats", ""))
+	router = mux.NewRouter()
+	api.APIKeyForReads = true
+	api.Register("/api", router)
+	(&PrometheusRestApi{Col: col}).Register("/api", router)
+	assert.Equal(http.StatusUnauthorized, request("GET", "/api/stats", ""))
+	assert.Equal(http.StatusOK, request("GET", "/api/stats", "Bearer secret"))
+	assert.Equal(http.StatusUnauthorized, request("GET", "/metrics", ""))
+	assert.Equal(http.StatusOK, request("GET", "/metrics", "Bearer secret"))
+
+	// The routes registered by bitflow on the same router require the key as well
+	router = mux.NewRouter()
+	api.APIKeyForReads = false
+	steps.NewHttpTagger("/api", router)
+	(&cmd.FileOutputFilterApi{}).Register("/api", router)
+	api.Register("/api", router)
+	assert.Equal(http.StatusUnauthorized, request("POST", "/api/file_output", ""))
+	assert.Equal(http.StatusUnauthorized, request("POST", "/api/tags?tag=value", ""))
+	assert.Equal(http.StatusOK, request("GET", "/api/file_output", ""))
+	assert.Equal(http.StatusOK, request("POST", "/api/tags?tag=value", "Bearer secret"))
+	assert.Equal(http.StatusServiceUnavailable, request("GET", "/api/health", ""), "The health check must not require the key")
+}
+
+func TestPrometheusMetrics(t *testing.T) {
+	assert := testAssert.New(t)
+	col := &StreamStatisticsCollector{Factory: &RtmpStreamFactory{}}
+	router := mux.NewRouter()
+	(&PrometheusRestApi{Col: col}).Register("/api", router)
+
+	col.bytes.Increment(12345)
+	col.openConnections.Increment(4)
+	col.packetDelay.Add(0.25)
+	col.collectSample(time.Second)
+
+	response := doRequest(router, "GET", "/metrics", nil)
+	assert.Equal(http.StatusOK, response.Code)
+	metrics := make(map[string]string)
+	types := make(map[string]string)
+	for _, line := range strings.Split(response.Body.String(), "\n") {
+		parts := strings.Fields(line)
+		if len(parts) == 4 && parts[1] == "TYPE" {
+			types[parts[2]] = parts[3]
+		} else if len(parts) == 2 {
+			metrics[parts[0]] = parts[1]
+		}
+	}
+	assert.Equal("12345", metrics["stream_statistics_bytes_total"])
+	assert.Equal("counter", types["stream_statistics_bytes_total"])
+	assert.Equal("4", metrics["stream_statistics_open_connections"])
+	assert.Equal("gauge", types["stream_statistics_open_connections"])
+	assert.Equal("0.25", metrics["stream_statistics_packet_delay_seconds"])
+	assert.Equal("counter", types["stream_statistics_errors_total"])
+}
+
+func TestGetEndpoints(t *testing.T) {
+	assert := testAssert.New(t)
+	factory := &RtmpStreamFactory{TimeoutDuration: time.Second}
+	router := newTestRestApi(&StreamStatisticsCollector{Factory: factory})
+
+	// The endpoints added through the REST API are returned
+	response := doRequest(router, "POST", "/api/endpoints", strings.NewReader("rtmp://host1/app/stream?pixels=100\nrtmp://host2/app/other\n"))
+	assert.Equal(http.StatusOK, response.Code)
+	response = doRequest(router, "GET", "/api/endpoints", nil)
+	assert.Equal(http.StatusOK, response.Code)
+	var endpoints []EndpointInfo
+	assert.NoError(json.Unmarshal(response.Body.Bytes(), &endpoints))
+	assert.Equal([]EndpointInfo{
+		{Host: "host1:1935", URL: "rtmp://host1/app/stream", Pixels: 100},
+		{Host: "host2:1935", URL: "rtmp://host2/app/other", Pixels: 0},
+	}, endpoints)
+}
+
+func TestDeleteEndpoints(t *testing.T) {
+	assert := testAssert.New(t)
+	factory := newTestFactory(t, "rtmp://host1/app/stream{{1 3}}", "rtmp://host2/app/other", "rtmp://host3/app/x{{1 2}}")
+	router := newTestRestApi(&StreamStatisticsCollector{Factory: factory})
+	otherHost := factory.hosts[1]
+
+	response := doRequest(router, "DELETE", "/api/endpoints", strings.NewReader("rtmp://host1/app/stream2\nhost3\n"))
+	assert.Equal(http.StatusOK, response.Code)
+	assert.Equal("Removed 3 endpoint(s)\n", response.Body.String())
+	assert.Equal([]EndpointInfo{
+		{Host: "host1:1935", URL: "rtmp://host1/app/stream1"},
+		{Host: "host1:1935", URL: "rtmp://host1/app/stream3"},
+		{Host: "host2:1935", URL: "rtmp://host2/app/other"},
+	}, factory.EndpointInfos())
+	assert.Len(factory.hosts, 2)
+	assert.Equal(otherHost, factory.hosts[1])
+
+	// Templates remove all generated endpoints, empty hosts are removed
+	response = doRequest(router, "DELETE", "/api/endpoints", strings.NewReader("rtmp://host1/app/stream{{1 3}}"))
+	assert.Equal("Removed 2 endpoint(s)\n", response.Body.String())
+	assert.Equal([]*RtmpHost{otherHost}, factory.hosts)
+
+	response = doRequest(router, "DELETE", "/api/endpoints", strings.NewReader("unknown-host"))
+	assert.Equal("Removed 0 endpoint(s)\n", response.Body.String())
+	assert.Len(factory.EndpointInfos(), 1)
+}
+
+func TestPostEndpoints(t *testing.T) {
+	assert := testAssert.New(t)
+	factory := newTestFactory(t, "rtmp://old/app/stream")
+	router := newTestRestApi(&StreamStatisticsCollector{Factory: factory})
+
+	response := doRequest(router, "POST", "/api/endpoints", strings.NewReader("rtmp://host1/app/stream\n\n  rtmp://host2/app/other?pixels=5 \n"))
+	assert.Equal(http.StatusOK, response.Code)
+	assert.Contains(response.Body.String(), "successfully added")
+	assert.NotContains(response.Body.String(), "Error")
+	assert.Equal([]EndpointInfo{
+		{Host: "host1:1935", URL: "rtmp://host1/app/stream"},
+		{Host: "host2:1935", URL: "rtmp://host2/app/other", Pixels: 5},
+	}, factory.EndpointInfos())
+	endpoint, err := factory.nextEndpoint()
+	assert.NoError(err)
+	assert.Equal("rtmp://host1/app/stream", endpoint.String())
+
+	response = doRequest(router, "PUT", "/api/endpoints", strings.NewReader("rtmp://host1/app/second"))
+	assert.Contains(response.Body.String(), "successfully added")
+	assert.Len(factory.EndpointInfos(), 3)
+	assert.Len(factory.hosts, 2)
+
+	// Existing endpoints are not added again
+	response = doRequest(router, "PUT", "/api/endpoints", strings.NewReader("rtmp://host1/app/second\nrtmp://host2/app/other?pixels=5"))
+	assert.Equal(http.StatusOK, response.Code)
+	assert.NotContains(response.Body.String(), "successfully added")
+	assert.Equal(2, strings.Count(response.Body.String(), "skipped 1 URL(s) that are already defined as streaming endpoints"))
+	assert.Len(factory.EndpointInfos(), 3)
+}
+
+func TestPostInvalidEndpoints(t *testing.T) {
+	assert := testAssert.New(t)
+	factory := newTestFactory(t)
+	router := newTestRestApi(&StreamStatisticsCollector{Factory: factory})
+
+	response := doRequest(router, "PUT", "/api/endpoints", strings.NewReader("rtmp://%zz/app/stream"))
+	assert.Contains(response.Body.String(), "Error handling streaming endpoint line")
+	assert.NotContains(response.Body.String(), "successfully added")
+	assert.Empty(factory.EndpointInfos())
+	_, err := factory.nextEndpoint()
+	assert.Equal(ErrorNoURLs, err)
+}
+
+// hostRecordingFactory selects endpoints like RtmpStreamFactory, but returns fake streams and records the selected hosts
+type hostRecordingFactory struct {
+	*RtmpStreamFactory
+	lock  sync.Mutex
+	hosts []string
+}
+
+func (f *hostRecordingFactory) OpenStream(context.Context) (Stream, error) {
+	return f.record(f.nextEndpoint())
+}
+
+func (f *hostRecordingFactory) OpenHostStream(_ context.Context, host string) (Stream, error) {
+	return f.record(f.nextHostEndpoint(host))
+}
+
+func (f *hostRecordingFactory) record(endpoint *RtmpEndpoint, err error) (Stream, error) {
+	if err != nil {
+		return nil, err
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.hosts = append(f.hosts, endpoint.host.host)
+	return newEndlessStream(endpoint, 5*time.Millisecond), nil
+}
+
+func (f *hostRecordingFactory) selectedHosts() []string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return append([]string(nil), f.hosts...)
+}
+
+func TestStreamsHandlerPerHost(t *testing.T) {
+	assert := testAssert.New(t)
+	col := newTestCollector()
+	col.Factory = newTestFactory(t, "rtmp://host1/app/stream{{1 2}}", "rtmp://host2/app/stream{{1 2}}")
+	factory := &hostRecordingFactory{RtmpStreamFactory: col.Factory}
+	col.StreamFactory = factory
+	router := newTestRestApi(col)
+	defer func() {
+		col.Close()
+		col.wg.Wait()
+	}()
+
+	response := doRequest(router, "POST", "/api/streams?num=3&host=host2", nil)
+	assert.Equal(http.StatusOK, response.Code)
+	assert.Contains(response.Body.String(), "set from 0 to 3")
+	assert.Equal(map[string]int{"host2:1935": 3}, col.HostStreamCounts())
+	assert.Equal(0, col.NumStreams())
+
+	// Streams pinned to a host keep selecting that host, also when reconnecting
+	assert.Eventually(func() bool { return len(factory.selectedHosts()) >= 3 }, time.Second, time.Millisecond)
+	for _, host := range factory.selectedHosts() {
+		assert.Equal("host2:1935", host)
+	}
+
+	// The host can be given with or without the default port
+	response = doRequest(router, "POST", "/api/streams?num=1&host=host2:1935", nil)
+	assert.Equal(http.StatusOK, response.Code)
+	assert.Contains(response.Body.String(), "set from 3 to 1")
+	assert.Equal(map[string]int{"host2:1935": 1}, col.HostStreamCounts())
+
+	response = doRequest(router, "POST", "/api/streams?num=2", nil)
+	assert.Equal(http.StatusOK, response.Code)
+	assert.Equal(2, col.NumStreams())
+	assert.Equal(map[string]int{"host2:1935": 1}, col.HostStreamCounts())
+	assert.Contains(doRequest(router, "GET", "/api/streams", nil).Body.String(), "pinned to host host2:1935: 1")
+
+	response = doRequest(router, "POST", "/api/streams?num=1&host=unknown", nil)
+	assert.Equal(http.StatusBadRequest, response.Code)
+	assert.Empty(col.HostStreamCounts()["unknown"])
+}
+
+func TestStreamsHandlerConcurrently(t *testing.T) {
+	assert := testAssert.New(t)
+	col := newTestCollector()
+	col.Factory = newTestFactory(t, "rtmp://host/app/stream")
+	col.StreamFactory = &hostRecordingFactory{RtmpStreamFactory: col.Factory}
+	router := newTestRestApi(col)
+	defer func() {
+		col.Close()
+		col.wg.Wait()
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				doRequest(router, "POST", "/api/streams?num="+strconv.Itoa((i+j)%5), nil)
+			}
+		}(i)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				doRequest(router, "GET", "/api/streams", nil)
+			}
+		}()
+	}
+	wg.Wait()
+	response := doRequest(router, "POST", "/api/streams?num=3", nil)
+	assert.Contains(response.Body.String(), "to 3")
+	assert.Equal("Number of active streams: 3\n", doRequest(router, "GET", "/api/streams", nil).Body.String())
+	assert.Equal(3, col.NumStreams())
+}
+
+func TestConfigHandlerRestartDelay(t *testing.T) {
+	assert := testAssert.New(t)
+	col := newTestCollector()
+	router := newTestRestApi(col)
+
+	response := doRequest(router, "POST", "/api/config?restartDelay=norm:10s,2s", nil)
+	assert.Equal(http.StatusOK, response.Code)
+	assert.Contains(response.Body.String(), "Normal distribution with mean 10s and standard deviation 2s")
+	assert.IsType(&NormalDistribution{}, col.DelaySampler.distribution)
+	assert.Contains(doRequest(router, "GET", "/api/config", nil).Body.String(), "Normal distribution")
+
+	response = doRequest(router, "POST", "/api/config?restartDelay=norm:10s", nil)
+	assert.Equal(http.StatusBadRequest, response.Code)
+	assert.IsType(&NormalDistribution{}, col.DelaySampler.distribution, "Invalid definitions must not replace the distribution")
+
+	response = doRequest(router, "POST", "/api/config", nil)
+	assert.Equal(http.StatusBadRequest, response.Code)
+
+	// Running streams sample the restart delay while it is replaced
+	col.StreamFactory = &fakeStreamFactory{open: func() (Stream, error) {
+		return nil, errors.New("Test error")
+	}}
+	col.SetRestartDelay("const:1ms")
+	col.SetNumberOfStreams(3)
+	for _, definition := range []string{"equal:0ms,2ms", "const:0ms", "list:1ms,2ms"} {
+		doRequest(router, "POST", "/api/config?restartDelay="+definition, nil)
+		time.Sleep(5 * time.Millisecond)
+	}
+	col.Close()
+	col.wg.Wait()
+	assert.Contains(col.RestartDelay(), "Uniform choice from list of values")
+}
+
+func TestPauseResumeHandlers(t *testing.T) {
+	assert := testAssert.New(t)
+	col := newTestCollector()
+	col.Factory = newTestFactory(t, "rtmp://host1/app/stream", "rtmp://host2/app/stream")
+	col.StreamFactory = &hostRecordingFactory{RtmpStreamFactory: col.Factory}
+	router := newTestRestApi(col)
+	defer func() {
+		col.Close()
+		col.wg.Wait()
+	}()
+	col.SetNumberOfStreams(3)
+	col.SetNumberOfHostStreams("host2", 2)
+	assert.Eventually(func() bool { return col.opened.Get() >= 5 }, time.Second, time.Millisecond)
+
+	response := doRequest(router, "POST", "/api/pause", nil)
+	assert.Equal(http.StatusOK, response.Code)
+	assert.Contains(response.Body.String(), "Paused")
+	assert.Equal(0, col.NumStreams())
+	assert.Empty(col.HostStreamCounts())
+	assert.Equal(bitflow.Value(0), col.openConnections.Get())
+	opened := col.opened.Get()
+	assert.True(opened >= 5, "Statistics must be kept while paused")
+	assert.Contains(doRequest(router, "POST", "/api/pause", nil).Body.String(), "already paused")
+
+	// Stream counts changed while paused take effect when resuming
+	col.SetNumberOfStreams(4)
+	assert.Equal(0, col.NumStreams())
+
+	response = doRequest(router, "POST", "/api/resume", nil)
+	assert.Equal(http.StatusOK, response.Code)
+	assert.Contains(response.Body.String(), "Resumed")
+	assert.Equal(4, col.NumStreams())
+	assert.Equal(map[string]int{"host2": 2}, col.HostStreamCounts())
+	assert.Eventually(func() bool { return col.opened.Get() >= opened+6 }, time.Second, time.Millisecond)
+	assert.Contains(doRequest(router, "POST", "/api/resume", nil).Body.String(), "not paused")
+}
@@ -1,42 +1,151 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
 	"math/rand"
 	"net"
+	"net/http"
 	"net/url"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/antongulenko/golib"
 
 	rtmp "github.com/antongulenko/rtmpclient"
 	log "github.com/sirupsen/logrus"
+	amf "github.com/zhangpeihao/goamf"
 )
 
 const maxRtmpChannelNumber = 100
 
+const defaultRtmpPort = "1935"
+
 var ErrorNoURLs = errors.New("No URLs available for streaming...")
 
-const urlTemplateRegexString = "{{(?P<min>[1-9][0-9]*) (?P<max>[1-9][0-9]*)}}" // {{123 456}}
+// ErrorHostsSaturated is returned when opening a stream, if all hosts with endpoints have reached their connection limit
+var ErrorHostsSaturated = errors.New("All hosts reached their maximum number of connections")
+
+// Numeric ranges like {{123 456}}, {{123 456 2}} or {{001 250}}, or token lists like {{a,b,main}}.
+// Leading zeros of the minimal value define the width of the zero-padded values.
+const urlTemplateRegexString = "{{(?:(?P<min>0*[1-9][0-9]*) (?P<max>0*[1-9][0-9]*)(?: (?P<step>[0-9]+))?|(?P<list>[^{} ]*))}}"
 
 var urlTemplateRegex = regexp.MustCompile(urlTemplateRegexString)
 
 type RtmpEndpoint struct {
-	url *url.URL
+	// Meta info about the RTMP stream. Accessed atomically, because it can be updated from the stream metadata.
+	// Must be the first field to be 64-bit aligned.
+	pixels uint64
+	// Number of times the endpoint was selected to open a stream, accessed atomically
+	selections uint64
+	// Number of streams that were opened successfully or failed to open, accessed atomically
+	opens        uint64
+	openFailures uint64
+
+	url  *url.URL
+	host *RtmpHost
+
+	// Additional parameters for the RTMP connect command, e.g. authentication tokens
+	connectParams map[string]string
+
+	// Name of the RTMP stream from the 'stream' query parameter. If empty, the last path component is the stream name.
+	streamName string
+
+	// Weight of the host from the 'hostWeight' query parameter, 0 if not defined
+	hostWeight uint
+
+	// Limit of concurrent streams to the host from the 'maxConnections' query parameter, 0 if not defined
+	maxConnections uint
+}
+
+func (e *RtmpEndpoint) String() string {
+	return e.url.String()
+}
+
+// key identifies endpoints that open the same stream, including the connect parameters that are not part of the URL.
+// Meta info like the pixels is ignored.
+func (e *RtmpEndpoint) key() string {
+	target := *e.url
+	if e.streamName != "" {
+		if urlPathPrefix, streamName, err := splitStreamName(e.url, e.streamName); err == nil {
+			target.Path = urlPathPrefix + streamName
+		}
+	}
+	key := target.String()
+	params := make([]string, 0, len(e.connectParams))
+	for param, value := range e.connectParams {
+		params = append(params, param+"="+value)
+	}
+	sort.Strings(params)
+	for _, param := range params {
+		key += " " + param
+	}
+	return key
+}
+
+// Selections returns the number of times the endpoint was selected to open a stream
+func (e *RtmpEndpoint) Selections() uint64 {
+	return atomic.LoadUint64(&e.selections)
+}
 
-	// Meta info about the RTMP stream
-	pixels uint
+// OpenResults returns the number of streams that were opened successfully and that failed to open
+func (e *RtmpEndpoint) OpenResults() (uint64, uint64) {
+	return atomic.LoadUint64(&e.opens), atomic.LoadUint64(&e.openFailures)
+}
+
+// countOpen counts the result of opening a stream. Opening streams that was canceled is not counted.
+func (e *RtmpEndpoint) countOpen(err error) {
+	if err == nil {
+		atomic.AddUint64(&e.opens, 1)
+	} else if !errors.Is(err, context.Canceled) {
+		atomic.AddUint64(&e.openFailures, 1)
+	}
+}
+
+func (e *RtmpEndpoint) Pixels() uint {
+	return uint(atomic.LoadUint64(&e.pixels))
+}
+
+// updatePixels sets the pixels of the endpoint, if they are not yet known. Returns true if the pixels were updated.
+func (e *RtmpEndpoint) updatePixels(pixels uint) bool {
+	if pixels == 0 || !atomic.CompareAndSwapUint64(&e.pixels, 0, uint64(pixels)) {
+		return false
+	}
+	if e.host != nil {
+		atomic.StoreInt32(&e.host.pixelsChanged, 1)
+	}
+	return true
 }
 
 type RtmpHost struct {
-	host      string
-	endpoints []*RtmpEndpoint
+	host            string
+	endpoints       []*RtmpEndpoint
+	endpointCounter int      // Used for RoundRobinSelection
+	pixelWeights    []uint64 // Cumulative pixels of the endpoints, used for PixelWeightedSelection. Reset when the endpoints change.
+	pixelsChanged   int32    // Set atomically when the pixels of an endpoint are updated, to recompute pixelWeights
+	weight          int      // Largest hostWeight of the endpoints, at least 1. Updated when the endpoints change.
+	currentWeight   int      // Used for the weighted selection of hosts
+	maxConnections  int      // Largest maxConnections of the endpoints, 0 if not defined. Updated when the endpoints change.
+	connections     int      // Number of selected endpoints whose streams are not yet released, see StreamInfo.releaseConnection
+	stats           HostStatistics
+}
+
+// HostStatistics are the per-host counterparts of the statistics collected by StreamStatisticsCollector
+type HostStatistics struct {
+	openConnections TwoWayCounter
+	bytes           IncrementedCounter
+	packets         IncrementedCounter
 }
 
 func (h *RtmpHost) getRandomEndpoint() *RtmpEndpoint {
@@ -45,8 +154,114 @@ func (h *RtmpHost) getRandomEndpoint() *RtmpEndpoint {
 	return h.endpoints[randomIndex]
 }
 
+func (h *RtmpHost) getRoundRobinEndpoint() *RtmpEndpoint {
+	endpoint := h.endpoints[h.endpointCounter%len(h.endpoints)]
+	h.endpointCounter++
+	return endpoint
+}
+
+// getPixelWeightedEndpoint chooses endpoints with a probability proportional to their pixels.
+// If no endpoint defines its pixels, the selection is uniformly random.
+func (h *RtmpHost) getPixelWeightedEndpoint() *RtmpEndpoint {
+	if atomic.SwapInt32(&h.pixelsChanged, 0) == 1 || len(h.pixelWeights) != len(h.endpoints) {
+		h.pixelWeights = make([]uint64, len(h.endpoints))
+		var sum uint64
+		for i, endpoint := range h.endpoints {
+			sum += uint64(endpoint.Pixels())
+			h.pixelWeights[i] = sum
+		}
+	}
+	total := h.pixelWeights[len(h.pixelWeights)-1]
+	if total == 0 {
+		return h.getRandomEndpoint()
+	}
+	value := uint64(rand.Int63n(int64(total)))
+	index := sort.Search(len(h.pixelWeights), func(i int) bool {
+		return h.pixelWeights[i] > value
+	})
+	return h.endpoints[index]
+}
+
+// getEndpoint returns false if the host has no endpoints. The selections of the returned endpoint are counted.
+func (h *RtmpHost) getEndpoint(selection EndpointSelection) (*RtmpEndpoint, bool) {
+	if len(h.endpoints) == 0 {
+		return nil, false
+	}
+	var endpoint *RtmpEndpoint
+	switch selection {
+	case RoundRobinSelection:
+		endpoint = h.getRoundRobinEndpoint()
+	case PixelWeightedSelection:
+		endpoint = h.getPixelWeightedEndpoint()
+	default:
+		endpoint = h.getRandomEndpoint()
+	}
+	atomic.AddUint64(&endpoint.selections, 1)
+	return endpoint, true
+}
+
+// EndpointSelection defines how the endpoints of a host are chosen when opening a stream
+type EndpointSelection int
+
+const (
+	RandomSelection EndpointSelection = iota
+	RoundRobinSelection
+	PixelWeightedSelection
+)
+
+var endpointSelectionNames = map[EndpointSelection]string{
+	RandomSelection:        "random",
+	RoundRobinSelection:    "round-robin",
+	PixelWeightedSelection: "pixels",
+}
+
+func (s *EndpointSelection) Set(value string) error {
+	for selection, name := range endpointSelectionNames {
+		if name == value {
+			*s = selection
+			return nil
+		}
+	}
+	return fmt.Errorf("Unknown endpoint selection '%v', must be one of: random, round-robin, pixels", value)
+}
+
+func (s *EndpointSelection) String() string {
+	if s == nil {
+		return endpointSelectionNames[RandomSelection]
+	}
+	return endpointSelectionNames[*s]
+}
+
 func (h *RtmpHost) addEndpoints(endpoints []*RtmpEndpoint) {
+	for _, endpoint := range endpoints {
+		endpoint.host = h
+	}
 	h.endpoints = append(h.endpoints, endpoints...)
+	h.pixelWeights = nil
+	h.updateWeight()
+}
+
+func (h *RtmpHost) updateWeight() {
+	h.weight = 1
+	h.maxConnections = 0
+	for _, endpoint := range h.endpoints {
+		if weight := int(endpoint.hostWeight); weight > h.weight {
+			h.weight = weight
+		}
+		if maxConnections := int(endpoint.maxConnections); maxConnections > h.maxConnections {
+			h.maxConnections = maxConnections
+		}
+	}
+}
+
+// saturated returns true if the host reached its connection limit, which defaults to the given limit.
+// Non-positive limits do not restrict the connections.
+func (h *RtmpHost) saturated(defaultLimit int) bool {
+	limit := h.maxConnections
+	if limit <= 0 {
+		limit = defaultLimit
+	}
+	return limit > 0 && h.connections >= limit
 }
 
 func (h *RtmpHost) String() string {
@@ -56,20 +271,143 @@ func (h *RtmpHost) String() string {
 type RtmpStreamFactory struct {
 	hosts       []*RtmpHost
 	hostCounter int
+	hostsLock   sync.Mutex // Protects hosts, hostCounter and the endpoints, endpointCounter and pixelWeights of each host
 
-	TimeoutDuration time.Duration
+	TimeoutDuration    time.Duration     // Timeout of all connections, unless overridden by ConnectTimeout or ReadTimeout
+	ConnectTimeout     time.Duration     // Timeout for dialing and creating RTMP streams, defaults to TimeoutDuration
+	ReadTimeout        time.Duration     // Timeout for receiving data from opened RTMP streams, defaults to TimeoutDuration
+	InsecureSkipVerify bool              // Skip the certificate verification for rtmps and https endpoints
+	Selection          EndpointSelection // Selection of the endpoint within the next host
+	TestConcurrency    int               // Number of endpoints tested in parallel by TestAllEndpointURLs, defaults to 1
+	HttpReceiveBuffer  int               // Size of the receive buffer of each HTTP download stream, see HttpStreamFactory
+	// If positive, limits the number of concurrent streams to each host, unless the 'maxConnections' query parameter is defined
+	MaxConnectionsPerHost int
+
+	insecureClient     *http.Client // Shared by the HLS and HTTP streams if InsecureSkipVerify is set
+	insecureClientOnce sync.Once
+
+	// Seams for testing, default to dialRtmp, net.Dialer.DialContext and time.Now
+	dial     func(ctx context.Context, dialer *net.Dialer, url string, maxChannelNumber int) (rtmp.ClientConn, error)
+	dialRtsp func(ctx context.Context, network, address string) (net.Conn, error)
+	now      func() time.Time
 }
 
 func (f *RtmpStreamFactory) printEndpoints(writer io.Writer) {
+	f.hostsLock.Lock()
+	defer f.hostsLock.Unlock()
 	fmt.Fprintln(writer, "Active endpoints:")
 	for i, host := range f.hosts {
 		fmt.Fprintf(writer, "\tHost %v: %v (%v endpoint(s))\n", i, host.host, len(host.endpoints))
 		for j, endpoint := range host.endpoints {
-			fmt.Fprintf(writer, "\t\tEndpoint %v (pixels: %v): %v\n", j, endpoint.pixels, endpoint.url)
+			fmt.Fprintf(writer, "\t\tEndpoint %v (pixels: %v): %v\n", j, endpoint.Pixels(), endpoint.url)
+		}
+	}
+}
+
+// EndpointInfo describes one configured streaming endpoint
+type EndpointInfo struct {
+	Host       string `json:"host"`
+	URL        string `json:"url"`
+	Pixels     uint   `json:"pixels"`
+	Selections uint64 `json:"selections"` // Number of times the endpoint was selected to open a stream
+}
+
+func (f *RtmpStreamFactory) EndpointInfos() []EndpointInfo {
+	endpoints := f.allEndpoints()
+	result := make([]EndpointInfo, len(endpoints))
+	for i, endpoint := range endpoints {
+		result[i] = EndpointInfo{
+			Host:       endpoint.host.host,
+			URL:        endpoint.url.String(),
+			Pixels:     endpoint.Pixels(),
+			Selections: endpoint.Selections(),
 		}
 	}
+	return result
 }
 
+// AddEndpoints adds the endpoints to the host with the given name, which is created if necessary.
+// Endpoints that already exist in any host are skipped. Returns the host and the endpoints that were actually added.
+func (f *RtmpStreamFactory) AddEndpoints(host string, endpoints []*RtmpEndpoint) (*RtmpHost, []*RtmpEndpoint) {
+	f.hostsLock.Lock()
+	defer f.hostsLock.Unlock()
+	existing := make(map[string]bool)
+	for _, existingHost := range f.hosts {
+		for _, endpoint := range existingHost.endpoints {
+			existing[endpoint.key()] = true
+		}
+	}
+	added := make([]*RtmpEndpoint, 0, len(endpoints))
+	for _, endpoint := range endpoints {
+		if key := endpoint.key(); !existing[key] {
+			existing[key] = true
+			added = append(added, endpoint)
+		}
+	}
+	if skipped := len(endpoints) - len(added); skipped > 0 {
+		log.Infof("Skipping %v endpoint(s) for host %v that are already defined", skipped, host)
+	}
+	rtmpHost := f.getHost(host)
+	rtmpHost.addEndpoints(added)
+	return rtmpHost, added
+}
+
+// ClearEndpoints removes all hosts and endpoints
+func (f *RtmpStreamFactory) ClearEndpoints() {
+	f.hostsLock.Lock()
+	defer f.hostsLock.Unlock()
+	f.hosts = nil
+}
+
+// RemoveEndpoints removes all endpoints matching the given function and returns the number of removed endpoints.
+// Hosts without remaining endpoints are removed as well. Streams that are already running are not affected.
+func (f *RtmpStreamFactory) RemoveEndpoints(matches func(endpoint *RtmpEndpoint) bool) int {
+	f.hostsLock.Lock()
+	defer f.hostsLock.Unlock()
+	removed := 0
+	remainingHosts := f.hosts[:0]
+	for _, host := range f.hosts {
+		remainingEndpoints := make([]*RtmpEndpoint, 0, len(host.endpoints))
+		for _, endpoint := range host.endpoints {
+			if matches(endpoint) {
+				removed++
+			} else {
+				remainingEndpoints = append(remainingEndpoints, endpoint)
+			}
+		}
+		host.endpoints = remainingEndpoints
+		host.pixelWeights = nil
+		host.updateWeight()
+		if len(remainingEndpoints) > 0 {
+			remainingHosts = append(remainingHosts, host)
+		}
+	}
+	for i := len(remainingHosts); i < len(f.hosts); i++ {
+		f.hosts[i] = nil
+	}
+	f.hosts = remainingHosts
+	return removed
+}
+
+// getHosts returns a copy of the current list of hosts
+func (f *RtmpStreamFactory) getHosts() []*RtmpHost {
+	f.hostsLock.Lock()
+	defer f.hostsLock.Unlock()
+	return append([]*RtmpHost(nil), f.hosts...)
+}
+
+// allEndpoints returns a copy of the current list of endpoints of all hosts
+func (f *RtmpStreamFactory) allEndpoints() []*RtmpEndpoint {
+	f.hostsLock.Lock()
+	defer f.hostsLock.Unlock()
+	var endpoints []*RtmpEndpoint
+	for _, host := range f.hosts {
+		endpoints = append(endpoints, host.endpoints...)
+	}
+	return endpoints
+}
+
+// getHost must be called while holding hostsLock
 func (f *RtmpStreamFactory) getHost(host string) *RtmpHost {
 	for _, existingHost := range f.hosts {
 		if existingHost.host == host {
@@ -83,17 +421,59 @@ func (f *RtmpStreamFactory) getHost(host string) *RtmpHost {
 	return newHost
 }
 
+// findHost returns the host with the given name, or nil. For hosts with the default RTMP port, the port can be omitted,
+// unless another host has the name without port. Must be called while holding hostsLock.
+func (f *RtmpStreamFactory) findHost(host string) *RtmpHost {
+	var withDefaultPort *RtmpHost
+	for _, existingHost := range f.hosts {
+		if existingHost.host == host {
+			return existingHost
+		} else if existingHost.host == net.JoinHostPort(host, defaultRtmpPort) {
+			withDefaultPort = existingHost
+		}
+	}
+	return withDefaultPort
+}
+
+// ResolveHost returns the name of the host that findHost selects for the given name, or the name itself if there is no such host
+func (f *RtmpStreamFactory) ResolveHost(host string) string {
+	f.hostsLock.Lock()
+	defer f.hostsLock.Unlock()
+	if existingHost := f.findHost(host); existingHost != nil {
+		return existingHost.host
+	}
+	return host
+}
+
+// nextEndpoint selects an endpoint of the next host in round-robin order. Hosts without endpoints are skipped,
+// so every host is tried exactly once before giving up with ErrorNoURLs.
+// If any host has a weight greater than 1, the hosts are selected proportionally to their weights instead.
+// Hosts that reached their connection limit are skipped as well. If only such hosts remain, ErrorHostsSaturated is returned.
+// The selected endpoint counts towards the connection limit of its host until releaseConnection is called.
 func (f *RtmpStreamFactory) nextEndpoint() (*RtmpEndpoint, error) {
-	for i := len(f.hosts); i >= 0; i-- {
-		if nextHost, err := f.nextHost(); err != nil {
-			return nil, ErrorNoURLs
-		} else {
-			if len(nextHost.endpoints) > 0 { // Success
-				return nextHost.getRandomEndpoint(), nil
-			}
+	f.hostsLock.Lock()
+	defer f.hostsLock.Unlock()
+	if nextHost := f.nextWeightedHost(); nextHost != nil {
+		endpoint, _ := nextHost.getEndpoint(f.Selection)
+		nextHost.connections++
+		return endpoint, nil
+	}
+	err := ErrorNoURLs
+	for range f.hosts {
+		nextHost, hostErr := f.nextHost()
+		if hostErr != nil {
+			break
+		}
+		if len(nextHost.endpoints) > 0 && nextHost.saturated(f.MaxConnectionsPerHost) {
+			err = ErrorHostsSaturated
+			continue
+		}
+		if endpoint, ok := nextHost.getEndpoint(f.Selection); ok { // Success
+			nextHost.connections++
+			return endpoint, nil
 		}
 	}
-	return nil, ErrorNoURLs
+	return nil, err
 }
 
 func (f *RtmpStreamFactory) nextHost() (*RtmpHost, error) {
@@ -106,47 +486,289 @@ func (f *RtmpStreamFactory) nextHost() (*RtmpHost, error) {
 	return nextHost, nil
 }
 
-func (f *RtmpStreamFactory) OpenStream() (*RtmpStream, error) {
+// nextWeightedHost selects one of the hosts with endpoints with the smooth weighted round-robin algorithm, which spreads
+// the selections of each host evenly. Returns nil if all hosts have the weight 1, or no host has endpoints.
+func (f *RtmpStreamFactory) nextWeightedHost() *RtmpHost {
+	weighted := false
+	for _, host := range f.hosts {
+		if host.weight > 1 {
+			weighted = true
+			break
+		}
+	}
+	if !weighted {
+		return nil
+	}
+	var selected *RtmpHost
+	totalWeight := 0
+	for _, host := range f.hosts {
+		if len(host.endpoints) == 0 || host.saturated(f.MaxConnectionsPerHost) {
+			continue
+		}
+		host.currentWeight += host.weight
+		totalWeight += host.weight
+		if selected == nil || host.currentWeight > selected.currentWeight {
+			selected = host
+		}
+	}
+	if selected != nil {
+		selected.currentWeight -= totalWeight
+	}
+	return selected
+}
+
+// nextHostEndpoint selects an endpoint of the given host. ErrorNoURLs is returned if the host is unknown or has no endpoints,
+// and ErrorHostsSaturated if the host reached its connection limit. The connection limit is handled like in nextEndpoint.
+func (f *RtmpStreamFactory) nextHostEndpoint(host string) (*RtmpEndpoint, error) {
+	f.hostsLock.Lock()
+	defer f.hostsLock.Unlock()
+	if existingHost := f.findHost(host); existingHost != nil {
+		if len(existingHost.endpoints) > 0 && existingHost.saturated(f.MaxConnectionsPerHost) {
+			return nil, ErrorHostsSaturated
+		}
+		if endpoint, ok := existingHost.getEndpoint(f.Selection); ok {
+			existingHost.connections++
+			return endpoint, nil
+		}
+	}
+	return nil, ErrorNoURLs
+}
+
+// releaseConnection frees the connection of the host of the given endpoint, which was counted when selecting the endpoint
+func (f *RtmpStreamFactory) releaseConnection(endpoint *RtmpEndpoint) {
+	f.hostsLock.Lock()
+	defer f.hostsLock.Unlock()
+	endpoint.host.connections--
+}
+
+// HasHost returns true if endpoints have been added for the given host
+func (f *RtmpStreamFactory) HasHost(host string) bool {
+	f.hostsLock.Lock()
+	defer f.hostsLock.Unlock()
+	return f.findHost(host) != nil
+}
+
+// OpenStream opens a stream to the next endpoint, see nextEndpoint. The connection to the host is counted until the
+// stream is released with StreamInfo.releaseConnection.
+func (f *RtmpStreamFactory) OpenStream(ctx context.Context) (Stream, error) {
 	rtmpEndpoint, err := f.nextEndpoint()
 	if err != nil {
 		return nil, err
 	}
-	conn, streamName, err := f.connect(rtmpEndpoint.url)
+	return f.openCountedEndpoint(ctx, rtmpEndpoint)
+}
+
+// OpenHostStream opens a stream to one of the endpoints of the given host, ignoring all other hosts
+func (f *RtmpStreamFactory) OpenHostStream(ctx context.Context, host string) (Stream, error) {
+	rtmpEndpoint, err := f.nextHostEndpoint(host)
+	if err != nil {
+		return nil, err
+	}
+	return f.openCountedEndpoint(ctx, rtmpEndpoint)
+}
+
+// openCountedEndpoint opens an endpoint selected by nextEndpoint or nextHostEndpoint and releases the connection
+// of its host when the returned stream is released, or immediately if opening fails
+func (f *RtmpStreamFactory) openCountedEndpoint(ctx context.Context, rtmpEndpoint *RtmpEndpoint) (Stream, error) {
+	stream, err := f.openEndpoint(ctx, rtmpEndpoint)
+	rtmpEndpoint.countOpen(err)
+	if err != nil {
+		f.releaseConnection(rtmpEndpoint)
+		return nil, err
+	}
+	stream.Info().release = func() {
+		f.releaseConnection(rtmpEndpoint)
+	}
+	return stream, nil
+}
+
+func (f *RtmpStreamFactory) openEndpoint(ctx context.Context, rtmpEndpoint *RtmpEndpoint) (Stream, error) {
+	if delegate := f.delegateFactory(rtmpEndpoint.url); delegate != nil {
+		return delegate.OpenEndpoint(ctx, rtmpEndpoint)
+	}
+	start := f.currentTime()
+	conn, streamName, err := f.connect(ctx, rtmpEndpoint)
 	if err != nil {
 		return nil, err
 	}
 	// Wait for the StreamCreatedEvent
-	if err := f.startStream(conn, streamName); err != nil {
+	if err := f.startStream(ctx, conn, streamName); err != nil {
 		conn.Close()
 		return nil, err
 	}
-	return &RtmpStream{
+	stream := &RtmpStream{
+		StreamInfo: StreamInfo{
+			Endpoint:       rtmpEndpoint,
+			ConnectLatency: f.currentTime().Sub(start),
+		},
 		Conn:            conn,
-		TimeoutDuration: f.TimeoutDuration,
-		Endpoint:        rtmpEndpoint,
-	}, nil
+		TimeoutDuration: f.readTimeout(),
+	}
+	if wireConn, ok := conn.(*wireClientConn); ok {
+		stream.wire = wireConn.wire
+	}
+	return stream, nil
+}
+
+// endpointOpener is implemented by the factories RtmpStreamFactory delegates non-RTMP endpoints to
+type endpointOpener interface {
+	OpenEndpoint(ctx context.Context, endpoint *RtmpEndpoint) (Stream, error)
+}
+
+// delegateFactory returns the factory responsible for the given URL, or nil if it is handled by RtmpStreamFactory itself
+func (f *RtmpStreamFactory) delegateFactory(target *url.URL) endpointOpener {
+	switch {
+	case isHlsURL(target):
+		return &HlsStreamFactory{
+			Endpoints:       f,
+			TimeoutDuration: f.TimeoutDuration,
+			Client:          f.httpClient(),
+			now:             f.now,
+		}
+	case isHttpURL(target):
+		return &HttpStreamFactory{
+			Endpoints:         f,
+			TimeoutDuration:   f.TimeoutDuration,
+			Client:            f.httpClient(),
+			ReceiveBufferSize: f.HttpReceiveBuffer,
+			now:               f.now,
+		}
+	case isRtspURL(target):
+		return &RtspStreamFactory{
+			Endpoints:       f,
+			TimeoutDuration: f.TimeoutDuration,
+			dial:            f.dialRtsp,
+			now:             f.now,
+		}
+	case isUdpURL(target):
+		return &UdpStreamFactory{
+			Endpoints:       f,
+			TimeoutDuration: f.TimeoutDuration,
+			now:             f.now,
+		}
+	case isSrtURL(target):
+		return &SrtStreamFactory{
+			Endpoints:       f,
+			TimeoutDuration: f.TimeoutDuration,
+			now:             f.now,
+		}
+	}
+	return nil
+}
+
+func (f *RtmpStreamFactory) connectTimeout() time.Duration {
+	if f.ConnectTimeout > 0 {
+		return f.ConnectTimeout
+	}
+	return f.TimeoutDuration
+}
+
+func (f *RtmpStreamFactory) readTimeout() time.Duration {
+	if f.ReadTimeout > 0 {
+		return f.ReadTimeout
+	}
+	return f.TimeoutDuration
+}
+
+// httpClient returns the client for https endpoints, which skips the certificate verification if InsecureSkipVerify is set
+func (f *RtmpStreamFactory) httpClient() *http.Client {
+	if !f.InsecureSkipVerify {
+		return http.DefaultClient
+	}
+	f.insecureClientOnce.Do(func() {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+		f.insecureClient = &http.Client{Transport: transport}
+	})
+	return f.insecureClient
+}
+
+func (f *RtmpStreamFactory) currentTime() time.Time {
+	if f.now != nil {
+		return f.now()
+	}
+	return time.Now()
 }
 
+// EndpointTestResult is the result of testing the connection to one endpoint
+type EndpointTestResult struct {
+	Host    string  `json:"host"`
+	URL     string  `json:"url"`
+	Success bool    `json:"success"`
+	Error   string  `json:"error,omitempty"`
+	Latency float64 `json:"latency"` // Seconds until the connection was opened or failed
+
+	// ErrorCategory of the failure, e.g. 'dial' if the server was not reachable or 'handshake' if the RTMP handshake failed
+	Category string `json:"category,omitempty"`
+}
+
+// TestEndpoints tries to open a connection to every endpoint, running up to TestConcurrency tests in parallel.
+// The results are returned in the order of the endpoints.
+func (f *RtmpStreamFactory) TestEndpoints() []EndpointTestResult {
+	endpoints := f.allEndpoints()
+	results := make([]EndpointTestResult, len(endpoints))
+	indices := make(chan int, len(endpoints))
+	for i := range endpoints {
+		indices <- i
+	}
+	close(indices)
+	workers := f.TestConcurrency
+	if workers < 1 {
+		workers = 1
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < workers && i < len(endpoints); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for index := range indices {
+				endpoint := endpoints[index]
+				start := f.currentTime()
+				err := f.testEndpoint(endpoint)
+				result := EndpointTestResult{
+					Host:    endpoint.host.host,
+					URL:     endpoint.url.String(),
+					Success: err == nil,
+					Latency: f.currentTime().Sub(start).Seconds(),
+				}
+				if err != nil {
+					result.Error = err.Error()
+					result.Category = categorizeError(err, ConnectError).String()
+				}
+				results[index] = result
+			}
+		}()
+	}
+	wg.Wait()
+	return results
+}
+
+// TestAllEndpointURLs tests all endpoints and returns a human readable summary
 func (f *RtmpStreamFactory) TestAllEndpointURLs() (string, error) {
-	var counter, successCounter = 0, 0
+	results := f.TestEndpoints()
+	successCounter := 0
+	categoryCounters := make(map[string]int)
 	var multiErr = golib.MultiError{}
-	for _, host := range f.hosts {
-		counter += len(host.endpoints)
-		for _, endpoint := range host.endpoints {
-			conn, _, err := f.connect(endpoint.url)
-			if err == nil {
-				successCounter++
-			} else {
-				multiErr.Add(fmt.Errorf("Failed to connect to host %v via URL %v: %v",
-					host, endpoint.url.String(), err))
-			}
-			if conn != nil {
-				conn.Close()
-			}
+	for _, result := range results {
+		if result.Success {
+			successCounter++
+		} else {
+			categoryCounters[result.Category]++
+			multiErr.Add(fmt.Errorf("Failed to connect to host %v via URL %v: %v", result.Host, result.URL, result.Error))
 		}
 	}
 	summary := fmt.Sprintf("Endpoint connection test summary: Successfully connected to %v / %v endpoints.",
-		successCounter, counter)
+		successCounter, len(results))
+	if len(categoryCounters) > 0 {
+		// Distinguish unreachable servers from servers that are reachable, but fail the handshake
+		var failures []string
+		for category := ErrorCategory(0); category < numErrorCategories; category++ {
+			if count := categoryCounters[category.String()]; count > 0 {
+				failures = append(failures, fmt.Sprintf("%v: %v", category, count))
+			}
+		}
+		summary = fmt.Sprintf("%v Failures by category: %v.", summary, strings.Join(failures, ", "))
+	}
 	err := multiErr.NilOrError()
 	if err != nil {
 		summary = fmt.Sprintf("%v\n Following errors occured:", summary)
@@ -154,13 +776,31 @@ func (f *RtmpStreamFactory) TestAllEndpointURLs() (string, error) {
 	return summary, err
 }
 
-func (f *RtmpStreamFactory) connect(target *url.URL) (rtmp.ClientConn, string, error) {
-	if target.Scheme != "rtmp" {
-		return nil, "", fmt.Errorf("URL does not have 'rtmp' scheme but '%v' scheme", target.Scheme)
+// testEndpoint opens and immediately closes a connection to the given endpoint
+func (f *RtmpStreamFactory) testEndpoint(endpoint *RtmpEndpoint) error {
+	if delegate := f.delegateFactory(endpoint.url); delegate != nil {
+		stream, err := delegate.OpenEndpoint(context.Background(), endpoint)
+		if err == nil {
+			stream.Close()
+		}
+		return err
 	}
-	urlPathPrefix, streamName := filepath.Split(target.Path)
-	if urlPathPrefix == "" || streamName == "" {
-		return nil, "", fmt.Errorf("URL path '%v' needs at least two components (have '%v' and '%v'): %v", target.Path, urlPathPrefix, streamName, target)
+	conn, _, err := f.connect(context.Background(), endpoint)
+	if conn != nil {
+		conn.Close()
+	}
+	return err
+}
+
+// connect dials the endpoint and connects to its RTMP application. Canceling the context aborts the dial and the handshake.
+func (f *RtmpStreamFactory) connect(ctx context.Context, endpoint *RtmpEndpoint) (rtmp.ClientConn, string, error) {
+	target, connectParams := endpoint.url, endpoint.connectParams
+	if target.Scheme != "rtmp" && target.Scheme != "rtmps" {
+		return nil, "", fmt.Errorf("URL does not have 'rtmp' or 'rtmps' scheme but '%v' scheme", target.Scheme)
+	}
+	urlPathPrefix, streamName, err := splitStreamName(target, endpoint.streamName)
+	if err != nil {
+		return nil, "", err
 	}
 
 	// Remove the trailing file name, because the named stream will be opened later
@@ -170,37 +810,175 @@ func (f *RtmpStreamFactory) connect(target *url.URL) (rtmp.ClientConn, string, e
 
 	// Establish connection
 	log.Debugln("Dialing RTMP URL:", dialURL)
-	conn, err := rtmp.DialWithDialer(&net.Dialer{Timeout: f.TimeoutDuration}, dialURL, maxRtmpChannelNumber)
+	dial := f.dial
+	if dial == nil {
+		dial = f.dialRtmp
+	}
+	conn, err := dial(ctx, &net.Dialer{Timeout: f.connectTimeout()}, dialURL, maxRtmpChannelNumber)
 	if err != nil {
-		return nil, "", err
+		return nil, "", categorizedError(categorizeError(err, DialError), err)
+	}
+	if len(connectParams) > 0 {
+		err = conn.Connect(connectParams)
+	} else {
+		err = conn.Connect()
 	}
-	err = conn.Connect()
 	if err != nil {
-		return nil, "", err
+		conn.Close()
+		return nil, "", categorizedError(HandshakeError, err)
 	}
 	return conn, streamName, nil
 }
 
-func (f *RtmpStreamFactory) startStream(conn rtmp.ClientConn, streamName string) error {
+// splitStreamName returns the path of the RTMP application to connect to and the name of the stream to play.
+// If the stream name is not given separately, it is the last component of the URL path.
+func splitStreamName(target *url.URL, streamName string) (string, string, error) {
+	urlPathPrefix := target.Path
+	if streamName == "" {
+		urlPathPrefix, streamName = filepath.Split(target.Path)
+	} else if urlPathPrefix != "" && !strings.HasSuffix(urlPathPrefix, "/") {
+		// The stream name is given separately, so the entire path is used to connect
+		urlPathPrefix += "/"
+	}
+	if urlPathPrefix == "" || streamName == "" {
+		return "", "", fmt.Errorf("URL path '%v' needs at least two components (have '%v' and '%v'): %v", target.Path, urlPathPrefix, streamName, target)
+	}
+	return urlPathPrefix, streamName, nil
+}
+
+// validateEndpointURL checks that the URL can be streamed by one of the supported protocols
+func validateEndpointURL(target *url.URL, streamName string) error {
+	switch {
+	case target.Scheme == "rtmp" || target.Scheme == "rtmps":
+		_, _, err := splitStreamName(target, streamName)
+		return err
+	case isHlsURL(target), isHttpURL(target), isRtspURL(target), isUdpURL(target):
+		if target.Host == "" {
+			return fmt.Errorf("URL does not define a host: %v", target)
+		}
+		return nil
+	case isSrtURL(target):
+		if target.Port() == "" {
+			return fmt.Errorf("SRT URL does not define a port: %v", target)
+		}
+		return nil
+	}
+	return fmt.Errorf("Unsupported URL scheme '%v', expected one of rtmp, rtmps, http, https, rtsp, udp or srt: %v", target.Scheme, target)
+}
+
+// dialRtmp establishes an RTMP connection, over TLS for rtmps URLs. rtmp.DialWithDialer also supports rtmps URLs, but never
+// verifies the server certificate and cannot be canceled, so the connection and the RTMP handshake are performed here instead.
+// The returned connection reports the URL with the plain 'rtmp' scheme, because rtmp.NewOutbounConn does not accept 'rtmps'.
+func (f *RtmpStreamFactory) dialRtmp(ctx context.Context, dialer *net.Dialer, dialURL string, maxChannelNumber int) (rtmp.ClientConn, error) {
+	target, err := url.Parse(dialURL)
+	if err != nil {
+		return nil, err
+	}
+	address := target.Host
+	if target.Port() == "" {
+		address = net.JoinHostPort(target.Hostname(), defaultRtmpPort)
+	}
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		// Also a timeout of the dialer is reported as DialError, instead of TimeoutError
+		return nil, categorizedError(DialError, err)
+	}
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		tcpConn.SetWriteBuffer(128 * 1024) // Same as rtmp.DialWithDialer
+	}
+	// Closing the connection aborts the handshakes
+	handshakeDone := abortOnCancel(ctx, func() { conn.Close() })
+	rtmpConn, err := f.handshake(conn, target, maxChannelNumber)
+	if canceled := handshakeDone(); canceled != nil {
+		if err == nil {
+			rtmpConn.Close()
+		}
+		return nil, canceled
+	}
+	return rtmpConn, err
+}
+
+// handshake performs the TLS handshake for rtmps URLs and the RTMP handshake. The connection is closed on errors.
+func (f *RtmpStreamFactory) handshake(conn net.Conn, target *url.URL, maxChannelNumber int) (rtmp.ClientConn, error) {
+	if target.Scheme == "rtmps" {
+		tlsConn := tls.Client(conn, &tls.Config{
+			ServerName:         target.Hostname(),
+			InsecureSkipVerify: f.InsecureSkipVerify,
+		})
+		tlsConn.SetDeadline(time.Now().Add(f.connectTimeout()))
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, categorizedError(categorizeError(err, HandshakeError), err)
+		}
+		tlsConn.SetDeadline(time.Time{})
+		conn = tlsConn
+	}
+	if err := rtmp.Handshake(conn, bufio.NewReader(conn), bufio.NewWriter(conn), f.connectTimeout()); err != nil {
+		conn.Close()
+		return nil, categorizedError(HandshakeError, err)
+	}
+	plainURL := *target
+	plainURL.Scheme = "rtmp"
+	wire := &wireConn{Conn: conn}
+	rtmpConn, err := rtmp.NewOutbounConn(wire, plainURL.String(), maxChannelNumber)
+	if err != nil {
+		conn.Close()
+		return nil, categorizedError(HandshakeError, err)
+	}
+	return &wireClientConn{ClientConn: rtmpConn, wire: wire}, nil
+}
+
+// wireConn counts the bytes read from a network connection. For RTMP connections, this includes the chunk headers and
+// the chunks of messages that are not complete yet, which are not visible in the received events.
+type wireConn struct {
+	net.Conn
+	bytes uint64 // Accessed atomically, because the connection is read by the read loop of the RTMP client
+}
+
+func (c *wireConn) Read(b []byte) (int, error) {
+	num, err := c.Conn.Read(b)
+	atomic.AddUint64(&c.bytes, uint64(num))
+	return num, err
+}
+
+// wireClientConn is an RTMP connection that counts the bytes received over its network connection
+type wireClientConn struct {
+	rtmp.ClientConn
+	wire *wireConn
+}
+
+// rtmpConnectTransactionID is the transaction ID of the connect command, which is the first command sent by rtmp.ClientConn
+const rtmpConnectTransactionID = 1
+
+// startStream waits until the server created the stream and starts playing it. Canceling the context aborts waiting.
+func (f *RtmpStreamFactory) startStream(ctx context.Context, conn rtmp.ClientConn, streamName string) error {
 	for {
 		select {
+		case <-ctx.Done():
+			return ctx.Err()
 		case msg, ok := <-conn.Events():
 			if !ok {
-				return errors.New("Stream closed early")
+				return categorizedError(EOFError, errors.New("Stream closed early"))
 			}
 			switch ev := msg.Data.(type) {
 			case *rtmp.StatusEvent:
 				log.Debugf("Updated status while creating stream (%v): %v", conn.URL(), ev.Status)
 			case *rtmp.CommandEvent:
+				if ev.Command.Name == "_error" && ev.Command.TransactionID == rtmpConnectTransactionID {
+					return categorizedError(HandshakeError, fmt.Errorf("RTMP server rejected the connection to %v: %v", conn.URL(), ev.Command.Objects))
+				}
 				log.Debugf("Ignoring unexpected event while creating stream (%v): (%T) %v", conn.URL(), ev, ev)
 			case *rtmp.StreamCreatedEvent:
 				log.Debugln("Created RTMP stream with ID", ev.Stream.ID())
-				return ev.Stream.Play(streamName, nil, nil, nil)
+				if err := ev.Stream.Play(streamName, nil, nil, nil); err != nil {
+					return categorizedError(HandshakeError, err)
+				}
+				return nil
 			default:
-				return fmt.Errorf("Unexpected event while waiting for stream creation (%v) (type %T): %v", conn.URL(), msg.Data, msg.Data)
+				return categorizedError(HandshakeError, fmt.Errorf("Unexpected event while waiting for stream creation (%v) (type %T): %v", conn.URL(), msg.Data, msg.Data))
 			}
-		case <-time.After(f.TimeoutDuration):
-			return fmt.Errorf("Timeout after %v waiting for data from %v", f.TimeoutDuration, conn.URL())
+		case <-time.After(f.connectTimeout()):
+			return categorizedError(TimeoutError, fmt.Errorf("Timeout after %v waiting for data from %v", f.connectTimeout(), conn.URL()))
 		}
 	}
 }
@@ -209,22 +987,19 @@ func (f *RtmpStreamFactory) ParseURLArgument(urlArg string) (string, []*RtmpEndp
 	var unparsedURLs []string
 	var regexInfo = fmt.Sprintf("Use regex that matches pattern '%v'", urlTemplateRegexString)
 
-	match := urlTemplateRegex.FindStringSubmatch(urlArg)
-	if match != nil { // URL is a template.
+	matches := urlTemplateRegex.FindAllStringSubmatch(urlArg, -1)
+	if matches != nil { // URL is a template.
 		log.Infof("Processing template URL %v with regex matching. (Used regex: '%v')", urlArg, urlTemplateRegexString)
 
-		min, err := strconv.Atoi(match[1])
-		if err != nil {
-			return "", nil, fmt.Errorf("Failed to parse minimal value from url %v. %v: %v", urlArg, regexInfo, err)
-		}
-		max, err := strconv.Atoi(match[2])
-		if err != nil {
-			return "", nil, fmt.Errorf("Failed to parse maximal value from url %v. %v: %v", urlArg, regexInfo, err)
-		}
-		if min > max {
-			return "", nil, fmt.Errorf("Minimal value cannot be greater than maximal value in url %v. %v.", urlArg, regexInfo)
+		placeholders := make([]urlPlaceholder, 0, len(matches))
+		for _, match := range matches {
+			placeholder, err := f.parsePlaceholder(urlArg, match, regexInfo)
+			if err != nil {
+				return "", nil, err
+			}
+			placeholders = append(placeholders, placeholder)
 		}
-		if urls, err := f.generateURLs(urlArg, match[0], min, max); err == nil {
+		if urls, err := f.generateURLs(urlArg, placeholders); err == nil {
 			unparsedURLs = append(unparsedURLs, urls...)
 		} else {
 			return "", nil, fmt.Errorf("URL generation based on template URL %v failed. %v: %v", urlArg, regexInfo, err)
@@ -243,24 +1018,62 @@ func (f *RtmpStreamFactory) ParseURLArgument(urlArg string) (string, []*RtmpEndp
 		} else {
 			log.Debugf("Parsed URL %v from URL template %v.", parsedURL.String(), urlArg)
 
-			// Take the query parameter pixels=XXX and parse it to an integer, to obtain the resolution as meta information (if available).
-			// Afterwards, delete the query parameter to fix the URL.
+			// Take the query parameter pixels=XXX or pixels=WIDTHxHEIGHT and parse it to an integer, to obtain the resolution
+			// as meta information (if available). Afterwards, delete the query parameter to fix the URL.
 			pixelsStr := parsedURL.Query().Get("pixels")
-			pixels := 0
+			var pixels uint
 			if pixelsStr != "" {
-				if parsedPixels, err := strconv.Atoi(pixelsStr); err != nil {
-					log.Errorf("URL %v contains 'pixels' query parameter, which could not be parsed to integer: %v", parsedURL, err)
+				if parsedPixels, err := parsePixels(pixelsStr); err != nil {
+					log.Warnf("URL %v contains 'pixels' query parameter, which could not be parsed: %v", parsedURL, err)
 				} else {
 					pixels = parsedPixels
 				}
 			}
+			// The query parameter hostWeight=XXX defines the share of streams opened to the host of the URL
+			var hostWeight uint
+			if weightStr := parsedURL.Query().Get("hostWeight"); weightStr != "" {
+				if parsedWeight, err := strconv.ParseUint(weightStr, 10, 32); err != nil || parsedWeight == 0 {
+					log.Warnf("URL %v contains 'hostWeight' query parameter, which is not a positive integer: %v", parsedURL, weightStr)
+				} else {
+					hostWeight = uint(parsedWeight)
+				}
+			}
+			// The query parameter maxConnections=XXX limits the concurrent streams to the host of the URL
+			var maxConnections uint
+			if maxStr := parsedURL.Query().Get("maxConnections"); maxStr != "" {
+				if parsedMax, err := strconv.ParseUint(maxStr, 10, 32); err != nil || parsedMax == 0 {
+					log.Warnf("URL %v contains 'maxConnections' query parameter, which is not a positive integer: %v", parsedURL, maxStr)
+				} else {
+					maxConnections = uint(parsedMax)
+				}
+			}
 			modifiedQuery := parsedURL.Query()
 			modifiedQuery.Del("pixels")
+			modifiedQuery.Del("hostWeight")
+			modifiedQuery.Del("maxConnections")
+
+			// For RTMP URLs, the query parameter stream=XXX overrides the stream name from the path, and all remaining
+			// query parameters are passed in the connect command. All parameters are removed from the URL.
+			var connectParams map[string]string
+			var streamName string
+			if parsedURL.Scheme == "rtmp" || parsedURL.Scheme == "rtmps" {
+				streamName = modifiedQuery.Get("stream")
+				modifiedQuery.Del("stream")
+				connectParams = extractConnectParams(modifiedQuery)
+			}
 			parsedURL.RawQuery = modifiedQuery.Encode()
+			if err := validateEndpointURL(parsedURL, streamName); err != nil {
+				multiErr.Add(err)
+				continue
+			}
 
 			endpoints = append(endpoints, &RtmpEndpoint{
-				url:    parsedURL,
-				pixels: uint(pixels),
+				url:            parsedURL,
+				pixels:         uint64(pixels),
+				connectParams:  connectParams,
+				streamName:     streamName,
+				hostWeight:     hostWeight,
+				maxConnections: maxConnections,
 			})
 		}
 	}
@@ -268,60 +1081,342 @@ func (f *RtmpStreamFactory) ParseURLArgument(urlArg string) (string, []*RtmpEndp
 	var host string
 	err := multiErr.NilOrError()
 	if len(endpoints) > 0 {
-		host = endpoints[0].url.Host
+		host = endpointHost(endpoints[0].url)
 	} else {
 		return "", nil, fmt.Errorf("Failed to parse streaming endpoint urls from template %v: %v", urlArg, err)
 	}
 	return host, endpoints, err
 }
 
-func (f *RtmpStreamFactory) generateURLs(urlArg string, toReplace string, min int, max int) ([]string, error) {
-	var urls []string
+// endpointHost returns the name of the host that the endpoint URL is grouped under. For RTMP URLs without a port,
+// the default port is added, so that the URLs with and without the explicit default port belong to the same host.
+func endpointHost(target *url.URL) string {
+	if (target.Scheme == "rtmp" || target.Scheme == "rtmps") && target.Port() == "" {
+		return net.JoinHostPort(target.Hostname(), defaultRtmpPort)
+	}
+	return target.Host
+}
 
-	if strings.Contains(urlArg, toReplace) {
-		for i := min; i <= max; i++ {
-			unparsedURL := strings.Replace(urlArg, toReplace, strconv.Itoa(i), 1)
-			urls = append(urls, unparsedURL)
+// parsePixels parses either a number of pixels or a resolution in the form WIDTHxHEIGHT, e.g. 1920x1080
+func parsePixels(value string) (uint, error) {
+	parts := strings.Split(value, "x")
+	if len(parts) > 2 {
+		return 0, fmt.Errorf("Expected number of pixels or WIDTHxHEIGHT, but got '%v'", value)
+	}
+	pixels := uint64(1)
+	for _, part := range parts {
+		factor, err := strconv.ParseUint(part, 10, 32)
+		if err != nil {
+			return 0, fmt.Errorf("Expected number of pixels or WIDTHxHEIGHT, but got '%v': %v", value, err)
+		}
+		pixels *= factor
+	}
+	return uint(pixels), nil
+}
+
+// extractConnectParams removes all parameters from the query and returns them as parameters for the RTMP connect command.
+// The rtmp library always sets the tcUrl field of the connect command object to the dialed URL, so tcUrl, swfUrl, pageUrl
+// and authentication parameters like token are all passed in one additional object argument of the connect command.
+// Only the first value of each parameter is used.
+func extractConnectParams(query url.Values) map[string]string {
+	if len(query) == 0 {
+		return nil
+	}
+	params := make(map[string]string, len(query))
+	for key, values := range query {
+		params[key] = values[0]
+		query.Del(key)
+	}
+	return params
+}
+
+// parsePlaceholder parses one match of urlTemplateRegex, which is either a numeric range or a list of tokens
+func (f *RtmpStreamFactory) parsePlaceholder(urlArg string, match []string, regexInfo string) (urlPlaceholder, error) {
+	placeholder := urlPlaceholder{toReplace: match[0]}
+	if match[1] == "" { // List template
+		tokens := strings.Split(match[4], ",")
+		for _, token := range tokens {
+			if token == "" {
+				return placeholder, fmt.Errorf("Token list %v in url %v must not contain empty tokens. %v.", match[0], urlArg, regexInfo)
+			}
+		}
+		placeholder.values = tokens
+		return placeholder, nil
+	}
+
+	min, err := strconv.Atoi(match[1])
+	if err != nil {
+		return placeholder, fmt.Errorf("Failed to parse minimal value of %v from url %v. %v: %v", match[0], urlArg, regexInfo, err)
+	}
+	max, err := strconv.Atoi(match[2])
+	if err != nil {
+		return placeholder, fmt.Errorf("Failed to parse maximal value of %v from url %v. %v: %v", match[0], urlArg, regexInfo, err)
+	}
+	if min > max {
+		return placeholder, fmt.Errorf("Minimal value cannot be greater than maximal value in %v in url %v. %v.", match[0], urlArg, regexInfo)
+	}
+	step := 1
+	if match[3] != "" {
+		step, err = strconv.Atoi(match[3])
+		if err != nil {
+			return placeholder, fmt.Errorf("Failed to parse step value of %v from url %v. %v: %v", match[0], urlArg, regexInfo, err)
+		}
+		if step <= 0 {
+			return placeholder, fmt.Errorf("Step value must be positive in %v in url %v. %v.", match[0], urlArg, regexInfo)
 		}
-	} else {
-		return nil, fmt.Errorf("URL generation failed. Template URL %v does not contain substring %v to replace.", urlArg, toReplace)
+	}
+	width := 0
+	if strings.HasPrefix(match[1], "0") {
+		width = len(match[1])
+	}
+	for i := min; i <= max; i += step {
+		placeholder.values = append(placeholder.values, fmt.Sprintf("%0*d", width, i))
+	}
+	return placeholder, nil
+}
+
+// urlPlaceholder is one template expression in a URL template, together with the values it expands to
+type urlPlaceholder struct {
+	toReplace string
+	values    []string
+}
+
+// generateURLs expands the placeholders in the order of their occurrence in the template URL.
+// The result contains one URL for every combination of placeholder values.
+func (f *RtmpStreamFactory) generateURLs(urlArg string, placeholders []urlPlaceholder) ([]string, error) {
+	if len(placeholders) == 0 {
+		return []string{urlArg}, nil
+	}
+	placeholder := placeholders[0]
+	if !strings.Contains(urlArg, placeholder.toReplace) {
+		return nil, fmt.Errorf("URL generation failed. Template URL %v does not contain substring %v to replace.", urlArg, placeholder.toReplace)
+	}
+	var urls []string
+	for _, value := range placeholder.values {
+		unparsedURL := strings.Replace(urlArg, placeholder.toReplace, value, 1)
+		generated, err := f.generateURLs(unparsedURL, placeholders[1:])
+		if err != nil {
+			return nil, err
+		}
+		urls = append(urls, generated...)
 	}
 	return urls, nil
 }
 
+// StreamFactory opens streams to the configured endpoints. It is implemented by RtmpStreamFactory, HlsStreamFactory,
+// RtspStreamFactory, HttpStreamFactory, UdpStreamFactory and SrtStreamFactory.
+// Canceling the context aborts opening the stream. Once opened, the stream is not affected by the context anymore.
+type StreamFactory interface {
+	OpenStream(ctx context.Context) (Stream, error)
+}
+
+var _ StreamFactory = &RtmpStreamFactory{}
+
+// HostStreamFactory is implemented by factories that can open streams pinned to a specific host
+type HostStreamFactory interface {
+	OpenHostStream(ctx context.Context, host string) (Stream, error)
+}
+
+var _ HostStreamFactory = &RtmpStreamFactory{}
+
+// abortOnCancel calls abort if the context is canceled before the returned function is called. It is used to interrupt
+// blocking operations while opening a stream, whose lifetime must not be bound to the context. The returned function
+// returns the error of the context if abort was called, which is then reported instead of the error of the interrupted operation.
+func abortOnCancel(ctx context.Context, abort func()) func() error {
+	if ctx.Done() == nil {
+		// The context can never be canceled
+		return func() error { return nil }
+	}
+	finished := make(chan struct{})
+	exited := make(chan struct{})
+	var aborted error
+	go func() {
+		defer close(exited)
+		select {
+		case <-ctx.Done():
+			abort()
+			aborted = ctx.Err()
+		case <-finished:
+		}
+	}()
+	return func() error {
+		close(finished)
+		<-exited
+		return aborted
+	}
+}
+
+// Stream is an opened stream that delivers data. It is implemented by RtmpStream, HlsStream, RtspStream, HttpStream,
+// UdpStream and SrtStream.
+type Stream interface {
+	Receive() (int, PacketType, error)
+	Close()
+	Info() *StreamInfo
+}
+
+var _ Stream = &RtmpStream{}
+
+// WireByteCounter is implemented by streams that count the bytes received over the network including the protocol
+// overhead, in addition to the payload sizes returned by Receive. WireBytes returns the total number of bytes received
+// since opening the stream, or false if the stream cannot count them.
+type WireByteCounter interface {
+	WireBytes() (uint64, bool)
+}
+
+// PacketLossCounter is implemented by streams that detect lost packets, e.g. through gaps in the sequence numbers.
+// LostPackets returns the total number of lost packets since opening the stream.
+type PacketLossCounter interface {
+	LostPackets() uint64
+}
+
+var _ WireByteCounter = &RtmpStream{}
+
+// StreamKind tells whether a stream is live or recorded, as reported by the server
+type StreamKind int
+
+const (
+	UnknownStream StreamKind = iota // The server did not report the kind of stream (yet)
+	LiveStream
+	RecordedStream
+)
+
+func (k StreamKind) String() string {
+	switch k {
+	case LiveStream:
+		return "live"
+	case RecordedStream:
+		return "recorded"
+	}
+	return "unknown"
+}
+
+// StreamKindReporter is implemented by streams that can tell whether they are live or recorded. The kind can change
+// while receiving, when the server reports it after the stream was opened.
+type StreamKindReporter interface {
+	StreamKind() StreamKind
+}
+
+var _ StreamKindReporter = &RtmpStream{}
+
+// PayloadReceiver is implemented by streams that keep the data of the packets they receive. Payload returns the data of
+// the packet last returned by Receive, which is only valid until the next call to Receive.
+type PayloadReceiver interface {
+	Payload() []byte
+}
+
+var _ PayloadReceiver = &RtmpStream{}
+
+// StreamInfo contains meta information about an opened stream and can be embedded by Stream implementations
+type StreamInfo struct {
+	Endpoint       *RtmpEndpoint
+	ConnectLatency time.Duration // Time from dialing until the stream was started
+
+	release func() // Frees the connection counted for the host of the endpoint, set by RtmpStreamFactory.openCountedEndpoint
+}
+
+func (info *StreamInfo) Info() *StreamInfo {
+	return info
+}
+
+// releaseConnection must be called once after closing a stream opened by a StreamFactory, so the stream no longer counts
+// towards the connection limit of its host
+func (info *StreamInfo) releaseConnection() {
+	if info.release != nil {
+		info.release()
+		info.release = nil
+	}
+}
+
+// PacketType classifies the data returned by RtmpStream.Receive
+type PacketType int
+
+const (
+	NoPacket PacketType = iota
+	AudioPacket
+	VideoPacket
+)
+
 type RtmpStream struct {
+	StreamInfo
 	Conn            rtmp.ClientConn
 	TimeoutDuration time.Duration
-	Endpoint        *RtmpEndpoint
+
+	wire *wireConn // Set if the connection was dialed by RtmpStreamFactory
+
+	// Stream state reported by the server, only accessed by Receive and StreamKind
+	begun    bool // A StreamBegin event was received
+	recorded bool // A StreamIsRecorded event was received
+
+	payload []byte // Data of the last received audio or video message
 }
 
-func (f *RtmpStream) Receive() (int, error) {
+func (f *RtmpStream) Receive() (int, PacketType, error) {
 	for {
 		select {
 		case msg, ok := <-f.Conn.Events():
 			if !ok {
-				return 0, errors.New("Stream closed early")
+				return 0, NoPacket, categorizedError(EOFError, errors.New("Stream closed early"))
 			}
 			switch ev := msg.Data.(type) {
 			case *rtmp.StatusEvent:
 				log.Debugf("Updated status while waiting for data (%v): %v", f.Conn.URL(), ev.Status)
-			case *rtmp.CommandEvent, *rtmp.StreamBegin, *rtmp.UnknownDataEvent, *rtmp.StreamIsRecorded, *rtmp.MetadataEvent:
+			case *rtmp.MetadataEvent:
+				f.handleMetadata(ev)
+			case *rtmp.StreamBegin:
+				log.Debugf("Stream began (%v)", f.Conn.URL())
+				f.begun = true
+			case *rtmp.StreamIsRecorded:
+				log.Debugf("Stream is recorded (%v)", f.Conn.URL())
+				f.recorded = true
+			case *rtmp.CommandEvent, *rtmp.UnknownDataEvent:
 				log.Debugf("Ignoring unexpected event while waiting for data (%v): (%T) %v", f.Conn.URL(), ev, ev)
 			case *rtmp.AudioEvent:
-				return int(ev.Message.Size), nil
+				f.payload = messagePayload(ev.Message)
+				return int(ev.Message.Size), AudioPacket, nil
 			case *rtmp.VideoEvent:
-				return int(ev.Message.Size), nil
+				f.payload = messagePayload(ev.Message)
+				return int(ev.Message.Size), VideoPacket, nil
 			case *rtmp.StreamEOF:
-				return 0, io.EOF
+				return 0, NoPacket, io.EOF
 			default:
-				return 0, fmt.Errorf("Unexpected event while waiting for data (%v) (type %T): %v", f.Conn.URL(), msg.Data, msg.Data)
+				return 0, NoPacket, fmt.Errorf("Unexpected event while waiting for data (%v) (type %T): %v", f.Conn.URL(), msg.Data, msg.Data)
 			}
 		case <-time.After(f.TimeoutDuration):
-			return 0, fmt.Errorf("No stream started")
+			return 0, NoPacket, categorizedError(TimeoutError, errors.New("No stream started"))
 		}
 	}
 }
 
+// StreamKind returns RecordedStream if the server reported the stream as recorded. Otherwise, streams are live after
+// the server reported the beginning of the stream.
+func (f *RtmpStream) StreamKind() StreamKind {
+	switch {
+	case f.recorded:
+		return RecordedStream
+	case f.begun:
+		return LiveStream
+	}
+	return UnknownStream
+}
+
+func (f *RtmpStream) Payload() []byte {
+	return f.payload
+}
+
+func messagePayload(message *rtmp.Message) []byte {
+	if message == nil || message.Buf == nil {
+		return nil
+	}
+	return message.Buf.Bytes()
+}
+
+func (f *RtmpStream) WireBytes() (uint64, bool) {
+	if f.wire == nil {
+		return 0, false
+	}
+	return atomic.LoadUint64(&f.wire.bytes), true
+}
+
 func (f *RtmpStream) Close() {
 	if f == nil {
 		return
@@ -330,3 +1425,40 @@ func (f *RtmpStream) Close() {
 		c.Close()
 	}
 }
+
+// handleMetadata sets the pixels of the endpoint from the resolution in the stream metadata, if they are not yet known
+func (f *RtmpStream) handleMetadata(ev *rtmp.MetadataEvent) {
+	if f.Endpoint == nil || f.Endpoint.Pixels() > 0 {
+		return
+	}
+	if pixels := metadataPixels(ev); f.Endpoint.updatePixels(pixels) {
+		log.Debugf("Obtained resolution of %v pixels from metadata of %v", pixels, f.Conn.URL())
+	}
+}
+
+// metadataPixels returns the product of the width and height fields of an onMetaData message, or 0 if they are not contained
+func metadataPixels(ev *rtmp.MetadataEvent) uint {
+	if ev.Message == nil || ev.Message.Buf == nil {
+		return 0
+	}
+	data := ev.Message.Buf.Bytes()
+	if ev.AMFVersion == rtmp.AMF3 && len(data) > 0 && data[0] == 0 {
+		// AMF3 data messages start with a format byte, followed by AMF0 values
+		data = data[1:]
+	}
+	reader := bytes.NewReader(data)
+	for reader.Len() > 0 {
+		value, err := amf.ReadValue(reader)
+		if err != nil {
+			return 0
+		}
+		if obj, ok := value.(amf.Object); ok {
+			width, _ := obj["width"].(float64)
+			height, _ := obj["height"].(float64)
+			if width > 0 && height > 0 {
+				return uint(width) * uint(height)
+			}
+		}
+	}
+	return 0
+}
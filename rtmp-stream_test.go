@@ -0,0 +1,974 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/antongulenko/golib"
+	rtmp "github.com/antongulenko/rtmpclient"
+	testAssert "github.com/stretchr/testify/require"
+	amf "github.com/zhangpeihao/goamf"
+)
+
+// fakeRtmpConn implements the parts of rtmp.ClientConn used by RtmpStream
+type fakeRtmpConn struct {
+	rtmp.ClientConn
+	events      chan rtmp.RTMPEvent
+	connectArgs []interface{}
+	closed      int32 // Set to 1 by Close, accessed atomically
+}
+
+func newFakeRtmpConn(events ...interface{}) *fakeRtmpConn {
+	conn := &fakeRtmpConn{events: make(chan rtmp.RTMPEvent, len(events))}
+	for _, event := range events {
+		conn.events <- rtmp.RTMPEvent{Data: event}
+	}
+	return conn
+}
+
+func (c *fakeRtmpConn) Events() <-chan rtmp.RTMPEvent {
+	return c.events
+}
+
+func (c *fakeRtmpConn) URL() string {
+	return "rtmp://fake/app/stream"
+}
+
+func (c *fakeRtmpConn) Close() {
+	atomic.StoreInt32(&c.closed, 1)
+}
+
+func (c *fakeRtmpConn) Connect(args ...interface{}) error {
+	c.connectArgs = args
+	return nil
+}
+
+// fakeClientStream implements the parts of rtmp.ClientStream used when starting a stream
+type fakeClientStream struct {
+	rtmp.ClientStream
+	played string
+}
+
+func (s *fakeClientStream) ID() uint32 {
+	return 1
+}
+
+func (s *fakeClientStream) Play(streamName string, _, _ *uint32, _ *bool) error {
+	s.played = streamName
+	return nil
+}
+
+// fakeDial returns a dial function for RtmpStreamFactory.dial, which returns a connection delivering the given events
+func fakeDial(events ...interface{}) func(context.Context, *net.Dialer, string, int) (rtmp.ClientConn, error) {
+	return func(context.Context, *net.Dialer, string, int) (rtmp.ClientConn, error) {
+		return newFakeRtmpConn(events...), nil
+	}
+}
+
+// fakeClock returns a time function, which advances by the given step on every call
+func fakeClock(step time.Duration) func() time.Time {
+	now := time.Unix(0, 0)
+	return func() time.Time {
+		now = now.Add(step)
+		return now
+	}
+}
+
+func newTestFactory(t *testing.T, urls ...string) *RtmpStreamFactory {
+	factory := &RtmpStreamFactory{TimeoutDuration: time.Second}
+	for _, urlArg := range urls {
+		host, endpoints, err := factory.ParseURLArgument(urlArg)
+		testAssert.NoError(t, err)
+		factory.AddEndpoints(host, endpoints)
+	}
+	return factory
+}
+
+func TestReceivePacketTypes(t *testing.T) {
+	assert := testAssert.New(t)
+	stream := &RtmpStream{
+		Conn: newFakeRtmpConn(
+			&rtmp.StreamBegin{},
+			&rtmp.AudioEvent{Message: &rtmp.Message{Size: 100}},
+			&rtmp.MetadataEvent{},
+			&rtmp.VideoEvent{Message: &rtmp.Message{Size: 2000}},
+			&rtmp.StreamEOF{}),
+		TimeoutDuration: time.Second,
+	}
+
+	num, packetType, err := stream.Receive()
+	assert.NoError(err)
+	assert.Equal(100, num)
+	assert.Equal(AudioPacket, packetType)
+
+	num, packetType, err = stream.Receive()
+	assert.NoError(err)
+	assert.Equal(2000, num)
+	assert.Equal(VideoPacket, packetType)
+
+	num, packetType, err = stream.Receive()
+	assert.Equal(io.EOF, err)
+	assert.Equal(0, num)
+	assert.Equal(NoPacket, packetType)
+}
+
+func TestStreamKind(t *testing.T) {
+	assert := testAssert.New(t)
+	live := &RtmpStream{
+		Conn: newFakeRtmpConn(
+			&rtmp.AudioEvent{Message: &rtmp.Message{Size: 100}},
+			&rtmp.StreamBegin{},
+			&rtmp.VideoEvent{Message: &rtmp.Message{Size: 200}}),
+		TimeoutDuration: time.Second,
+	}
+	assert.Equal(UnknownStream, live.StreamKind())
+	_, _, err := live.Receive()
+	assert.NoError(err)
+	assert.Equal(UnknownStream, live.StreamKind())
+	_, _, err = live.Receive()
+	assert.NoError(err)
+	assert.Equal(LiveStream, live.StreamKind())
+
+	recorded := &RtmpStream{
+		Conn: newFakeRtmpConn(
+			&rtmp.StreamBegin{},
+			&rtmp.MetadataEvent{},
+			&rtmp.StreamIsRecorded{},
+			&rtmp.VideoEvent{Message: &rtmp.Message{Size: 200}}),
+		TimeoutDuration: time.Second,
+	}
+	num, _, err := recorded.Receive()
+	assert.NoError(err)
+	assert.Equal(200, num)
+	assert.Equal(RecordedStream, recorded.StreamKind())
+	assert.Equal("recorded", recorded.StreamKind().String())
+}
+
+func TestWireBytes(t *testing.T) {
+	assert := testAssert.New(t)
+	// The connection is not closed, because the RTMP client closes its send and read loops without synchronization
+	client, server := net.Pipe()
+	wire := &wireConn{Conn: client}
+	conn, err := rtmp.NewOutbounConn(wire, "rtmp://host/app", maxRtmpChannelNumber)
+	assert.NoError(err)
+	stream := &RtmpStream{Conn: conn, TimeoutDuration: time.Second, wire: wire}
+
+	// A video message of 300 bytes is split into chunks of 128 bytes. The first chunk has a full header of 12 bytes,
+	// the continuation chunks have a header of 1 byte.
+	payload := bytes.Repeat([]byte{0xAB}, 300)
+	firstChunk := append([]byte{0x04, 0, 0, 0, 0x00, 0x01, 0x2C, rtmp.VIDEO_TYPE, 1, 0, 0, 0}, payload[:128]...)
+	secondChunk := append([]byte{0xC4}, payload[128:256]...)
+	lastChunk := append([]byte{0xC4}, payload[256:]...)
+	go func() {
+		server.Write(append(firstChunk, secondChunk...))
+	}()
+	// The incomplete message is not delivered, but its bytes are received
+	assert.Eventually(func() bool {
+		received, _ := stream.WireBytes()
+		return received == 269
+	}, time.Second, 10*time.Millisecond)
+
+	go func() {
+		server.Write(lastChunk)
+	}()
+	num, packetType, err := stream.Receive()
+	assert.NoError(err)
+	assert.Equal(300, num)
+	assert.Equal(VideoPacket, packetType)
+	received, ok := stream.WireBytes()
+	assert.True(ok)
+	assert.Equal(uint64(314), received)
+
+	// Streams with connections that were not dialed by the factory do not count
+	_, ok = (&RtmpStream{Conn: newFakeRtmpConn()}).WireBytes()
+	assert.False(ok)
+}
+
+func TestOpenStreamConnectLatency(t *testing.T) {
+	assert := testAssert.New(t)
+	factory := newTestFactory(t, "rtmp://host/app/stream")
+	clientStream := &fakeClientStream{}
+	factory.dial = fakeDial(&rtmp.StatusEvent{}, &rtmp.StreamCreatedEvent{Stream: clientStream})
+	factory.now = fakeClock(150 * time.Millisecond)
+
+	stream, err := factory.OpenStream(context.Background())
+	assert.NoError(err)
+	assert.Equal("stream", clientStream.played)
+	assert.Equal(150*time.Millisecond, stream.Info().ConnectLatency)
+
+	// No latency is measured without URLs
+	_, err = (&RtmpStreamFactory{now: func() time.Time {
+		panic("Time must not be measured without URLs")
+	}}).OpenStream(context.Background())
+	assert.Equal(ErrorNoURLs, err)
+}
+
+func TestConnectAndReadTimeout(t *testing.T) {
+	assert := testAssert.New(t)
+	factory := newTestFactory(t, "rtmp://host/app/stream")
+	factory.ConnectTimeout = 50 * time.Millisecond
+	factory.ReadTimeout = 3 * time.Second
+	var dialTimeout time.Duration
+	events := []interface{}{&rtmp.StreamCreatedEvent{Stream: &fakeClientStream{}}}
+	factory.dial = func(_ context.Context, dialer *net.Dialer, _ string, _ int) (rtmp.ClientConn, error) {
+		dialTimeout = dialer.Timeout
+		return newFakeRtmpConn(events...), nil
+	}
+
+	stream, err := factory.OpenStream(context.Background())
+	assert.NoError(err)
+	assert.Equal(50*time.Millisecond, dialTimeout)
+	assert.Equal(3*time.Second, stream.(*RtmpStream).TimeoutDuration)
+
+	// Creating the stream is part of connecting
+	events = nil
+	_, err = factory.OpenStream(context.Background())
+	assert.EqualError(err, "Timeout after 50ms waiting for data from rtmp://fake/app/stream")
+	assert.Equal(TimeoutError, categorizeError(err, DialError))
+
+	// Both timeouts default to TimeoutDuration
+	events = []interface{}{&rtmp.StreamCreatedEvent{Stream: &fakeClientStream{}}}
+	factory.ConnectTimeout, factory.ReadTimeout = 0, 0
+	stream, err = factory.OpenStream(context.Background())
+	assert.NoError(err)
+	assert.Equal(time.Second, dialTimeout)
+	assert.Equal(time.Second, stream.(*RtmpStream).TimeoutDuration)
+}
+
+func TestOpenStreamCanceled(t *testing.T) {
+	assert := testAssert.New(t)
+	// The server accepts connections, but never answers the RTMP handshake
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(err)
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	factory := newTestFactory(t, "rtmp://"+listener.Addr().String()+"/app/stream")
+	factory.ConnectTimeout = 10 * time.Second
+
+	openCanceled := func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(50*time.Millisecond, cancel)
+		start := time.Now()
+		_, err := factory.OpenStream(ctx)
+		assert.True(errors.Is(err, context.Canceled), "Unexpected error: %v", err)
+		assert.True(time.Since(start) < time.Second, "Opening the stream took %v", time.Since(start))
+	}
+	openCanceled()
+
+	// Canceling also aborts waiting for the stream to be created
+	factory.dial = fakeDial()
+	openCanceled()
+}
+
+func TestConnectSchemes(t *testing.T) {
+	assert := testAssert.New(t)
+	factory := newTestFactory(t)
+	var dialed []string
+	factory.dial = func(_ context.Context, _ *net.Dialer, dialURL string, _ int) (rtmp.ClientConn, error) {
+		dialed = append(dialed, dialURL)
+		return newFakeRtmpConn(), nil
+	}
+	for _, target := range []string{"rtmp://host/app/stream", "rtmps://host:443/app/stream"} {
+		host, endpoints, err := factory.ParseURLArgument(target)
+		assert.NoError(err)
+		factory.AddEndpoints(host, endpoints)
+	}
+	// Unsupported schemes are rejected by ParseURLArgument, but connect must not rely on that
+	ftpURL, err := url.Parse("ftp://host/app/stream")
+	assert.NoError(err)
+	factory.AddEndpoints("host", []*RtmpEndpoint{{url: ftpURL}})
+	for _, endpoint := range factory.allEndpoints() {
+		conn, streamName, err := factory.connect(context.Background(), endpoint)
+		if endpoint.url.Scheme == "ftp" {
+			assert.EqualError(err, "URL does not have 'rtmp' or 'rtmps' scheme but 'ftp' scheme")
+		} else {
+			assert.NoError(err)
+			assert.NotNil(conn)
+			assert.Equal("stream", streamName)
+		}
+	}
+	assert.Equal([]string{"rtmp://host/app/", "rtmps://host:443/app/"}, dialed)
+
+	summary, err := factory.TestAllEndpointURLs()
+	assert.Contains(summary, "Successfully connected to 2 / 3 endpoints")
+	assert.Error(err)
+}
+
+func TestStreamNameQuery(t *testing.T) {
+	assert := testAssert.New(t)
+	factory := newTestFactory(t)
+	var dialed []string
+	factory.dial = func(_ context.Context, _ *net.Dialer, dialURL string, _ int) (rtmp.ClientConn, error) {
+		dialed = append(dialed, dialURL)
+		return newFakeRtmpConn(), nil
+	}
+	for _, test := range []struct {
+		url, dialURL, streamName, err string
+	}{
+		{url: "rtmp://host/app/stream", dialURL: "rtmp://host/app/", streamName: "stream"},
+		{url: "rtmp://host/app/?stream=live_42", dialURL: "rtmp://host/app/", streamName: "live_42"},
+		{url: "rtmp://host/app/ignored?stream=live_42&token=secret", dialURL: "rtmp://host/app/ignored/", streamName: "live_42"},
+		{url: "rtmps://host/app?stream=live_42&pixels=100", dialURL: "rtmps://host/app/", streamName: "live_42"},
+		{url: "rtmp://host/app/", err: "URL path '/app/' needs at least two components (have '/app/' and ''): rtmp://host/app/"},
+		{url: "rtmp://host?stream=live_42", err: "URL path '' needs at least two components (have '' and 'live_42'): rtmp://host"},
+	} {
+		dialed = nil
+		_, endpoints, err := factory.ParseURLArgument(test.url)
+		if test.err != "" {
+			assert.Error(err)
+			assert.Contains(err.Error(), test.err)
+			assert.Empty(endpoints)
+			continue
+		}
+		assert.NoError(err)
+		assert.NotContains(endpoints[0].url.RawQuery, "stream=")
+		_, streamName, err := factory.connect(context.Background(), endpoints[0])
+		assert.NoError(err)
+		assert.Equal(test.streamName, streamName)
+		assert.Equal([]string{test.dialURL}, dialed)
+	}
+
+	// Other schemes keep the query parameter
+	_, endpoints, err := factory.ParseURLArgument("https://host/live/index.m3u8?stream=live_42")
+	assert.NoError(err)
+	assert.Equal("https://host/live/index.m3u8?stream=live_42", endpoints[0].url.String())
+}
+
+func TestAddDuplicateEndpoints(t *testing.T) {
+	assert := testAssert.New(t)
+	factory := newTestFactory(t, "rtmp://host/app/stream", "rtmp://host/app/stream")
+	assert.Len(factory.allEndpoints(), 1)
+
+	// Overlapping templates only add the missing endpoints
+	host, endpoints, err := factory.ParseURLArgument("rtmp://host/app/{{stream,other,other}}")
+	assert.NoError(err)
+	_, added := factory.AddEndpoints(host, endpoints)
+	assert.Len(added, 1)
+	assert.Equal("rtmp://host/app/other", added[0].String())
+	assert.Len(factory.allEndpoints(), 2)
+
+	// Endpoints with different connect parameters open different streams, but the pixels
+	// and the way the stream name is defined do not matter
+	for _, urlArg := range []string{"rtmp://host/app/stream?token=a", "rtmp://host/app/stream?token=b",
+		"rtmp://host/app/?stream=stream", "rtmp://host/app/stream?pixels=100"} {
+		host, endpoints, err := factory.ParseURLArgument(urlArg)
+		assert.NoError(err)
+		factory.AddEndpoints(host, endpoints)
+	}
+	assert.Len(factory.allEndpoints(), 4)
+	assert.Len(factory.hosts, 1)
+}
+
+func TestParseInvalidURLs(t *testing.T) {
+	assert := testAssert.New(t)
+	factory := newTestFactory(t)
+	for _, invalid := range []string{"ftp://host/app/stream", "rtmp://host", "rtmp://host/stream/", "host/app/stream", "http:///live/index.m3u8"} {
+		_, endpoints, err := factory.ParseURLArgument(invalid)
+		assert.Error(err, invalid)
+		assert.Empty(endpoints, invalid)
+	}
+	_, _, err := factory.ParseURLArgument("ftp://host/app/stream")
+	assert.Contains(err.Error(), "Unsupported URL scheme 'ftp'")
+
+	// Templates only drop the invalid URLs
+	host, endpoints, err := factory.ParseURLArgument("{{rtmp,ftp}}://host/app/stream")
+	assert.Error(err)
+	assert.Equal("host:1935", host)
+	assert.Len(endpoints, 1)
+	assert.Equal("rtmp://host/app/stream", endpoints[0].String())
+	for _, valid := range []string{"rtmp://host/stream", "https://host/video.mp4", "rtsp://host/live", "udp://239.0.0.1:5004"} {
+		_, _, err := factory.ParseURLArgument(valid)
+		assert.NoError(err, valid)
+	}
+}
+
+func TestEndpointSelectionCounts(t *testing.T) {
+	assert := testAssert.New(t)
+	factory := newTestFactory(t, "rtmp://host1/app/stream{{1 3}}", "rtmp://host2/app/stream{{1 3}}")
+	factory.dial = func(context.Context, *net.Dialer, string, int) (rtmp.ClientConn, error) {
+		return newFakeRtmpConn(&rtmp.StreamCreatedEvent{Stream: &fakeClientStream{}}), nil
+	}
+	const numGoroutines, numOpens = 8, 25
+	var wg sync.WaitGroup
+	var failures int32
+	for i := 0; i < numGoroutines; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < numOpens; j++ {
+				if _, err := factory.OpenStream(context.Background()); err != nil {
+					atomic.AddInt32(&failures, 1)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(int32(0), failures)
+	_, err := factory.OpenHostStream(context.Background(), "host2")
+	assert.NoError(err)
+
+	hostSelections := make(map[string]uint64)
+	for _, info := range factory.EndpointInfos() {
+		hostSelections[info.Host] += info.Selections
+	}
+	assert.Equal(map[string]uint64{"host1:1935": numGoroutines * numOpens / 2, "host2:1935": numGoroutines*numOpens/2 + 1}, hostSelections)
+
+	col := &StreamStatisticsCollector{Factory: factory}
+	var total uint64
+	for _, selections := range col.Snapshot().Selections {
+		total += selections
+	}
+	assert.Equal(uint64(numGoroutines*numOpens+1), total)
+}
+
+// closingTcpListener accepts TCP connections and closes them immediately, so the RTMP handshake fails
+func closingTcpListener(t *testing.T) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	testAssert.NoError(t, err)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	return listener
+}
+
+func TestDialAndHandshakeErrors(t *testing.T) {
+	assert := testAssert.New(t)
+	handshakeFailing := closingTcpListener(t)
+	defer handshakeFailing.Close()
+	unreachable := closingTcpListener(t)
+	unreachable.Close()
+	factory := newTestFactory(t, "rtmp://"+handshakeFailing.Addr().String()+"/app/stream",
+		"rtmp://"+unreachable.Addr().String()+"/app/stream")
+	factory.ConnectTimeout = time.Second
+	col := newTestCollector()
+	col.Factory = factory
+	running := &RunningStream{col: col, stopper: golib.NewStopChan()}
+	running.handleStream()
+	running.handleStream()
+
+	values := sampleValues(col.collectSample(time.Second))
+	assert.Equal(2.0, values["errors"])
+	assert.Equal(1.0, values["errors_dial/s"])
+	assert.Equal(1.0, values["errors_handshake/s"])
+
+	summary, err := factory.TestAllEndpointURLs()
+	assert.Contains(summary, "Successfully connected to 0 / 2 endpoints. Failures by category: dial: 1, handshake: 1.")
+	assert.Error(err)
+	results := factory.TestEndpoints()
+	assert.Equal("handshake", results[0].Category)
+	assert.Equal("dial", results[1].Category)
+
+	// A dialer that times out, e.g. for a firewalled server, is a dial error as well
+	_, err = factory.dialRtmp(context.Background(), &net.Dialer{Deadline: time.Now().Add(-time.Second)},
+		"rtmp://"+handshakeFailing.Addr().String()+"/app", maxRtmpChannelNumber)
+	var netErr net.Error
+	assert.True(errors.As(err, &netErr) && netErr.Timeout(), "Expected a timeout, got %v", err)
+	assert.Equal(DialError, categorizeError(err, HandshakeError))
+
+	// The server rejecting the connect command after the handshake is a handshake error as well.
+	// The rejected connections must be closed.
+	var conns []*fakeRtmpConn
+	var connsLock sync.Mutex
+	factory.dial = func(context.Context, *net.Dialer, string, int) (rtmp.ClientConn, error) {
+		conn := newFakeRtmpConn(&rtmp.CommandEvent{Command: &rtmp.Command{Name: "_onBWDone", TransactionID: 0}},
+			&rtmp.CommandEvent{Command: &rtmp.Command{Name: "_error", TransactionID: rtmpConnectTransactionID,
+				Objects: []interface{}{nil, "NetConnection.Connect.Rejected"}}})
+		connsLock.Lock()
+		conns = append(conns, conn)
+		connsLock.Unlock()
+		return conn, nil
+	}
+	running.handleStream()
+	running.handleStream()
+	values = sampleValues(col.collectSample(time.Second))
+	assert.Equal(0.0, values["errors_connect/s"])
+	assert.Equal(0.0, values["errors_dial/s"])
+	assert.Equal(2.0, values["errors_handshake/s"])
+	assert.Len(conns, 2)
+	for _, conn := range conns {
+		assert.Equal(int32(1), atomic.LoadInt32(&conn.closed))
+	}
+	_, err = factory.OpenStream(context.Background())
+	assert.EqualError(err, "RTMP server rejected the connection to rtmp://fake/app/stream: [<nil> NetConnection.Connect.Rejected]")
+	assert.Equal(HandshakeError, categorizeError(err, ConnectError))
+}
+
+func TestAllEndpointURLsConcurrently(t *testing.T) {
+	assert := testAssert.New(t)
+	factory := newTestFactory(t, "rtmp://ok{{1 15}}/app/stream", "rtmp://fail{{1 5}}/app/stream")
+	factory.TestConcurrency = 10
+	const dialDuration = 50 * time.Millisecond
+	var running, maxRunning int32
+	factory.dial = func(_ context.Context, _ *net.Dialer, dialURL string, _ int) (rtmp.ClientConn, error) {
+		current := atomic.AddInt32(&running, 1)
+		defer atomic.AddInt32(&running, -1)
+		for {
+			previous := atomic.LoadInt32(&maxRunning)
+			if current <= previous || atomic.CompareAndSwapInt32(&maxRunning, previous, current) {
+				break
+			}
+		}
+		time.Sleep(dialDuration)
+		if strings.Contains(dialURL, "fail") {
+			return nil, errors.New("Connection refused")
+		}
+		return newFakeRtmpConn(), nil
+	}
+
+	start := time.Now()
+	summary, err := factory.TestAllEndpointURLs()
+	duration := time.Since(start)
+	assert.Contains(summary, "Successfully connected to 15 / 20 endpoints")
+	assert.Contains(summary, "Following errors occured")
+	assert.Error(err)
+	assert.Len(err.(golib.MultiError), 5)
+	assert.Contains(err.Error(), "via URL rtmp://fail1/app/stream: Connection refused")
+	assert.True(duration < 20*dialDuration/2, "Testing took %v", duration)
+	assert.Equal(int32(10), atomic.LoadInt32(&maxRunning), "The number of parallel tests must be bounded")
+}
+
+func TestEndpointTestResults(t *testing.T) {
+	assert := testAssert.New(t)
+	factory := newTestFactory(t, "rtmp://reachable/app/stream", "rtmp://unreachable/app/stream")
+	factory.now = fakeClock(time.Second)
+	factory.dial = func(_ context.Context, _ *net.Dialer, dialURL string, _ int) (rtmp.ClientConn, error) {
+		if strings.Contains(dialURL, "unreachable") {
+			return nil, errors.New("Connection refused")
+		}
+		return newFakeRtmpConn(), nil
+	}
+
+	results := factory.TestEndpoints()
+	assert.Equal([]EndpointTestResult{
+		{Host: "reachable:1935", URL: "rtmp://reachable/app/stream", Success: true, Latency: 1},
+		{Host: "unreachable:1935", URL: "rtmp://unreachable/app/stream", Error: "Connection refused", Latency: 1, Category: "dial"},
+	}, results)
+
+	data, err := json.Marshal(results)
+	assert.NoError(err)
+	var decoded []map[string]interface{}
+	assert.NoError(json.Unmarshal(data, &decoded))
+	assert.Equal(map[string]interface{}{"host": "reachable:1935", "url": "rtmp://reachable/app/stream", "success": true, "latency": 1.0}, decoded[0])
+	assert.Equal(false, decoded[1]["success"])
+	assert.Equal("Connection refused", decoded[1]["error"])
+}
+
+func TestConnectParams(t *testing.T) {
+	assert := testAssert.New(t)
+	factory := newTestFactory(t)
+	host, endpoints, err := factory.ParseURLArgument("rtmp://host/app/stream?pixels=100&token=secret&swfUrl=http://host/player.swf")
+	assert.NoError(err)
+	assert.Len(endpoints, 1)
+	endpoint := endpoints[0]
+	assert.Equal("rtmp://host/app/stream", endpoint.url.String())
+	assert.Equal(uint(100), endpoint.Pixels())
+	assert.Equal(map[string]string{"token": "secret", "swfUrl": "http://host/player.swf"}, endpoint.connectParams)
+	factory.AddEndpoints(host, endpoints)
+
+	var conn *fakeRtmpConn
+	factory.dial = func(context.Context, *net.Dialer, string, int) (rtmp.ClientConn, error) {
+		conn = newFakeRtmpConn(&rtmp.StreamCreatedEvent{Stream: &fakeClientStream{}})
+		return conn, nil
+	}
+	_, err = factory.OpenStream(context.Background())
+	assert.NoError(err)
+	assert.Equal([]interface{}{endpoint.connectParams}, conn.connectArgs)
+
+	// Without parameters the connect command has no additional arguments, and other schemes keep their query
+	_, endpoints, err = factory.ParseURLArgument("rtmp://host/app/stream")
+	assert.NoError(err)
+	assert.Nil(endpoints[0].connectParams)
+	_, _, err = factory.connect(context.Background(), endpoints[0])
+	assert.NoError(err)
+	assert.Empty(conn.connectArgs)
+	_, endpoints, err = factory.ParseURLArgument("https://host/live/index.m3u8?token=secret")
+	assert.NoError(err)
+	assert.Nil(endpoints[0].connectParams)
+	assert.Equal("https://host/live/index.m3u8?token=secret", endpoints[0].url.String())
+}
+
+func TestNextEndpointSkipsEmptyHosts(t *testing.T) {
+	assert := testAssert.New(t)
+	factory := newTestFactory(t)
+	factory.AddEndpoints("empty1", nil)
+	factory.AddEndpoints("empty2", nil)
+	_, err := factory.nextEndpoint()
+	assert.Equal(ErrorNoURLs, err)
+	assert.Equal(2, factory.hostCounter, "Every host must be tried exactly once")
+
+	host, endpoints, err := factory.ParseURLArgument("rtmp://last/app/stream")
+	assert.NoError(err)
+	factory.AddEndpoints(host, endpoints)
+	for i := 0; i < 3; i++ {
+		factory.hostCounter = i
+		endpoint, err := factory.nextEndpoint()
+		assert.NoError(err)
+		assert.Equal("rtmp://last/app/stream", endpoint.String())
+		assert.Equal(3, factory.hostCounter, "The counter must point to the host after the selected one")
+	}
+
+	// Hosts with endpoints are selected alternately
+	host, endpoints, err = factory.ParseURLArgument("rtmp://first/app/stream")
+	assert.NoError(err)
+	factory.AddEndpoints(host, endpoints)
+	var selected []string
+	for i := 0; i < 4; i++ {
+		endpoint, err := factory.nextEndpoint()
+		assert.NoError(err)
+		selected = append(selected, endpoint.host.host)
+	}
+	assert.Equal([]string{"first:1935", "last:1935", "first:1935", "last:1935"}, selected)
+}
+
+func TestDefaultPortHost(t *testing.T) {
+	assert := testAssert.New(t)
+	factory := newTestFactory(t, "rtmp://origin:1935/app/stream1", "rtmp://origin/app/stream2", "rtmp://origin:1936/app/stream3",
+		"http://origin/video.mp4")
+	hosts := factory.getHosts()
+	assert.Len(hosts, 3)
+	assert.Equal("origin:1935", hosts[0].host)
+	assert.Len(hosts[0].endpoints, 2)
+	assert.Equal("rtmp://origin:1935/app/stream1", hosts[0].endpoints[0].String())
+	assert.Equal("rtmp://origin/app/stream2", hosts[0].endpoints[1].String())
+	assert.Equal("origin:1936", hosts[1].host)
+	assert.Equal("origin", hosts[2].host)
+
+	// The default port can be omitted when referring to the host
+	assert.True(factory.HasHost("origin:1935"))
+	assert.True(factory.HasHost("origin"))
+	endpoint, err := factory.nextHostEndpoint("origin")
+	assert.NoError(err)
+	assert.Equal(hosts[2], endpoint.host, "Hosts without port must be matched exactly first")
+}
+
+func TestHostWeights(t *testing.T) {
+	assert := testAssert.New(t)
+	factory := newTestFactory(t, "rtmp://big/app/stream{{1 2}}?hostWeight=5", "rtmp://big/app/other?hostWeight=2",
+		"rtmp://small1/app/stream", "rtmp://small2/app/stream?hostWeight=1", "rtmp://invalid/app/stream?hostWeight=abc")
+	assert.Equal("rtmp://big/app/stream1", factory.allEndpoints()[0].String())
+	factory.AddEndpoints("empty", nil)
+
+	counts := make(map[string]int)
+	for i := 0; i < 800; i++ {
+		endpoint, err := factory.nextEndpoint()
+		assert.NoError(err)
+		counts[endpoint.host.host]++
+		if i%8 == 7 {
+			// The selections are spread evenly, not in bursts
+			assert.Equal(map[string]int{"big:1935": 5 * (i + 1) / 8, "small1:1935": (i + 1) / 8, "small2:1935": (i + 1) / 8, "invalid:1935": (i + 1) / 8}, counts)
+		}
+	}
+
+	// Without weights, the hosts are selected in round-robin order
+	factory.RemoveEndpoints(func(endpoint *RtmpEndpoint) bool { return endpoint.host.host == "big:1935" })
+	counts = make(map[string]int)
+	for i := 0; i < 30; i++ {
+		endpoint, err := factory.nextEndpoint()
+		assert.NoError(err)
+		counts[endpoint.host.host]++
+	}
+	assert.Equal(map[string]int{"small1:1935": 10, "small2:1935": 10, "invalid:1935": 10}, counts)
+}
+
+func TestMaxConnectionsPerHost(t *testing.T) {
+	assert := testAssert.New(t)
+	factory := newTestFactory(t, "rtmp://limited/app/stream?maxConnections=1", "rtmp://default/app/stream{{1 3}}")
+	factory.MaxConnectionsPerHost = 2
+	assert.Equal("rtmp://limited/app/stream", factory.allEndpoints()[0].String())
+
+	var selected []*RtmpEndpoint
+	for i := 0; i < 3; i++ {
+		endpoint, err := factory.nextEndpoint()
+		assert.NoError(err)
+		selected = append(selected, endpoint)
+	}
+	assert.Equal([]string{"limited:1935", "default:1935", "default:1935"},
+		[]string{selected[0].host.host, selected[1].host.host, selected[2].host.host})
+	_, err := factory.nextEndpoint()
+	assert.Equal(ErrorHostsSaturated, err)
+	_, err = factory.nextHostEndpoint("limited")
+	assert.Equal(ErrorHostsSaturated, err)
+	_, err = factory.nextHostEndpoint("unknown")
+	assert.Equal(ErrorNoURLs, err)
+
+	// Released connections can be selected again
+	factory.releaseConnection(selected[0])
+	endpoint, err := factory.nextEndpoint()
+	assert.NoError(err)
+	assert.Equal("limited:1935", endpoint.host.host)
+
+	// Failing to open a stream releases the connection immediately
+	factory.releaseConnection(selected[1])
+	factory.dial = func(context.Context, *net.Dialer, string, int) (rtmp.ClientConn, error) {
+		return nil, errors.New("dial failed")
+	}
+	for i := 0; i < 3; i++ {
+		_, err = factory.OpenHostStream(context.Background(), "default")
+		assert.EqualError(err, "dial failed")
+	}
+
+	// Opened streams count until they are released
+	factory.dial = fakeDial(&rtmp.StreamCreatedEvent{Stream: &fakeClientStream{}})
+	stream, err := factory.OpenHostStream(context.Background(), "default")
+	assert.NoError(err)
+	_, err = factory.OpenHostStream(context.Background(), "default")
+	assert.Equal(ErrorHostsSaturated, err)
+	stream.Info().releaseConnection()
+	stream.Info().releaseConnection()
+	assert.Equal(1, factory.hosts[1].connections)
+}
+
+func TestRoundRobinSelection(t *testing.T) {
+	assert := testAssert.New(t)
+	factory := newTestFactory(t, "rtmp://host/app/stream{{1 3}}")
+	factory.Selection = RoundRobinSelection
+
+	const numStreams = 30
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	counts := make(map[string]int)
+	for i := 0; i < numStreams; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			endpoint, err := factory.nextEndpoint()
+			lock.Lock()
+			defer lock.Unlock()
+			if err == nil {
+				counts[endpoint.String()]++
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(map[string]int{
+		"rtmp://host/app/stream1": numStreams / 3,
+		"rtmp://host/app/stream2": numStreams / 3,
+		"rtmp://host/app/stream3": numStreams / 3,
+	}, counts)
+}
+
+func TestEndpointSelectionFlag(t *testing.T) {
+	assert := testAssert.New(t)
+	var selection EndpointSelection
+	assert.Equal("random", selection.String())
+	assert.NoError(selection.Set("round-robin"))
+	assert.Equal(RoundRobinSelection, selection)
+	assert.Equal("round-robin", selection.String())
+	assert.Error(selection.Set("first"))
+}
+
+func TestNextEndpointEmptyHost(t *testing.T) {
+	assert := testAssert.New(t)
+	for _, selection := range []EndpointSelection{RandomSelection, RoundRobinSelection} {
+		factory := &RtmpStreamFactory{Selection: selection}
+		factory.hosts = []*RtmpHost{{host: "empty"}}
+		endpoint, err := factory.nextEndpoint()
+		assert.Equal(ErrorNoURLs, err)
+		assert.Nil(endpoint)
+
+		_, ok := factory.hosts[0].getEndpoint(selection)
+		assert.False(ok)
+	}
+}
+
+func TestPixelWeightedSelection(t *testing.T) {
+	assert := testAssert.New(t)
+	factory := newTestFactory(t, "rtmp://host/app/small?pixels=100", "rtmp://host/app/large?pixels=300")
+	factory.Selection = PixelWeightedSelection
+
+	const numStreams = 20000
+	counts := make(map[string]int)
+	for i := 0; i < numStreams; i++ {
+		endpoint, err := factory.nextEndpoint()
+		assert.NoError(err)
+		counts[endpoint.String()]++
+	}
+	assert.InDelta(0.25, float64(counts["rtmp://host/app/small"])/numStreams, 0.02)
+	assert.InDelta(0.75, float64(counts["rtmp://host/app/large"])/numStreams, 0.02)
+
+	// Adding an endpoint updates the weights, endpoints without pixels are never chosen
+	host, endpoints, err := factory.ParseURLArgument("rtmp://host/app/unknown")
+	assert.NoError(err)
+	factory.AddEndpoints(host, endpoints)
+	for i := 0; i < 1000; i++ {
+		endpoint, err := factory.nextEndpoint()
+		assert.NoError(err)
+		assert.NotEqual("rtmp://host/app/unknown", endpoint.String())
+	}
+
+	// Without any pixels, the selection is uniform
+	factory = newTestFactory(t, "rtmp://host/app/stream{{1 2}}")
+	factory.Selection = PixelWeightedSelection
+	counts = make(map[string]int)
+	for i := 0; i < numStreams; i++ {
+		endpoint, err := factory.nextEndpoint()
+		assert.NoError(err)
+		counts[endpoint.String()]++
+	}
+	assert.InDelta(0.5, float64(counts["rtmp://host/app/stream1"])/numStreams, 0.02)
+}
+
+func parseTemplate(t *testing.T, template string) []string {
+	_, endpoints, err := (&RtmpStreamFactory{}).ParseURLArgument(template)
+	testAssert.NoError(t, err)
+	urls := make([]string, len(endpoints))
+	for i, endpoint := range endpoints {
+		urls[i] = endpoint.String()
+	}
+	return urls
+}
+
+func TestMultiPlaceholderTemplates(t *testing.T) {
+	assert := testAssert.New(t)
+	assert.Equal([]string{"rtmp://host/app/cam1", "rtmp://host/app/cam2"}, parseTemplate(t, "rtmp://host/app/cam{{1 2}}"))
+	urls := parseTemplate(t, "rtmp://host/app/cam{{1 4}}_q{{1 3}}")
+	assert.Len(urls, 4*3)
+	assert.Equal("rtmp://host/app/cam1_q1", urls[0])
+	assert.Equal("rtmp://host/app/cam1_q2", urls[1])
+	assert.Equal("rtmp://host/app/cam4_q3", urls[11])
+	assert.Len(parseTemplate(t, "rtmp://host{{1 2}}/app{{1 3}}/cam{{5 9}}"), 2*3*5)
+
+	// Identical placeholders are expanded independently
+	assert.Equal([]string{"rtmp://host/app1/cam1", "rtmp://host/app1/cam2", "rtmp://host/app2/cam1", "rtmp://host/app2/cam2"},
+		parseTemplate(t, "rtmp://host/app{{1 2}}/cam{{1 2}}"))
+
+	// Every placeholder is validated
+	_, _, err := (&RtmpStreamFactory{}).ParseURLArgument("rtmp://host/app/cam{{1 4}}_q{{3 1}}")
+	assert.Error(err)
+}
+
+func TestTemplateStep(t *testing.T) {
+	assert := testAssert.New(t)
+	urls := parseTemplate(t, "rtmp://host/app/channel{{2 20 2}}")
+	assert.Len(urls, 10)
+	assert.Equal("rtmp://host/app/channel2", urls[0])
+	assert.Equal("rtmp://host/app/channel4", urls[1])
+	assert.Equal("rtmp://host/app/channel20", urls[9])
+
+	// The last value equals max only if it is reached by the step
+	assert.Equal([]string{"rtmp://host/app/c1", "rtmp://host/app/c4", "rtmp://host/app/c7", "rtmp://host/app/c10"},
+		parseTemplate(t, "rtmp://host/app/c{{1 10 3}}"))
+	assert.Equal([]string{"rtmp://host/app/c1", "rtmp://host/app/c4", "rtmp://host/app/c7"},
+		parseTemplate(t, "rtmp://host/app/c{{1 9 3}}"))
+	assert.Len(parseTemplate(t, "rtmp://host/app/c{{1 3 1}}"), 3)
+
+	factory := &RtmpStreamFactory{}
+	_, _, err := factory.ParseURLArgument("rtmp://host/app/c{{1 10 0}}")
+	assert.Error(err)
+	_, _, err = factory.ParseURLArgument("rtmp://host/app/c{{10 1 2}}")
+	assert.Error(err)
+}
+
+func TestTemplateZeroPadding(t *testing.T) {
+	assert := testAssert.New(t)
+	assert.Equal([]string{"rtmp://host/app/stream_001", "rtmp://host/app/stream_002", "rtmp://host/app/stream_003"},
+		parseTemplate(t, "rtmp://host/app/stream_{{001 003}}"))
+	assert.Equal([]string{"rtmp://host/app/stream_1", "rtmp://host/app/stream_2", "rtmp://host/app/stream_3"},
+		parseTemplate(t, "rtmp://host/app/stream_{{1 3}}"))
+
+	// Values wider than the padding are not truncated
+	urls := parseTemplate(t, "rtmp://host/app/stream_{{08 100 4}}")
+	assert.Equal("rtmp://host/app/stream_08", urls[0])
+	assert.Equal("rtmp://host/app/stream_100", urls[len(urls)-1])
+
+	_, _, err := (&RtmpStreamFactory{}).ParseURLArgument("rtmp://host/app/stream_{{010 002}}")
+	assert.Error(err)
+}
+
+func TestTemplateLists(t *testing.T) {
+	assert := testAssert.New(t)
+	assert.Equal([]string{"rtmp://host/app/a", "rtmp://host/app/b", "rtmp://host/app/main"},
+		parseTemplate(t, "rtmp://host/app/{{a,b,main}}"))
+	assert.Equal([]string{"rtmp://host/app/main"}, parseTemplate(t, "rtmp://host/app/{{main}}"))
+	assert.Equal([]string{"rtmp://host/app/cam1_hd", "rtmp://host/app/cam1_sd", "rtmp://host/app/cam2_hd", "rtmp://host/app/cam2_sd"},
+		parseTemplate(t, "rtmp://host/app/cam{{1 2}}_{{hd,sd}}"))
+
+	factory := &RtmpStreamFactory{}
+	for _, invalid := range []string{"rtmp://host/app/{{}}", "rtmp://host/app/{{,}}", "rtmp://host/app/{{a,,b}}"} {
+		_, _, err := factory.ParseURLArgument(invalid)
+		assert.Error(err, invalid)
+	}
+}
+
+func TestParsePixels(t *testing.T) {
+	assert := testAssert.New(t)
+	factory := &RtmpStreamFactory{}
+	for query, pixels := range map[string]uint{
+		"pixels=1920x1080": 1920 * 1080,
+		"pixels=2073600":   2073600,
+		"pixels=1920x":     0,
+		"pixels=axb":       0,
+		"pixels=1x2x3":     0,
+		"pixels=-5":        0,
+	} {
+		_, endpoints, err := factory.ParseURLArgument("rtmp://host/app/stream?" + query)
+		assert.NoError(err)
+		assert.Equal(pixels, endpoints[0].Pixels(), query)
+		assert.Equal("rtmp://host/app/stream", endpoints[0].url.String())
+	}
+}
+
+func metadataEvent(t *testing.T, values ...interface{}) *rtmp.MetadataEvent {
+	var buf bytes.Buffer
+	for _, value := range values {
+		_, err := amf.WriteValue(&buf, value)
+		testAssert.NoError(t, err)
+	}
+	return &rtmp.MetadataEvent{AMFVersion: rtmp.AMF0, Message: &rtmp.Message{Buf: &buf}}
+}
+
+func TestMetadataPixels(t *testing.T) {
+	assert := testAssert.New(t)
+	factory := newTestFactory(t, "rtmp://host/app/stream", "rtmp://host/app/known?pixels=100")
+	endpoint := factory.hosts[0].endpoints[0]
+	stream := &RtmpStream{
+		StreamInfo: StreamInfo{Endpoint: endpoint},
+		Conn: newFakeRtmpConn(
+			metadataEvent(t, "onMetaData", amf.Object{"duration": 0.0}),
+			metadataEvent(t, "@setDataFrame", "onMetaData", amf.Object{"width": 1280.0, "height": 720.0}),
+			&rtmp.VideoEvent{Message: &rtmp.Message{Size: 10}},
+			metadataEvent(t, "onMetaData", amf.Object{"width": 1920.0, "height": 1080.0}),
+			&rtmp.VideoEvent{Message: &rtmp.Message{Size: 10}},
+		),
+		TimeoutDuration: time.Second,
+	}
+	assert.Equal(uint(0), endpoint.Pixels())
+	_, _, err := stream.Receive()
+	assert.NoError(err)
+	assert.Equal(uint(1280*720), endpoint.Pixels())
+
+	// Known pixels are not overwritten
+	_, _, err = stream.Receive()
+	assert.NoError(err)
+	assert.Equal(uint(1280*720), endpoint.Pixels())
+	stream.Endpoint = factory.hosts[0].endpoints[1]
+	stream.handleMetadata(metadataEvent(t, "onMetaData", amf.Object{"width": 1920.0, "height": 1080.0}))
+	assert.Equal(uint(100), stream.Endpoint.Pixels())
+
+	assert.Equal(uint(0), metadataPixels(metadataEvent(t, "onMetaData", "invalid")))
+	assert.Equal(uint(0), metadataPixels(&rtmp.MetadataEvent{}))
+}
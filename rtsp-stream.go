@@ -0,0 +1,440 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const defaultRtspPort = "554"
+
+// defaultRtspSessionTimeout applies if the Session header of the server does not define a timeout
+const defaultRtspSessionTimeout = 60 * time.Second
+
+// rtcpBye is the RTCP packet type sent by servers when a stream ends
+const rtcpBye = 203
+
+// isRtspURL returns true for rtsp:// URLs. Such endpoints are streamed via RtspStreamFactory.
+func isRtspURL(target *url.URL) bool {
+	return target.Scheme == "rtsp"
+}
+
+// RtspStreamFactory opens RTSP streams to the endpoints managed by Endpoints. All media tracks of a stream are
+// received via RTP interleaved into the RTSP TCP connection.
+// RtmpStreamFactory automatically delegates to an RtspStreamFactory for rtsp:// endpoint URLs.
+type RtspStreamFactory struct {
+	Endpoints       *RtmpStreamFactory
+	TimeoutDuration time.Duration
+
+	// Seams for testing, default to net.Dialer.DialContext and time.Now
+	dial func(ctx context.Context, network, address string) (net.Conn, error)
+	now  func() time.Time
+}
+
+var _ StreamFactory = &RtspStreamFactory{}
+
+func (f *RtspStreamFactory) OpenStream(ctx context.Context) (Stream, error) {
+	endpoint, err := f.Endpoints.nextEndpoint()
+	if err != nil {
+		return nil, err
+	}
+	return f.OpenEndpoint(ctx, endpoint)
+}
+
+// OpenEndpoint performs the DESCRIBE, SETUP and PLAY requests for the given endpoint
+func (f *RtspStreamFactory) OpenEndpoint(ctx context.Context, endpoint *RtmpEndpoint) (Stream, error) {
+	start := f.currentTime()
+	target := endpoint.url
+	address := target.Host
+	if target.Port() == "" {
+		address = net.JoinHostPort(target.Hostname(), defaultRtspPort)
+	}
+	dial := f.dial
+	if dial == nil {
+		dial = (&net.Dialer{Timeout: f.TimeoutDuration}).DialContext
+	}
+	log.Debugln("Dialing RTSP URL:", target)
+	conn, err := dial(ctx, "tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	stream := &RtspStream{
+		StreamInfo:      StreamInfo{Endpoint: endpoint},
+		TimeoutDuration: f.TimeoutDuration,
+		conn:            conn,
+		reader:          bufio.NewReader(conn),
+		url:             target,
+	}
+	// Closing the connection aborts the requests
+	requestsDone := abortOnCancel(ctx, func() { conn.Close() })
+	err = stream.start()
+	if canceled := requestsDone(); canceled != nil {
+		conn.Close()
+		return nil, canceled
+	} else if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	stream.ConnectLatency = f.currentTime().Sub(start)
+	return stream, nil
+}
+
+func (f *RtspStreamFactory) currentTime() time.Time {
+	if f.now != nil {
+		return f.now()
+	}
+	return time.Now()
+}
+
+// RtspStream receives the interleaved RTP packets of an RTSP session. Receive returns the RTP payload sizes.
+// When the server closes the connection or sends an RTCP BYE packet, io.EOF is returned.
+// While receiving, a GET_PARAMETER request is sent after half of the session timeout, so the server keeps the session alive.
+type RtspStream struct {
+	StreamInfo
+	TimeoutDuration time.Duration
+
+	conn           net.Conn
+	reader         *bufio.Reader
+	url            *url.URL
+	cseq           int
+	session        string
+	sessionTimeout time.Duration // If zero, no keep-alive requests are sent
+	lastKeepalive  time.Time     // Time of the PLAY request or the last keep-alive request
+	tracks         []PacketType  // Packet type of the media track for each pair of interleaved channels
+	packet         []byte        // RTP packet last returned by Receive
+}
+
+var _ Stream = &RtspStream{}
+
+func (s *RtspStream) Receive() (int, PacketType, error) {
+	deadline := time.Now().Add(s.TimeoutDuration)
+	for {
+		if err := s.keepAlive(); err != nil {
+			return 0, NoPacket, err
+		}
+		// Wake up in time for the next keep-alive request while waiting for data
+		readDeadline := deadline
+		if s.sessionTimeout > 0 {
+			if next := s.lastKeepalive.Add(s.sessionTimeout / 2); next.Before(readDeadline) {
+				readDeadline = next
+			}
+		}
+		if err := s.conn.SetReadDeadline(readDeadline); err != nil {
+			return 0, NoPacket, err
+		}
+		marker, err := s.reader.Peek(1)
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() && time.Now().Before(deadline) {
+			continue
+		} else if err != nil {
+			return 0, NoPacket, s.mapReadError(err)
+		}
+		// The rest of the message must not be interrupted by the next keep-alive
+		if err := s.conn.SetReadDeadline(deadline); err != nil {
+			return 0, NoPacket, err
+		}
+		if marker[0] != '$' {
+			// The server can send RTSP messages in between the interleaved data, e.g. responses to keep-alive requests
+			if _, _, _, err := s.readMessage(); err != nil {
+				return 0, NoPacket, s.mapReadError(err)
+			}
+			continue
+		}
+		var header [4]byte
+		if _, err := io.ReadFull(s.reader, header[:]); err != nil {
+			return 0, NoPacket, s.mapReadError(err)
+		}
+		channel := int(header[1])
+		packet := make([]byte, binary.BigEndian.Uint16(header[2:]))
+		if _, err := io.ReadFull(s.reader, packet); err != nil {
+			return 0, NoPacket, s.mapReadError(err)
+		}
+		if channel%2 == 1 {
+			if isRtcpBye(packet) {
+				return 0, NoPacket, io.EOF
+			}
+			continue
+		}
+		size, err := rtpPayloadSize(packet)
+		if err != nil {
+			return 0, NoPacket, fmt.Errorf("Received invalid RTP packet from %v: %v", s.url, err)
+		}
+		packetType := NoPacket
+		if track := channel / 2; track < len(s.tracks) {
+			packetType = s.tracks[track]
+		}
+		s.packet = packet
+		return size, packetType, nil
+	}
+}
+
+// keepAlive sends a GET_PARAMETER request without waiting for the response, if half of the session timeout passed
+// since the last request. The response is skipped by Receive.
+func (s *RtspStream) keepAlive() error {
+	if s.sessionTimeout <= 0 || time.Since(s.lastKeepalive) < s.sessionTimeout/2 {
+		return nil
+	}
+	if err := s.conn.SetWriteDeadline(time.Now().Add(s.TimeoutDuration)); err != nil {
+		return err
+	}
+	s.lastKeepalive = time.Now()
+	return s.writeRequest("GET_PARAMETER", s.url.String(), nil)
+}
+
+// Payload returns the complete RTP packet last returned by Receive, including the RTP header
+func (s *RtspStream) Payload() []byte {
+	return s.packet
+}
+
+func (s *RtspStream) mapReadError(err error) error {
+	if err == io.ErrUnexpectedEOF {
+		return io.EOF
+	}
+	return err
+}
+
+// Close sends a TEARDOWN request without waiting for the response and closes the connection
+func (s *RtspStream) Close() {
+	if s == nil || s.conn == nil {
+		return
+	}
+	if s.session != "" {
+		_ = s.conn.SetWriteDeadline(time.Now().Add(s.TimeoutDuration))
+		_ = s.writeRequest("TEARDOWN", s.url.String(), nil)
+	}
+	s.conn.Close()
+}
+
+func (s *RtspStream) start() error {
+	header, body, err := s.request("DESCRIBE", s.url.String(), map[string]string{"Accept": "application/sdp"})
+	if err != nil {
+		return err
+	}
+	base := s.url
+	if contentBase := header.Get("Content-Base"); contentBase != "" {
+		if parsed, err := url.Parse(contentBase); err == nil {
+			base = parsed
+		}
+	}
+	tracks, err := parseSdpTracks(base, string(body))
+	if err != nil {
+		return fmt.Errorf("Failed to parse session description of %v: %v", s.url, err)
+	}
+	for i, track := range tracks {
+		transport := fmt.Sprintf("RTP/AVP/TCP;unicast;interleaved=%v-%v", 2*i, 2*i+1)
+		header, _, err := s.request("SETUP", track.control, map[string]string{"Transport": transport})
+		if err != nil {
+			return err
+		}
+		if s.session == "" {
+			s.session, s.sessionTimeout = parseRtspSession(header.Get("Session"))
+		}
+		s.tracks = append(s.tracks, track.packetType)
+	}
+	s.lastKeepalive = time.Now()
+	_, _, err = s.request("PLAY", s.url.String(), map[string]string{"Range": "npt=0.000-"})
+	return err
+}
+
+// parseRtspSession returns the session ID and the timeout of the value of a Session header, e.g. '12345;timeout=30'
+func parseRtspSession(value string) (string, time.Duration) {
+	parts := strings.Split(value, ";")
+	timeout := defaultRtspSessionTimeout
+	for _, param := range parts[1:] {
+		param = strings.TrimSpace(param)
+		if strings.HasPrefix(param, "timeout=") {
+			if seconds, err := strconv.Atoi(strings.TrimPrefix(param, "timeout=")); err == nil && seconds > 0 {
+				timeout = time.Duration(seconds) * time.Second
+			}
+		}
+	}
+	return strings.TrimSpace(parts[0]), timeout
+}
+
+func (s *RtspStream) request(method, target string, headers map[string]string) (textproto.MIMEHeader, []byte, error) {
+	if err := s.conn.SetDeadline(time.Now().Add(s.TimeoutDuration)); err != nil {
+		return nil, nil, err
+	}
+	if err := s.writeRequest(method, target, headers); err != nil {
+		return nil, nil, err
+	}
+	status, header, body, err := s.readResponse()
+	if err != nil {
+		return nil, nil, categorizedError(categorizeError(err, HandshakeError),
+			fmt.Errorf("Failed to receive response to %v request for %v: %v", method, target, err))
+	}
+	if status != 200 {
+		return nil, nil, categorizedError(HandshakeError, fmt.Errorf("%v request for %v failed with status %v", method, target, status))
+	}
+	return header, body, nil
+}
+
+func (s *RtspStream) writeRequest(method, target string, headers map[string]string) error {
+	s.cseq++
+	var request strings.Builder
+	fmt.Fprintf(&request, "%v %v RTSP/1.0\r\nCSeq: %v\r\n", method, target, s.cseq)
+	if s.session != "" {
+		fmt.Fprintf(&request, "Session: %v\r\n", s.session)
+	}
+	for key, value := range headers {
+		fmt.Fprintf(&request, "%v: %v\r\n", key, value)
+	}
+	request.WriteString("\r\n")
+	_, err := io.WriteString(s.conn, request.String())
+	return err
+}
+
+// readResponse reads RTSP messages until a response is received. Interleaved data received before the response is dropped.
+func (s *RtspStream) readResponse() (int, textproto.MIMEHeader, []byte, error) {
+	for {
+		marker, err := s.reader.Peek(1)
+		if err != nil {
+			return 0, nil, nil, err
+		}
+		if marker[0] == '$' {
+			var header [4]byte
+			if _, err := io.ReadFull(s.reader, header[:]); err != nil {
+				return 0, nil, nil, err
+			}
+			if _, err := s.reader.Discard(int(binary.BigEndian.Uint16(header[2:]))); err != nil {
+				return 0, nil, nil, err
+			}
+			continue
+		}
+		startLine, header, body, err := s.readMessage()
+		if err != nil {
+			return 0, nil, nil, err
+		}
+		if !strings.HasPrefix(startLine, "RTSP/") {
+			log.Debugf("Ignoring RTSP request from server %v: %v", s.url, startLine)
+			continue
+		}
+		parts := strings.SplitN(startLine, " ", 3)
+		if len(parts) < 2 {
+			return 0, nil, nil, fmt.Errorf("Malformed status line: %v", startLine)
+		}
+		status, err := strconv.Atoi(parts[1])
+		if err != nil {
+			return 0, nil, nil, fmt.Errorf("Malformed status line: %v", startLine)
+		}
+		return status, header, body, nil
+	}
+}
+
+func (s *RtspStream) readMessage() (string, textproto.MIMEHeader, []byte, error) {
+	reader := textproto.NewReader(s.reader)
+	startLine, err := reader.ReadLine()
+	if err != nil {
+		return "", nil, nil, err
+	}
+	header, err := reader.ReadMIMEHeader()
+	if err != nil {
+		return "", nil, nil, err
+	}
+	var body []byte
+	if lengthStr := header.Get("Content-Length"); lengthStr != "" {
+		length, err := strconv.Atoi(lengthStr)
+		if err != nil || length < 0 {
+			return "", nil, nil, fmt.Errorf("Invalid Content-Length: %v", lengthStr)
+		}
+		body, err = ioutil.ReadAll(io.LimitReader(s.reader, int64(length)))
+		if err != nil {
+			return "", nil, nil, err
+		}
+	}
+	return startLine, header, body, nil
+}
+
+type sdpTrack struct {
+	control    string
+	packetType PacketType
+}
+
+// parseSdpTracks returns the audio and video media sections of a session description with their absolute control URLs
+func parseSdpTracks(base *url.URL, sdp string) ([]sdpTrack, error) {
+	var tracks []sdpTrack
+	var current *sdpTrack
+	for _, line := range strings.Split(sdp, "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, "m="):
+			current = nil
+			packetType := NoPacket
+			if strings.HasPrefix(line, "m=audio") {
+				packetType = AudioPacket
+			} else if strings.HasPrefix(line, "m=video") {
+				packetType = VideoPacket
+			}
+			if packetType != NoPacket {
+				tracks = append(tracks, sdpTrack{control: base.String(), packetType: packetType})
+				current = &tracks[len(tracks)-1]
+			}
+		case strings.HasPrefix(line, "a=control:") && current != nil:
+			control := strings.TrimPrefix(line, "a=control:")
+			if control == "*" {
+				continue
+			}
+			if !strings.Contains(control, "://") {
+				// Relative control URLs are appended to the base URL
+				control = strings.TrimSuffix(base.String(), "/") + "/" + control
+			}
+			current.control = control
+		}
+	}
+	if len(tracks) == 0 {
+		return nil, errors.New("No audio or video media found")
+	}
+	return tracks, nil
+}
+
+// rtpPayloadSize returns the size of the payload of an RTP packet, without header, extension and padding
+func rtpPayloadSize(packet []byte) (int, error) {
+	const headerSize = 12
+	if len(packet) < headerSize {
+		return 0, fmt.Errorf("Packet too short (%v bytes)", len(packet))
+	}
+	if version := packet[0] >> 6; version != 2 {
+		return 0, fmt.Errorf("Unsupported RTP version %v", version)
+	}
+	offset := headerSize + 4*int(packet[0]&0x0f)
+	if packet[0]&0x10 != 0 {
+		if len(packet) < offset+4 {
+			return 0, errors.New("Truncated header extension")
+		}
+		offset += 4 + 4*int(binary.BigEndian.Uint16(packet[offset+2:]))
+	}
+	end := len(packet)
+	if packet[0]&0x20 != 0 && end > 0 {
+		end -= int(packet[end-1])
+	}
+	if end < offset {
+		return 0, errors.New("Header exceeds packet size")
+	}
+	return end - offset, nil
+}
+
+// isRtcpBye returns true if the compound RTCP packet contains a BYE packet
+func isRtcpBye(packet []byte) bool {
+	for len(packet) >= 4 {
+		if packet[1] == rtcpBye {
+			return true
+		}
+		length := 4 * (int(binary.BigEndian.Uint16(packet[2:])) + 1)
+		if length > len(packet) {
+			break
+		}
+		packet = packet[length:]
+	}
+	return false
+}
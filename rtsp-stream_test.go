@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"testing"
+	"time"
+
+	testAssert "github.com/stretchr/testify/require"
+)
+
+const testSdp = "v=0\r\ns=Test\r\nm=video 0 RTP/AVP 96\r\na=control:trackID=1\r\nm=audio 0 RTP/AVP 97\r\na=control:trackID=2\r\n"
+
+// mockRtspServer answers the RTSP requests of one client and records the requested methods and URLs.
+// After the PLAY request, it sends the given interleaved packets and closes the connection.
+type mockRtspServer struct {
+	requests chan string
+	packets  [][]byte
+	status   int
+	session  string // Value of the Session header, '12345;timeout=60' by default
+	keepOpen bool   // If set, the connection stays open and the packets are sent again after every GET_PARAMETER request
+}
+
+func (s *mockRtspServer) dial(_ context.Context, _, _ string) (net.Conn, error) {
+	client, server := net.Pipe()
+	go s.serve(server)
+	return client, nil
+}
+
+func (s *mockRtspServer) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := textproto.NewReader(bufio.NewReader(conn))
+	for {
+		line, err := reader.ReadLine()
+		if err != nil {
+			return
+		}
+		header, err := reader.ReadMIMEHeader()
+		if err != nil {
+			return
+		}
+		s.requests <- line
+		var method string
+		fmt.Sscan(line, &method)
+		status := 200
+		if s.status != 0 {
+			status = s.status
+		}
+		response := fmt.Sprintf("RTSP/1.0 %v OK\r\nCSeq: %v\r\n", status, header.Get("CSeq"))
+		switch method {
+		case "DESCRIBE":
+			response += fmt.Sprintf("Content-Type: application/sdp\r\nContent-Length: %v\r\n\r\n%v", len(testSdp), testSdp)
+		case "SETUP":
+			session := "12345;timeout=60"
+			if s.session != "" {
+				session = s.session
+			}
+			response += "Session: " + session + "\r\nTransport: " + header.Get("Transport") + "\r\n\r\n"
+		default:
+			response += "\r\n"
+		}
+		if _, err := io.WriteString(conn, response); err != nil {
+			return
+		}
+		if (method == "PLAY" || method == "GET_PARAMETER") && status == 200 {
+			for _, packet := range s.packets {
+				if _, err := conn.Write(packet); err != nil {
+					return
+				}
+			}
+			if !s.keepOpen {
+				return
+			}
+		}
+	}
+}
+
+func interleaved(channel byte, payload []byte) []byte {
+	packet := []byte{'$', channel, 0, 0}
+	binary.BigEndian.PutUint16(packet[2:], uint16(len(payload)))
+	return append(packet, payload...)
+}
+
+func rtpPacket(payloadSize int) []byte {
+	packet := make([]byte, 12+payloadSize)
+	packet[0] = 0x80 // Version 2
+	return packet
+}
+
+func newTestRtspFactory(t *testing.T, server *mockRtspServer) *RtmpStreamFactory {
+	factory := newTestFactory(t, "rtsp://camera/live")
+	factory.dialRtsp = server.dial
+	return factory
+}
+
+func TestRtspStream(t *testing.T) {
+	assert := testAssert.New(t)
+	bye := []byte{0x80, rtcpBye, 0, 1, 0, 0, 0, 0}
+	server := &mockRtspServer{requests: make(chan string, 10), packets: [][]byte{
+		interleaved(0, rtpPacket(100)),
+		interleaved(1, []byte{0x80, 200, 0, 0}), // RTCP sender report, ignored
+		interleaved(2, rtpPacket(20)),
+		interleaved(1, bye),
+	}}
+	stream, err := newTestRtspFactory(t, server).OpenStream(context.Background())
+	assert.NoError(err)
+	assert.IsType(&RtspStream{}, stream)
+	assert.Equal("DESCRIBE rtsp://camera/live RTSP/1.0", <-server.requests)
+	assert.Equal("SETUP rtsp://camera/live/trackID=1 RTSP/1.0", <-server.requests)
+	assert.Equal("SETUP rtsp://camera/live/trackID=2 RTSP/1.0", <-server.requests)
+	assert.Equal("PLAY rtsp://camera/live RTSP/1.0", <-server.requests)
+
+	size, packetType, err := stream.Receive()
+	assert.NoError(err)
+	assert.Equal(100, size)
+	assert.Equal(VideoPacket, packetType)
+	size, packetType, err = stream.Receive()
+	assert.NoError(err)
+	assert.Equal(20, size)
+	assert.Equal(AudioPacket, packetType)
+	_, _, err = stream.Receive()
+	assert.Equal(io.EOF, err)
+	stream.Close()
+}
+
+func TestRtspStreamTeardown(t *testing.T) {
+	assert := testAssert.New(t)
+	server := &mockRtspServer{requests: make(chan string, 10), packets: [][]byte{interleaved(0, rtpPacket(10))}}
+	stream, err := newTestRtspFactory(t, server).OpenStream(context.Background())
+	assert.NoError(err)
+	_, _, err = stream.Receive()
+	assert.NoError(err)
+	// The server closes the connection after the last packet
+	_, _, err = stream.Receive()
+	assert.Equal(io.EOF, err)
+}
+
+func TestRtspStreamKeepalive(t *testing.T) {
+	assert := testAssert.New(t)
+	server := &mockRtspServer{requests: make(chan string, 10), packets: [][]byte{interleaved(0, rtpPacket(10))},
+		session: "12345;timeout=1", keepOpen: true}
+	factory := newTestRtspFactory(t, server)
+	factory.TimeoutDuration = 5 * time.Second
+	stream, err := factory.OpenStream(context.Background())
+	assert.NoError(err)
+	defer stream.Close()
+	assert.Equal(time.Second, stream.(*RtspStream).sessionTimeout)
+	for i := 0; i < 4; i++ {
+		<-server.requests
+	}
+	size, _, err := stream.Receive()
+	assert.NoError(err)
+	assert.Equal(10, size)
+
+	// Without data, the session is kept alive after half of the timeout. The server answers with another packet.
+	start := time.Now()
+	size, _, err = stream.Receive()
+	assert.NoError(err)
+	assert.Equal(10, size)
+	assert.Equal("GET_PARAMETER rtsp://camera/live RTSP/1.0", <-server.requests)
+	elapsed := time.Since(start)
+	assert.True(elapsed >= 400*time.Millisecond && elapsed < time.Second, "Keep-alive sent after %v", elapsed)
+
+	session, timeout := parseRtspSession("abc")
+	assert.Equal("abc", session)
+	assert.Equal(defaultRtspSessionTimeout, timeout)
+	session, timeout = parseRtspSession("abc ; timeout=30")
+	assert.Equal("abc", session)
+	assert.Equal(30*time.Second, timeout)
+}
+
+func TestRtspStreamErrors(t *testing.T) {
+	assert := testAssert.New(t)
+	server := &mockRtspServer{requests: make(chan string, 10), status: 404}
+	_, err := newTestRtspFactory(t, server).OpenStream(context.Background())
+	assert.Error(err)
+
+	// The read timeout is the TimeoutDuration of the factory
+	client, _ := net.Pipe()
+	stream := &RtspStream{TimeoutDuration: 10 * time.Millisecond, conn: client, reader: bufio.NewReader(client)}
+	_, _, err = stream.Receive()
+	assert.Error(err)
+	assert.NotEqual(io.EOF, err)
+}
+
+func TestRtpPayloadSize(t *testing.T) {
+	assert := testAssert.New(t)
+	packet := rtpPacket(10)
+	size, err := rtpPayloadSize(packet)
+	assert.NoError(err)
+	assert.Equal(10, size)
+
+	// Two CSRCs, header extension with one word, padding of 3 bytes
+	packet = append(make([]byte, 12+8+8), make([]byte, 20)...)
+	packet[0] = 0x80 | 0x20 | 0x10 | 2
+	binary.BigEndian.PutUint16(packet[20+2:], 1)
+	packet[len(packet)-1] = 3
+	size, err = rtpPayloadSize(packet)
+	assert.NoError(err)
+	assert.Equal(17, size)
+
+	_, err = rtpPayloadSize([]byte{0x80})
+	assert.Error(err)
+	_, err = rtpPayloadSize(make([]byte, 12))
+	assert.Error(err)
+}
@@ -0,0 +1,381 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/url"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Constants of the SRT protocol, see https://datatracker.ietf.org/doc/html/draft-sharabayko-srt
+const (
+	srtHeaderSize        = 16
+	srtHandshakeSize     = 48
+	srtControlFlag       = 0x80000000
+	srtSequenceMask      = 0x7FFFFFFF
+	srtHandshakeMagic    = 0x4A17 // Extension field of HSv5 induction responses
+	srtExtensionHsReq    = 1
+	srtExtensionStreamId = 5
+	srtExtensionFlagHs   = 0x1 // Extension flags of the HSv5 conclusion request
+	srtExtensionFlagConf = 0x4
+	srtHandshakeRejected = 1000 // Handshake types from this value on report the reason for a rejected connection
+	srtLatencyMillis     = 120
+
+	// Flags of the HSREQ extension: TSBPD sender and receiver, too-late packet drop, periodic NAK and retransmit flag
+	srtHsReqFlags = 0x1 | 0x2 | 0x8 | 0x10 | 0x20
+	srtVersion    = 0x010401
+)
+
+const (
+	srtControlHandshake = 0x0
+	srtControlKeepalive = 0x1
+	srtControlAck       = 0x2
+	srtControlShutdown  = 0x5
+)
+
+const (
+	srtHandshakeInduction  = 1
+	srtHandshakeConclusion = 0xFFFFFFFF
+)
+
+const (
+	srtHandshakeRetryInterval = 250 * time.Millisecond
+	srtAckInterval            = 10 * time.Millisecond
+	srtKeepaliveInterval      = time.Second
+)
+
+// isSrtURL returns true for srt:// URLs. Such endpoints are received via SrtStreamFactory.
+func isSrtURL(target *url.URL) bool {
+	return target.Scheme == "srt"
+}
+
+// SrtStreamFactory receives SRT streams from the srt://host:port endpoints managed by Endpoints. It connects in caller
+// mode and requests the stream given by the 'streamid' query parameter, if any. Encrypted streams are not supported.
+// RtmpStreamFactory automatically delegates to an SrtStreamFactory for srt:// endpoint URLs.
+type SrtStreamFactory struct {
+	Endpoints       *RtmpStreamFactory
+	TimeoutDuration time.Duration
+
+	now func() time.Time // Seam for testing, defaults to time.Now
+}
+
+var _ StreamFactory = &SrtStreamFactory{}
+
+func (f *SrtStreamFactory) OpenStream(ctx context.Context) (Stream, error) {
+	endpoint, err := f.Endpoints.nextEndpoint()
+	if err != nil {
+		return nil, err
+	}
+	return f.OpenEndpoint(ctx, endpoint)
+}
+
+// OpenEndpoint performs the SRT handshake with the listener of the given endpoint. If the listener does not respond
+// within TimeoutDuration, a TimeoutError is returned.
+func (f *SrtStreamFactory) OpenEndpoint(ctx context.Context, endpoint *RtmpEndpoint) (Stream, error) {
+	start := f.currentTime()
+	log.Debugln("Connecting to SRT URL:", endpoint.url)
+	conn, err := (&net.Dialer{}).DialContext(ctx, "udp", endpoint.url.Host)
+	if err != nil {
+		return nil, err
+	}
+	stream := &SrtStream{
+		StreamInfo:      StreamInfo{Endpoint: endpoint},
+		TimeoutDuration: f.TimeoutDuration,
+		conn:            conn,
+		buffer:          make([]byte, maxDatagramSize),
+		socketId:        rand.Uint32()&srtSequenceMask | 1,
+		started:         time.Now(),
+	}
+	// Closing the connection aborts the handshake
+	handshakeDone := abortOnCancel(ctx, func() { conn.Close() })
+	err = stream.handshake(endpoint.url.Query().Get("streamid"))
+	if canceled := handshakeDone(); canceled != nil {
+		conn.Close()
+		return nil, canceled
+	} else if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	stream.ConnectLatency = f.currentTime().Sub(start)
+	return stream, nil
+}
+
+func (f *SrtStreamFactory) currentTime() time.Time {
+	if f.now != nil {
+		return f.now()
+	}
+	return time.Now()
+}
+
+// SrtStream receives the data packets of an SRT connection. Receive returns the payload size of each data packet.
+// Received packets are acknowledged and keepalive packets are sent while waiting for data, but lost packets are not
+// reported to the sender. Instead, gaps in the sequence numbers are counted as lost packets, and retransmitted or late
+// packets at or below the acknowledged sequence number are dropped. When the sender shuts down the connection, io.EOF
+// is returned.
+type SrtStream struct {
+	StreamInfo
+	TimeoutDuration time.Duration
+
+	conn      net.Conn
+	buffer    []byte // Owned by this stream, the received data is discarded
+	payload   []byte // Payload of the data packet last returned by Receive
+	socketId  uint32
+	peerId    uint32
+	started   time.Time // Reference for the timestamps of sent packets
+	wireBytes uint64
+
+	receivedData bool
+	ackSequence  uint32 // Sequence number following the last received data packet
+	lostPackets  uint64 // Sequence numbers skipped by the received data packets
+	ackNumber    uint32
+	unacked      bool // Data was received since the last ACK
+	lastAck      time.Time
+	lastSent     time.Time
+}
+
+var _ Stream = &SrtStream{}
+var _ WireByteCounter = &SrtStream{}
+var _ PacketLossCounter = &SrtStream{}
+
+func (s *SrtStream) Receive() (int, PacketType, error) {
+	deadline := time.Now().Add(s.TimeoutDuration)
+	for {
+		if s.unacked && time.Since(s.lastAck) >= srtAckInterval {
+			if err := s.sendAck(); err != nil {
+				return 0, NoPacket, err
+			}
+		}
+		if time.Since(s.lastSent) >= srtKeepaliveInterval {
+			if err := s.sendControl(srtControlKeepalive, 0, nil); err != nil {
+				return 0, NoPacket, err
+			}
+		}
+		readDeadline := s.lastSent.Add(srtKeepaliveInterval)
+		if s.unacked {
+			readDeadline = s.lastAck.Add(srtAckInterval)
+		}
+		if deadline.Before(readDeadline) {
+			readDeadline = deadline
+		}
+		packet, err := s.read(readDeadline)
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			if time.Now().Before(deadline) {
+				continue
+			}
+			return 0, NoPacket, categorizedError(TimeoutError, fmt.Errorf("Timeout after %v waiting for data from %v", s.TimeoutDuration, s.Endpoint.url))
+		} else if err != nil {
+			return 0, NoPacket, err
+		}
+		if len(packet) < srtHeaderSize {
+			continue
+		}
+		first := binary.BigEndian.Uint32(packet)
+		if first&srtControlFlag != 0 {
+			if uint16(first>>16)&0x7FFF == srtControlShutdown {
+				return 0, NoPacket, io.EOF
+			}
+			continue
+		}
+		sequence := first & srtSequenceMask
+		if s.receivedData {
+			if !srtSequenceAfter(sequence+1, s.ackSequence) {
+				// Acknowledge again, the sender retransmits because it did not receive the last ACK
+				s.unacked = true
+				continue
+			}
+			s.lostPackets += uint64((sequence - s.ackSequence) & srtSequenceMask)
+		}
+		s.ackSequence = (sequence + 1) & srtSequenceMask
+		s.receivedData = true
+		s.unacked = true
+		s.payload = packet[srtHeaderSize:]
+		return len(s.payload), NoPacket, nil
+	}
+}
+
+// Payload returns the payload of the data packet last returned by Receive, without the SRT header
+func (s *SrtStream) Payload() []byte {
+	return s.payload
+}
+
+// WireBytes returns the total size of all SRT packets received, including the SRT headers and control packets
+func (s *SrtStream) WireBytes() (uint64, bool) {
+	return s.wireBytes, true
+}
+
+// LostPackets returns the number of data packets skipped in the sequence numbers
+func (s *SrtStream) LostPackets() uint64 {
+	return s.lostPackets
+}
+
+// Close sends a shutdown packet without waiting for a response and closes the connection
+func (s *SrtStream) Close() {
+	if s == nil || s.conn == nil {
+		return
+	}
+	if s.peerId != 0 {
+		_ = s.conn.SetWriteDeadline(time.Now().Add(s.TimeoutDuration))
+		_ = s.sendControl(srtControlShutdown, 0, make([]byte, 4))
+	}
+	s.conn.Close()
+}
+
+// handshake performs the induction and conclusion phases of the SRT caller handshake. Requests are repeated until
+// the listener responds or TimeoutDuration expires.
+func (s *SrtStream) handshake(streamId string) error {
+	deadline := time.Now().Add(s.TimeoutDuration)
+	initialSequence := rand.Uint32() & srtSequenceMask
+	induction := s.handshakePacket(4, 2, initialSequence, srtHandshakeInduction, 0)
+	response, err := s.handshakeRequest(induction, srtHandshakeInduction, deadline)
+	if err != nil {
+		return err
+	}
+	if binary.BigEndian.Uint32(response) != 5 || binary.BigEndian.Uint16(response[6:]) != srtHandshakeMagic {
+		return categorizedError(HandshakeError, fmt.Errorf("SRT listener %v does not support handshake version 5", s.Endpoint.url))
+	}
+	cookie := binary.BigEndian.Uint32(response[28:])
+
+	flags := uint16(srtExtensionFlagHs)
+	if streamId != "" {
+		flags |= srtExtensionFlagConf
+	}
+	conclusion := s.handshakePacket(5, flags, initialSequence, srtHandshakeConclusion, cookie)
+	hsReq := make([]byte, 12)
+	binary.BigEndian.PutUint32(hsReq, srtVersion)
+	binary.BigEndian.PutUint32(hsReq[4:], srtHsReqFlags)
+	binary.BigEndian.PutUint32(hsReq[8:], srtLatencyMillis<<16|srtLatencyMillis)
+	conclusion = appendSrtExtension(conclusion, srtExtensionHsReq, hsReq)
+	if streamId != "" {
+		conclusion = appendSrtExtension(conclusion, srtExtensionStreamId, srtStreamIdWords(streamId))
+	}
+	response, err = s.handshakeRequest(conclusion, srtHandshakeConclusion, deadline)
+	if err != nil {
+		return err
+	}
+	s.peerId = binary.BigEndian.Uint32(response[24:])
+	return nil
+}
+
+// handshakeRequest sends the given handshake packet until a handshake response of the given type is received.
+// Returns the control information field of the response.
+func (s *SrtStream) handshakeRequest(request []byte, handshakeType uint32, deadline time.Time) ([]byte, error) {
+	for {
+		if err := s.sendPacket(srtControlFlag|srtControlHandshake<<16, 0, request); err != nil {
+			return nil, err
+		}
+		retry := time.Now().Add(srtHandshakeRetryInterval)
+		if deadline.Before(retry) {
+			retry = deadline
+		}
+		for {
+			packet, err := s.read(retry)
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				if time.Now().Before(deadline) {
+					break
+				}
+				return nil, categorizedError(TimeoutError, fmt.Errorf("Timeout after %v waiting for the SRT handshake with %v", s.TimeoutDuration, s.Endpoint.url))
+			} else if err != nil {
+				return nil, err
+			}
+			if len(packet) < srtHeaderSize+srtHandshakeSize || binary.BigEndian.Uint32(packet) != srtControlFlag|srtControlHandshake<<16 {
+				continue
+			}
+			response := packet[srtHeaderSize:]
+			responseType := binary.BigEndian.Uint32(response[20:])
+			if responseType == handshakeType {
+				return response, nil
+			} else if responseType >= srtHandshakeRejected && responseType != srtHandshakeConclusion {
+				return nil, categorizedError(HandshakeError, fmt.Errorf("SRT listener %v rejected the connection (reason %v)", s.Endpoint.url, responseType-srtHandshakeRejected))
+			}
+		}
+	}
+}
+
+func (s *SrtStream) handshakePacket(version uint32, extension uint16, initialSequence, handshakeType, cookie uint32) []byte {
+	packet := make([]byte, srtHandshakeSize)
+	binary.BigEndian.PutUint32(packet, version)
+	binary.BigEndian.PutUint16(packet[6:], extension)
+	binary.BigEndian.PutUint32(packet[8:], initialSequence)
+	binary.BigEndian.PutUint32(packet[12:], 1500) // MTU
+	binary.BigEndian.PutUint32(packet[16:], 8192) // Flow window size
+	binary.BigEndian.PutUint32(packet[20:], handshakeType)
+	binary.BigEndian.PutUint32(packet[24:], s.socketId)
+	binary.BigEndian.PutUint32(packet[28:], cookie)
+	if addr, ok := s.conn.RemoteAddr().(*net.UDPAddr); ok {
+		if ip := addr.IP.To4(); ip != nil {
+			copy(packet[32:], ip)
+		} else {
+			copy(packet[32:], addr.IP)
+		}
+	}
+	return packet
+}
+
+func appendSrtExtension(packet []byte, extensionType uint16, content []byte) []byte {
+	var header [4]byte
+	binary.BigEndian.PutUint16(header[:], extensionType)
+	binary.BigEndian.PutUint16(header[2:], uint16(len(content)/4))
+	return append(append(packet, header[:]...), content...)
+}
+
+// srtStreamIdWords encodes the stream ID for the SID handshake extension. It is padded to full 32-bit words,
+// and the bytes of every word are reversed.
+func srtStreamIdWords(streamId string) []byte {
+	words := make([]byte, (len(streamId)+3)/4*4)
+	copy(words, streamId)
+	for i := 0; i < len(words); i += 4 {
+		binary.LittleEndian.PutUint32(words[i:], binary.BigEndian.Uint32(words[i:]))
+	}
+	return words
+}
+
+// srtSequenceAfter returns true if the sequence number a follows b, taking the wrap-around into account
+func srtSequenceAfter(a, b uint32) bool {
+	diff := (a - b) & srtSequenceMask
+	return diff != 0 && diff < srtSequenceMask/2
+}
+
+func (s *SrtStream) read(deadline time.Time) ([]byte, error) {
+	if err := s.conn.SetReadDeadline(deadline); err != nil {
+		return nil, err
+	}
+	num, err := s.conn.Read(s.buffer)
+	if err != nil {
+		return nil, err
+	}
+	s.wireBytes += uint64(num)
+	return s.buffer[:num], nil
+}
+
+func (s *SrtStream) sendAck() error {
+	s.ackNumber++
+	ack := make([]byte, 28)
+	binary.BigEndian.PutUint32(ack, s.ackSequence)
+	binary.BigEndian.PutUint32(ack[4:], 100000) // RTT in microseconds
+	binary.BigEndian.PutUint32(ack[8:], 50000)  // RTT variance
+	binary.BigEndian.PutUint32(ack[12:], 8192)  // Available buffer size in packets
+	s.unacked = false
+	s.lastAck = time.Now()
+	return s.sendControl(srtControlAck, s.ackNumber, ack)
+}
+
+func (s *SrtStream) sendControl(controlType uint16, typeInfo uint32, content []byte) error {
+	return s.sendPacket(srtControlFlag|uint32(controlType)<<16, typeInfo, content)
+}
+
+func (s *SrtStream) sendPacket(first, second uint32, content []byte) error {
+	packet := make([]byte, srtHeaderSize, srtHeaderSize+len(content))
+	binary.BigEndian.PutUint32(packet, first)
+	binary.BigEndian.PutUint32(packet[4:], second)
+	binary.BigEndian.PutUint32(packet[8:], uint32(time.Since(s.started).Microseconds()))
+	binary.BigEndian.PutUint32(packet[12:], s.peerId)
+	_, err := s.conn.Write(append(packet, content...))
+	s.lastSent = time.Now()
+	return err
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	testAssert "github.com/stretchr/testify/require"
+)
+
+const mockSrtCookie = 0x1234
+
+// mockSrtListener answers the SRT handshake of one caller on a loopback UDP socket. After the conclusion, it sends
+// one data packet for each of the given payloads. The stream IDs requested by the caller and the acknowledged
+// sequence numbers are reported through the channels.
+type mockSrtListener struct {
+	conn     *net.UDPConn
+	payloads [][]byte
+	reject   uint32   // If set, the conclusion is answered with this rejection reason
+	sequence []uint32 // Sequence numbers of the payloads, defaults to their index
+
+	streamIds chan string
+	acks      chan uint32
+	caller    *net.UDPAddr
+	callerId  uint32
+}
+
+func newMockSrtListener(t *testing.T, payloads ...string) *mockSrtListener {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	testAssert.NoError(t, err)
+	listener := &mockSrtListener{
+		conn:      conn,
+		streamIds: make(chan string, 10),
+		acks:      make(chan uint32, 1000),
+	}
+	for _, payload := range payloads {
+		listener.payloads = append(listener.payloads, []byte(payload))
+	}
+	return listener
+}
+
+func (l *mockSrtListener) url(query string) string {
+	return "srt://" + l.conn.LocalAddr().String() + query
+}
+
+func (l *mockSrtListener) serve() {
+	buffer := make([]byte, maxDatagramSize)
+	for {
+		num, addr, err := l.conn.ReadFromUDP(buffer)
+		if err != nil {
+			return
+		}
+		packet := buffer[:num]
+		switch binary.BigEndian.Uint32(packet) {
+		case srtControlFlag | srtControlAck<<16:
+			l.acks <- binary.BigEndian.Uint32(packet[srtHeaderSize:])
+		case srtControlFlag | srtControlHandshake<<16:
+			request := packet[srtHeaderSize:]
+			response := append([]byte(nil), request[:srtHandshakeSize]...)
+			switch binary.BigEndian.Uint32(request[20:]) {
+			case srtHandshakeInduction:
+				binary.BigEndian.PutUint32(response, 5)
+				binary.BigEndian.PutUint16(response[6:], srtHandshakeMagic)
+				binary.BigEndian.PutUint32(response[28:], mockSrtCookie)
+				l.send(addr, srtControlFlag, 0, response)
+			case srtHandshakeConclusion:
+				if binary.BigEndian.Uint32(request[28:]) != mockSrtCookie {
+					continue
+				}
+				for extensions := request[srtHandshakeSize:]; len(extensions) >= 4; {
+					size := 4 + 4*int(binary.BigEndian.Uint16(extensions[2:]))
+					if binary.BigEndian.Uint16(extensions) == srtExtensionStreamId {
+						l.streamIds <- strings.TrimRight(string(srtStreamIdWords(string(extensions[4:size]))), "\x00")
+					}
+					extensions = extensions[size:]
+				}
+				callerId := binary.BigEndian.Uint32(request[24:])
+				if l.reject != 0 {
+					binary.BigEndian.PutUint32(response[20:], srtHandshakeRejected+l.reject)
+					l.send(addr, srtControlFlag, callerId, response)
+					continue
+				}
+				binary.BigEndian.PutUint32(response[24:], 77)
+				l.send(addr, srtControlFlag, callerId, response)
+				l.caller, l.callerId = addr, callerId
+				for i, payload := range l.payloads {
+					sequence := uint32(i)
+					if i < len(l.sequence) {
+						sequence = l.sequence[i]
+					}
+					l.send(addr, sequence, callerId, payload)
+				}
+			}
+		}
+	}
+}
+
+func (l *mockSrtListener) send(addr *net.UDPAddr, first, destination uint32, content []byte) {
+	packet := make([]byte, srtHeaderSize)
+	binary.BigEndian.PutUint32(packet, first)
+	binary.BigEndian.PutUint32(packet[12:], destination)
+	_, _ = l.conn.WriteToUDP(append(packet, content...), addr)
+}
+
+// shutdown must only be called after an ACK was received, so the caller is known
+func (l *mockSrtListener) shutdown() {
+	l.send(l.caller, srtControlFlag|srtControlShutdown<<16, l.callerId, make([]byte, 4))
+}
+
+func TestSrtStream(t *testing.T) {
+	assert := testAssert.New(t)
+	listener := newMockSrtListener(t, "first packet", "second", strings.Repeat("x", 1316))
+	defer listener.conn.Close()
+	go listener.serve()
+	factory := newTestFactory(t, listener.url("?streamid=%23%21%3A%3Ar%3Dlive%2Ftest"))
+	assert.IsType(&SrtStreamFactory{}, factory.delegateFactory(factory.allEndpoints()[0].url))
+
+	stream, err := factory.OpenStream(context.Background())
+	assert.NoError(err)
+	defer stream.Close()
+	assert.IsType(&SrtStream{}, stream)
+	assert.Equal("#!::r=live/test", <-listener.streamIds)
+
+	expectedWireBytes := 2 * (srtHeaderSize + srtHandshakeSize)
+	for _, payload := range listener.payloads {
+		num, packetType, err := stream.Receive()
+		assert.NoError(err)
+		assert.Equal(len(payload), num)
+		assert.Equal(NoPacket, packetType)
+		assert.Equal(payload, stream.(PayloadReceiver).Payload())
+		expectedWireBytes += srtHeaderSize + len(payload)
+	}
+
+	// The received packets are acknowledged while waiting for more data
+	go func() {
+		for ack := range listener.acks {
+			if ack == uint32(len(listener.payloads)) {
+				listener.shutdown()
+				return
+			}
+		}
+	}()
+	_, _, err = stream.Receive()
+	assert.Equal(io.EOF, err)
+	expectedWireBytes += srtHeaderSize + 4
+	wireBytes, ok := stream.(WireByteCounter).WireBytes()
+	assert.True(ok)
+	assert.Equal(uint64(expectedWireBytes), wireBytes)
+}
+
+func TestSrtStreamLostAndDuplicatePackets(t *testing.T) {
+	assert := testAssert.New(t)
+	listener := newMockSrtListener(t, "first", "second", "retransmitted", "after gap", "late")
+	listener.sequence = []uint32{0, 1, 1, 4, 2}
+	defer listener.conn.Close()
+	go listener.serve()
+	factory := newTestFactory(t, listener.url(""))
+	stream, err := factory.OpenStream(context.Background())
+	assert.NoError(err)
+	defer stream.Close()
+
+	// Packets at or below the acknowledged sequence number are dropped, the skipped sequence numbers are lost
+	for _, payload := range []string{"first", "second", "after gap"} {
+		num, _, err := stream.Receive()
+		assert.NoError(err)
+		assert.Equal(payload, string(stream.(PayloadReceiver).Payload()[:num]))
+	}
+	assert.Equal(uint64(2), stream.(PacketLossCounter).LostPackets())
+	go func() {
+		for ack := range listener.acks {
+			if ack == 5 {
+				listener.shutdown()
+				return
+			}
+		}
+	}()
+	_, _, err = stream.Receive()
+	assert.Equal(io.EOF, err)
+	assert.Equal(uint64(2), stream.(PacketLossCounter).LostPackets())
+}
+
+func TestSrtStreamErrors(t *testing.T) {
+	assert := testAssert.New(t)
+
+	// A rejected connection is a handshake error
+	listener := newMockSrtListener(t)
+	defer listener.conn.Close()
+	listener.reject = 3
+	go listener.serve()
+	factory := newTestFactory(t, listener.url(""))
+	factory.TimeoutDuration = 100 * time.Millisecond
+	_, err := factory.OpenStream(context.Background())
+	assert.Error(err)
+	assert.Contains(err.Error(), "rejected the connection (reason 3)")
+	assert.Equal(HandshakeError, categorizeError(err, DialError))
+
+	// Without data, receiving times out
+	idle := newMockSrtListener(t)
+	defer idle.conn.Close()
+	go idle.serve()
+	factory = newTestFactory(t, idle.url(""))
+	factory.TimeoutDuration = 100 * time.Millisecond
+	stream, err := factory.OpenStream(context.Background())
+	assert.NoError(err)
+	defer stream.Close()
+	_, _, err = stream.Receive()
+	assert.Error(err)
+	assert.Equal(TimeoutError, categorizeError(err, ReadError))
+
+	// A listener that does not respond times out
+	silent := newMockSrtListener(t)
+	defer silent.conn.Close()
+	factory = newTestFactory(t, silent.url(""))
+	factory.TimeoutDuration = 100 * time.Millisecond
+	_, err = factory.OpenStream(context.Background())
+	assert.Error(err)
+	assert.Equal(TimeoutError, categorizeError(err, DialError))
+
+	// SRT URLs require a port
+	target, err := url.Parse("srt://example.com?streamid=test")
+	assert.NoError(err)
+	assert.Error(validateEndpointURL(target, ""))
+}
@@ -1,7 +1,11 @@
 package main
 
 import (
+	"fmt"
 	"math"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -9,8 +13,12 @@ import (
 	"github.com/bitflow-stream/go-bitflow/bitflow"
 )
 
+// TwoWayCounter is a value that can be increased and decreased. It records the peak value since the counter was created
+// and the peak value since the last call to ComputeIntervalPeak.
 type TwoWayCounter struct {
-	value int64
+	value        int64
+	peak         int64
+	intervalPeak int64
 }
 
 func (c *TwoWayCounter) Get() bitflow.Value {
@@ -18,57 +26,424 @@ func (c *TwoWayCounter) Get() bitflow.Value {
 }
 
 func (c *TwoWayCounter) Increment(val int64) {
-	atomic.AddInt64(&c.value, val)
+	newValue := atomic.AddInt64(&c.value, val)
+	if val > 0 {
+		raisePeak(&c.peak, newValue)
+		raisePeak(&c.intervalPeak, newValue)
+	}
+}
+
+// Peak returns the highest value since the counter was created, or since the last call to ResetPeak
+func (c *TwoWayCounter) Peak() bitflow.Value {
+	return bitflow.Value(atomic.LoadInt64(&c.peak))
+}
+
+// ResetPeak sets the peak to the current value
+func (c *TwoWayCounter) ResetPeak() {
+	atomic.StoreInt64(&c.peak, atomic.LoadInt64(&c.value))
+	// Concurrent increments might have been overwritten
+	raisePeak(&c.peak, atomic.LoadInt64(&c.value))
+}
+
+// ComputeIntervalPeak returns the highest value since the last call and resets the interval peak to the current value
+func (c *TwoWayCounter) ComputeIntervalPeak() bitflow.Value {
+	peak := atomic.SwapInt64(&c.intervalPeak, math.MinInt64)
+	// Concurrent increments might have raised the peak in the meantime, so only raise it to the current value
+	raisePeak(&c.intervalPeak, atomic.LoadInt64(&c.value))
+	if current := atomic.LoadInt64(&c.value); peak < current {
+		peak = current
+	}
+	return bitflow.Value(peak)
+}
+
+// raisePeak atomically replaces the peak with the value, if the value is larger
+func raisePeak(peak *int64, value int64) {
+	for {
+		current := atomic.LoadInt64(peak)
+		if value <= current || atomic.CompareAndSwapInt64(peak, current, value) {
+			return
+		}
+	}
 }
 
 type IncrementedCounter struct {
 	current  uint64
 	previous uint64
+	base     uint64 // Value of current at the last call to ResetTotal, accessed atomically
 }
 
+// Get returns the total of all increments since the counter was created. It is not affected by ResetTotal.
 func (c *IncrementedCounter) Get() bitflow.Value {
 	return bitflow.Value(atomic.LoadUint64(&c.current))
 }
 
+// GetSinceReset returns the total of all increments since the last call to ResetTotal
+func (c *IncrementedCounter) GetSinceReset() bitflow.Value {
+	return bitflow.Value(atomic.LoadUint64(&c.current) - atomic.LoadUint64(&c.base))
+}
+
+// ResetTotal makes the total returned by GetSinceReset and ComputeDiff start from 0 again. The values per second
+// computed by ComputeDiff and the total returned by Get are not affected.
+func (c *IncrementedCounter) ResetTotal() {
+	atomic.StoreUint64(&c.base, atomic.LoadUint64(&c.current))
+}
+
 func (c *IncrementedCounter) Increment(val uint64) {
 	atomic.AddUint64(&c.current, val)
 }
 
+// ComputeDiff returns the total since the last call to ResetTotal and the increments per second since the last call
 func (c *IncrementedCounter) ComputeDiff(timeDiff time.Duration) (bitflow.Value, bitflow.Value) {
 	current := atomic.LoadUint64(&c.current)
 	previous := c.previous
 	c.previous = current
-	diff := current - previous
-	if current < previous {
-		// Value overflow
-		diff = math.MaxUint64 - previous + current
+	diff := current - previous // Unsigned arithmetic also handles an overflow of the counter correctly
+	diffPerSecond := 0.0
+	if timeDiff > 0 {
+		diffPerSecond = float64(diff) / timeDiff.Seconds()
 	}
-	diffPerSecond := float64(diff) / timeDiff.Seconds()
-	return bitflow.Value(current), bitflow.Value(diffPerSecond)
+	return bitflow.Value(current - atomic.LoadUint64(&c.base)), bitflow.Value(diffPerSecond)
 }
 
 type AveragingCounter struct {
 	count uint
-	value float64
+	mean  float64
+	m2    float64 // Sum of squared differences from the mean, updated with Welford's algorithm
+	min   float64
+	max   float64
 	lock  sync.Mutex
 }
 
+// AveragingStatistics summarizes the values added to an AveragingCounter during one interval
+type AveragingStatistics struct {
+	Avg    bitflow.Value
+	Min    bitflow.Value
+	Max    bitflow.Value
+	Stddev bitflow.Value // Population standard deviation
+}
+
 func (avg *AveragingCounter) Add(val float64) {
 	avg.lock.Lock()
 	defer avg.lock.Unlock()
+	if avg.count == 0 || val < avg.min {
+		avg.min = val
+	}
+	if avg.count == 0 || val > avg.max {
+		avg.max = val
+	}
 	avg.count++
-	avg.value += val
+	delta := val - avg.mean
+	avg.mean += delta / float64(avg.count)
+	avg.m2 += delta * (val - avg.mean)
 }
 
 func (avg *AveragingCounter) ComputeAvg() bitflow.Value {
+	return avg.ComputeStats().Avg
+}
+
+// ComputeStats returns the statistics of the values added since the last computation
+// and resets the counter. All values are 0, if no values were added.
+func (avg *AveragingCounter) ComputeStats() AveragingStatistics {
 	avg.lock.Lock()
-	count := avg.count
-	value := avg.value
+	count, mean, m2, min, max := avg.count, avg.mean, avg.m2, avg.min, avg.max
 	avg.count = 0
-	avg.value = 0
+	avg.mean = 0
+	avg.m2 = 0
+	avg.min = 0
+	avg.max = 0
 	avg.lock.Unlock()
 	if count == 0 {
-		return bitflow.Value(0)
+		return AveragingStatistics{}
+	}
+	return AveragingStatistics{
+		Avg:    bitflow.Value(mean),
+		Min:    bitflow.Value(min),
+		Max:    bitflow.Value(max),
+		Stddev: bitflow.Value(math.Sqrt(m2 / float64(count))),
+	}
+}
+
+// StreamingQuantile estimates quantiles with the P² algorithm (Jain and Chlamtac, 1985), which keeps five markers
+// per quantile instead of storing the values. Every added value is processed in constant time and memory.
+// For smooth distributions, the estimates are usually within 1% of the value range of the exact quantiles.
+// The zero value estimates the default quantiles 0.5, 0.95 and 0.99.
+type StreamingQuantile struct {
+	Quantiles []float64 // In the range [0, 1], must not be changed after adding values
+
+	estimators []p2Estimator
+	lock       sync.Mutex
+}
+
+var defaultStreamingQuantiles = []float64{0.5, 0.95, 0.99}
+
+func (q *StreamingQuantile) Add(val float64) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.estimators == nil {
+		q.reset()
+	}
+	for i := range q.estimators {
+		q.estimators[i].add(val)
+	}
+}
+
+// ComputeQuantiles returns the estimated quantiles of the values added since the last call and resets the estimators.
+// If no values were added, all quantiles are 0.
+func (q *StreamingQuantile) ComputeQuantiles() []bitflow.Value {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.estimators == nil {
+		q.reset()
+	}
+	result := make([]bitflow.Value, len(q.estimators))
+	for i := range q.estimators {
+		result[i] = bitflow.Value(q.estimators[i].estimate())
+	}
+	q.reset()
+	return result
+}
+
+func (q *StreamingQuantile) reset() {
+	quantiles := q.Quantiles
+	if len(quantiles) == 0 {
+		quantiles = defaultStreamingQuantiles
+	}
+	q.estimators = make([]p2Estimator, len(quantiles))
+	for i, quantile := range quantiles {
+		q.estimators[i] = p2Estimator{
+			quantile:  quantile,
+			desired:   [5]float64{1, 1 + 2*quantile, 1 + 4*quantile, 3 + 2*quantile, 5},
+			increment: [5]float64{0, quantile / 2, quantile, (1 + quantile) / 2, 1},
+		}
+	}
+}
+
+// p2Estimator estimates one quantile. The heights of the markers approximate the minimum, the quantile/2, quantile,
+// (1+quantile)/2 quantiles and the maximum of the values.
+type p2Estimator struct {
+	quantile  float64
+	count     int
+	heights   [5]float64
+	positions [5]float64 // Actual marker positions, always integers
+	desired   [5]float64
+	increment [5]float64
+}
+
+func (e *p2Estimator) add(val float64) {
+	if e.count < 5 {
+		e.heights[e.count] = val
+		e.count++
+		if e.count == 5 {
+			sort.Float64s(e.heights[:])
+			e.positions = [5]float64{1, 2, 3, 4, 5}
+		}
+		return
+	}
+	e.count++
+
+	// Find the cell containing the value and adjust the extreme markers
+	var cell int
+	switch {
+	case val < e.heights[0]:
+		e.heights[0] = val
+		cell = 0
+	case val >= e.heights[4]:
+		e.heights[4] = val
+		cell = 3
+	default:
+		for val >= e.heights[cell+1] {
+			cell++
+		}
+	}
+	for i := cell + 1; i < 5; i++ {
+		e.positions[i]++
+	}
+	for i := range e.desired {
+		e.desired[i] += e.increment[i]
+	}
+
+	// Move the middle markers towards their desired positions, if necessary
+	for i := 1; i < 4; i++ {
+		diff := e.desired[i] - e.positions[i]
+		if (diff >= 1 && e.positions[i+1]-e.positions[i] > 1) || (diff <= -1 && e.positions[i-1]-e.positions[i] < -1) {
+			direction := math.Copysign(1, diff)
+			height := e.parabolic(i, direction)
+			if height <= e.heights[i-1] || height >= e.heights[i+1] {
+				height = e.linear(i, direction)
+			}
+			e.heights[i] = height
+			e.positions[i] += direction
+		}
+	}
+}
+
+func (e *p2Estimator) parabolic(i int, d float64) float64 {
+	h, n := e.heights, e.positions
+	return h[i] + d/(n[i+1]-n[i-1])*((n[i]-n[i-1]+d)*(h[i+1]-h[i])/(n[i+1]-n[i])+(n[i+1]-n[i]-d)*(h[i]-h[i-1])/(n[i]-n[i-1]))
+}
+
+func (e *p2Estimator) linear(i int, d float64) float64 {
+	j := i + int(d)
+	return e.heights[i] + d*(e.heights[j]-e.heights[i])/(e.positions[j]-e.positions[i])
+}
+
+// estimate returns the height of the middle marker, or of the extreme markers for the quantiles 0 and 1.
+// With less than five values, the exact quantile is returned.
+func (e *p2Estimator) estimate() float64 {
+	if e.count == 0 {
+		return 0
+	}
+	if e.count < 5 {
+		values := append([]float64(nil), e.heights[:e.count]...)
+		sort.Float64s(values)
+		index := int(math.Ceil(e.quantile*float64(len(values)))) - 1
+		if index < 0 {
+			index = 0
+		}
+		return values[index]
+	}
+	switch {
+	case e.quantile <= 0:
+		return e.heights[0]
+	case e.quantile >= 1:
+		return e.heights[4]
+	}
+	return e.heights[2]
+}
+
+// HistogramCounter counts values in buckets defined by ascending upper boundaries. Values larger than
+// the last boundary are counted in an additional overflow bucket. It implements flag.Value to parse
+// the bucket boundaries from a comma-separated list of byte sizes with optional K/M/G suffixes.
+type HistogramCounter struct {
+	boundaries []uint64
+	counts     []uint64
+}
+
+const defaultPacketSizeBuckets = "0,256,1K,4K,16K,64K"
+
+func (h *HistogramCounter) String() string {
+	names := make([]string, len(h.boundaries))
+	for i, boundary := range h.boundaries {
+		names[i] = formatByteSize(boundary)
+	}
+	return strings.Join(names, ",")
+}
+
+func (h *HistogramCounter) Set(value string) error {
+	var boundaries []uint64
+	for _, part := range strings.Split(value, ",") {
+		boundary, err := parseByteSize(strings.TrimSpace(part))
+		if err != nil {
+			return err
+		}
+		if len(boundaries) > 0 && boundary <= boundaries[len(boundaries)-1] {
+			return fmt.Errorf("Histogram bucket boundaries must be strictly ascending, but %v follows %v",
+				formatByteSize(boundary), formatByteSize(boundaries[len(boundaries)-1]))
+		}
+		boundaries = append(boundaries, boundary)
+	}
+	h.boundaries = boundaries
+	h.counts = make([]uint64, len(boundaries)+1)
+	return nil
+}
+
+func (h *HistogramCounter) Add(val uint64) {
+	bucket := sort.Search(len(h.boundaries), func(i int) bool {
+		return val <= h.boundaries[i]
+	})
+	atomic.AddUint64(&h.counts[bucket], 1)
+}
+
+// ComputeCounts returns the number of values per bucket since the last computation and resets the counts
+func (h *HistogramCounter) ComputeCounts() []bitflow.Value {
+	result := make([]bitflow.Value, len(h.counts))
+	for i := range h.counts {
+		result[i] = bitflow.Value(atomic.SwapUint64(&h.counts[i], 0))
+	}
+	return result
+}
+
+// Fields returns one field name per bucket, using the given prefix
+func (h *HistogramCounter) Fields(prefix string) []string {
+	fields := make([]string, 0, len(h.boundaries)+1)
+	for _, boundary := range h.boundaries {
+		fields = append(fields, prefix+"_le_"+formatByteSize(boundary))
+	}
+	if len(h.boundaries) > 0 {
+		fields = append(fields, prefix+"_gt_"+formatByteSize(h.boundaries[len(h.boundaries)-1]))
+	} else {
+		fields = append(fields, prefix+"_all")
+	}
+	return fields
+}
+
+// MovingAverage is an exponentially weighted moving average. It is not synchronized, because it is only updated when
+// computing samples.
+type MovingAverage struct {
+	value       float64
+	initialized bool
+}
+
+// Update adds a new value, weighted with the given smoothing factor alpha between 0 and 1, and returns the new average.
+// Higher values of alpha discount older values faster. The first value initializes the average.
+func (m *MovingAverage) Update(val float64, alpha float64) bitflow.Value {
+	if m.initialized {
+		m.value = alpha*val + (1-alpha)*m.value
+	} else {
+		m.value = val
+		m.initialized = true
+	}
+	return bitflow.Value(m.value)
+}
+
+// ByteSize implements flag.Value to parse a number of bytes with optional K/M/G suffix
+type ByteSize uint64
+
+func (b *ByteSize) String() string {
+	return formatByteSize(uint64(*b))
+}
+
+func (b *ByteSize) Set(value string) error {
+	size, err := parseByteSize(strings.TrimSpace(value))
+	if err != nil {
+		return err
+	}
+	*b = ByteSize(size)
+	return nil
+}
+
+var byteSizeSuffixes = []string{"", "K", "M", "G"}
+
+func parseByteSize(value string) (uint64, error) {
+	for i := len(byteSizeSuffixes) - 1; i > 0; i-- {
+		if suffix := byteSizeSuffixes[i]; strings.HasSuffix(value, suffix) {
+			number, err := strconv.ParseUint(strings.TrimSuffix(value, suffix), 10, 64)
+			if err != nil {
+				return 0, fmt.Errorf("Failed to parse byte size '%v': %v", value, err)
+			}
+			return number << (10 * uint(i)), nil
+		}
+	}
+	number, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("Failed to parse byte size '%v': %v", value, err)
+	}
+	return number, nil
+}
+
+func formatByteSize(size uint64) string {
+	suffix := 0
+	for size != 0 && size%1024 == 0 && suffix < len(byteSizeSuffixes)-1 {
+		size /= 1024
+		suffix++
+	}
+	return strconv.FormatUint(size, 10) + byteSizeSuffixes[suffix]
+}
+
+// safeDivide returns 0 instead of an infinite or undefined value when dividing by zero
+func safeDivide(value, divisor bitflow.Value) bitflow.Value {
+	if divisor == 0 {
+		return 0
 	}
-	return bitflow.Value(value / float64(count))
+	return value / divisor
 }
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bitflow-stream/go-bitflow/bitflow"
+	testAssert "github.com/stretchr/testify/require"
+)
+
+func toFloats(values []bitflow.Value) []float64 {
+	result := make([]float64, len(values))
+	for i, value := range values {
+		result[i] = float64(value)
+	}
+	return result
+}
+
+// exactQuantile returns the smallest of the sorted values, for which the given fraction of the values is less or equal.
+// For fewer than five values, StreamingQuantile returns this quantile exactly.
+func exactQuantile(sorted []float64, quantile float64) float64 {
+	index := int(math.Ceil(quantile*float64(len(sorted)))) - 1
+	if index < 0 {
+		index = 0
+	}
+	return sorted[index]
+}
+
+func TestStreamingQuantile(t *testing.T) {
+	assert := testAssert.New(t)
+	rnd := rand.New(rand.NewSource(1))
+	distributions := map[string]func() float64{
+		"uniform":     rnd.Float64,
+		"normal":      func() float64 { return 10 + 2*rnd.NormFloat64() },
+		"exponential": rnd.ExpFloat64,
+	}
+	for name, sample := range distributions {
+		var q StreamingQuantile
+		values := make([]float64, 50000)
+		for i := range values {
+			values[i] = sample()
+			q.Add(values[i])
+		}
+		sort.Float64s(values)
+		// The documented error bound is 1% of the value range
+		bound := 0.01 * (values[len(values)-1] - values[0])
+		estimates := q.ComputeQuantiles()
+		for i, quantile := range defaultStreamingQuantiles {
+			assert.InDelta(exactQuantile(values, quantile), float64(estimates[i]), bound, "Quantile %v of %v distribution", quantile, name)
+		}
+	}
+}
+
+func TestStreamingQuantileFewValues(t *testing.T) {
+	assert := testAssert.New(t)
+	q := StreamingQuantile{Quantiles: []float64{0, 0.5, 1}}
+	assert.Equal([]float64{0, 0, 0}, toFloats(q.ComputeQuantiles()))
+	for _, val := range []float64{4, 1, 3} {
+		q.Add(val)
+	}
+	assert.Equal([]float64{1, 3, 4}, toFloats(q.ComputeQuantiles()))
+
+	// The estimators are reset after computing the quantiles, the extreme markers are exact
+	for i := 10; i > 0; i-- {
+		q.Add(float64(i))
+	}
+	estimates := toFloats(q.ComputeQuantiles())
+	assert.Equal(1.0, estimates[0])
+	assert.InDelta(5.5, estimates[1], 1)
+	assert.Equal(10.0, estimates[2])
+	assert.Equal([]float64{0, 0, 0}, toFloats(q.ComputeQuantiles()))
+}
+
+func TestStreamingQuantileConcurrently(t *testing.T) {
+	assert := testAssert.New(t)
+	var q StreamingQuantile
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			rnd := rand.New(rand.NewSource(seed))
+			for j := 0; j < 5000; j++ {
+				q.Add(1000 * rnd.Float64())
+			}
+		}(int64(i))
+	}
+	wg.Wait()
+	estimates := toFloats(q.ComputeQuantiles())
+	assert.InDelta(500, estimates[0], 10)
+	assert.InDelta(950, estimates[1], 10)
+	assert.InDelta(990, estimates[2], 10)
+}
+
+func TestAveragingCounterMinMax(t *testing.T) {
+	assert := testAssert.New(t)
+	var avg AveragingCounter
+	for _, val := range []float64{3, 1, 4, 1, 5, 9, 2, 6} {
+		avg.Add(val)
+	}
+	stats := avg.ComputeStats()
+	assert.InDelta(31.0/8, float64(stats.Avg), 1e-12)
+	assert.Equal(1.0, float64(stats.Min))
+	assert.Equal(9.0, float64(stats.Max))
+
+	// Reset after computation
+	assert.Equal(AveragingStatistics{}, avg.ComputeStats())
+
+	// The minimum is not influenced by the reset value of 0
+	avg.Add(7)
+	avg.Add(8)
+	assert.Equal(AveragingStatistics{Avg: 7.5, Min: 7, Max: 8, Stddev: 0.5}, avg.ComputeStats())
+}
+
+func TestAveragingCounterStddev(t *testing.T) {
+	assert := testAssert.New(t)
+	var avg AveragingCounter
+	for _, val := range []float64{2, 4, 4, 4, 5, 5, 7, 9} {
+		avg.Add(val)
+	}
+	stats := avg.ComputeStats()
+	assert.InDelta(5, float64(stats.Avg), 1e-12)
+	assert.InDelta(2, float64(stats.Stddev), 1e-12)
+
+	// Large offsets do not destroy the precision
+	for _, val := range []float64{2, 4, 4, 4, 5, 5, 7, 9} {
+		avg.Add(1e9 + val)
+	}
+	assert.InDelta(2, float64(avg.ComputeStats().Stddev), 1e-6)
+
+	avg.Add(3)
+	assert.Equal(0.0, float64(avg.ComputeStats().Stddev))
+}
+
+func TestIncrementedCounterOverflow(t *testing.T) {
+	assert := testAssert.New(t)
+	c := IncrementedCounter{current: math.MaxUint64 - 4, previous: math.MaxUint64 - 9}
+	_, diff := c.ComputeDiff(time.Second)
+	assert.Equal(5.0, float64(diff))
+
+	// Wrap around: 4 increments up to MaxUint64, 1 increment to 0, and 11 more
+	c.Increment(16)
+	current, diff := c.ComputeDiff(time.Second)
+	assert.Equal(11.0, float64(current))
+	assert.Equal(16.0, float64(diff))
+}
+
+func TestIncrementedCounterResetTotal(t *testing.T) {
+	assert := testAssert.New(t)
+	var c IncrementedCounter
+	c.Increment(30)
+	c.ComputeDiff(time.Second)
+	c.Increment(10)
+	c.ResetTotal()
+	assert.Equal(0.0, float64(c.GetSinceReset()))
+	assert.Equal(40.0, float64(c.Get()))
+
+	// The increments before the reset still count for the next value per second
+	c.Increment(5)
+	total, diff := c.ComputeDiff(time.Second)
+	assert.Equal(5.0, float64(total))
+	assert.Equal(15.0, float64(diff))
+	assert.Equal(5.0, float64(c.GetSinceReset()))
+	assert.Equal(45.0, float64(c.Get()))
+}
+
+func TestHistogramCounter(t *testing.T) {
+	assert := testAssert.New(t)
+	var h HistogramCounter
+	assert.NoError(h.Set(defaultPacketSizeBuckets))
+	assert.Equal(defaultPacketSizeBuckets, h.String())
+	assert.Equal([]string{"packets_le_0", "packets_le_256", "packets_le_1K", "packets_le_4K", "packets_le_16K",
+		"packets_le_64K", "packets_gt_64K"}, h.Fields("packets"))
+
+	for _, size := range []uint64{0, 1, 256, 257, 1024, 1025, 4096, 10000, 65536, 65537, 1000000} {
+		h.Add(size)
+	}
+	assert.Equal([]float64{1, 2, 2, 2, 1, 1, 2}, toFloats(h.ComputeCounts()))
+	assert.Equal([]float64{0, 0, 0, 0, 0, 0, 0}, toFloats(h.ComputeCounts()))
+
+	assert.NoError(h.Set("100,2M"))
+	assert.Equal([]string{"p_le_100", "p_le_2M", "p_gt_2M"}, h.Fields("p"))
+
+	for _, wrong := range []string{"", "1,1", "2,1", "1X", "-1", "1K,abc"} {
+		assert.Error(h.Set(wrong), wrong)
+	}
+}
+
+func TestTwoWayCounterPeak(t *testing.T) {
+	assert := testAssert.New(t)
+	var c TwoWayCounter
+	c.Increment(3)
+	c.Increment(-2)
+	c.Increment(1)
+	assert.Equal(2.0, float64(c.Get()))
+	assert.Equal(3.0, float64(c.Peak()))
+	assert.Equal(3.0, float64(c.ComputeIntervalPeak()))
+	// The interval peak starts at the current value
+	c.Increment(-1)
+	assert.Equal(2.0, float64(c.ComputeIntervalPeak()))
+	assert.Equal(1.0, float64(c.ComputeIntervalPeak()))
+	assert.Equal(3.0, float64(c.Peak()))
+
+	// Every goroutine holds one unit at a time, so the peak is reached when all goroutines are blocked
+	const numGoroutines = 50
+	var c2 TwoWayCounter
+	var started, release sync.WaitGroup
+	started.Add(numGoroutines)
+	release.Add(1)
+	var done sync.WaitGroup
+	done.Add(numGoroutines)
+	for i := 0; i < numGoroutines; i++ {
+		go func() {
+			defer done.Done()
+			for j := 0; j < 100; j++ {
+				c2.Increment(1)
+				c2.Increment(-1)
+			}
+			c2.Increment(1)
+			started.Done()
+			release.Wait()
+			c2.Increment(-1)
+		}()
+	}
+	started.Wait()
+	assert.Equal(float64(numGoroutines), float64(c2.Peak()))
+	release.Done()
+	done.Wait()
+	assert.Equal(0.0, float64(c2.Get()))
+	assert.Equal(float64(numGoroutines), float64(c2.Peak()))
+	assert.Equal(float64(numGoroutines), float64(c2.ComputeIntervalPeak()))
+	assert.Equal(0.0, float64(c2.ComputeIntervalPeak()))
+}
+
+func TestMovingAverage(t *testing.T) {
+	assert := testAssert.New(t)
+	var avg MovingAverage
+	assert.Equal(100.0, float64(avg.Update(100, 0.3)), "The first value initializes the average")
+	assert.Equal(100.0, float64(avg.Update(100, 0.3)))
+
+	// After a step change, the average approaches the new value monotonically without overshooting
+	previous := 100.0
+	for i := 0; i < 30; i++ {
+		value := float64(avg.Update(1000, 0.3))
+		assert.True(value > previous && value <= 1000, "Moving average must grow towards 1000, was %v and is %v", previous, value)
+		previous = value
+	}
+	assert.InDelta(1000, previous, 1)
+	assert.Equal(370.0, float64((&MovingAverage{value: 100, initialized: true}).Update(1000, 0.3)))
+}
+
+func TestSafeDivide(t *testing.T) {
+	assert := testAssert.New(t)
+	assert.Equal(bitflow.Value(2), safeDivide(10, 5))
+	assert.Equal(bitflow.Value(0), safeDivide(10, 0))
+	assert.Equal(bitflow.Value(0), safeDivide(0, 0))
+}
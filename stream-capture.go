@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const defaultCaptureMaxBytes = 100 * 1024 * 1024
+
+var captureFileNameRegex = regexp.MustCompile("[^a-zA-Z0-9._-]+")
+
+// StreamCapture writes the payload of the packets received by the first stream of every endpoint to one file per stream
+// in the directory Dir. Only streams implementing PayloadReceiver can be captured. When the files reach MaxBytes
+// in total, capturing stops. A nil StreamCapture does not capture any stream.
+type StreamCapture struct {
+	Dir      string
+	MaxBytes uint64
+
+	lock     sync.Mutex
+	captured map[*RtmpEndpoint]bool // Endpoints for which a stream was captured
+	files    int
+	bytes    uint64 // Total bytes written to all files
+}
+
+// captureFile receives the payload of one stream. A nil captureFile discards all data.
+type captureFile struct {
+	capture *StreamCapture
+	file    *os.File
+}
+
+// start creates a file for the given stream, if it is the first stream of its endpoint and it provides its payload.
+// Returns nil if the stream is not captured.
+func (c *StreamCapture) start(stream Stream) *captureFile {
+	if c == nil {
+		return nil
+	}
+	endpoint := stream.Info().Endpoint
+	if _, ok := stream.(PayloadReceiver); !ok || endpoint == nil {
+		return nil
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.captured[endpoint] || c.bytes >= c.MaxBytes {
+		return nil
+	}
+	if c.captured == nil {
+		c.captured = make(map[*RtmpEndpoint]bool)
+	}
+	c.captured[endpoint] = true
+	c.files++
+	name := fmt.Sprintf("%03d_%v.bin", c.files, captureFileNameRegex.ReplaceAllString(endpoint.url.Host+endpoint.url.Path, "_"))
+	path := filepath.Join(c.Dir, name)
+	file, err := os.Create(path)
+	if err != nil {
+		log.Warnf("Failed to create capture file for %v: %v", endpoint, err)
+		return nil
+	}
+	log.Infof("Capturing the received data of %v to %v", endpoint, path)
+	return &captureFile{capture: c, file: file}
+}
+
+// write appends the payload of the packet last received by the stream to the file. When the total size limit is
+// reached, the payload is truncated and the file is closed.
+func (f *captureFile) write(stream Stream) {
+	if f == nil || f.file == nil {
+		return
+	}
+	data := stream.(PayloadReceiver).Payload()
+	f.capture.lock.Lock()
+	remaining := f.capture.MaxBytes - f.capture.bytes
+	if uint64(len(data)) > remaining {
+		data = data[:remaining]
+	}
+	f.capture.bytes += uint64(len(data))
+	limitReached := f.capture.bytes >= f.capture.MaxBytes
+	f.capture.lock.Unlock()
+
+	if _, err := f.file.Write(data); err != nil {
+		log.Warnf("Failed to write capture file %v, stopping the capture: %v", f.file.Name(), err)
+		f.close()
+	} else if limitReached {
+		if len(data) > 0 {
+			log.Infof("Stopped capturing stream data after writing %v bytes", f.capture.MaxBytes)
+		}
+		f.close()
+	}
+}
+
+func (f *captureFile) close() {
+	if f == nil || f.file == nil {
+		return
+	}
+	if err := f.file.Close(); err != nil {
+		log.Warnf("Failed to close capture file %v: %v", f.file.Name(), err)
+	}
+	f.file = nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	testAssert "github.com/stretchr/testify/require"
+)
+
+// fakePayloadStream is a fakeStream that returns the given payloads, one per packet
+type fakePayloadStream struct {
+	fakeStream
+	payloads [][]byte
+	payload  []byte
+}
+
+func newFakePayloadStream(endpoint *RtmpEndpoint, payloads ...string) *fakePayloadStream {
+	stream := &fakePayloadStream{fakeStream: fakeStream{StreamInfo: StreamInfo{Endpoint: endpoint}}}
+	for _, payload := range payloads {
+		stream.packets = append(stream.packets, fakePacket{num: len(payload), packetType: VideoPacket})
+		stream.payloads = append(stream.payloads, []byte(payload))
+	}
+	return stream
+}
+
+func (s *fakePayloadStream) Receive() (int, PacketType, error) {
+	if len(s.payloads) > 0 {
+		s.payload = s.payloads[0]
+		s.payloads = s.payloads[1:]
+	}
+	return s.fakeStream.Receive()
+}
+
+func (s *fakePayloadStream) Payload() []byte {
+	return s.payload
+}
+
+func captureFiles(t *testing.T, dir string) map[string]string {
+	files, err := ioutil.ReadDir(dir)
+	testAssert.NoError(t, err)
+	result := make(map[string]string)
+	for _, file := range files {
+		content, err := ioutil.ReadFile(filepath.Join(dir, file.Name()))
+		testAssert.NoError(t, err)
+		result[file.Name()] = string(content)
+	}
+	return result
+}
+
+func TestStreamCapture(t *testing.T) {
+	assert := testAssert.New(t)
+	dir, err := ioutil.TempDir("", "capture")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+	factory := newTestFactory(t, "rtmp://host1/app/stream", "udp://host2:1234", "http://host3/file")
+	endpoints := factory.allEndpoints()
+	running := newTestRunningStream()
+	running.col.Capture = &StreamCapture{Dir: dir, MaxBytes: 20}
+
+	running.receiveStream(newFakePayloadStream(endpoints[0], "abc", "defg"), &HostStatistics{})
+	assert.Equal(map[string]string{"001_host1_app_stream.bin": "abcdefg"}, captureFiles(t, dir))
+
+	// Only the first stream of every endpoint is captured, streams without payload are ignored
+	running.receiveStream(newFakePayloadStream(endpoints[0], "other"), &HostStatistics{})
+	running.receiveStream(&fakeStream{StreamInfo: StreamInfo{Endpoint: endpoints[1]}, packets: []fakePacket{{num: 10}}}, &HostStatistics{})
+	assert.Len(captureFiles(t, dir), 1)
+
+	// The total size is limited
+	running.receiveStream(newFakePayloadStream(endpoints[1], "0123456789", "0123456789"), &HostStatistics{})
+	assert.Equal(map[string]string{"001_host1_app_stream.bin": "abcdefg", "002_host2_1234.bin": "0123456789012"},
+		captureFiles(t, dir))
+	assert.Nil(running.col.Capture.start(newFakePayloadStream(endpoints[2])))
+
+	// Without a capture, nothing is written
+	running.col.Capture = nil
+	running.receiveStream(newFakePayloadStream(endpoints[0], "abc"), &HostStatistics{})
+	assert.Len(captureFiles(t, dir), 2)
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+)
+
+// ErrorCategory classifies stream errors by the stage of the stream in which they occurred
+type ErrorCategory int
+
+const (
+	ConnectError   ErrorCategory = iota // Opening the stream failed for another reason
+	DialError                           // The connection to the server could not be established, e.g. the TCP dial failed
+	HandshakeError                      // The server was reachable, but the protocol handshake or the request failed
+	ReadError                           // Receiving data from an opened stream failed
+	TimeoutError                        // The server did not respond or stopped sending data in time
+	EOFError                            // The server closed the stream unexpectedly
+	numErrorCategories
+)
+
+var errorCategoryNames = [numErrorCategories]string{
+	ConnectError:   "connect",
+	DialError:      "dial",
+	HandshakeError: "handshake",
+	ReadError:      "read",
+	TimeoutError:   "timeout",
+	EOFError:       "eof",
+}
+
+func (c ErrorCategory) String() string {
+	return errorCategoryNames[c]
+}
+
+// CategorizedError marks an error with its ErrorCategory. The message of the wrapped error is not changed.
+type CategorizedError struct {
+	Category ErrorCategory
+	Err      error
+}
+
+func categorizedError(category ErrorCategory, err error) error {
+	return &CategorizedError{Category: category, Err: err}
+}
+
+func (e *CategorizedError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *CategorizedError) Unwrap() error {
+	return e.Err
+}
+
+// categorizeError returns the category of the given error. Errors that are not marked with a category are reported as
+// TimeoutError or EOFError if they are recognized as such, and as the given fallback category otherwise.
+func categorizeError(err error, fallback ErrorCategory) ErrorCategory {
+	var categorized *CategorizedError
+	if errors.As(err, &categorized) {
+		return categorized.Category
+	}
+	var netErr net.Error
+	if (errors.As(err, &netErr) && netErr.Timeout()) || errors.Is(err, context.DeadlineExceeded) {
+		return TimeoutError
+	}
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		return EOFError
+	}
+	return fallback
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+
+	testAssert "github.com/stretchr/testify/require"
+)
+
+type timeoutNetError struct{}
+
+func (timeoutNetError) Error() string   { return "i/o timeout" }
+func (timeoutNetError) Timeout() bool   { return true }
+func (timeoutNetError) Temporary() bool { return true }
+
+var _ net.Error = timeoutNetError{}
+
+func TestCategorizeError(t *testing.T) {
+	assert := testAssert.New(t)
+	plain := errors.New("Connection refused")
+	assert.Equal(ConnectError, categorizeError(plain, ConnectError))
+	assert.Equal(DialError, categorizeError(plain, DialError))
+	assert.Equal(ReadError, categorizeError(plain, ReadError))
+
+	// Explicit categories take precedence over the fallback, also when wrapped
+	handshake := categorizedError(HandshakeError, plain)
+	assert.Equal("Connection refused", handshake.Error())
+	assert.True(errors.Is(handshake, plain))
+	assert.Equal(HandshakeError, categorizeError(handshake, ReadError))
+	assert.Equal(HandshakeError, categorizeError(fmt.Errorf("Wrapped: %w", handshake), ReadError))
+
+	// Timeouts and unexpected EOFs are recognized without explicit category
+	assert.Equal(TimeoutError, categorizeError(&net.OpError{Op: "dial", Err: timeoutNetError{}}, DialError))
+	assert.Equal(TimeoutError, categorizeError(fmt.Errorf("Request failed: %w", context.DeadlineExceeded), ReadError))
+	assert.Equal(EOFError, categorizeError(io.ErrUnexpectedEOF, ReadError))
+	assert.Equal(ReadError, categorizeError(io.EOF, ReadError))
+}
+
+func TestErrorCategoryNames(t *testing.T) {
+	assert := testAssert.New(t)
+	var names []string
+	for category := ErrorCategory(0); category < numErrorCategories; category++ {
+		names = append(names, category.String())
+	}
+	assert.Equal([]string{"connect", "dial", "handshake", "read", "timeout", "eof"}, names)
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Stream lifecycle events written to the StreamEventLog
+const (
+	streamEventOpened    = "opened"
+	streamEventFirstByte = "firstByte"
+	streamEventError     = "error"
+	streamEventClosed    = "closed"
+)
+
+// StreamEventLog writes one JSON object per line for every lifecycle event of the streams.
+// A nil StreamEventLog discards all events. Writes of concurrent streams are serialized.
+type StreamEventLog struct {
+	Writer io.Writer
+	now    func() time.Time // Seam for testing, defaults to time.Now
+
+	lock sync.Mutex
+}
+
+type streamEvent struct {
+	Time  time.Time `json:"time"`
+	Event string    `json:"event"`
+	Host  string    `json:"host,omitempty"`
+	URL   string    `json:"url,omitempty"`
+	Error string    `json:"error,omitempty"`
+}
+
+// Log writes an event for the given endpoint, which can be nil if the event does not relate to a known endpoint
+func (l *StreamEventLog) Log(event string, endpoint *RtmpEndpoint, err error) {
+	if l == nil {
+		return
+	}
+	record := streamEvent{Event: event}
+	if l.now != nil {
+		record.Time = l.now()
+	} else {
+		record.Time = time.Now()
+	}
+	if endpoint != nil {
+		record.URL = endpoint.url.String()
+		if endpoint.host != nil {
+			record.Host = endpoint.host.host
+		}
+	}
+	if err != nil {
+		record.Error = err.Error()
+	}
+	line, marshalErr := json.Marshal(record)
+	if marshalErr != nil {
+		log.Warnln("Failed to encode stream event:", marshalErr)
+		return
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if _, writeErr := l.Writer.Write(append(line, '\n')); writeErr != nil {
+		log.Warnln("Failed to write stream event log:", writeErr)
+	}
+}
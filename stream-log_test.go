@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	testAssert "github.com/stretchr/testify/require"
+)
+
+func TestStreamEventLog(t *testing.T) {
+	assert := testAssert.New(t)
+	endpoints := newTestFactory(t, "rtmp://host/app/stream{{1 2}}").hosts[0].endpoints
+	var buf bytes.Buffer
+	running := newTestRunningStream()
+	running.col.StreamLog = &StreamEventLog{Writer: &buf, now: fakeClock(time.Second)}
+	opens := []func() (Stream, error){
+		func() (Stream, error) {
+			return &fakeStream{StreamInfo: StreamInfo{Endpoint: endpoints[0]}, packets: []fakePacket{{num: 10}}}, nil
+		},
+		func() (Stream, error) {
+			return nil, errors.New("Connection refused")
+		},
+		func() (Stream, error) {
+			return &fakeStream{StreamInfo: StreamInfo{Endpoint: endpoints[1]}, packets: []fakePacket{{err: errors.New("Broken pipe")}}}, nil
+		},
+	}
+	for _, open := range opens {
+		running.col.StreamFactory = &fakeStreamFactory{open: open}
+		running.handleStream()
+	}
+
+	var events []streamEvent
+	scanner := bufio.NewScanner(&buf)
+	for scanner.Scan() {
+		var event streamEvent
+		assert.NoError(json.Unmarshal(scanner.Bytes(), &event), scanner.Text())
+		events = append(events, event)
+	}
+	for i := range events {
+		assert.Equal(time.Unix(int64(i+1), 0).UTC(), events[i].Time.UTC())
+		events[i].Time = time.Time{}
+	}
+	assert.Equal([]streamEvent{
+		{Event: "opened", Host: "host:1935", URL: "rtmp://host/app/stream1"},
+		{Event: "firstByte", Host: "host:1935", URL: "rtmp://host/app/stream1"},
+		{Event: "closed", Host: "host:1935", URL: "rtmp://host/app/stream1"},
+		{Event: "error", Error: "Connection refused"},
+		{Event: "opened", Host: "host:1935", URL: "rtmp://host/app/stream2"},
+		{Event: "error", Host: "host:1935", URL: "rtmp://host/app/stream2", Error: "Broken pipe"},
+		{Event: "closed", Host: "host:1935", URL: "rtmp://host/app/stream2"},
+	}, events)
+
+	// Concurrent streams do not interleave their lines
+	buf.Reset()
+	running.col.StreamLog.now = nil
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				running.col.StreamLog.Log(streamEventOpened, endpoints[0], nil)
+			}
+		}()
+	}
+	wg.Wait()
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	assert.Len(lines, 100)
+	for _, line := range lines {
+		assert.True(json.Valid([]byte(line)), line)
+	}
+
+	// Without a log, events are discarded
+	var disabled *StreamEventLog
+	disabled.Log(streamEventOpened, endpoints[0], nil)
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// maxDatagramSize is the size of the receive buffer of each UDP stream, large enough for any UDP datagram
+const maxDatagramSize = 64 * 1024
+
+// isUdpURL returns true for udp:// URLs. Such endpoints are received via UdpStreamFactory.
+func isUdpURL(target *url.URL) bool {
+	return target.Scheme == "udp"
+}
+
+// StallError is returned by streams that did not receive any data within their timeout.
+// Such errors are counted as stalls instead of errors.
+type StallError struct {
+	Duration time.Duration
+}
+
+func (e *StallError) Error() string {
+	return fmt.Sprintf("Stalled for %v", e.Duration)
+}
+
+// UdpStreamFactory receives raw datagrams, e.g. RTP over UDP, for the udp://host:port endpoints managed by Endpoints.
+// If the host is a multicast address, the group is joined on the default interface. Otherwise, the given address
+// is bound, so only one stream can receive from a unicast endpoint at a time.
+// RtmpStreamFactory automatically delegates to a UdpStreamFactory for udp:// endpoint URLs.
+type UdpStreamFactory struct {
+	Endpoints       *RtmpStreamFactory
+	TimeoutDuration time.Duration
+
+	now func() time.Time // Seam for testing, defaults to time.Now
+}
+
+var _ StreamFactory = &UdpStreamFactory{}
+
+func (f *UdpStreamFactory) OpenStream(ctx context.Context) (Stream, error) {
+	endpoint, err := f.Endpoints.nextEndpoint()
+	if err != nil {
+		return nil, err
+	}
+	return f.OpenEndpoint(ctx, endpoint)
+}
+
+// OpenEndpoint joins the multicast group or binds the unicast address of the given endpoint.
+// The context is not used, because opening a UDP stream does not block.
+func (f *UdpStreamFactory) OpenEndpoint(_ context.Context, endpoint *RtmpEndpoint) (Stream, error) {
+	start := f.currentTime()
+	addr, err := net.ResolveUDPAddr("udp", endpoint.url.Host)
+	if err != nil {
+		return nil, err
+	}
+	var conn *net.UDPConn
+	if addr.IP != nil && addr.IP.IsMulticast() {
+		log.Debugln("Joining UDP multicast group:", endpoint.url)
+		conn, err = net.ListenMulticastUDP("udp", nil, addr)
+	} else {
+		log.Debugln("Listening on UDP address:", endpoint.url)
+		conn, err = net.ListenUDP("udp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &UdpStream{
+		StreamInfo: StreamInfo{
+			Endpoint:       endpoint,
+			ConnectLatency: f.currentTime().Sub(start),
+		},
+		TimeoutDuration: f.TimeoutDuration,
+		conn:            conn,
+		buffer:          make([]byte, maxDatagramSize),
+	}, nil
+}
+
+func (f *UdpStreamFactory) currentTime() time.Time {
+	if f.now != nil {
+		return f.now()
+	}
+	return time.Now()
+}
+
+// UdpStream receives the datagrams sent to a UDP address. Receive returns the size of each datagram.
+// If no datagram was received since opening the stream within TimeoutDuration, a StallError is returned.
+// A timeout after receiving data is reported as regular error.
+type UdpStream struct {
+	StreamInfo
+	TimeoutDuration time.Duration
+
+	conn     *net.UDPConn
+	buffer   []byte // Owned by this stream, the received data is discarded
+	num      int    // Number of bytes in buffer from the last call to Receive
+	received bool
+}
+
+var _ Stream = &UdpStream{}
+
+func (s *UdpStream) Receive() (int, PacketType, error) {
+	if err := s.conn.SetReadDeadline(time.Now().Add(s.TimeoutDuration)); err != nil {
+		return 0, NoPacket, err
+	}
+	num, _, err := s.conn.ReadFrom(s.buffer)
+	s.num = num
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		if !s.received {
+			return 0, NoPacket, &StallError{Duration: s.TimeoutDuration}
+		}
+		return 0, NoPacket, categorizedError(TimeoutError, fmt.Errorf("Timeout after %v waiting for data from %v", s.TimeoutDuration, s.Endpoint.url))
+	}
+	if num > 0 {
+		s.received = true
+	}
+	return num, NoPacket, err
+}
+
+func (s *UdpStream) Payload() []byte {
+	return s.buffer[:s.num]
+}
+
+func (s *UdpStream) Close() {
+	if s == nil || s.conn == nil {
+		return
+	}
+	s.conn.Close()
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	testAssert "github.com/stretchr/testify/require"
+)
+
+// freeUdpAddress returns a local UDP address that is not bound by any socket
+func freeUdpAddress(t *testing.T) string {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	testAssert.NoError(t, err)
+	defer conn.Close()
+	return conn.LocalAddr().String()
+}
+
+func TestUdpStream(t *testing.T) {
+	assert := testAssert.New(t)
+	address := freeUdpAddress(t)
+	factory := newTestFactory(t, "udp://"+address)
+	assert.IsType(&UdpStreamFactory{}, factory.delegateFactory(factory.allEndpoints()[0].url))
+
+	stream, err := factory.OpenStream(context.Background())
+	assert.NoError(err)
+	defer stream.Close()
+	assert.IsType(&UdpStream{}, stream)
+
+	sender, err := net.Dial("udp", address)
+	assert.NoError(err)
+	defer sender.Close()
+	sizes := []int{1316, 200, 1472}
+	for i, size := range sizes {
+		packet := make([]byte, size)
+		packet[0] = byte(i)
+		_, err := sender.Write(packet)
+		assert.NoError(err)
+	}
+	for i, size := range sizes {
+		num, packetType, err := stream.Receive()
+		assert.NoError(err)
+		assert.Equal(size, num)
+		assert.Equal(NoPacket, packetType)
+		assert.Len(stream.(PayloadReceiver).Payload(), size)
+		assert.Equal(byte(i), stream.(PayloadReceiver).Payload()[0])
+	}
+}
+
+func TestUdpStreamTimeout(t *testing.T) {
+	assert := testAssert.New(t)
+	address := freeUdpAddress(t)
+	factory := newTestFactory(t, "udp://"+address)
+	factory.TimeoutDuration = 50 * time.Millisecond
+
+	// Without any data, the timeout is a stall
+	stream, err := factory.OpenStream(context.Background())
+	assert.NoError(err)
+	running := newTestRunningStream()
+	running.receiveStream(stream, &factory.hosts[0].stats)
+	stream.Close()
+	assert.Equal(float64(1), float64(running.col.stalls.Get()))
+	assert.Equal(float64(0), float64(running.col.errors.Get()))
+	assert.Equal(float64(1), float64(running.col.closed.Get()))
+
+	// After receiving data, the timeout is an error
+	stream, err = factory.OpenStream(context.Background())
+	assert.NoError(err)
+	defer stream.Close()
+	sender, err := net.Dial("udp", address)
+	assert.NoError(err)
+	defer sender.Close()
+	_, err = sender.Write(make([]byte, 100))
+	assert.NoError(err)
+	num, _, err := stream.Receive()
+	assert.NoError(err)
+	assert.Equal(100, num)
+	_, _, err = stream.Receive()
+	assert.Error(err)
+	_, isStall := err.(*StallError)
+	assert.False(isStall)
+	assert.Contains(err.Error(), "Timeout after 50ms")
+}